@@ -0,0 +1,40 @@
+package api
+
+// MediaTypeChunkManifest identifies a ChunkManifest encoded as JSON.
+//
+// A PUT of a file with this content type creates the file by concatenating
+// the listed chunks, each of which must already be stored, such as by the
+// upload API. A GET of a file which accepts this media type returns the
+// file's chunk manifest if it was written this way, or 406 if it wasn't.
+const MediaTypeChunkManifest = "application/vnd.fileheap.chunk-manifest+json"
+
+// ChunkManifest lists the content-defined chunks of a file in order. Since
+// chunk boundaries depend only on the data around them, versions of a file,
+// or different files, with runs of identical data share most of their chunks.
+type ChunkManifest struct {
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// ChunkRef identifies a chunk of a file by its contents.
+type ChunkRef struct {
+	// SHA256 digest of the chunk.
+	Digest []byte `json:"digest"`
+
+	// Size of the chunk in bytes. Always positive.
+	Size int64 `json:"size"`
+}
+
+// Size returns the size of the file in bytes.
+func (m *ChunkManifest) Size() int64 {
+	var size int64
+	for _, chunk := range m.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// BlobDigests lists stored contents by digest. A POST of a list to
+// /blobs/missing responds with the subset the server doesn't have.
+type BlobDigests struct {
+	Digests [][]byte `json:"digests"`
+}
@@ -0,0 +1,22 @@
+package api
+
+// FileChunks describes the fixed-size chunks a file was uploaded in. Ranged
+// readers can verify the chunks they touch without reading the whole file.
+type FileChunks struct {
+	// Size of each chunk in bytes. The final chunk may be smaller.
+	ChunkSize int64 `json:"chunkSize"`
+
+	// SHA256 digest of each chunk, in order. Files written in a single
+	// request have exactly one chunk.
+	Digests [][]byte `json:"digests"`
+}
+
+// Root returns the root of a SHA256 Merkle tree (RFC 6962) whose leaves are
+// the chunk digests. It matches FileInfo.ChunkRoot for the same file.
+func (c *FileChunks) Root() []byte {
+	var tree merkleTree
+	for _, digest := range c.Digests {
+		tree.add(digest)
+	}
+	return tree.root()
+}
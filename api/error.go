@@ -1,18 +1,46 @@
 package api
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
+
+// Reasons for errors which clients distinguish, sent in Error.Reason.
+const (
+	ReasonDatasetNotFound = "dataset_not_found"
+	ReasonFileNotFound    = "file_not_found"
+	ReasonDatasetReadOnly = "dataset_read_only"
+	ReasonQuotaExceeded   = "quota_exceeded"
+)
 
 // Error encodes an error as a JSON-serializable struct.
 type Error struct {
 	// HTTP status code, such as 404
 	Code int `json:"code"`
 
+	// (optional) Machine-readable reason for the error, such as
+	// ReasonDatasetReadOnly, for callers which need finer distinctions than
+	// the status code provides.
+	Reason string `json:"reason,omitempty"`
+
 	// The text of the error, which should follow the guidelines found at:
 	// https://github.com/golang/go/wiki/CodeReviewComments#error-strings
 	Message string `json:"message"`
 
 	// (optional) Long-form detail, such as the error's call stack
 	Detail string `json:"detail,omitempty"`
+
+	// (optional) Identifier of the failed request in server logs. Include
+	// this when reporting problems.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Method and URL of the failed request. These are filled in by clients
+	// and never sent by the server.
+	Method string `json:"-"`
+	URL    string `json:"-"`
+
+	// Metadata sent with the failed request. Filled in by clients.
+	Metadata map[string]string `json:"-"`
 }
 
 // Error implements the standard error interface.
@@ -21,11 +49,31 @@ func (e Error) Error() string {
 }
 
 // Format implements the fmt.Formatter interface.
+//
+// The %+v verb includes the request and any long-form detail.
 func (e Error) Format(s fmt.State, verb rune) {
 	switch verb {
 	case 'v':
 		if s.Flag('+') {
-			fmt.Fprintf(s, "%s\n%s", e.Message, e.Detail)
+			fmt.Fprint(s, e.Message)
+			if e.Method != "" || e.URL != "" {
+				fmt.Fprintf(s, "\nrequest: %s %s", e.Method, e.URL)
+			}
+			if e.Code != 0 {
+				fmt.Fprintf(s, "\nstatus: %d", e.Code)
+			}
+			if e.Reason != "" {
+				fmt.Fprintf(s, "\nreason: %s", e.Reason)
+			}
+			if e.RequestID != "" {
+				fmt.Fprintf(s, "\nrequest ID: %s", e.RequestID)
+			}
+			for _, key := range sortedKeys(e.Metadata) {
+				fmt.Fprintf(s, "\n%s: %s", key, e.Metadata[key])
+			}
+			if e.Detail != "" {
+				fmt.Fprintf(s, "\n%s", e.Detail)
+			}
 			return
 		}
 		fallthrough
@@ -35,3 +83,12 @@ func (e Error) Format(s fmt.State, verb rune) {
 		fmt.Fprintf(s, "%q", e.Message)
 	}
 }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
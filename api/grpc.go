@@ -0,0 +1,307 @@
+package api
+
+import "time"
+
+// Metadata operations may also be served over gRPC, which costs less per call
+// than HTTP/1.1 for chatty workloads. File contents are always sent over HTTP.
+// The service follows this schema, using the messages of manifest pages for
+// ListManifest:
+//
+//	service Metadata {  // fileheap.v1.Metadata
+//	  rpc GetDataset(DatasetRequest) returns (Dataset);
+//	  rpc CreateDataset(DatasetSpec) returns (Dataset);
+//	  rpc PatchDataset(DatasetPatchRequest) returns (Dataset);
+//	  rpc DeleteDataset(DatasetRequest) returns (google.protobuf.Empty);
+//	  rpc ListManifest(ManifestRequest) returns (ManifestPage);
+//	  rpc MissingBlobs(BlobDigests) returns (BlobDigests);
+//	}
+//
+//	message DatasetRequest {
+//	  string id = 1;
+//	}
+//
+//	message Dataset {
+//	  string id = 1;
+//	  int64 created = 2;  // Unix time in nanoseconds.
+//	  string namespace = 3;
+//	  string owner = 4;
+//	  bool readonly = 5;
+//	  DatasetSize size = 6;
+//	  bytes manifest_digest = 7;
+//	  optional int64 expires_at = 8;  // Unix time in nanoseconds.
+//	}
+//
+//	message DatasetSize {
+//	  bool final = 1;
+//	  int64 files = 2;
+//	  int64 bytes = 3;
+//	}
+//
+//	message DatasetSpec {
+//	  string namespace = 1;
+//	}
+//
+//	message DatasetPatchRequest {
+//	  string id = 1;
+//	  bool readonly = 2;
+//	  optional int64 expires_at = 3;  // Zero removes any expiry.
+//	}
+//
+//	message ManifestRequest {
+//	  string dataset = 1;
+//	  string cursor = 2;
+//	  string prefix = 3;
+//	  int64 limit = 4;
+//	  bool include_urls = 5;
+//	  int64 inline_threshold = 6;
+//	  string snapshot = 7;
+//	}
+//
+//	message BlobDigests {
+//	  repeated bytes digests = 1;
+//	}
+//
+// Status codes follow gRPC's conventions, such as NOT_FOUND for a missing
+// dataset and FAILED_PRECONDITION for a change to a sealed one. Servers which
+// don't serve a method respond with UNIMPLEMENTED.
+const (
+	GRPCService   = "fileheap.v1.Metadata"
+	MediaTypeGRPC = "application/grpc+proto"
+)
+
+// DatasetRequest names a dataset in a gRPC request.
+type DatasetRequest struct {
+	ID string
+}
+
+// DatasetPatchRequest modifies a dataset in a gRPC request.
+type DatasetPatchRequest struct {
+	ID    string
+	Patch DatasetPatch
+}
+
+// ManifestRequest requests a manifest page in a gRPC request. Its fields are
+// the parameters of manifest requests over HTTP.
+type ManifestRequest struct {
+	Dataset         string
+	Cursor          string
+	Prefix          string
+	Limit           int64
+	IncludeURLs     bool
+	InlineThreshold int64
+	Snapshot        string
+}
+
+// MarshalProto encodes a request in the gRPC schema.
+func (r *DatasetRequest) MarshalProto() []byte {
+	return appendStringField(nil, 1, r.ID)
+}
+
+// UnmarshalProto decodes a request in the gRPC schema.
+func (r *DatasetRequest) UnmarshalProto(data []byte) error {
+	*r = DatasetRequest{}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		if field == 1 && wire == wireBytes {
+			r.ID = string(b)
+		}
+		return nil
+	})
+}
+
+// MarshalProto encodes a dataset in the gRPC schema.
+func (d *Dataset) MarshalProto() []byte {
+	buf := appendStringField(nil, 1, d.ID)
+	if !d.Created.IsZero() {
+		buf = appendVarintField(buf, 2, uint64(d.Created.UnixNano()))
+	}
+	buf = appendStringField(buf, 3, d.Namespace)
+	buf = appendStringField(buf, 4, d.Owner)
+	buf = appendBoolField(buf, 5, d.ReadOnly)
+	if d.Size != nil {
+		var size []byte
+		size = appendBoolField(size, 1, d.Size.Final)
+		size = appendVarintField(size, 2, uint64(d.Size.Files))
+		size = appendVarintField(size, 3, uint64(d.Size.Bytes))
+		buf = appendBytesField(buf, 6, size)
+	}
+	if len(d.ManifestDigest) != 0 {
+		buf = appendBytesField(buf, 7, d.ManifestDigest)
+	}
+	if d.ExpiresAt != nil {
+		buf = appendVarintField(buf, 8, protoTime(*d.ExpiresAt))
+	}
+	return buf
+}
+
+// UnmarshalProto decodes a dataset in the gRPC schema.
+func (d *Dataset) UnmarshalProto(data []byte) error {
+	*d = Dataset{}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			d.ID = string(b)
+		case field == 2 && wire == wireVarint:
+			d.Created = fromProtoTime(v)
+		case field == 3 && wire == wireBytes:
+			d.Namespace = string(b)
+		case field == 4 && wire == wireBytes:
+			d.Owner = string(b)
+		case field == 5 && wire == wireVarint:
+			d.ReadOnly = v != 0
+		case field == 6 && wire == wireBytes:
+			d.Size = &DatasetSize{}
+			return readProto(b, func(field, wire int, v uint64, b []byte) error {
+				switch {
+				case field == 1 && wire == wireVarint:
+					d.Size.Final = v != 0
+				case field == 2 && wire == wireVarint:
+					d.Size.Files = int64(v)
+				case field == 3 && wire == wireVarint:
+					d.Size.Bytes = int64(v)
+				}
+				return nil
+			})
+		case field == 7 && wire == wireBytes:
+			d.ManifestDigest = append([]byte{}, b...)
+		case field == 8 && wire == wireVarint:
+			t := fromProtoTime(v)
+			d.ExpiresAt = &t
+		}
+		return nil
+	})
+}
+
+// MarshalProto encodes a spec in the gRPC schema.
+func (s *DatasetSpec) MarshalProto() []byte {
+	return appendStringField(nil, 1, s.Namespace)
+}
+
+// UnmarshalProto decodes a spec in the gRPC schema.
+func (s *DatasetSpec) UnmarshalProto(data []byte) error {
+	*s = DatasetSpec{}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		if field == 1 && wire == wireBytes {
+			s.Namespace = string(b)
+		}
+		return nil
+	})
+}
+
+// MarshalProto encodes a request in the gRPC schema.
+func (r *DatasetPatchRequest) MarshalProto() []byte {
+	buf := appendStringField(nil, 1, r.ID)
+	buf = appendBoolField(buf, 2, r.Patch.ReadOnly)
+	if r.Patch.ExpiresAt != nil {
+		buf = appendVarintField(buf, 3, protoTime(*r.Patch.ExpiresAt))
+	}
+	return buf
+}
+
+// UnmarshalProto decodes a request in the gRPC schema.
+func (r *DatasetPatchRequest) UnmarshalProto(data []byte) error {
+	*r = DatasetPatchRequest{}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			r.ID = string(b)
+		case field == 2 && wire == wireVarint:
+			r.Patch.ReadOnly = v != 0
+		case field == 3 && wire == wireVarint:
+			t := fromProtoTime(v)
+			r.Patch.ExpiresAt = &t
+		}
+		return nil
+	})
+}
+
+// MarshalProto encodes a request in the gRPC schema.
+func (r *ManifestRequest) MarshalProto() []byte {
+	buf := appendStringField(nil, 1, r.Dataset)
+	buf = appendStringField(buf, 2, r.Cursor)
+	buf = appendStringField(buf, 3, r.Prefix)
+	if r.Limit != 0 {
+		buf = appendVarintField(buf, 4, uint64(r.Limit))
+	}
+	buf = appendBoolField(buf, 5, r.IncludeURLs)
+	if r.InlineThreshold != 0 {
+		buf = appendVarintField(buf, 6, uint64(r.InlineThreshold))
+	}
+	return appendStringField(buf, 7, r.Snapshot)
+}
+
+// UnmarshalProto decodes a request in the gRPC schema.
+func (r *ManifestRequest) UnmarshalProto(data []byte) error {
+	*r = ManifestRequest{}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			r.Dataset = string(b)
+		case field == 2 && wire == wireBytes:
+			r.Cursor = string(b)
+		case field == 3 && wire == wireBytes:
+			r.Prefix = string(b)
+		case field == 4 && wire == wireVarint:
+			r.Limit = int64(v)
+		case field == 5 && wire == wireVarint:
+			r.IncludeURLs = v != 0
+		case field == 6 && wire == wireVarint:
+			r.InlineThreshold = int64(v)
+		case field == 7 && wire == wireBytes:
+			r.Snapshot = string(b)
+		}
+		return nil
+	})
+}
+
+// MarshalProto encodes digests in the gRPC schema.
+func (d *BlobDigests) MarshalProto() []byte {
+	var buf []byte
+	for _, digest := range d.Digests {
+		buf = appendBytesField(buf, 1, digest)
+	}
+	return buf
+}
+
+// UnmarshalProto decodes digests in the gRPC schema.
+func (d *BlobDigests) UnmarshalProto(data []byte) error {
+	*d = BlobDigests{Digests: [][]byte{}}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		if field == 1 && wire == wireBytes {
+			d.Digests = append(d.Digests, append([]byte{}, b...))
+		}
+		return nil
+	})
+}
+
+// appendStringField appends a string field, omitting it if empty as proto3
+// does.
+func appendStringField(buf []byte, field int, v string) []byte {
+	if v == "" {
+		return buf
+	}
+	return appendBytesField(buf, field, []byte(v))
+}
+
+// appendBoolField appends a bool field, omitting it if false as proto3 does.
+func appendBoolField(buf []byte, field int, v bool) []byte {
+	if !v {
+		return buf
+	}
+	return appendVarintField(buf, field, 1)
+}
+
+// protoTime encodes a time as Unix nanoseconds. The zero time is encoded as
+// zero, since it is far outside the range of Unix nanoseconds.
+func protoTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromProtoTime(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(v)).UTC()
+}
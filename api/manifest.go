@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// ManifestHash incrementally computes the canonical digest of a manifest: the
+// root of a SHA256 Merkle tree (RFC 6962) whose leaves are the files of a
+// dataset sorted by path. Two datasets have the same manifest digest if and
+// only if they contain the same paths with the same contents.
+//
+// Each leaf hashes a file's path length as a big-endian uint64, its path, and
+// its digest. The digest of an empty manifest is the SHA256 of no data.
+type ManifestHash struct {
+	tree  merkleTree
+	last  string
+	count int64
+}
+
+// Add appends a file to the manifest. Files must be added in strictly
+// ascending order by path.
+func (h *ManifestHash) Add(path string, digest []byte) error {
+	if h.count != 0 && path <= h.last {
+		return errors.Errorf("manifest is not sorted: %q follows %q", path, h.last)
+	}
+	h.last = path
+	h.count++
+
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(path)))
+	h.tree.add(length[:], []byte(path), digest)
+	return nil
+}
+
+// Sum returns the manifest digest of all files added so far.
+func (h *ManifestHash) Sum() []byte {
+	return h.tree.root()
+}
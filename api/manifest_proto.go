@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Media types of manifest pages. Clients may ask for MediaTypeProtobuf in the
+// Accept header of manifest requests, which is much cheaper to parse than
+// JSON for large manifests. Servers which don't support it respond with JSON.
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeProtobuf = "application/x-protobuf"
+)
+
+// Manifest pages encoded as MediaTypeProtobuf follow this schema:
+//
+//	message ManifestPage {
+//	  repeated FileInfo files = 1;
+//	  string cursor = 2;
+//	}
+//
+//	message FileInfo {
+//	  string path = 1;
+//	  int64 size = 2;
+//	  bytes digest = 3;
+//	  int64 updated = 4;  // Unix time in nanoseconds; absent if unknown.
+//	  uint32 mode = 5;
+//	  bytes chunk_root = 6;
+//	  string url = 7;
+//	  optional bytes data = 8;  // Present, possibly empty, if inlined.
+//	}
+const (
+	protoPageFiles  = 1
+	protoPageCursor = 2
+
+	protoFilePath      = 1
+	protoFileSize      = 2
+	protoFileDigest    = 3
+	protoFileUpdated   = 4
+	protoFileMode      = 5
+	protoFileChunkRoot = 6
+	protoFileURL       = 7
+	protoFileData      = 8
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MarshalProto encodes a manifest page as MediaTypeProtobuf.
+func (p *ManifestPage) MarshalProto() []byte {
+	var buf, file []byte
+	for i := range p.Files {
+		file = p.Files[i].appendProto(file[:0])
+		buf = appendBytesField(buf, protoPageFiles, file)
+	}
+	if p.Cursor != "" {
+		buf = appendBytesField(buf, protoPageCursor, []byte(p.Cursor))
+	}
+	return buf
+}
+
+func (f *FileInfo) appendProto(buf []byte) []byte {
+	if f.Path != "" {
+		buf = appendBytesField(buf, protoFilePath, []byte(f.Path))
+	}
+	if f.Size != 0 {
+		buf = appendVarintField(buf, protoFileSize, uint64(f.Size))
+	}
+	if len(f.Digest) != 0 {
+		buf = appendBytesField(buf, protoFileDigest, f.Digest)
+	}
+	if !f.Updated.IsZero() {
+		buf = appendVarintField(buf, protoFileUpdated, uint64(f.Updated.UnixNano()))
+	}
+	if f.Mode != 0 {
+		buf = appendVarintField(buf, protoFileMode, uint64(f.Mode))
+	}
+	if len(f.ChunkRoot) != 0 {
+		buf = appendBytesField(buf, protoFileChunkRoot, f.ChunkRoot)
+	}
+	if f.URL != "" {
+		buf = appendBytesField(buf, protoFileURL, []byte(f.URL))
+	}
+	if f.Data != nil {
+		buf = appendBytesField(buf, protoFileData, f.Data)
+	}
+	return buf
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendUvarint(buf, uint64(field)<<3|wireVarint)
+	return appendUvarint(buf, v)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	buf = appendUvarint(buf, uint64(field)<<3|wireBytes)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// UnmarshalProto decodes a manifest page encoded as MediaTypeProtobuf. Unknown
+// fields are ignored.
+func (p *ManifestPage) UnmarshalProto(data []byte) error {
+	*p = ManifestPage{Files: []FileInfo{}}
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		switch {
+		case field == protoPageFiles && wire == wireBytes:
+			var f FileInfo
+			if err := f.unmarshalProto(b); err != nil {
+				return err
+			}
+			p.Files = append(p.Files, f)
+		case field == protoPageCursor && wire == wireBytes:
+			p.Cursor = string(b)
+		}
+		return nil
+	})
+}
+
+func (f *FileInfo) unmarshalProto(data []byte) error {
+	return readProto(data, func(field, wire int, v uint64, b []byte) error {
+		if wire == wireBytes {
+			switch field {
+			case protoFilePath:
+				f.Path = string(b)
+			case protoFileDigest:
+				f.Digest = append([]byte{}, b...)
+			case protoFileChunkRoot:
+				f.ChunkRoot = append([]byte{}, b...)
+			case protoFileURL:
+				f.URL = string(b)
+			case protoFileData:
+				f.Data = append([]byte{}, b...)
+			}
+			return nil
+		}
+		if wire == wireVarint {
+			switch field {
+			case protoFileSize:
+				f.Size = int64(v)
+			case protoFileUpdated:
+				f.Updated = time.Unix(0, int64(v)).UTC()
+			case protoFileMode:
+				f.Mode = os.FileMode(v)
+			}
+		}
+		return nil
+	})
+}
+
+// readProto calls fn with each field of a message. Varint fields are passed
+// as v and length-delimited fields as b; fixed-size fields are skipped.
+func readProto(data []byte, fn func(field, wire int, v uint64, b []byte) error) error {
+	for len(data) != 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid protobuf: bad field key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid protobuf: bad varint")
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errors.New("invalid protobuf: bad length")
+			}
+			b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("invalid protobuf: truncated field")
+			}
+			data = data[size:]
+			continue
+		default:
+			return errors.Errorf("invalid protobuf: unsupported wire type %d", wire)
+		}
+		if err := fn(field, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
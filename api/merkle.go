@@ -0,0 +1,69 @@
+package api
+
+import (
+	"crypto/sha256"
+)
+
+// Domain separation prefixes for Merkle tree nodes, as in RFC 6962.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// merkleTree incrementally computes the root of a SHA256 Merkle tree as
+// defined by RFC 6962, holding only O(log n) hashes in memory.
+type merkleTree struct {
+	// Roots of complete subtrees, ordered from largest to smallest.
+	stack []merkleSubtree
+}
+
+type merkleSubtree struct {
+	hash []byte
+	size int64
+}
+
+// add appends a leaf with the given data.
+func (t *merkleTree) add(data ...[]byte) {
+	leaf := sha256.New()
+	leaf.Write([]byte{merkleLeafPrefix})
+	for _, d := range data {
+		leaf.Write(d)
+	}
+
+	t.stack = append(t.stack, merkleSubtree{hash: leaf.Sum(nil), size: 1})
+	for len(t.stack) > 1 {
+		right := t.stack[len(t.stack)-1]
+		left := t.stack[len(t.stack)-2]
+		if left.size != right.size {
+			break
+		}
+		t.stack = t.stack[:len(t.stack)-2]
+		t.stack = append(t.stack, merkleSubtree{
+			hash: hashMerkleNode(left.hash, right.hash),
+			size: left.size + right.size,
+		})
+	}
+}
+
+// root returns the root of the tree. The root of an empty tree is the SHA256
+// of no data.
+func (t *merkleTree) root() []byte {
+	if len(t.stack) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+
+	root := t.stack[len(t.stack)-1].hash
+	for i := len(t.stack) - 2; i >= 0; i-- {
+		root = hashMerkleNode(t.stack[i].hash, root)
+	}
+	return root
+}
+
+func hashMerkleNode(left, right []byte) []byte {
+	node := sha256.New()
+	node.Write([]byte{merkleNodePrefix})
+	node.Write(left)
+	node.Write(right)
+	return node.Sum(nil)
+}
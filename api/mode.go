@@ -0,0 +1,29 @@
+package api
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeFileMode formats the permission bits of a mode for the File-Mode header.
+func EncodeFileMode(mode os.FileMode) string {
+	return strconv.FormatUint(uint64(mode.Perm()), 8)
+}
+
+// DecodeFileMode parses a File-Mode header. An empty header decodes to zero.
+func DecodeFileMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid file mode")
+	}
+	if os.FileMode(bits)&^os.ModePerm != 0 {
+		return 0, errors.Errorf("invalid file mode: %q has bits outside of permissions", mode)
+	}
+	return os.FileMode(bits), nil
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"os"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // Request size limits.
@@ -28,6 +32,9 @@ const (
 	// a resource. The header must consist of the name of the digest algorithm
 	// and the Base64-encoded checksum separated by a space.
 	//
+	// On upload PATCH requests, the header specifies the hash of the chunk
+	// being written rather than the whole file.
+	//
 	// Example:
 	// Digest: SHA256 qj7BbmrMgJ2LKBhmInYlar/S8bRBy1FXSTPz1L0RXRE=
 	HeaderDigest = "Digest"
@@ -47,6 +54,49 @@ const (
 	// within a resource. The value must be a non-negative integer.
 	HeaderUploadOffset = "Upload-Offset"
 
+	// The Upload-Source request header names the digest of an existing file
+	// on upload PATCH requests. Instead of reading the request body, the
+	// server copies the chunk from the range of that file given by the
+	// Upload-Source-Range header. Servers supporting copies respond with the
+	// new Upload-Offset.
+	HeaderUploadSource = "Upload-Source"
+
+	// The Upload-Source-Range request header gives the range of bytes to copy
+	// from the file named by Upload-Source, in the form of an HTTP Range
+	// header with a single range.
+	//
+	// Example:
+	// Upload-Source-Range: bytes=0-4194303
+	HeaderUploadSourceRange = "Upload-Source-Range"
+
+	// The File-Mode request and response header records the POSIX permission
+	// bits of a file as an octal number. Files uploaded without the header
+	// have no recorded mode.
+	//
+	// Example:
+	// File-Mode: 755
+	HeaderFileMode = "File-Mode"
+
+	// The Allow-Redirect request header indicates whether a client will follow
+	// redirects to blob storage when downloading files. Servers may respond
+	// with a 307 to a signed URL unless the value is "false".
+	HeaderAllowRedirect = "Allow-Redirect"
+
+	// The Idempotency-Key request header identifies a batch request, or an
+	// update which may be retried. If a request with the same key was already
+	// processed, the server responds with the original result instead of
+	// processing it again.
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// The X-Request-ID header identifies a request in client and server logs.
+	// Clients send a unique ID with each request, which servers echo in the
+	// response, or generate if the request has none.
+	HeaderRequestID = "X-Request-ID"
+
+	// Request headers beginning with Client-Meta- carry caller-defined
+	// metadata, such as a job ID, for attributing requests in server logs.
+	HeaderMetadataPrefix = "Client-Meta-"
+
 	// The Source header indicates the reason for a dataset PUT request.
 	// The only valid value is "deleted" which indicates that the dataset
 	// should be undeleted.
@@ -61,6 +111,33 @@ const (
 // HTTPTimeFormat is the standard HTTP format for timestamps.
 const HTTPTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
+// httpTimeFormats are the formats accepted by ParseHTTPTime: the standard
+// format and the two obsolete ones HTTP requires recipients to accept, followed
+// by variants seen from proxies which don't use GMT.
+var httpTimeFormats = []string{
+	HTTPTimeFormat,
+	time.RFC850,
+	time.ANSIC,
+	time.RFC1123,
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+}
+
+// ParseHTTPTime parses a timestamp from an HTTP header such as Last-Modified.
+// It accepts every format HTTP allows, as well as numeric and named time zones
+// other than GMT. The result is in UTC.
+func ParseHTTPTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, format := range httpTimeFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.Errorf("invalid HTTP time %q", s)
+}
+
 // Recognized scope classes. Example: "read:dataset[:datasetID]"
 const (
 	DatasetScope = "dataset"
@@ -72,11 +149,142 @@ type Dataset struct {
 	ID      string    `json:"id"`
 	Created time.Time `json:"created"`
 
+	// Namespace the dataset belongs to, such as a team's, on servers shared by
+	// several tenants. Empty in the default namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// (optional) Identity of the user or service which created the dataset.
+	Owner string `json:"owner,omitempty"`
+
 	// Whether the dataset is locked for writes.
 	ReadOnly bool `json:"readonly"`
 
 	// Size of the dataset. May be nil.
 	Size *DatasetSize `json:"size,omitempty"`
+
+	// Canonical digest of the dataset's manifest as computed by ManifestHash.
+	// Only set for read-only datasets, whose manifests can no longer change.
+	ManifestDigest []byte `json:"manifestDigest,omitempty"`
+
+	// Time after which the dataset may be deleted automatically, such as for
+	// temporary scratch datasets. Nil if the dataset doesn't expire.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// HealthOK is the status of a healthy server.
+const HealthOK = "ok"
+
+// Health reports whether a server is ready to serve requests. Servers respond
+// to /health with 200 when healthy and 503 otherwise.
+type Health struct {
+	// HealthOK if the server can serve requests; otherwise a short reason why
+	// it can't, such as "database unavailable".
+	Status string `json:"status"`
+
+	// (optional) Status of each dependency the server checked, such as its
+	// database or blob storage, by name.
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// ServerVersion describes the build of a server, served at /version.
+type ServerVersion struct {
+	// Version of the server, such as "1.4.2".
+	Version string `json:"version"`
+
+	// (optional) Source control revision the server was built from.
+	Commit string `json:"commit,omitempty"`
+
+	// (optional) Time the server was built.
+	Built *time.Time `json:"built,omitempty"`
+}
+
+// Capabilities lists the optional features a server implements, served at
+// /capabilities. Servers which predate it implement every feature except
+// BatchAdd.
+type Capabilities struct {
+	// Whether /datasets/{id}/batch/upload, download and delete are served.
+	BatchUpload   bool `json:"batchUpload"`
+	BatchDownload bool `json:"batchDownload"`
+	BatchDelete   bool `json:"batchDelete"`
+
+	// Whether /datasets/{id}/batch/add is served.
+	BatchAdd bool `json:"batchAdd"`
+
+	// Whether files larger than a single request can be written through
+	// /uploads.
+	Uploads bool `json:"uploads"`
+
+	// Whether manifests include presigned URLs when requested.
+	PresignedURLs bool `json:"presignedUrls"`
+
+	// (optional) Maximum number of files in a batch request.
+	MaxBatchSize int `json:"maxBatchSize,omitempty"`
+
+	// (optional) Maximum size of a request body in bytes.
+	MaxRequestSize int64 `json:"maxRequestSize,omitempty"`
+}
+
+// GCReport describes storage which an operator could reclaim, served to
+// administrators at /admin/gc-report.
+type GCReport struct {
+	// Datasets past their expiry which haven't been deleted yet.
+	Expired []Dataset `json:"expired"`
+
+	// Datasets which were never sealed and were created before the time in
+	// the request's unsealedBefore parameter, which are often abandoned.
+	// Empty if the request had no such parameter.
+	Unsealed []Dataset `json:"unsealed"`
+
+	// Stored contents which no dataset or snapshot references.
+	OrphanedBlobs int64 `json:"orphanedBlobs"`
+	OrphanedBytes int64 `json:"orphanedBytes"`
+
+	// Bytes which deleting the expired datasets and orphaned contents would
+	// free. Contents shared with other datasets are not counted.
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+}
+
+// DatasetSpec describes a dataset to create. Servers accept an empty body in
+// place of an empty spec.
+type DatasetSpec struct {
+	// (optional) Namespace to create the dataset in.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// DatasetPage describes a list of datasets.
+type DatasetPage struct {
+	// Datasets matching the request, sorted by creation time. Results are
+	// limited to a fixed number of datasets per request.
+	Datasets []Dataset `json:"datasets"`
+
+	// An optional cursor to retrieve further results.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// ReadSessionSpec requests a read session for a dataset.
+type ReadSessionSpec struct {
+	// (optional) Path of a single file to limit the session to. If empty, the
+	// session may read any file in the dataset.
+	Path string `json:"path,omitempty"`
+
+	// (optional) If true, pin the dataset's current files for the session.
+	// Reads which pass the returned snapshot ID see the dataset as it was when
+	// the session was created.
+	Snapshot bool `json:"snapshot,omitempty"`
+}
+
+// ReadSession grants short-lived read access to a dataset or one of its files.
+// Requests to read files may present the token as a bearer token in place of
+// the caller's credentials, which the server can check without further lookups.
+type ReadSession struct {
+	Token string `json:"token"`
+
+	// Time after which the token is no longer accepted.
+	Expires time.Time `json:"expires"`
+
+	// ID of the session's snapshot, if one was requested. Pass it in the
+	// snapshot query parameter of manifest and file reads.
+	Snapshot string `json:"snapshot,omitempty"`
 }
 
 // DatasetSize describes the size of a dataset.
@@ -92,18 +300,102 @@ type DatasetSize struct {
 type DatasetPatch struct {
 	// (optional) If true, lock the dataset for writes. Ignored if false.
 	ReadOnly bool `json:"readonly,omitempty"`
+
+	// (optional) Time after which the dataset may be deleted automatically.
+	// The zero time removes any expiry. Ignored if nil.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Upload describes a newly created upload.
+type Upload struct {
+	ID string `json:"id"`
+
+	// Size of each part in bytes when uploading to presigned URLs. The final
+	// part may be smaller.
+	PartSize int64 `json:"partSize,omitempty"`
+
+	// (optional) Presigned blob storage URLs which accept a PUT of each part,
+	// in order. If present, data should be sent to these URLs instead of the
+	// upload API, then the upload completed with its digest.
+	PartURLs []string `json:"partURLs,omitempty"`
+}
+
+// BatchResults reports the outcome of each file in a batch request. Servers
+// which do not report per-file results respond with an empty body instead.
+type BatchResults struct {
+	Results []BatchFileResult `json:"results"`
+}
+
+// BatchFileResult is the outcome of a single file in a batch request.
+type BatchFileResult struct {
+	Path string `json:"path"`
+
+	// HTTP status code for the file, such as 200 or 503.
+	Code int `json:"code"`
+
+	// (optional) Reason the file failed.
+	Message string `json:"message,omitempty"`
 }
 
 // ManifestPage describes a list of files within a dataset.
 type ManifestPage struct {
-	// A list of files in the dataset, sorted by path. Results are limited to a
-	// fix number of of files per request. If the res
+	// A list of files in the dataset, sorted by path in ascending byte-wise
+	// order, continuing across pages. Results are limited to a fixed number of
+	// files per request.
 	Files []FileInfo `json:"files"`
 
 	// An optional cursor to retrieve further results.
 	Cursor string `json:"cursor,omitempty"`
 }
 
+// Kinds of FileEvent.
+const (
+	FileWritten = "written"
+	FileDeleted = "deleted"
+)
+
+// FileEvent describes a change to a file in a dataset.
+type FileEvent struct {
+	// Kind of change, such as FileWritten.
+	Type string `json:"type"`
+
+	// Path of the file relative to its dataset root.
+	Path string `json:"path"`
+
+	// The file as written. Nil if the file was deleted.
+	File *FileInfo `json:"file,omitempty"`
+}
+
+// FileEventPage lists the changes to a dataset's files after a cursor, served
+// at /datasets/{id}/events. Without a cursor, it lists no changes and returns
+// a cursor for those which follow. Requests may set wait to a number of
+// seconds to hold the response until there is a change or the time passes.
+type FileEventPage struct {
+	// Changes in the order they were made.
+	Events []FileEvent `json:"events"`
+
+	// Cursor to retrieve the changes which follow.
+	Cursor string `json:"cursor"`
+
+	// Whether the dataset is read-only and every change has been listed, so
+	// there will be no more.
+	Final bool `json:"final,omitempty"`
+}
+
+// FileEntry names contents the server already holds to add to a dataset as a
+// file. Batches of entries are sent to /datasets/{id}/batch/add as the headers
+// of empty parts.
+type FileEntry struct {
+	// Path of the file relative to its dataset root.
+	Path string `json:"path"`
+
+	// SHA256 digest of the file's contents.
+	Digest []byte `json:"digest"`
+
+	// (optional) POSIX permission bits of the file.
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
 // FileInfo describes a single file within a dataset.
 type FileInfo struct {
 	// Path of the file relative to its dataset root.
@@ -118,6 +410,16 @@ type FileInfo struct {
 	// Time at which the file was last updated.
 	Updated time.Time `json:"updated"`
 
+	// POSIX permission bits of the file. Zero if no mode was recorded.
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	// Root of the Merkle tree over the file's chunk digests. See FileChunks.
+	ChunkRoot []byte `json:"chunkRoot,omitempty"`
+
 	// URL where the file can be retrieved with a GET request.
 	URL string `json:"url,omitempty"`
+
+	// Contents of the file, if small enough to be inlined in the manifest.
+	// Nil if the contents were not inlined.
+	Data []byte `json:"data,omitempty"`
 }
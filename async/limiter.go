@@ -38,6 +38,35 @@ func (l *Limiter) Go(fn func()) {
 	}()
 }
 
+// TryGo runs a routine asynchronously if the limiter has capacity, and
+// returns false without running it otherwise. Callers which hold a slot of a
+// shared limiter can use it to spread work without waiting on themselves.
+func (l *Limiter) TryGo(fn func()) bool {
+	select {
+	case l.c <- struct{}{}:
+	default:
+		return false
+	}
+	l.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-l.c
+			l.wg.Done()
+		}()
+
+		fn()
+	}()
+	return true
+}
+
+// Share returns a limiter which shares this limiter's capacity, so routines
+// started by either count against the same limit, but whose Wait only waits for
+// its own routines.
+func (l *Limiter) Share() *Limiter {
+	return &Limiter{c: l.c}
+}
+
 // Wait blocks until all outstanding routines complete.
 func (l *Limiter) Wait() {
 	l.wg.Wait()
@@ -0,0 +1,187 @@
+// Package bundle reads and writes FileHeap bundles: single files holding a
+// dataset's files and manifest, so that datasets can be moved where the
+// FileHeap service is unreachable, such as into air-gapped environments, and
+// imported again without loss.
+//
+// A bundle consists of a header, the contents of each distinct file
+// concatenated in manifest order, an index, and a trailer:
+//
+//	header:  "FHBUNDLE" | version (uint32) | reserved (4 bytes)
+//	blobs:   contents of each distinct digest, once
+//	index:   JSON-encoded Index
+//	trailer: index offset (uint64) | index length (uint64) |
+//	         SHA-256 of the index (32 bytes) | "FHBUNDLE"
+//
+// Integers are big-endian. Since the index follows the data it describes,
+// bundles can be written to a stream, such as a pipe or tape, in one pass.
+package bundle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Version of the bundle format written by this package.
+const Version = 1
+
+const (
+	magic       = "FHBUNDLE"
+	headerSize  = len(magic) + 8
+	trailerSize = 8 + 8 + sha256.Size + len(magic)
+)
+
+// Index describes the contents of a bundle.
+type Index struct {
+	// Name of the dataset the bundle was made from, if known.
+	Dataset string `json:"dataset,omitempty"`
+
+	// Time the bundle was written.
+	Created time.Time `json:"created"`
+
+	// Digest of the bundle's manifest, as computed by api.ManifestHash.
+	ManifestDigest []byte `json:"manifestDigest"`
+
+	// Files in ascending path order.
+	Files []Entry `json:"files"`
+}
+
+// Entry is a file in a bundle.
+type Entry struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Digest  []byte      `json:"digest"`
+	Updated time.Time   `json:"updated"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+
+	// Offset of the file's contents from the start of the bundle. Files with
+	// the same digest share their contents.
+	Offset int64 `json:"offset"`
+}
+
+// FileInfo describes the entry as it would be listed by a dataset.
+func (e *Entry) FileInfo() *api.FileInfo {
+	return &api.FileInfo{
+		Path:    e.Path,
+		Size:    e.Size,
+		Digest:  e.Digest,
+		Updated: e.Updated,
+		Mode:    e.Mode,
+	}
+}
+
+// Writer writes a bundle to a stream. Files must be added in ascending path
+// order, such as the order in which datasets list them. Close must be called
+// to write the index; until then, the bundle is incomplete.
+type Writer struct {
+	w      io.Writer
+	offset int64
+	err    error
+
+	index   Index
+	hash    api.ManifestHash
+	offsets map[string]int64 // Offset of the contents of each digest.
+}
+
+// NewWriter writes the header of a bundle to w and returns a Writer to add
+// files to it. The dataset names the bundle's source and may be empty.
+func NewWriter(w io.Writer, dataset string) (*Writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[len(magic):], Version)
+	if _, err := w.Write(header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Writer{
+		w:       w,
+		offset:  int64(headerSize),
+		index:   Index{Dataset: dataset, Created: time.Now().UTC(), Files: []Entry{}},
+		offsets: map[string]int64{},
+	}, nil
+}
+
+// AddFile adds a file to the bundle, reading its contents from r. Contents are
+// verified against the file's digest; on a mismatch or any other error the
+// bundle is invalid and further calls fail. If the bundle already holds a file
+// with the same digest, r is not read.
+func (w *Writer) AddFile(info *api.FileInfo, r io.Reader) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.hash.Add(info.Path, info.Digest); err != nil {
+		w.err = err
+		return err
+	}
+
+	offset, ok := w.offsets[string(info.Digest)]
+	if !ok {
+		offset = w.offset
+		hash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w.w, hash), io.LimitReader(r, info.Size))
+		w.offset += n
+		if err != nil {
+			w.err = errors.WithStack(err)
+			return w.err
+		}
+		if n != info.Size {
+			w.err = errors.Errorf("%s: truncated at %d of %d bytes", info.Path, n, info.Size)
+			return w.err
+		}
+		if digest := hash.Sum(nil); !bytes.Equal(digest, info.Digest) {
+			w.err = errors.Errorf("%s: digest mismatch: expected %s, got %s",
+				info.Path, api.EncodeDigest(info.Digest), api.EncodeDigest(digest))
+			return w.err
+		}
+		w.offsets[string(info.Digest)] = offset
+	}
+
+	w.index.Files = append(w.index.Files, Entry{
+		Path:    info.Path,
+		Size:    info.Size,
+		Digest:  info.Digest,
+		Updated: info.Updated,
+		Mode:    info.Mode,
+		Offset:  offset,
+	})
+	return nil
+}
+
+// Close writes the bundle's index and trailer. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("bundle is closed")
+
+	w.index.ManifestDigest = w.hash.Sum()
+	index, err := json.Marshal(&w.index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	trailer := make([]byte, 0, trailerSize)
+	trailer = appendUint64(trailer, uint64(w.offset))
+	trailer = appendUint64(trailer, uint64(len(index)))
+	sum := sha256.Sum256(index)
+	trailer = append(trailer, sum[:]...)
+	trailer = append(trailer, magic...)
+	if _, err := w.w.Write(append(index, trailer...)); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
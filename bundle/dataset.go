@@ -0,0 +1,327 @@
+package bundle
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/allenai/bytefmt"
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Dataset exposes a bundle as a dataset, so that code written against
+// client.DatasetAPI, or against fs.FS, runs the same on an offline bundle as
+// on a live dataset. Bundles are immutable: the dataset is sealed, and writes
+// fail with client.ErrDatasetReadOnly.
+//
+// Files are verified against their digests when they are read to the end.
+type Dataset struct {
+	r *Reader
+}
+
+var (
+	_ client.DatasetAPI = (*Dataset)(nil)
+	_ fs.FS             = (*Dataset)(nil)
+)
+
+// OpenDataset opens a bundle file as a dataset. Call Close when finished.
+func OpenDataset(name string) (*Dataset, error) {
+	r, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Dataset{r: r}, nil
+}
+
+// NewDataset exposes an open bundle as a dataset.
+func NewDataset(r *Reader) *Dataset {
+	return &Dataset{r: r}
+}
+
+// Close closes the bundle.
+func (d *Dataset) Close() error {
+	return d.r.Close()
+}
+
+// Name returns the name of the dataset the bundle was made from.
+func (d *Dataset) Name() string { return d.r.index.Dataset }
+
+// Info returns metadata about the dataset. Its creation time is the time the
+// bundle was written.
+func (d *Dataset) Info(ctx context.Context) (*api.Dataset, error) {
+	size := &api.DatasetSize{Final: true, Files: int64(len(d.r.index.Files))}
+	for _, entry := range d.r.index.Files {
+		size.Bytes += entry.Size
+	}
+	size.BytesHuman = bytefmt.New(size.Bytes, bytefmt.Binary).String()
+	return &api.Dataset{
+		ID:             d.r.index.Dataset,
+		Created:        d.r.index.Created,
+		ReadOnly:       true,
+		Size:           size,
+		ManifestDigest: d.r.index.ManifestDigest,
+	}, nil
+}
+
+// ManifestDigest returns the digest of the bundle's manifest.
+func (d *Dataset) ManifestDigest(ctx context.Context) ([]byte, error) {
+	return d.r.index.ManifestDigest, nil
+}
+
+// Seal does nothing, since bundles are always read-only.
+func (d *Dataset) Seal(ctx context.Context) error {
+	return nil
+}
+
+// Delete returns client.ErrDatasetReadOnly.
+func (d *Dataset) Delete(ctx context.Context) error {
+	return client.ErrDatasetReadOnly
+}
+
+// ListFiles returns an iterator over files in the bundle in ascending
+// byte-wise order of their paths. URLs are not supported.
+func (d *Dataset) ListFiles(ctx context.Context, opts *client.FileIteratorOptions) client.Iterator {
+	if opts == nil {
+		opts = &client.FileIteratorOptions{}
+	}
+	files := d.r.index.Files
+	start := sort.Search(len(files), func(i int) bool { return files[i].Path >= opts.Prefix })
+	return &fileIterator{ctx: ctx, dataset: d, opts: *opts, files: files[start:]}
+}
+
+// fileIterator returns the files in a bundle beginning with a prefix.
+type fileIterator struct {
+	ctx     context.Context
+	dataset *Dataset
+	opts    client.FileIteratorOptions
+	files   []Entry
+}
+
+func (i *fileIterator) Next() (*api.FileInfo, error) {
+	if err := i.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(i.files) == 0 || !strings.HasPrefix(i.files[0].Path, i.opts.Prefix) {
+		return nil, client.ErrDone
+	}
+	entry := &i.files[0]
+	i.files = i.files[1:]
+
+	info := entry.FileInfo()
+	if threshold := i.opts.InlineThreshold; threshold > 0 && info.Size <= threshold {
+		r, err := i.dataset.r.ReadFile(entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Data, err = ioutil.ReadAll(r); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return info, nil
+}
+
+// FileInfo returns metadata about a file, or client.ErrFileNotFound.
+func (d *Dataset) FileInfo(ctx context.Context, filename string, opts ...client.CallOption) (*api.FileInfo, error) {
+	entry, ok := d.r.Entry(strings.Trim(path.Clean("/"+filename), "/"))
+	if !ok {
+		return nil, client.ErrFileNotFound
+	}
+	return entry.FileInfo(), nil
+}
+
+// ReadFile reads the contents of a file, or returns client.ErrFileNotFound.
+func (d *Dataset) ReadFile(ctx context.Context, filename string, opts ...client.CallOption) (io.ReadCloser, error) {
+	name := strings.Trim(path.Clean("/"+filename), "/")
+	if _, ok := d.r.Entry(name); !ok {
+		return nil, client.ErrFileNotFound
+	}
+	r, err := d.r.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// ReadFileRange reads at most length bytes from a file starting at the given
+// offset. If length is negative, the file is read until the end. Length must
+// not be zero.
+func (d *Dataset) ReadFileRange(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	opts ...client.CallOption,
+) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+	if length == 0 {
+		return nil, errors.New("length must not be zero")
+	}
+	name := strings.Trim(path.Clean("/"+filename), "/")
+	if _, ok := d.r.Entry(name); !ok {
+		return nil, client.ErrFileNotFound
+	}
+	r, err := d.r.ReadFileRange(name, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// WriteFile returns client.ErrDatasetReadOnly.
+func (d *Dataset) WriteFile(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	opts ...client.CallOption,
+) error {
+	return client.ErrDatasetReadOnly
+}
+
+// WriteFileWithOptions returns client.ErrDatasetReadOnly.
+func (d *Dataset) WriteFileWithOptions(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	opts *client.WriteFileOptions,
+	callOpts ...client.CallOption,
+) error {
+	return client.ErrDatasetReadOnly
+}
+
+// DeleteFile returns client.ErrDatasetReadOnly.
+func (d *Dataset) DeleteFile(ctx context.Context, filename string, opts ...client.CallOption) error {
+	return client.ErrDatasetReadOnly
+}
+
+// Open implements fs.FS. Directories are implied by the paths of files within
+// them, and are listed in ascending order.
+func (d *Dataset) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, ok := d.r.Entry(name); ok {
+		r, err := d.r.ReadFile(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &file{Reader: r, entry: entry}, nil
+	}
+
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+	files := d.r.index.Files
+	start := sort.Search(len(files), func(i int) bool { return files[i].Path >= prefix })
+	if start == len(files) || !strings.HasPrefix(files[start].Path, prefix) {
+		if name != "." {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+
+	// List the directory's immediate children.
+	listing := &dir{name: name}
+	for _, entry := range files[start:] {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			break
+		}
+		child := strings.TrimPrefix(entry.Path, prefix)
+		if i := strings.IndexByte(child, '/'); i >= 0 {
+			child = child[:i]
+			if n := len(listing.entries); n == 0 || listing.entries[n-1].Name() != child {
+				listing.entries = append(listing.entries, fs.FileInfoToDirEntry(dirInfo{name: child}))
+			}
+			continue
+		}
+		entry := entry
+		listing.entries = append(listing.entries, fs.FileInfoToDirEntry(fileInfo{&entry}))
+	}
+
+	// Paths sort a directory's contents, such as "a/b", after its siblings,
+	// such as "a-b", but entries are listed by name.
+	sort.Slice(listing.entries, func(i, j int) bool {
+		return listing.entries[i].Name() < listing.entries[j].Name()
+	})
+	return listing, nil
+}
+
+// file is an open file in a bundle.
+type file struct {
+	io.Reader
+	entry *Entry
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return fileInfo{f.entry}, nil }
+func (f *file) Close() error               { return nil }
+
+// dir is an open directory in a bundle.
+type dir struct {
+	name    string
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return dirInfo{name: path.Base(d.name)}, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.read:]
+	if n <= 0 {
+		d.read = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.read += n
+	return remaining[:n], nil
+}
+
+// fileInfo describes a file in a bundle.
+type fileInfo struct {
+	entry *Entry
+}
+
+func (i fileInfo) Name() string       { return path.Base(i.entry.Path) }
+func (i fileInfo) Size() int64        { return i.entry.Size }
+func (i fileInfo) ModTime() time.Time { return i.entry.Updated }
+func (i fileInfo) IsDir() bool        { return false }
+func (i fileInfo) Sys() interface{}   { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.entry.Mode != 0 {
+		return i.entry.Mode
+	}
+	return 0444
+}
+
+// dirInfo describes a directory implied by the files in a bundle.
+type dirInfo struct {
+	name string
+}
+
+func (i dirInfo) Name() string       { return i.name }
+func (i dirInfo) Size() int64        { return 0 }
+func (i dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i dirInfo) ModTime() time.Time { return time.Time{} }
+func (i dirInfo) IsDir() bool        { return true }
+func (i dirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,178 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Reader reads files from a bundle.
+type Reader struct {
+	r     io.ReaderAt
+	index Index
+	files map[string]*Entry
+
+	// Underlying file, if the bundle was opened by name.
+	file *os.File
+}
+
+// Open opens a bundle file for reading. Call Close when finished.
+func Open(name string) (*Reader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.WithStack(err)
+	}
+	r, err := NewReader(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to open bundle %s", name)
+	}
+	r.file = file
+	return r, nil
+}
+
+// NewReader reads a bundle of the given size from r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < int64(headerSize+trailerSize) {
+		return nil, errors.New("not a bundle: too short")
+	}
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, errors.New("not a bundle")
+	}
+	if version := binary.BigEndian.Uint32(header[len(magic):]); version != Version {
+		return nil, errors.Errorf("unsupported bundle version %d", version)
+	}
+
+	trailer := make([]byte, trailerSize)
+	if _, err := r.ReadAt(trailer, size-int64(trailerSize)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(trailer[trailerSize-len(magic):]) != magic {
+		return nil, errors.New("bundle is incomplete: missing trailer")
+	}
+	offset := binary.BigEndian.Uint64(trailer)
+	length := binary.BigEndian.Uint64(trailer[8:])
+	if offset < uint64(headerSize) || length > uint64(size) || offset+length != uint64(size)-uint64(trailerSize) {
+		return nil, errors.New("bundle is corrupt: invalid index location")
+	}
+	raw := make([]byte, length)
+	if _, err := r.ReadAt(raw, int64(offset)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sum := sha256.Sum256(raw); !bytes.Equal(sum[:], trailer[16:16+sha256.Size]) {
+		return nil, errors.New("bundle is corrupt: index digest mismatch")
+	}
+
+	b := &Reader{r: r, files: map[string]*Entry{}}
+	if err := json.Unmarshal(raw, &b.index); err != nil {
+		return nil, errors.Wrap(err, "bundle is corrupt: invalid index")
+	}
+	for i := range b.index.Files {
+		entry := &b.index.Files[i]
+		if entry.Offset < int64(headerSize) || entry.Size < 0 || entry.Offset+entry.Size > int64(offset) {
+			return nil, errors.Errorf("bundle is corrupt: %s is out of bounds", entry.Path)
+		}
+	}
+	sort.Slice(b.index.Files, func(i, j int) bool {
+		return b.index.Files[i].Path < b.index.Files[j].Path
+	})
+	for i := range b.index.Files {
+		b.files[b.index.Files[i].Path] = &b.index.Files[i]
+	}
+	return b, nil
+}
+
+// Index describes the bundle's contents. It must not be modified.
+func (b *Reader) Index() *Index {
+	return &b.index
+}
+
+// Entry returns the named file, or false if the bundle doesn't contain it.
+func (b *Reader) Entry(path string) (*Entry, bool) {
+	entry, ok := b.files[path]
+	return entry, ok
+}
+
+// ReadFile returns a reader of the named file's contents, or
+// os.ErrNotExist if the bundle doesn't contain it. The reader verifies the
+// contents against the file's digest when it reaches the end, returning an
+// error in place of the last bytes on a mismatch.
+func (b *Reader) ReadFile(path string) (io.Reader, error) {
+	entry, ok := b.files[path]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, path)
+	}
+	return &verifyingReader{
+		r:     io.NewSectionReader(b.r, entry.Offset, entry.Size),
+		entry: entry,
+		hash:  sha256.New(),
+	}, nil
+}
+
+// ReadFileRange returns a reader of length bytes of the named file starting
+// at offset. A negative length reads to the end of the file. Partial reads are
+// not verified.
+func (b *Reader) ReadFileRange(path string, offset, length int64) (io.Reader, error) {
+	entry, ok := b.files[path]
+	if !ok {
+		return nil, errors.Wrap(os.ErrNotExist, path)
+	}
+	if offset < 0 || offset > entry.Size {
+		return nil, errors.Errorf("%s: offset %d out of range", path, offset)
+	}
+	if length < 0 || offset+length > entry.Size {
+		length = entry.Size - offset
+	}
+	return io.NewSectionReader(b.r, entry.Offset+offset, length), nil
+}
+
+// Close closes the bundle's file if it was opened with Open.
+func (b *Reader) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return errors.WithStack(b.file.Close())
+}
+
+// verifyingReader reads a file's contents, checking its digest once all of
+// them have been read. Callers such as io.CopyN stop reading at the file's
+// size, so the check can't wait for io.EOF.
+type verifyingReader struct {
+	r     io.Reader
+	entry *Entry
+	hash  hash.Hash
+	read  int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if n > 0 && r.read == r.entry.Size {
+		if digest := r.hash.Sum(nil); !bytes.Equal(digest, r.entry.Digest) {
+			// Withhold the last bytes, since io.CopyN ignores errors once it
+			// has copied everything it asked for.
+			return 0, errors.Errorf("%s: digest mismatch: expected %s, got %s",
+				r.entry.Path, api.EncodeDigest(r.entry.Digest), api.EncodeDigest(digest))
+		}
+	}
+	return n, err
+}
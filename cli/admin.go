@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// GCReport writes a JSON report of storage which could be reclaimed to w, for
+// cleanup automation: datasets past their expiry, datasets never sealed which
+// are more than unsealedDays old, and the bytes deleting them would free.
+// Unsealed datasets are not reported if unsealedDays is zero. It requires an
+// administrator's token.
+func GCReport(ctx context.Context, c *client.Client, w io.Writer, unsealedDays int) error {
+	if unsealedDays < 0 {
+		return errors.New("days must not be negative")
+	}
+	report, err := c.GCReport(ctx, &client.GCReportOptions{
+		UnsealedOlderThan: time.Duration(unsealedDays) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(json.NewEncoder(w).Encode(report))
+}
@@ -0,0 +1,308 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Number of bytes read from the start of a file to preview it.
+const previewSize = 16 * 1024
+
+// Browser is a full-screen terminal UI for exploring a dataset. It shows the
+// entries of the current directory beside a preview of the selected file.
+type Browser struct {
+	ctx     context.Context
+	dataset client.DatasetAPI
+
+	// Current directory within the dataset, without leading or trailing slashes.
+	dir      string
+	entries  []string
+	selected int
+	scroll   int
+
+	// Preview of the selected entry, split into lines.
+	preview []string
+	status  string
+}
+
+// NewBrowser creates a browser for a dataset, starting at its root.
+func NewBrowser(ctx context.Context, dataset client.DatasetAPI) *Browser {
+	return &Browser{ctx: ctx, dataset: dataset}
+}
+
+const browserHelp = "↑/↓ select  → open  ← up  q quit"
+
+// Run takes over the terminal until the user quits. Both in and out must be
+// attached to the terminal.
+func (b *Browser) Run(in, out *os.File) error {
+	fd := int(in.Fd())
+	if !terminal.IsTerminal(fd) || !terminal.IsTerminal(int(out.Fd())) {
+		return errors.New("browse requires a terminal")
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer terminal.Restore(fd, state)
+
+	// Switch to the alternate screen and hide the cursor until we exit.
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	if err := b.open(""); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 16)
+	for {
+		width, height, err := terminal.GetSize(int(out.Fd()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		b.render(out, width, height)
+
+		n, err := in.Read(buf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if quit := b.handleKey(string(buf[:n]), height); quit {
+			return nil
+		}
+	}
+}
+
+// handleKey applies a single key press, returning true if the browser should exit.
+func (b *Browser) handleKey(key string, height int) bool {
+	b.status = ""
+	switch key {
+	case "q", "\x03", "\x1b":
+		return true
+	case "k", "\x1b[A", "\x1bOA":
+		b.move(-1)
+	case "j", "\x1b[B", "\x1bOB":
+		b.move(1)
+	case "\x1b[5~":
+		b.move(-(height - 2))
+	case "\x1b[6~":
+		b.move(height - 2)
+	case "l", "\r", "\x1b[C", "\x1bOC":
+		if len(b.entries) == 0 {
+			break
+		}
+		entry := b.entries[b.selected]
+		if strings.HasSuffix(entry, "/") {
+			b.report(b.open(path.Join(b.dir, strings.TrimSuffix(entry, "/"))))
+		}
+	case "h", "\x7f", "\x1b[D", "\x1bOD":
+		if b.dir == "" {
+			break
+		}
+		child := path.Base(b.dir) + "/"
+		parent := path.Dir(b.dir)
+		if parent == "." {
+			parent = ""
+		}
+		if err := b.open(parent); err != nil {
+			b.report(err)
+			break
+		}
+		// Keep the directory we came from selected.
+		for i, entry := range b.entries {
+			if entry == child {
+				b.move(i)
+				break
+			}
+		}
+	}
+	return false
+}
+
+func (b *Browser) report(err error) {
+	if err != nil {
+		b.status = err.Error()
+	}
+}
+
+// open lists a directory and selects its first entry.
+func (b *Browser) open(dir string) error {
+	entries, err := listDir(b.ctx, b.dataset, dir)
+	if err != nil {
+		return err
+	}
+	b.dir = dir
+	b.entries = entries
+	b.selected = 0
+	b.scroll = 0
+	b.loadPreview()
+	return nil
+}
+
+// move changes the selection by delta entries, clamped to the listing.
+func (b *Browser) move(delta int) {
+	selected := b.selected + delta
+	if selected >= len(b.entries) {
+		selected = len(b.entries) - 1
+	}
+	if selected < 0 {
+		selected = 0
+	}
+	if selected != b.selected {
+		b.selected = selected
+		b.loadPreview()
+	}
+}
+
+// loadPreview fills the preview pane for the selected entry. Text files are
+// previewed with a ranged read of their first bytes so large files are cheap.
+func (b *Browser) loadPreview() {
+	b.preview = nil
+	if len(b.entries) == 0 {
+		return
+	}
+	entry := b.entries[b.selected]
+	if strings.HasSuffix(entry, "/") {
+		b.preview = []string{"Directory " + entry}
+		return
+	}
+
+	info, err := b.dataset.FileInfo(b.ctx, path.Join(b.dir, entry))
+	if err != nil {
+		b.preview = []string{"error: " + err.Error()}
+		return
+	}
+	b.preview = []string{
+		fmt.Sprintf("Size:    %d (%s)", info.Size, FormatBytes(info.Size)),
+		fmt.Sprintf("Digest:  %s", api.EncodeDigest(info.Digest)),
+		fmt.Sprintf("Updated: %s", info.Updated.Local()),
+		"",
+	}
+	if info.Size == 0 {
+		return
+	}
+
+	r, err := b.dataset.ReadFileRange(b.ctx, info.Path, 0, previewSize)
+	if err != nil {
+		b.preview = append(b.preview, "error: "+err.Error())
+		return
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, previewSize))
+	if err != nil {
+		b.preview = append(b.preview, "error: "+err.Error())
+		return
+	}
+	if !isText(data) {
+		b.preview = append(b.preview, "(binary file)")
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		b.preview = append(b.preview, strings.TrimSuffix(line, "\r"))
+	}
+}
+
+// isText guesses whether the start of a file is text. The data may end within
+// a multi-byte character if it was truncated.
+func isText(data []byte) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return false
+	}
+	for i := 0; i < utf8.UTFMax && len(data) > 0; i++ {
+		if utf8.Valid(data) {
+			return true
+		}
+		data = data[:len(data)-1]
+	}
+	return utf8.Valid(data)
+}
+
+// render draws the whole screen: a header, the listing and preview panes, and
+// a status line.
+func (b *Browser) render(out io.Writer, width, height int) {
+	rows := height - 2
+	if rows < 1 || width < 10 {
+		return
+	}
+
+	// Scroll the listing to keep the selection visible.
+	if b.selected < b.scroll {
+		b.scroll = b.selected
+	}
+	if b.selected >= b.scroll+rows {
+		b.scroll = b.selected - rows + 1
+	}
+
+	listWidth := width / 3
+	previewWidth := width - listWidth - 1
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H\x1b[2J")
+	screen.WriteString("\x1b[7m" + pad(fmt.Sprintf(" %s:/%s", b.dataset.Name(), b.dir), width) + "\x1b[0m\r\n")
+	for row := 0; row < rows; row++ {
+		var entry string
+		if i := b.scroll + row; i < len(b.entries) {
+			entry = pad(" "+b.entries[i], listWidth)
+			if i == b.selected {
+				entry = "\x1b[7m" + entry + "\x1b[0m"
+			}
+		} else {
+			entry = pad("", listWidth)
+		}
+
+		var preview string
+		if row < len(b.preview) {
+			preview = b.preview[row]
+		}
+		screen.WriteString(entry + "│" + pad(preview, previewWidth) + "\r\n")
+	}
+
+	status := b.status
+	if status == "" {
+		status = browserHelp
+	}
+	screen.WriteString(pad(" "+status, width))
+	io.WriteString(out, screen.String())
+}
+
+// pad truncates or pads a line to exactly width columns, replacing tabs and
+// control characters so they cannot disturb the layout.
+func pad(s string, width int) string {
+	var line strings.Builder
+	n := 0
+	for _, r := range s {
+		if n >= width {
+			break
+		}
+		switch {
+		case r == '\t':
+			// Advance to the next tab stop.
+			line.WriteByte(' ')
+			for n++; n < width && n%4 != 0; n++ {
+				line.WriteByte(' ')
+			}
+			continue
+		case !unicode.IsPrint(r):
+			r = '.'
+		}
+		line.WriteRune(r)
+		n++
+	}
+	for ; n < width; n++ {
+		line.WriteByte(' ')
+	}
+	return line.String()
+}
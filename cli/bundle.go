@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/async"
+	"github.com/allenai/fileheap-client/bundle"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Bundle writes all files under the sourcePath in the sourcePkg to w as a
+// single-file bundle, which can be moved where the service is unreachable and
+// read there, or imported again with Unbundle. See package bundle for the
+// format. Files are verified against their digests as they are written.
+func Bundle(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	sourcePath string,
+	w io.Writer,
+	tracker ProgressTracker,
+) (err error) {
+	defer explainCancel(ctx, &err)
+
+	writer, err := bundle.NewWriter(w, sourcePkg.Name())
+	if err != nil {
+		return err
+	}
+
+	// Bundles list files in manifest order, so batches must preserve it.
+	files := sourcePkg.Files(ctx, &client.FileIteratorOptions{Prefix: sourcePath})
+	downloader := sourcePkg.DownloadBatchWithOptions(ctx, files, &client.DownloadBatchOptions{
+		PreserveOrder: true,
+	})
+	for {
+		batch, err := downloader.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for {
+			info, reader, err := batch.Next()
+			if err == client.ErrDone {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			tracker.Update(&ProgressUpdate{FilesPending: 1, BytesPending: info.Size})
+			fileStarted(tracker, info.Path, info.Size)
+			err = writer.AddFile(info, reader)
+			reader.Close()
+			fileFinished(tracker, info.Path, err)
+			if err != nil {
+				tracker.Update(&ProgressUpdate{
+					FilesPending: -1,
+					BytesPending: -info.Size,
+					FilesFailed:  1,
+				})
+				return err
+			}
+			tracker.Update(&ProgressUpdate{
+				FilesWritten: 1,
+				FilesPending: -1,
+				BytesWritten: info.Size,
+				BytesPending: -info.Size,
+			})
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	tracker.Close()
+	return nil
+}
+
+// Unbundle uploads every file in a bundle to the targetPath in the targetPkg,
+// restoring their modes. Contents are verified against their digests as they
+// are read, so a damaged bundle fails the import rather than writing corrupt
+// files.
+func Unbundle(
+	ctx context.Context,
+	source *bundle.Reader,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+) (err error) {
+	defer explainCancel(ctx, &err)
+	if concurrency < 1 {
+		return errors.New("concurrency must be positive")
+	}
+
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	asyncErr := async.Error{}
+	limiter := async.NewLimiter(concurrency)
+
+	uploadBatch := func(batch *client.UploadBatch) {
+		length := int64(batch.Length())
+		size := batch.Size()
+
+		tracker.Update(&ProgressUpdate{
+			FilesPending: length,
+			BytesPending: size,
+		})
+		if _, err := batch.UploadWithLimiter(ctx, limiter); err != nil {
+			tracker.Update(&ProgressUpdate{
+				FilesPending: -length,
+				BytesPending: -size,
+				FilesFailed:  length,
+			})
+			asyncErr.Report(err)
+			cancel(err)
+			return
+		}
+		tracker.Update(&ProgressUpdate{
+			FilesWritten: length,
+			FilesPending: -length,
+			BytesWritten: size,
+			BytesPending: -size,
+		})
+	}
+
+	batch := targetPkg.NewUploadBatch()
+	for _, entry := range source.Index().Files {
+		if err := asyncErr.Err(); err != nil {
+			break
+		}
+
+		if !batch.HasCapacity(entry.Size) {
+			b := batch
+			limiter.Go(func() { uploadBatch(b) })
+			batch = targetPkg.NewUploadBatch()
+		}
+		reader, err := source.ReadFile(entry.Path)
+		if err != nil {
+			asyncErr.Report(err)
+			break
+		}
+		target := path.Join(targetPath, entry.Path)
+		if err := batch.AddFileWithMode(target, reader, entry.Size, entry.Mode); err != nil {
+			asyncErr.Report(err)
+			break
+		}
+	}
+	if asyncErr.Err() == nil && batch.Length() != 0 {
+		limiter.Go(func() { uploadBatch(batch) })
+	}
+	limiter.Wait()
+	if err := asyncErr.Err(); err != nil {
+		return err
+	}
+
+	tracker.Close()
+	return nil
+}
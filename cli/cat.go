@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Size of each range requested by Head and Tail when looking for line endings.
+const headRangeSize = 64 * 1024
+
+// Cat streams the contents of a file in a dataset to w.
+func Cat(ctx context.Context, dataset client.DatasetAPI, filename string, w io.Writer) error {
+	r, err := dataset.ReadFile(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return errors.WithStack(err)
+}
+
+// HeadOptions selects how much of a file Head prints. If both are set, Bytes
+// takes precedence. If neither is set, Head prints 10 lines.
+type HeadOptions struct {
+	// Number of lines to print from the start of the file.
+	Lines int
+
+	// Number of bytes to print from the start of the file.
+	Bytes int64
+}
+
+// Head prints the start of a file in a dataset to w. Only the ranges needed are
+// read, so it is cheap even for very large files. The options may be nil.
+func Head(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	filename string,
+	w io.Writer,
+	opts *HeadOptions,
+) error {
+	if opts == nil {
+		opts = &HeadOptions{}
+	}
+	if opts.Lines < 0 || opts.Bytes < 0 {
+		return errors.New("line and byte counts must not be negative")
+	}
+
+	info, err := dataset.FileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	if opts.Bytes > 0 {
+		length := opts.Bytes
+		if length > info.Size {
+			length = info.Size
+		}
+		if length == 0 {
+			return nil
+		}
+		r, err := dataset.ReadFileRange(ctx, filename, 0, length)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return errors.WithStack(err)
+	}
+
+	lines := opts.Lines
+	if lines == 0 {
+		lines = 10
+	}
+	for offset := int64(0); offset < info.Size && lines > 0; offset += headRangeSize {
+		length := int64(headRangeSize)
+		if info.Size-offset < length {
+			length = info.Size - offset
+		}
+		buf, err := readRange(ctx, dataset, filename, offset, length)
+		if err != nil {
+			return err
+		}
+
+		// Print up to and including the last requested line ending.
+		end := 0
+		for lines > 0 {
+			i := bytes.IndexByte(buf[end:], '\n')
+			if i < 0 {
+				end = len(buf)
+				break
+			}
+			end += i + 1
+			lines--
+		}
+		if _, err := w.Write(buf[:end]); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func readRange(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	filename string,
+	offset, length int64,
+) ([]byte, error) {
+	r, err := dataset.ReadFileRange(ctx, filename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf, err := ioutil.ReadAll(r)
+	return buf, errors.WithStack(err)
+}
+
+// TailOptions selects how much of a file Tail prints and whether it follows the
+// file as it grows. If both Lines and Bytes are set, Bytes takes precedence. If
+// neither is set, Tail prints 10 lines.
+type TailOptions struct {
+	// Number of lines to print from the end of the file.
+	Lines int
+
+	// Number of bytes to print from the end of the file.
+	Bytes int64
+
+	// Keep printing data as it is appended to the file, such as a log written
+	// by a running job, until ctx is done or the dataset is sealed.
+	Follow bool
+
+	// Time between checks for new data when following. Defaults to a second.
+	Interval time.Duration
+}
+
+// Tail prints the end of a file in a dataset to w. Like Head, only the ranges
+// needed are read. When following, the file's size is polled and new data is
+// read from where the last read ended; a file replaced by a shorter one is
+// printed again from its start. The options may be nil.
+func Tail(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	filename string,
+	w io.Writer,
+	opts *TailOptions,
+) error {
+	if opts == nil {
+		opts = &TailOptions{}
+	}
+	if opts.Lines < 0 || opts.Bytes < 0 {
+		return errors.New("line and byte counts must not be negative")
+	}
+	interval := opts.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	if interval < 0 {
+		return errors.New("interval must be positive")
+	}
+
+	info, err := dataset.FileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if opts.Bytes > 0 {
+		if offset = info.Size - opts.Bytes; offset < 0 {
+			offset = 0
+		}
+	} else {
+		lines := opts.Lines
+		if lines == 0 {
+			lines = 10
+		}
+		if offset, err = lastLines(ctx, dataset, filename, info.Size, lines); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if info.Size < offset {
+			offset = 0
+		}
+		if info.Size > offset {
+			r, err := dataset.ReadFileRange(ctx, filename, offset, info.Size-offset)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(w, r)
+			r.Close()
+			offset += n
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if !opts.Follow {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		size := info.Size
+		if info, err = dataset.FileInfo(ctx, filename); err != nil {
+			return err
+		}
+		if info.Size == size {
+			// Sealed files can't grow, so there is nothing more to follow.
+			dsInfo, err := dataset.Info(ctx)
+			if err != nil {
+				return err
+			}
+			if dsInfo.ReadOnly {
+				return nil
+			}
+		}
+	}
+}
+
+// lastLines returns the offset at which the last lines of a file begin. A final
+// line ending does not begin another line.
+func lastLines(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	filename string,
+	size int64,
+	lines int,
+) (int64, error) {
+	end := size
+	for end > 0 {
+		start := end - headRangeSize
+		if start < 0 {
+			start = 0
+		}
+		buf, err := readRange(ctx, dataset, filename, start, end-start)
+		if err != nil {
+			return 0, err
+		}
+		if end == size && buf[len(buf)-1] == '\n' {
+			buf = buf[:len(buf)-1]
+		}
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			if lines--; lines == 0 {
+				return start + int64(i) + 1, nil
+			}
+			buf = buf[:i]
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// SignalError reports that an operation was cancelled by a signal.
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e *SignalError) Error() string {
+	return fmt.Sprintf("received %s", e.Signal)
+}
+
+// CanceledError is returned when an operation stops because its context was
+// cancelled. It records why the context was cancelled, such as a
+// *SignalError or context.DeadlineExceeded.
+type CanceledError struct {
+	// Why the context was cancelled.
+	Cause error
+
+	// The error the operation failed with, such as context.Canceled.
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Err, e.Cause)
+}
+
+// Unwrap returns the cause.
+func (e *CanceledError) Unwrap() error {
+	return e.Cause
+}
+
+type causeKey struct{}
+
+// causeContext is a cancellable context which records why it was cancelled.
+type causeContext struct {
+	context.Context
+
+	lock  sync.Mutex
+	cause error
+}
+
+func (c *causeContext) Value(key interface{}) interface{} {
+	if key == (causeKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// withCancelCause returns a copy of parent which is cancelled, with the given
+// cause, when cancel is called. A nil cause is recorded as context.Canceled.
+// Only the first cause is recorded, and none if parent was cancelled first.
+func withCancelCause(parent context.Context) (context.Context, func(cause error)) {
+	ctx, cancel := context.WithCancel(parent)
+	c := &causeContext{Context: ctx}
+	return c, func(cause error) {
+		c.lock.Lock()
+		if c.cause == nil && ctx.Err() == nil {
+			if cause == nil {
+				cause = context.Canceled
+			}
+			c.cause = cause
+		}
+		c.lock.Unlock()
+		cancel()
+	}
+}
+
+// Cause returns why a context was cancelled, or nil if it hasn't been. Contexts
+// cancelled by this package, such as by InterruptContext, report a specific
+// cause; others report ctx.Err().
+func Cause(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	for c, ok := ctx.Value(causeKey{}).(*causeContext); ok; c, ok = c.Context.Value(causeKey{}).(*causeContext) {
+		c.lock.Lock()
+		cause := c.cause
+		c.lock.Unlock()
+		if cause != nil {
+			return cause
+		}
+	}
+	return ctx.Err()
+}
+
+// explainCancel replaces *err with a *CanceledError if it was caused by the
+// cancellation of ctx, so that callers can tell why the operation stopped.
+func explainCancel(ctx context.Context, err *error) {
+	if *err == nil || ctx.Err() == nil {
+		return
+	}
+	if !errors.Is(*err, context.Canceled) && !errors.Is(*err, context.DeadlineExceeded) {
+		return
+	}
+	// A plain context error would add nothing.
+	if cause := Cause(ctx); cause != ctx.Err() {
+		*err = &CanceledError{Cause: cause, Err: *err}
+	}
+}
+
+// Process exit codes returned by ExitCode.
+const (
+	ExitOK            = 0
+	ExitError         = 1
+	ExitQuotaExceeded = 73  // EX_CANTCREAT
+	ExitUnauthorized  = 77  // EX_NOPERM
+	ExitTimeout       = 124 // As timeout(1).
+	ExitInterrupted   = 130 // As shells report SIGINT.
+)
+
+// ExitCode maps an error returned by this package to a process exit code.
+// Operations cancelled by a signal exit with 128 plus the signal number.
+func ExitCode(err error) int {
+	var signalErr *SignalError
+	var interruptedErr *InterruptedError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &signalErr):
+		if sig, ok := signalErr.Signal.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+		return ExitInterrupted
+	case errors.As(err, &interruptedErr):
+		return ExitInterrupted
+	case errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	case errors.Is(err, client.ErrQuotaExceeded):
+		return ExitQuotaExceeded
+	case errors.Is(err, client.ErrUnauthorized):
+		return ExitUnauthorized
+	default:
+		return ExitError
+	}
+}
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Checksums prints the SHA256 digest of each file under the prefix in a
+// dataset in the format of sha256sum, taking digests from the manifest rather
+// than reading any files. Paths are the files' paths within the dataset, which
+// are also their paths below the target of a download, so the output can be
+// checked against a download with VerifyChecksums or sha256sum --check.
+func Checksums(ctx context.Context, dataset client.DatasetAPI, prefix string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if isDirPlaceholder(info) {
+			continue
+		}
+		if _, err := bw.WriteString(formatChecksum(info.Digest, info.Path)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// formatChecksum formats a line of sha256sum output. As in sha256sum, paths
+// containing a backslash or newline are escaped, and the line is prefixed with
+// a backslash to show it.
+func formatChecksum(digest []byte, name string) string {
+	prefix := ""
+	if strings.ContainsAny(name, "\\\n") {
+		prefix = "\\"
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+	}
+	return fmt.Sprintf("%s%x  %s\n", prefix, digest, name)
+}
+
+// parseChecksum parses a line of sha256sum output.
+func parseChecksum(line string) ([]byte, string, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	// The digest is followed by a space and a mode: a space for text or an
+	// asterisk for binary, which are the same to SHA256.
+	n := 2 * sha256.Size
+	if len(line) < n+2 || line[n] != ' ' || (line[n+1] != ' ' && line[n+1] != '*') {
+		return nil, "", errors.New("improperly formatted checksum line")
+	}
+	digest, err := hex.DecodeString(line[:n])
+	if err != nil {
+		return nil, "", errors.New("improperly formatted checksum line")
+	}
+
+	name := line[n+2:]
+	if escaped {
+		name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+	}
+	return digest, name, nil
+}
+
+// VerifyChecksums checks the files listed in sha256sum output, such as that of
+// Checksums, against their copies below dir. Like sha256sum --check, it prints
+// each file's path followed by "OK" or "FAILED" to w, and returns an error if
+// any file is missing or doesn't match.
+func VerifyChecksums(ctx context.Context, sums io.Reader, dir string, w io.Writer) error {
+	var total, failed, malformed int
+	scanner := bufio.NewScanner(sums)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		expected, name, err := parseChecksum(line)
+		if err != nil {
+			malformed++
+			continue
+		}
+
+		total++
+		result := "OK"
+		digest, err := getDigest(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			result = "FAILED open or read"
+			failed++
+		} else if !bytes.Equal(digest, expected) {
+			result = "FAILED"
+			failed++
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", name, result); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if total == 0 {
+		return errors.New("no properly formatted checksum lines found")
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d computed checksums did NOT match", failed, total)
+	}
+	if malformed > 0 {
+		return errors.Errorf("%d lines are improperly formatted", malformed)
+	}
+	return nil
+}
@@ -5,16 +5,47 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+// InterruptContext returns a context which is cancelled on SIGINT or SIGTERM.
+// Its Cause is a *SignalError.
 func InterruptContext() context.Context {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := withCancelCause(context.Background())
 	go func() {
-		<-quit
-		cancel()
+		cancel(&SignalError{Signal: <-quit})
 	}()
 	return ctx
 }
+
+// GracefulInterruptContext supports cooperative shutdown on SIGINT or SIGTERM.
+//
+// The first signal cancels stop, asking operations to start no new work and
+// finish what is in flight; pass stop.Done() as the Stop option of Upload or
+// Download. The returned ctx is cancelled once the grace period elapses or a
+// second signal arrives, aborting any work still in flight. The Cause of each
+// is a *SignalError.
+func GracefulInterruptContext(grace time.Duration) (ctx, stop context.Context) {
+	quit := make(chan os.Signal, 2)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	ctx, cancel := withCancelCause(context.Background())
+	stop, stopNow := withCancelCause(ctx)
+	go func() {
+		cause := &SignalError{Signal: <-quit}
+		stopNow(cause)
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case sig := <-quit:
+			cause = &SignalError{Signal: sig}
+		case <-timer.C:
+		}
+		cancel(cause)
+	}()
+	return ctx, stop
+}
@@ -0,0 +1,191 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/async"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Copy all files under the sourcePath in the sourcePkg to the targetPath in
+// the targetPkg.
+//
+// The datasets may belong to clients of different servers, such as when
+// promoting a dataset from one environment to another. File contents are
+// streamed through this process without touching disk and are verified
+// against their digests on the way.
+func Copy(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	sourcePath string,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+) (err error) {
+	defer explainCancel(ctx, &err)
+	if concurrency < 1 {
+		return errors.New("concurrency must be positive")
+	}
+
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	asyncErr := async.Error{}
+	limiter := async.NewLimiter(concurrency)
+
+	files := sourcePkg.Files(ctx, &client.FileIteratorOptions{Prefix: sourcePath})
+	downloader := sourcePkg.DownloadBatch(ctx, files)
+	for {
+		if err := asyncErr.Err(); err != nil {
+			return err
+		}
+
+		batch, err := downloader.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		limiter.Go(func() {
+			length := int64(batch.Length())
+			size := batch.Size()
+
+			tracker.Update(&ProgressUpdate{
+				FilesPending: length,
+				BytesPending: size,
+			})
+
+			if err := copyBatch(ctx, batch, targetPkg, targetPath); err != nil {
+				tracker.Update(&ProgressUpdate{
+					FilesPending: -length,
+					BytesPending: -size,
+					FilesFailed:  length,
+				})
+				asyncErr.Report(err)
+				cancel(err)
+				return
+			}
+
+			tracker.Update(&ProgressUpdate{
+				FilesWritten: length,
+				FilesPending: -length,
+				BytesWritten: size,
+				BytesPending: -size,
+			})
+		})
+	}
+	limiter.Wait()
+	if err := asyncErr.Err(); err != nil {
+		return err
+	}
+
+	tracker.Close()
+	return nil
+}
+
+// copyBatch writes each file of a downloaded batch to the targetPath in the
+// targetPkg. Small files are buffered and uploaded in batches; large files are
+// streamed directly from the source.
+func copyBatch(
+	ctx context.Context,
+	batch *client.FileBatch,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+) error {
+	upload := targetPkg.NewUploadBatch()
+	for {
+		info, reader, err := batch.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		target := path.Join(targetPath, info.Path)
+		if info.Size > api.PutFileSizeLimit {
+			err := copyLargeFile(ctx, info, reader, targetPkg, target)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		buf, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := checkDigest(info, sha256.Sum256(buf)); err != nil {
+			return err
+		}
+
+		// The target server may accept smaller batches than the source.
+		if !upload.HasCapacity(info.Size) {
+			if _, err := upload.Upload(ctx); err != nil {
+				return err
+			}
+			upload = targetPkg.NewUploadBatch()
+		}
+		if err := upload.AddFileWithMode(target, bytes.NewReader(buf), info.Size, info.Mode); err != nil {
+			return err
+		}
+	}
+	_, err := upload.Upload(ctx)
+	return err
+}
+
+// copyLargeFile streams a single file to the target. The digest can only be
+// checked once the file is written, so a corrupt copy is deleted.
+func copyLargeFile(
+	ctx context.Context,
+	info *api.FileInfo,
+	reader io.Reader,
+	targetPkg *client.DatasetRef,
+	target string,
+) error {
+	hash := sha256.New()
+	if err := targetPkg.WriteFileWithOptions(
+		ctx,
+		target,
+		io.TeeReader(reader, hash),
+		info.Size,
+		&client.WriteFileOptions{Mode: info.Mode},
+	); err != nil {
+		return err
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], hash.Sum(nil))
+	if err := checkDigest(info, digest); err != nil {
+		if deleteErr := targetPkg.DeleteFile(ctx, target); deleteErr != nil {
+			return errors.Wrapf(err, "failed to delete corrupt copy: %v", deleteErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func checkDigest(info *api.FileInfo, digest [sha256.Size]byte) error {
+	if !bytes.Equal(digest[:], info.Digest) {
+		return errors.Errorf(
+			"%s has incorrect digest: expected %s, got %s",
+			info.Path,
+			base64.StdEncoding.EncodeToString(info.Digest),
+			base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	return nil
+}
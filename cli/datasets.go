@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// LsDatasetsOptions provides optional configuration to LsDatasets.
+type LsDatasetsOptions struct {
+	// List datasets in this namespace instead of the client's. See
+	// client.WithNamespace.
+	Namespace string
+}
+
+// LsDatasets lists the datasets visible to the client to w, oldest first, with
+// their namespace, owner, age, and size. The options may be nil.
+func LsDatasets(ctx context.Context, c *client.Client, w io.Writer, opts *LsDatasetsOptions) error {
+	if opts == nil {
+		opts = &LsDatasetsOptions{}
+	}
+
+	table := (&Table{}).AlignRight(4)
+	now := time.Now()
+	datasets := c.ListDatasets(ctx, &client.DatasetFilter{Namespace: opts.Namespace})
+	for {
+		dataset, err := datasets.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		namespace, owner, size := dataset.Namespace, dataset.Owner, "unknown size"
+		if namespace == "" {
+			namespace = "-"
+		}
+		if owner == "" {
+			owner = "-"
+		}
+		if dataset.Size != nil {
+			size = FormatBytes(dataset.Size.Bytes)
+		}
+		table.Row(dataset.ID, namespace, owner, "created "+FormatAge(dataset.Created, now), size)
+	}
+	return table.Render(w)
+}
@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// MaxClockSkew is the largest difference between the local and server clocks
+// which Doctor accepts.
+const MaxClockSkew = 30 * time.Second
+
+// Doctor checks the client's environment for common problems, printing the
+// result of each check to w. It returns an error if any check fails.
+//
+// It currently checks that the local clock agrees with the server's, since
+// skew makes update times misleading and can cause signed URLs to be rejected.
+func Doctor(ctx context.Context, c *client.Client, w io.Writer) error {
+	skew, err := c.ClockSkew(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "Clock skew: unknown (%v)\n", err)
+		return err
+	}
+	if skew < 0 {
+		fmt.Fprintf(w, "Clock skew: server is %v behind this machine\n", -skew)
+	} else {
+		fmt.Fprintf(w, "Clock skew: server is %v ahead of this machine\n", skew)
+	}
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return errors.Errorf("clock skew of %v exceeds %v; synchronize this machine's clock", skew, MaxClockSkew)
+	}
+	return nil
+}
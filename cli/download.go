@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,6 +18,81 @@ import (
 	"github.com/allenai/fileheap-client/client"
 )
 
+// DownloadOptions provides optional configuration to Download.
+type DownloadOptions struct {
+	// Download from a snapshot of the dataset taken as the download starts,
+	// so that files written or deleted by others meanwhile don't leave a mix
+	// of old and new files. Unnecessary for sealed datasets.
+	Snapshot bool
+
+	// Download large files directly from presigned URLs in the manifest,
+	// bypassing the FileHeap service for bulk data. Files are still verified
+	// against their digests. Files whose URLs fail, such as because they
+	// expired or the object store is unreachable, are fetched through the
+	// FileHeap service instead.
+	UseURLs bool
+
+	// Number of concurrent range requests per file downloaded from a URL.
+	// Defaults to 4.
+	URLConnections int
+
+	// Inline the contents of files up to this many bytes in the manifest,
+	// avoiding further requests for datasets of many tiny files.
+	InlineThreshold int64
+
+	// Closing Stop asks the download to let batches in flight finish, start no
+	// new ones, and return an *InterruptedError. Downloading to the same path
+	// again skips files which were completed. See GracefulInterruptContext.
+	Stop <-chan struct{}
+
+	// Path of a journal recording each file as it completes. Files recorded in
+	// the journal are skipped by later downloads with the same journal,
+	// without hashing them again, as long as they are unchanged locally.
+	Journal string
+
+	// Number of bytes to read ahead of each batch's current file, so that
+	// network reads overlap with disk writes on high-latency links.
+	ReadAhead int64
+
+	// Download only the files named in this reader, one path per line, such
+	// as the output of Find, instead of every file under the source path.
+	// UseURLs and InlineThreshold do not apply to listed files.
+	PathsFrom io.Reader
+
+	// Store files in directories named by the first ShardDirs hex digits of
+	// their digests, named by the whole digest, instead of at their dataset
+	// paths. This avoids huge directories, which some filesystems handle
+	// poorly. The original paths are recorded in ShardMapFile; upload with
+	// UploadOptions.Unshard to restore them. Files with the same contents are
+	// stored once.
+	ShardDirs int
+
+	// Path of a content-addressed store shared by downloads on this machine.
+	// Files are written to the store once per digest and linked into the
+	// target path, so datasets sharing contents consume disk space only once.
+	// Linked files share the stored copy and must not be modified in place.
+	// Cannot be combined with ShardDirs.
+	Store string
+
+	// Link files from the store with symbolic links instead of hard links,
+	// such as when the store is on a different filesystem than the target.
+	StoreSymlinks bool
+
+	// Path of a digest cache shared by downloads on this machine, recording
+	// the digest of each file they write. Files whose digest matches an
+	// unchanged file from an earlier download are hard linked to it instead of
+	// downloaded, or copied if they can't be linked. Hard linked files share
+	// contents, so must not be modified in place; see ReuseCopies.
+	DigestCache string
+
+	// Copy files reused from the digest cache instead of hard linking them.
+	ReuseCopies bool
+
+	// Once the download finishes, successfully or not, write a DownloadReport
+	// of every file it fetched or skipped to this writer as a line of JSON.
+	Report io.Writer
+}
+
 // Download all files under the sourcePath in the sourcePkg to the targetPath.
 func Download(
 	ctx context.Context,
@@ -26,29 +102,194 @@ func Download(
 	tracker ProgressTracker,
 	concurrency int,
 ) error {
+	return DownloadWithOptions(ctx, sourcePkg, sourcePath, targetPath, tracker, concurrency, nil)
+}
+
+// DownloadWithOptions is like Download, with additional configuration. The
+// options may be nil.
+func DownloadWithOptions(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	sourcePath string,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+	opts *DownloadOptions,
+) (err error) {
+	defer explainCancel(ctx, &err)
 	if concurrency < 1 {
 		return errors.New("concurrency must be positive")
 	}
+	return download(ctx, sourcePkg, sourcePath, targetPath, tracker, async.NewLimiter(concurrency), opts)
+}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// download is Download with a limiter which may be shared with other downloads.
+func download(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	sourcePath string,
+	targetPath string,
+	tracker ProgressTracker,
+	limiter *async.Limiter,
+	opts *DownloadOptions,
+) (err error) {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	var report *downloadReport
+	if opts.Report != nil {
+		report = newDownloadReport(sourcePkg.Name(), sourcePath, targetPath)
+		defer func() {
+			if reportErr := report.write(opts.Report, err); err == nil {
+				err = reportErr
+			}
+		}()
+	}
+	connections := opts.URLConnections
+	if connections == 0 {
+		connections = 4
+	}
+	if opts.ShardDirs < 0 || opts.ShardDirs > 2*sha256.Size {
+		return errors.Errorf("shard directories must use between 0 and %d digits", 2*sha256.Size)
+	}
+	if opts.Snapshot && !sourcePkg.IsSnapshot() {
+		snapshot, err := sourcePkg.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		sourcePkg = snapshot
+	}
+
+	layout := &localLayout{root: targetPath, shard: opts.ShardDirs}
+	if opts.Store != "" {
+		if opts.ShardDirs != 0 {
+			return errors.New("a store cannot be combined with shard directories")
+		}
+		store, err := filepath.Abs(opts.Store)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		layout = &localLayout{root: store, shard: storeShardDirs}
+	}
+
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	counter := &countingTracker{ProgressTracker: tracker}
+	tracker = counter
+
+	records := &downloadRecords{copies: opts.ReuseCopies, report: report}
+	if opts.Journal != "" {
+		var err error
+		if records.journal, err = openJournal(opts.Journal); err != nil {
+			return err
+		}
+		defer records.journal.Close()
+	}
+	if opts.DigestCache != "" {
+		var err error
+		if records.digests, err = openJournal(opts.DigestCache); err != nil {
+			return err
+		}
+		defer records.digests.Close()
+	}
 
 	// Create target directory explicitly for empty datasets.
 	if err := os.MkdirAll(targetPath, 0755); err != nil {
 		return err
 	}
 
-	files := &modifiedIterator{
-		files:      sourcePkg.Files(ctx, &client.FileIteratorOptions{Prefix: sourcePath}),
-		targetPath: targetPath,
-		tracker:    tracker,
-	}
-	downloader := sourcePkg.DownloadBatch(ctx, files)
 	asyncErr := async.Error{}
-	limiter := async.NewLimiter(concurrency)
+
+	var listing client.Iterator
+	if opts.PathsFrom != nil {
+		listing = &pathIterator{ctx: ctx, dataset: sourcePkg, paths: newPathReader(opts.PathsFrom)}
+	} else {
+		listing = sourcePkg.Files(ctx, &client.FileIteratorOptions{
+			Prefix:          sourcePath,
+			IncludeURLs:     opts.UseURLs,
+			InlineThreshold: opts.InlineThreshold,
+		})
+	}
+	var shardMap *shardMapIterator
+	var mapFile *os.File
+	if layout.shard != 0 {
+		// Links into a store are only recorded until they are made.
+		var err error
+		if opts.Store != "" {
+			mapFile, err = ioutil.TempFile("", "fileheap-links-*.jsonl")
+		} else {
+			mapFile, err = os.Create(filepath.Join(targetPath, ShardMapFile))
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer mapFile.Close()
+		if opts.Store != "" {
+			defer os.Remove(mapFile.Name())
+		}
+		shardMap = newShardMapIterator(listing, layout, mapFile)
+		defer shardMap.flush()
+		listing = shardMap
+	}
+	var files client.Iterator = &modifiedIterator{
+		files:   listing,
+		layout:  layout,
+		tracker: tracker,
+		records: records,
+	}
+	if opts.UseURLs {
+		// Divert large files out of batches to be fetched from their URLs.
+		files = &urlIterator{
+			files: files,
+			divert: func(info *api.FileInfo) {
+				limiter.Go(func() {
+					tracker.Update(&ProgressUpdate{FilesPending: 1, BytesPending: info.Size})
+					fileStarted(tracker, info.Path, info.Size)
+					records.report.fileStarted(info)
+					err := downloadFromURL(ctx, sourcePkg, info, layout, connections)
+					if err != nil && ctx.Err() == nil {
+						tracker.Update(&ProgressUpdate{FilesRetried: 1, BytesRetried: info.Size})
+						err = downloadFromService(ctx, sourcePkg, info, layout)
+					}
+					if err == nil {
+						err = records.record(info, layout)
+					}
+					fileFinished(tracker, info.Path, err)
+					records.report.fileFinished(info, err)
+					if err != nil {
+						tracker.Update(&ProgressUpdate{
+							FilesPending: -1,
+							BytesPending: -info.Size,
+							FilesFailed:  1,
+						})
+						asyncErr.Report(err)
+						cancel(err)
+						return
+					}
+					tracker.Update(&ProgressUpdate{
+						FilesWritten: 1,
+						FilesPending: -1,
+						BytesWritten: info.Size,
+						BytesPending: -info.Size,
+					})
+				})
+			},
+		}
+	}
+	batchOpts := &client.DownloadBatchOptions{ReadAhead: opts.ReadAhead}
+	downloader := sourcePkg.DownloadBatchWithOptions(ctx, files, batchOpts)
+	// Every exit from the loop waits for batches in flight, so that their
+	// files are recorded before the journal, report, and shard map are closed.
+	var interrupted bool
+	var listErr error
 	for {
-		if err := asyncErr.Err(); err != nil {
-			return err
+		if asyncErr.Err() != nil {
+			break
+		}
+		if stopped(opts.Stop) {
+			interrupted = true
+			break
 		}
 
 		batch, err := downloader.Next()
@@ -56,95 +297,298 @@ func Download(
 			break
 		}
 		if err != nil {
-			return err
+			listErr = err
+			cancel(err)
+			break
 		}
 
 		limiter.Go(func() {
-			length := int64(batch.Length())
-			size := batch.Size()
-
+			infos := batch.Files()
 			tracker.Update(&ProgressUpdate{
-				FilesPending: length,
-				BytesPending: size,
+				FilesPending: int64(batch.Length()),
+				BytesPending: batch.Size(),
 			})
 
-			reportError := func(err error) {
+			// Files are written in order, so after a failure only those
+			// following the last written file need to be fetched again.
+			written, err := writeBatch(batch, layout, tracker, records)
+			for attempt := 1; err != nil && attempt < batchDownloadAttempts && ctx.Err() == nil; attempt++ {
+				infos = infos[written:]
+				tracker.Update(&ProgressUpdate{
+					FilesRetried: int64(len(infos)),
+					BytesRetried: totalSize(infos),
+				})
+				written, err = writeFiles(ctx, sourcePkg, batchOpts, infos, layout, tracker, records)
+			}
+			if err != nil {
+				failed := infos[written:]
+				size := totalSize(failed)
 				tracker.Update(&ProgressUpdate{
-					FilesPending: -length,
+					FilesPending: -int64(len(failed)),
 					BytesPending: -size,
+					FilesFailed:  int64(len(failed)),
 				})
 				asyncErr.Report(err)
-				cancel()
+				cancel(err)
 			}
+		})
+	}
+	limiter.Wait()
+	if listErr != nil {
+		return listErr
+	}
+	if err := asyncErr.Err(); err != nil {
+		return err
+	}
+	if interrupted {
+		return &InterruptedError{
+			Completed: counter.filesWritten(),
+			Remaining: -1,
+		}
+	}
 
-			for {
-				info, reader, err := batch.Next()
-				if err == client.ErrDone {
-					break
-				}
-				if err != nil {
-					reportError(errors.WithStack(err))
-					return
-				}
-
-				// Wrap in a function to defer close until the end of each file
-				// instead of the end of the batch.
-				func() {
-					defer reader.Close()
-
-					filePath := path.Join(targetPath, info.Path)
-					if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-						reportError(errors.WithStack(err))
-						return
-					}
+	if opts.Store != "" {
+		if err := shardMap.flush(); err != nil {
+			return err
+		}
+		if _, err := mapFile.Seek(0, io.SeekStart); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := linkTree(mapFile, targetPath, layout.root, opts.StoreSymlinks); err != nil {
+			return err
+		}
+	}
 
-					file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-					if err != nil {
-						reportError(errors.WithStack(err))
-						return
-					}
-					defer file.Close()
+	tracker.Close()
+	return nil
+}
 
-					hash := sha256.New()
-					hashReader := io.TeeReader(reader, hash)
-					if _, err := io.Copy(file, hashReader); err != nil {
-						reportError(errors.WithStack(err))
-						return
-					}
-					if digest := hash.Sum(nil); !bytes.Equal(digest, info.Digest) {
-						reportError(errors.Errorf(
-							"%s has incorrect digest: expected %s, got %s",
-							info.Path,
-							base64.StdEncoding.EncodeToString(info.Digest),
-							base64.StdEncoding.EncodeToString(digest)))
-						return
-					}
-				}()
-			}
+// Number of attempts to download the files of a batch before giving up.
+const batchDownloadAttempts = 3
 
-			tracker.Update(&ProgressUpdate{
-				FilesWritten: length,
-				FilesPending: -length,
-				BytesWritten: size,
-				BytesPending: -size,
-			})
+// writeFiles downloads files to their local paths in as many batches as needed.
+// It returns the number of files written before any error.
+func writeFiles(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	batchOpts *client.DownloadBatchOptions,
+	infos []*api.FileInfo,
+	layout *localLayout,
+	tracker ProgressTracker,
+	records *downloadRecords,
+) (int, error) {
+	var written int
+	downloader := sourcePkg.DownloadBatchWithOptions(ctx, &sliceIterator{infos: infos}, batchOpts)
+	for {
+		batch, err := downloader.Next()
+		if err == client.ErrDone {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		n, err := writeBatch(batch, layout, tracker, records)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeBatch writes each file in a batch to its local path and verifies its
+// digest, marking files as written one at a time. It returns the number of
+// files written before any error.
+func writeBatch(
+	batch *client.FileBatch,
+	layout *localLayout,
+	tracker ProgressTracker,
+	records *downloadRecords,
+) (int, error) {
+	var written int
+	for {
+		info, reader, err := batch.Next()
+		if err == client.ErrDone {
+			return written, nil
+		}
+		if err != nil {
+			return written, errors.WithStack(err)
+		}
+
+		fileStarted(tracker, info.Path, info.Size)
+		records.report.fileStarted(info)
+		err = writeFile(info, reader, layout)
+		reader.Close()
+		if err == nil {
+			err = records.record(info, layout)
+		}
+		fileFinished(tracker, info.Path, err)
+		records.report.fileFinished(info, err)
+		if err != nil {
+			return written, err
+		}
+
+		written++
+		tracker.Update(&ProgressUpdate{
+			FilesWritten: 1,
+			FilesPending: -1,
+			BytesWritten: info.Size,
+			BytesPending: -info.Size,
 		})
 	}
-	limiter.Wait()
-	if err := asyncErr.Err(); err != nil {
+}
+
+// writeFile copies a single file from reader to its local path and verifies it.
+// A file left incomplete by an error will not match its digest, so it is
+// fetched again by the next download.
+func writeFile(info *api.FileInfo, reader io.Reader, layout *localLayout) error {
+	file, err := createFile(info, layout.path(info))
+	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	tracker.Close()
+	hash := sha256.New()
+	hashReader := io.TeeReader(reader, hash)
+	if _, err := io.Copy(file, hashReader); err != nil {
+		return errors.WithStack(err)
+	}
+	if digest := hash.Sum(nil); !bytes.Equal(digest, info.Digest) {
+		return errors.Errorf(
+			"%s has incorrect digest: expected %s, got %s",
+			info.Path,
+			base64.StdEncoding.EncodeToString(info.Digest),
+			base64.StdEncoding.EncodeToString(digest))
+	}
+	return errors.WithStack(file.Close())
+}
+
+// createFile creates a local file to download into, replacing any existing
+// file. The existing file is removed rather than truncated in case it is linked
+// to a stored or reused copy shared with other downloads.
+func createFile(info *api.FileInfo, filePath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode(info))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// OpenFile applies the umask to the mode.
+	if info.Mode != 0 {
+		if err := file.Chmod(info.Mode); err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+	return file, nil
+}
+
+// downloadFromURL writes a single file from its presigned URL and verifies it.
+func downloadFromURL(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	info *api.FileInfo,
+	layout *localLayout,
+	connections int,
+) error {
+	filePath := layout.path(info)
+	file, err := createFile(info, filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := sourcePkg.DownloadFromURL(ctx, info, file, connections); err != nil {
+		return err
+	}
+
+	// Parts are written out of order, so hash the file once it is complete.
+	digest, err := getDigest(filePath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, info.Digest) {
+		return errors.Errorf(
+			"%s has incorrect digest: expected %s, got %s",
+			info.Path,
+			base64.StdEncoding.EncodeToString(info.Digest),
+			base64.StdEncoding.EncodeToString(digest))
+	}
 	return nil
 }
 
+// downloadFromService writes a single file read through the FileHeap service,
+// for files which could not be fetched from their presigned URLs.
+func downloadFromService(
+	ctx context.Context,
+	sourcePkg *client.DatasetRef,
+	info *api.FileInfo,
+	layout *localLayout,
+) error {
+	reader, err := sourcePkg.ReadFile(ctx, info.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeFile(info, reader, layout)
+}
+
+// totalSize returns the combined size of files.
+func totalSize(infos []*api.FileInfo) int64 {
+	var size int64
+	for _, info := range infos {
+		size += info.Size
+	}
+	return size
+}
+
+// sliceIterator is an Iterator over a fixed list of files.
+type sliceIterator struct {
+	infos []*api.FileInfo
+}
+
+func (i *sliceIterator) Next() (*api.FileInfo, error) {
+	if len(i.infos) == 0 {
+		return nil, client.ErrDone
+	}
+	info := i.infos[0]
+	i.infos = i.infos[1:]
+	return info, nil
+}
+
+// urlIterator wraps an Iterator and diverts files large enough to benefit from
+// parallel range requests, passing them to divert instead of returning them.
+type urlIterator struct {
+	files  client.Iterator
+	divert func(*api.FileInfo)
+}
+
+func (i *urlIterator) Next() (*api.FileInfo, error) {
+	for {
+		info, err := i.files.Next()
+		if err != nil {
+			return nil, err
+		}
+		if info.URL == "" || info.Size <= api.PutFileSizeLimit {
+			return info, nil
+		}
+		i.divert(info)
+	}
+}
+
 // modifiedFilter wraps a FileIterator and filters out files that already
 // exist in the local filesystem and have the same content as the remote copy.
 type modifiedIterator struct {
-	files      client.Iterator
-	targetPath string
-	tracker    ProgressTracker
+	files   client.Iterator
+	layout  *localLayout
+	tracker ProgressTracker
+	records *downloadRecords
 }
 
 func (i *modifiedIterator) Next() (*api.FileInfo, error) {
@@ -154,27 +598,49 @@ func (i *modifiedIterator) Next() (*api.FileInfo, error) {
 			return nil, err
 		}
 
-		filename := path.Join(i.targetPath, info.Path)
-		finfo, err := os.Stat(filename)
-		if os.IsNotExist(err) {
-			return info, nil
+		// Sharded layouts have no directories to restore.
+		if i.layout.shard == 0 && isDirPlaceholder(info) {
+			if err := restoreDir(path.Dir(i.layout.path(info)), info.Mode); err != nil {
+				return nil, err
+			}
+			i.tracker.Update(&ProgressUpdate{FilesWritten: 1})
+			continue
 		}
+
+		filename := i.layout.path(info)
+		unchanged, err := i.unchanged(info, filename)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, err
 		}
-		if finfo.Size() != info.Size {
-			return info, nil
+		if !unchanged {
+			reused, err := i.records.reuse(info, i.layout)
+			if err != nil {
+				return nil, err
+			}
+			if !reused {
+				return info, nil
+			}
+			i.records.report.fileSkipped(info, ReportReused)
+			i.tracker.Update(&ProgressUpdate{
+				FilesWritten: 1,
+				BytesWritten: info.Size,
+			})
+			continue
 		}
-
-		digest, err := getDigest(filename)
+		finfo, err := os.Stat(filename)
 		if err != nil {
-			return nil, err
+			return nil, errors.WithStack(err)
 		}
-		if !bytes.Equal(digest, info.Digest) {
-			return info, nil
+
+		// Local file is the same as remote, but its recorded mode may have changed.
+		if info.Mode != 0 && finfo.Mode().Perm() != info.Mode {
+			if err := os.Chmod(filename, info.Mode); err != nil {
+				return nil, errors.WithStack(err)
+			}
 		}
 
-		// Local file is the same as remote. Mark as written.
+		// Mark as written.
+		i.records.report.fileSkipped(info, ReportUnchanged)
 		i.tracker.Update(&ProgressUpdate{
 			FilesWritten: 1,
 			BytesWritten: info.Size,
@@ -182,6 +648,52 @@ func (i *modifiedIterator) Next() (*api.FileInfo, error) {
 	}
 }
 
+// unchanged returns true if the local file has the same contents as the remote.
+func (i *modifiedIterator) unchanged(info *api.FileInfo, filename string) (bool, error) {
+	finfo, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if finfo.Size() != info.Size {
+		return false, nil
+	}
+
+	// Trust the journal over hashing the file again.
+	entry, ok := i.records.journal.lookup(info.Path, finfo)
+	if ok && bytes.Equal(entry.Digest, info.Digest) {
+		return true, nil
+	}
+	digest, err := getDigest(filename)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(digest, info.Digest), nil
+}
+
+// fileMode returns the permission bits to create a downloaded file with,
+// falling back to 0644 if no mode was recorded on upload.
+func fileMode(info *api.FileInfo) os.FileMode {
+	if info.Mode != 0 {
+		return info.Mode
+	}
+	return 0644
+}
+
+// restoreDir creates the directory recorded by a placeholder, restoring its
+// permission bits if they were recorded.
+func restoreDir(dir string, mode os.FileMode) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	if mode != 0 {
+		return errors.WithStack(os.Chmod(dir, mode))
+	}
+	return nil
+}
+
 func getDigest(filename string) ([]byte, error) {
 	file, err := os.Open(filename)
 	if err != nil {
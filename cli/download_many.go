@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/async"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// DownloadSource names files to download with DownloadDatasets.
+type DownloadSource struct {
+	Dataset *client.DatasetRef
+
+	// (optional) Path within the dataset to download. Empty downloads the
+	// whole dataset.
+	Path string
+
+	// (optional) Subdirectory of the target to download into. Defaults to the
+	// dataset's name.
+	Dir string
+}
+
+// DownloadDatasets downloads several datasets concurrently, each into its own
+// subdirectory of targetPath. All downloads share one limit of concurrency
+// batches in flight and report to one tracker, which is closed once every
+// download completes. The first error cancels the remaining downloads.
+//
+// The options apply to every download and may be nil. Journal and PathsFrom
+// name a single dataset's files, so cannot be used. A Report is written for
+// each dataset.
+func DownloadDatasets(
+	ctx context.Context,
+	sources []DownloadSource,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+	opts *DownloadOptions,
+) (err error) {
+	defer explainCancel(ctx, &err)
+	if concurrency < 1 {
+		return errors.New("concurrency must be positive")
+	}
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	if opts.Journal != "" || opts.PathsFrom != nil {
+		return errors.New("a journal or list of paths cannot be shared by multiple datasets")
+	}
+	if opts.Report != nil {
+		// Each download writes its own report when it finishes.
+		shared := *opts
+		shared.Report = &lockedWriter{w: opts.Report}
+		opts = &shared
+	}
+
+	// Subdirectories are cleaned so they can't escape the target.
+	dirs := make([]string, len(sources))
+	seen := map[string]bool{}
+	for i, source := range sources {
+		dir := source.Dir
+		if dir == "" {
+			dir = source.Dataset.Name()
+		}
+		dir = path.Clean("/" + filepath.ToSlash(dir))[1:]
+		if dir == "" {
+			return errors.Errorf("%q: invalid directory", source.Dir)
+		}
+		if seen[dir] {
+			return errors.Errorf("%s: more than one dataset downloads to the same directory", dir)
+		}
+		seen[dir] = true
+		dirs[i] = dir
+	}
+
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	limiter := async.NewLimiter(concurrency)
+	asyncErr := async.Error{}
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		shared := &sharedTracker{ProgressTracker: tracker, prefix: dirs[i]}
+		target := filepath.Join(targetPath, filepath.FromSlash(dirs[i]))
+
+		source := source
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := download(ctx, source.Dataset, source.Path, target, shared, limiter.Share(), opts)
+			if err != nil {
+				err = errors.WithMessagef(err, "download %s", source.Dataset.Name())
+				asyncErr.Report(err)
+				cancel(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := asyncErr.Err(); err != nil {
+		return err
+	}
+
+	tracker.Close()
+	return nil
+}
+
+// sharedTracker forwards updates from one of several operations to a tracker
+// they share, which is closed once all of them complete rather than by each.
+// Files are reported below a prefix naming the operation.
+type sharedTracker struct {
+	ProgressTracker
+	prefix string
+}
+
+func (t *sharedTracker) FileStarted(p string, size int64) {
+	fileStarted(t.ProgressTracker, path.Join(t.prefix, p), size)
+}
+
+func (t *sharedTracker) FileFinished(p string, err error) {
+	fileFinished(t.ProgressTracker, path.Join(t.prefix, p), err)
+}
+
+func (t *sharedTracker) Close() error {
+	return nil
+}
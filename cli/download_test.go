@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allenai/fileheap-client/client"
+	"github.com/allenai/fileheap-client/fileheaptest"
+)
+
+func TestDownloadFailureRecordsCompletedFiles(t *testing.T) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	// The first file is refused once others have had time to complete, and
+	// while more are still being written.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/files/") {
+			if strings.HasSuffix(r.URL.Path, "/files/bad") {
+				time.Sleep(100 * time.Millisecond)
+				http.Error(w, `{"message":"forbidden"}`, http.StatusForbidden)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, err := client.New(server.URL, client.WithBatchSizeLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataset, err := c.NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"bad": "bad"}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("f%02d", i)] = fmt.Sprintf("contents of file %d", i)
+	}
+	for name, contents := range files {
+		if err := dataset.WriteFile(ctx, name, strings.NewReader(contents), int64(len(contents))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target")
+	journalPath := filepath.Join(dir, "journal")
+	var report bytes.Buffer
+	err = DownloadWithOptions(ctx, dataset, "", target, NoTracker, 4, &DownloadOptions{
+		Journal: journalPath,
+		Report:  &report,
+	})
+	if err == nil {
+		t.Fatal("download succeeded despite a forbidden file")
+	}
+
+	var r DownloadReport
+	if err := json.Unmarshal(report.Bytes(), &r); err != nil {
+		t.Fatalf("parsing report %q: %v", report.String(), err)
+	}
+	reported := map[string]string{}
+	for _, file := range r.Files {
+		reported[file.Path] = file.Result
+	}
+
+	journal, err := os.Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	journaled := map[string]bool{}
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("parsing journal line %q: %v", scanner.Text(), err)
+		}
+		journaled[entry.Path] = true
+	}
+
+	var completed int
+	for name, contents := range files {
+		data, err := ioutil.ReadFile(filepath.Join(target, name))
+		if err != nil || string(data) != contents {
+			continue
+		}
+		completed++
+		if reported[name] != ReportVerified {
+			t.Errorf("%s: completed, but reported as %q", name, reported[name])
+		}
+		if !journaled[name] {
+			t.Errorf("%s: completed, but missing from the journal", name)
+		}
+	}
+	if completed == 0 {
+		t.Error("no files completed")
+	}
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pathFilter selects files by glob patterns in the syntax of path.Match.
+//
+// Patterns containing a slash are matched against a file's full path relative
+// to the upload root. Other patterns are matched against the name of each file
+// and directory, so ".git" excludes every .git directory and "*.tmp" excludes
+// temporary files at any depth.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	for _, pattern := range append(include, exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+	return &pathFilter{include: include, exclude: exclude}, nil
+}
+
+// skipDir returns true if a directory and everything in it should be skipped.
+// Only exclude patterns apply to directories.
+func (f *pathFilter) skipDir(relpath string) bool {
+	return matchAny(f.exclude, relpath)
+}
+
+// skipFile returns true if a file should be skipped. Files are skipped if they
+// match an exclude pattern or if include patterns are given and none match.
+func (f *pathFilter) skipFile(relpath string) bool {
+	if matchAny(f.exclude, relpath) {
+		return true
+	}
+	return len(f.include) != 0 && !matchAny(f.include, relpath)
+}
+
+// skipPath returns true if a file would be skipped by a walk, either directly
+// or because one of its parent directories is skipped.
+func (f *pathFilter) skipPath(relpath string) bool {
+	for dir := path.Dir(relpath); dir != "."; dir = path.Dir(dir) {
+		if f.skipDir(dir) {
+			return true
+		}
+	}
+	return f.skipFile(relpath)
+}
+
+func matchAny(patterns []string, relpath string) bool {
+	for _, pattern := range patterns {
+		name := relpath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relpath)
+		}
+		// Patterns were validated on construction, so errors are impossible.
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
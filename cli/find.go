@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// FindOptions selects the files printed by Find. Zero fields match all files.
+type FindOptions struct {
+	// Glob patterns in the syntax of path.Match, of which a file must match at
+	// least one. Patterns containing a slash match the file's full path within
+	// the dataset; other patterns match its name.
+	Name []string
+
+	// Only match files updated within this long of now.
+	NewerThan time.Duration
+
+	// Only match files last updated longer ago than this.
+	OlderThan time.Duration
+
+	// Only match files larger than this many bytes.
+	LargerThan int64
+
+	// Only match files smaller than this many bytes.
+	SmallerThan int64
+
+	// Output format, either FormatText for one path per line or FormatJSON
+	// for a FileStat per line. Empty means FormatText.
+	Format string
+}
+
+// Find prints each file under the prefix in a dataset which matches every
+// predicate in the options. The text output is suitable for passing to
+// commands which read paths, one per line. The options may be nil.
+func Find(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	prefix string,
+	w io.Writer,
+	opts *FindOptions,
+) error {
+	if opts == nil {
+		opts = &FindOptions{}
+	}
+	format := opts.Format
+	if format == "" {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatJSON {
+		return errors.Errorf("unknown format %q", format)
+	}
+	filter, err := newPathFilter(opts.Name, nil)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	match := func(info *api.FileInfo) bool {
+		if opts.NewerThan > 0 && info.Updated.Before(now.Add(-opts.NewerThan)) {
+			return false
+		}
+		if opts.OlderThan > 0 && info.Updated.After(now.Add(-opts.OlderThan)) {
+			return false
+		}
+		if opts.LargerThan > 0 && info.Size <= opts.LargerThan {
+			return false
+		}
+		if opts.SmallerThan > 0 && info.Size >= opts.SmallerThan {
+			return false
+		}
+		return !filter.skipFile(info.Path)
+	}
+
+	prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !match(info) {
+			continue
+		}
+
+		if format == FormatJSON {
+			if err := printFileStat(w, info, FormatJSON); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintln(w, info.Path); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Gateways serve a dataset to tools which speak other protocols. Directories
+// are implied by the paths of the files within them, or by placeholders
+// recording empty directories; see DirPlaceholder.
+
+// gatewayFileInfo describes a file in a dataset as an os.FileInfo.
+type gatewayFileInfo struct {
+	info *api.FileInfo
+}
+
+func (i gatewayFileInfo) Name() string       { return path.Base(i.info.Path) }
+func (i gatewayFileInfo) Size() int64        { return i.info.Size }
+func (i gatewayFileInfo) ModTime() time.Time { return i.info.Updated }
+func (i gatewayFileInfo) IsDir() bool        { return false }
+func (i gatewayFileInfo) Sys() interface{}   { return i.info }
+
+func (i gatewayFileInfo) Mode() os.FileMode {
+	if i.info.Mode != 0 {
+		return i.info.Mode.Perm()
+	}
+	return 0644
+}
+
+// ETag identifies the file's contents by their digest.
+func (i gatewayFileInfo) ETag(ctx context.Context) (string, error) {
+	return `"` + hex.EncodeToString(i.info.Digest) + `"`, nil
+}
+
+// gatewayDirInfo describes a directory in a dataset as an os.FileInfo. Its
+// modification time is that of the latest file within it.
+type gatewayDirInfo struct {
+	name    string
+	updated time.Time
+}
+
+func (i gatewayDirInfo) Name() string       { return i.name }
+func (i gatewayDirInfo) Size() int64        { return 0 }
+func (i gatewayDirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (i gatewayDirInfo) ModTime() time.Time { return i.updated }
+func (i gatewayDirInfo) IsDir() bool        { return true }
+func (i gatewayDirInfo) Sys() interface{}   { return nil }
+
+// gatewayPath converts a slash-separated path from a request into a dataset
+// path, which has no leading or trailing slash. The root is empty.
+func gatewayPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// gatewayStat describes a file or directory in a dataset, or returns an error
+// matching os.ErrNotExist.
+func gatewayStat(ctx context.Context, dataset client.DatasetAPI, name string) (os.FileInfo, error) {
+	p := gatewayPath(name)
+	if p == "" {
+		return gatewayDirInfo{name: "/"}, nil
+	}
+	info, err := dataset.FileInfo(ctx, p)
+	if err == nil {
+		return gatewayFileInfo{info}, nil
+	}
+	if !errors.Is(err, client.ErrFileNotFound) {
+		return nil, err
+	}
+
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: p + "/"})
+	if _, err := files.Next(); err == client.ErrDone {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	} else if err != nil {
+		return nil, err
+	}
+	return gatewayDirInfo{name: path.Base(p)}, nil
+}
+
+// gatewayList lists the immediate contents of a directory in a dataset,
+// ordered by name. Placeholders of empty directories are omitted.
+func gatewayList(ctx context.Context, dataset client.DatasetAPI, dir string) ([]os.FileInfo, error) {
+	prefix := gatewayPath(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []os.FileInfo
+	dirs := map[string]int{} // Index of each subdirectory in entries.
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(info.Path, prefix)
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[:i]
+			j, ok := dirs[name]
+			if !ok {
+				j = len(entries)
+				dirs[name] = j
+				entries = append(entries, gatewayDirInfo{name: name})
+			}
+			if dir := entries[j].(gatewayDirInfo); info.Updated.After(dir.updated) {
+				entries[j] = gatewayDirInfo{name: name, updated: info.Updated}
+			}
+			continue
+		}
+		if isDirPlaceholder(info) {
+			continue
+		}
+		entries = append(entries, gatewayFileInfo{info})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// gatewayRename moves a file. Files in remote datasets are moved without
+// copying their contents. Directories can't be renamed.
+func gatewayRename(ctx context.Context, dataset client.DatasetAPI, oldName, newName string) error {
+	info, err := gatewayStat(ctx, dataset, oldName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "rename", Path: oldName, Err: errors.New("renaming directories is not supported")}
+	}
+	file := info.(gatewayFileInfo).info
+	target := gatewayPath(newName)
+	if target == "" {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+	}
+
+	if remote, ok := dataset.(client.RemoteDatasetAPI); ok {
+		err = remote.AddFile(ctx, target, file.Digest)
+	} else {
+		var r io.ReadCloser
+		if r, err = dataset.ReadFile(ctx, file.Path); err == nil {
+			err = dataset.WriteFile(ctx, target, r, file.Size)
+			r.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return dataset.DeleteFile(ctx, file.Path)
+}
+
+// gatewayFile reads a file in a dataset, opening a ranged read at the current
+// offset on demand so that seeking is cheap.
+type gatewayFile struct {
+	ctx     context.Context
+	dataset client.DatasetAPI
+	info    *api.FileInfo
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (f *gatewayFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.dataset.ReadFileRange(f.ctx, f.info.Path, f.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *gatewayFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *gatewayFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// serveGateway serves a handler on an address until the context is done, then
+// shuts the server down, letting requests in progress finish.
+func serveGateway(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	server := &http.Server{Handler: handler}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+	select {
+	case err := <-done:
+		return errors.WithStack(err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return errors.WithStack(server.Shutdown(shutdownCtx))
+	}
+}
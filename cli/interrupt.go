@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InterruptedError is returned by Upload and Download when their Stop option
+// fires. In-flight batches are allowed to finish before it is returned.
+type InterruptedError struct {
+	// Number of files transferred before stopping.
+	Completed int64
+
+	// Number of files not transferred, or -1 if unknown.
+	Remaining int64
+
+	// Path of the file recording progress, if any. Passing the same state file
+	// to a later Upload skips the files already uploaded.
+	StateFile string
+}
+
+func (e *InterruptedError) Error() string {
+	msg := fmt.Sprintf("interrupted after %d files", e.Completed)
+	if e.Remaining >= 0 {
+		msg += fmt.Sprintf(" with %d remaining", e.Remaining)
+	}
+	if e.StateFile != "" {
+		msg += fmt.Sprintf("; progress saved to %s", e.StateFile)
+	}
+	return msg
+}
+
+// stopped returns true if the stop channel is closed. A nil channel never stops.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// uploadState records files uploaded from a directory so an interrupted upload
+// can resume without sending them again.
+type uploadState struct {
+	// Uploaded files keyed by remote path.
+	Files map[string]uploadedFile `json:"files"`
+}
+
+// uploadedFile identifies the version of a local file that was uploaded.
+type uploadedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// loadUploadState reads a state file, returning an empty state if it doesn't exist.
+func loadUploadState(filename string) (*uploadState, error) {
+	state := &uploadState{Files: map[string]uploadedFile{}}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "invalid state file %s", filename)
+	}
+	if state.Files == nil {
+		state.Files = map[string]uploadedFile{}
+	}
+	return state, nil
+}
+
+// uploaded returns true if the local file is unchanged since it was uploaded.
+func (s *uploadState) uploaded(remotePath string, info os.FileInfo) bool {
+	file, ok := s.Files[remotePath]
+	return ok && file.Size == info.Size() && file.ModTime.Equal(info.ModTime())
+}
+
+// save writes the state file atomically.
+func (s *uploadState) save(filename string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, filename))
+}
+
+// countingTracker counts files written while forwarding updates to a tracker.
+type countingTracker struct {
+	ProgressTracker
+	written int64
+}
+
+func (t *countingTracker) Update(u *ProgressUpdate) {
+	atomic.AddInt64(&t.written, u.FilesWritten)
+	t.ProgressTracker.Update(u)
+}
+
+func (t *countingTracker) FileStarted(path string, size int64) {
+	fileStarted(t.ProgressTracker, path, size)
+}
+
+func (t *countingTracker) FileFinished(path string, err error) {
+	fileFinished(t.ProgressTracker, path, err)
+}
+
+func (t *countingTracker) filesWritten() int64 {
+	return atomic.LoadInt64(&t.written)
+}
@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// journal is an append-only record of files completed by a transfer. Each
+// line is a JSON-encoded journalEntry. A transfer re-run with the same journal
+// trusts its entries instead of hashing local files again.
+//
+// Entries are written as soon as files complete, so the journal survives
+// crashes; a torn final line is ignored when it is read back. A nil journal
+// records nothing.
+type journal struct {
+	lock    sync.Mutex
+	file    *os.File
+	entries map[string]journalEntry
+
+	// Path of the latest entry with each digest, keyed by the digest's string.
+	digests map[string]string
+}
+
+// journalEntry records a completed file.
+type journalEntry struct {
+	// Path of the file within the dataset.
+	Path string `json:"path"`
+
+	// Size and modification time of the local copy when it was completed.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	// Digest of the file's contents, if known.
+	Digest []byte `json:"digest,omitempty"`
+}
+
+// openJournal reads a journal's existing entries and opens it for appending,
+// creating it if it doesn't exist.
+func openJournal(filename string) (*journal, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	j := &journal{file: file, entries: map[string]journalEntry{}, digests: map[string]string{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// Skip lines torn by a crash.
+			continue
+		}
+		j.add(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to read journal %s", filename)
+	}
+
+	// Terminate a torn line so that new entries start on their own line.
+	if stat, err := file.Stat(); err == nil && stat.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, stat.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return nil, errors.Wrap(err, "failed to write journal")
+			}
+		}
+	}
+	return j, nil
+}
+
+// lookup returns the entry for a path if the local file described by info is
+// unchanged since it was recorded.
+func (j *journal) lookup(path string, info os.FileInfo) (journalEntry, bool) {
+	if j == nil {
+		return journalEntry{}, false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entry, ok := j.entries[path]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return journalEntry{}, false
+	}
+	return entry, true
+}
+
+// record appends entries for completed files.
+func (j *journal) record(entries ...journalEntry) error {
+	if j == nil || len(entries) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(&entry); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "failed to write journal")
+	}
+	for _, entry := range entries {
+		j.add(entry)
+	}
+	return nil
+}
+
+func (j *journal) add(entry journalEntry) {
+	j.entries[entry.Path] = entry
+	if len(entry.Digest) != 0 {
+		j.digests[string(entry.Digest)] = entry.Path
+	}
+}
+
+// lookupDigest returns the latest entry with a digest. The recorded file may
+// have changed since; check it with lookup before trusting its contents.
+func (j *journal) lookupDigest(digest []byte) (journalEntry, bool) {
+	if j == nil || len(digest) == 0 {
+		return journalEntry{}, false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	path, ok := j.digests[string(digest)]
+	if !ok {
+		return journalEntry{}, false
+	}
+	entry := j.entries[path]
+	return entry, bytes.Equal(entry.Digest, digest)
+}
+
+// Close the journal's file.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return errors.WithStack(j.file.Close())
+}
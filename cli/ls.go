@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// LsOptions provides optional configuration to Ls.
+type LsOptions struct {
+	// Show each entry's size, age, and digest. Directories show the total size
+	// and latest update of their contents.
+	Long bool
+
+	// Show everything under the directory as a tree instead of only its
+	// immediate entries. The whole listing is held in memory.
+	Tree bool
+
+	// Finish with the total number of files and bytes listed, and when the
+	// dataset expires, if it does.
+	Summarize bool
+}
+
+// lsEntry is a file or a directory summarizing the files beneath it.
+type lsEntry struct {
+	name    string
+	info    *api.FileInfo // Nil for directories.
+	files   int64
+	size    int64
+	updated time.Time
+
+	// Entries beneath a directory. Only populated for trees.
+	children map[string]*lsEntry
+}
+
+func (e *lsEntry) add(info *api.FileInfo) {
+	e.files++
+	e.size += info.Size
+	if info.Updated.After(e.updated) {
+		e.updated = info.Updated
+	}
+}
+
+// sorted returns the entry's children ordered by name.
+func (e *lsEntry) sorted() []*lsEntry {
+	entries := make([]*lsEntry, 0, len(e.children))
+	for _, child := range e.children {
+		entries = append(entries, child)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries
+}
+
+// Ls lists a directory in a dataset to w, paging through the manifest as
+// needed. The directory is relative to the dataset root; empty lists the root.
+// If it names a file instead, that file alone is listed. The options may be nil.
+func Ls(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	dir string,
+	w io.Writer,
+	opts *LsOptions,
+) error {
+	if opts == nil {
+		opts = &LsOptions{}
+	}
+
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	root := &lsEntry{name: dir, children: map[string]*lsEntry{}}
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		root.add(info)
+
+		// Record the file under each directory on its path, or only the first
+		// when listing a single level.
+		parent := root
+		names := strings.Split(strings.TrimPrefix(info.Path, prefix), "/")
+		for i, name := range names {
+			if i == len(names)-1 {
+				parent.children[name] = &lsEntry{name: name, info: info, files: 1, size: info.Size, updated: info.Updated}
+				break
+			}
+			child, ok := parent.children[name+"/"]
+			if !ok {
+				child = &lsEntry{name: name + "/", children: map[string]*lsEntry{}}
+				parent.children[name+"/"] = child
+			}
+			child.add(info)
+			if !opts.Tree {
+				break
+			}
+			parent = child
+		}
+	}
+
+	if root.files == 0 && dir != "" {
+		info, err := dataset.FileInfo(ctx, dir)
+		if err == client.ErrFileNotFound {
+			return errors.Errorf("%s: no such file or directory", dir)
+		}
+		if err != nil {
+			return err
+		}
+		root.add(info)
+		root.children[path.Base(dir)] = &lsEntry{name: path.Base(dir), info: info, files: 1, size: info.Size, updated: info.Updated}
+	}
+
+	table := &Table{}
+	if opts.Long {
+		table.AlignRight(0)
+	}
+	now := time.Now()
+	if opts.Tree {
+		name := root.name
+		if name == "" {
+			name = "."
+		}
+		fmt.Fprintln(w, name)
+		addTree(table, root, "", opts.Long, now)
+	} else {
+		for _, entry := range root.sorted() {
+			addEntry(table, entry, "", opts.Long, now)
+		}
+	}
+	if err := table.Render(w); err != nil {
+		return err
+	}
+
+	if opts.Summarize {
+		fmt.Fprintf(w, "\n%d files, %s (%d bytes)\n", root.files, FormatBytes(root.size), root.size)
+		info, err := dataset.Info(ctx)
+		if err != nil {
+			return err
+		}
+		if info.ExpiresAt != nil {
+			fmt.Fprintf(w, "Expires %s\n", FormatExpiry(*info.ExpiresAt, now))
+		}
+	}
+	return nil
+}
+
+func addTree(table *Table, dir *lsEntry, indent string, long bool, now time.Time) {
+	entries := dir.sorted()
+	for i, entry := range entries {
+		branch, next := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, next = "└── ", "    "
+		}
+		addEntry(table, entry, indent+branch, long, now)
+		if entry.info == nil {
+			addTree(table, entry, indent+next, long, now)
+		}
+	}
+}
+
+func addEntry(table *Table, entry *lsEntry, indent string, long bool, now time.Time) {
+	if !long {
+		table.Row(indent + entry.name)
+		return
+	}
+
+	digest := "-"
+	if entry.info != nil {
+		digest = hex.EncodeToString(entry.info.Digest)
+	}
+	table.Row(FormatBytes(entry.size), FormatAge(entry.updated, now), digest, indent+entry.name)
+}
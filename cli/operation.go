@@ -0,0 +1,315 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Kinds of operation.
+const (
+	OperationUpload   = "upload"
+	OperationDownload = "download"
+)
+
+// Statuses of an operation.
+const (
+	// OperationPending has not started yet.
+	OperationPending = "pending"
+
+	// OperationRunning has started and not finished. An operation left running
+	// by a process which crashed can be resumed like an interrupted one.
+	OperationRunning = "running"
+
+	// OperationInterrupted was stopped before it completed.
+	OperationInterrupted = "interrupted"
+
+	// OperationFailed stopped with an error.
+	OperationFailed = "failed"
+
+	// OperationCompleted transferred every file.
+	OperationCompleted = "completed"
+)
+
+// OperationPlan describes a transfer to run as an Operation. Unlike the
+// options of Upload and Download, it holds only what can be saved, so the
+// transfer can be resumed by another process.
+type OperationPlan struct {
+	// OperationUpload or OperationDownload.
+	Kind string `json:"kind"`
+
+	// Base URL of the server and ID of the dataset to transfer to or from.
+	Server  string `json:"server"`
+	Dataset string `json:"dataset"`
+
+	// Local files and directories to upload, as with UploadSources.
+	Sources []string `json:"sources,omitempty"`
+
+	// Path within the dataset to download.
+	SourcePath string `json:"sourcePath,omitempty"`
+
+	// Path within the dataset to upload to, or local directory to download to.
+	TargetPath string `json:"targetPath"`
+
+	Concurrency int `json:"concurrency"`
+
+	// Options for uploads, as in UploadOptions.
+	PreserveMode bool     `json:"preserveMode,omitempty"`
+	Include      []string `json:"include,omitempty"`
+	Exclude      []string `json:"exclude,omitempty"`
+	Mirror       bool     `json:"mirror,omitempty"`
+}
+
+// Operation is a transfer whose plan and progress are saved to disk, so that
+// if it is interrupted or fails it can be resumed by ID, even by another
+// process. Files completed by earlier runs are recorded in a journal and are
+// not transferred again.
+type Operation struct {
+	ID      string        `json:"id"`
+	Plan    OperationPlan `json:"plan"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+	Status  string        `json:"status"`
+
+	// Number of runs of the operation, including the current one.
+	Runs int `json:"runs"`
+
+	// Files transferred by the latest run, and files which failed.
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+
+	// Error which ended the latest run, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// OperationStore keeps operations in a directory, each in a subdirectory
+// named by its ID.
+type OperationStore struct {
+	dir string
+}
+
+// DefaultOperationsDir returns the directory in which operations are kept by
+// default, below the system's temporary directory.
+func DefaultOperationsDir() string {
+	return filepath.Join(os.TempDir(), "fileheap-operations")
+}
+
+// OpenOperationStore opens a store of operations in dir, creating it if it
+// doesn't exist. Empty means DefaultOperationsDir.
+func OpenOperationStore(dir string) (*OperationStore, error) {
+	if dir == "" {
+		dir = DefaultOperationsDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &OperationStore{dir: dir}, nil
+}
+
+// Create saves a new pending operation with the given plan. Local paths in
+// the plan are made absolute, so the operation can be resumed from any
+// working directory.
+func (s *OperationStore) Create(plan *OperationPlan) (*Operation, error) {
+	if plan.Concurrency < 1 {
+		return nil, errors.New("concurrency must be positive")
+	}
+	p := *plan
+	p.Sources = nil
+	switch plan.Kind {
+	case OperationUpload:
+		for _, source := range plan.Sources {
+			abs, err := filepath.Abs(source)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			p.Sources = append(p.Sources, abs)
+		}
+	case OperationDownload:
+		abs, err := filepath.Abs(plan.TargetPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		p.TargetPath = abs
+	default:
+		return nil, errors.Errorf("unknown operation kind %q", plan.Kind)
+	}
+
+	var id [6]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	now := time.Now()
+	op := &Operation{
+		ID:      "op_" + hex.EncodeToString(id[:]),
+		Plan:    p,
+		Created: now,
+		Updated: now,
+		Status:  OperationPending,
+	}
+	if err := os.Mkdir(filepath.Join(s.dir, op.ID), 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return op, s.save(op)
+}
+
+// Get loads an operation by ID.
+func (s *OperationStore) Get(id string) (*Operation, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, errors.Errorf("invalid operation ID %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, id, "operation.json"))
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("operation %s not found", id)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var op Operation
+	if err := json.Unmarshal(data, &op); err != nil {
+		return nil, errors.Wrapf(err, "invalid operation %s", id)
+	}
+	return &op, nil
+}
+
+// List returns every operation in the store, oldest first. Unreadable
+// operations are skipped.
+func (s *OperationStore) List() ([]*Operation, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var ops []*Operation
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		op, err := s.Get(entry.Name())
+		if err != nil {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Created.Before(ops[j].Created) })
+	return ops, nil
+}
+
+// Remove deletes an operation and its journal.
+func (s *OperationStore) Remove(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return errors.WithStack(os.RemoveAll(filepath.Join(s.dir, id)))
+}
+
+// Run runs an operation, or resumes it if an earlier run didn't complete. The
+// client must be connected to the server in the operation's plan. Closing stop
+// interrupts the operation as with the Stop option of Upload and Download.
+//
+// The operation's status is saved when the run starts and when it ends.
+func (s *OperationStore) Run(
+	ctx context.Context,
+	c *client.Client,
+	op *Operation,
+	tracker ProgressTracker,
+	stop <-chan struct{},
+) error {
+	if op.Status == OperationCompleted {
+		return errors.Errorf("operation %s already completed", op.ID)
+	}
+	if server := c.BaseURL().String(); server != op.Plan.Server {
+		return errors.Errorf("operation %s is for %s, not %s", op.ID, op.Plan.Server, server)
+	}
+
+	op.Status = OperationRunning
+	op.Runs++
+	op.Completed, op.Failed, op.Error = 0, 0, ""
+	if err := s.save(op); err != nil {
+		return err
+	}
+
+	counter := &operationTracker{countingTracker: countingTracker{ProgressTracker: tracker}}
+	journal := filepath.Join(s.dir, op.ID, "journal.jsonl")
+	dataset := c.Dataset(op.Plan.Dataset)
+	plan := &op.Plan
+
+	var err error
+	switch plan.Kind {
+	case OperationUpload:
+		err = UploadSources(ctx, plan.Sources, dataset, plan.TargetPath, counter, plan.Concurrency, &UploadOptions{
+			PreserveMode: plan.PreserveMode,
+			Include:      plan.Include,
+			Exclude:      plan.Exclude,
+			Mirror:       plan.Mirror,
+			Stop:         stop,
+			Journal:      journal,
+		})
+	case OperationDownload:
+		err = DownloadWithOptions(ctx, dataset, plan.SourcePath, plan.TargetPath, counter, plan.Concurrency, &DownloadOptions{
+			Stop:    stop,
+			Journal: journal,
+		})
+	default:
+		err = errors.Errorf("unknown operation kind %q", plan.Kind)
+	}
+
+	op.Completed = counter.filesWritten()
+	op.Failed = counter.filesFailed()
+	var interrupted *InterruptedError
+	switch {
+	case err == nil:
+		op.Status = OperationCompleted
+	case errors.As(err, &interrupted):
+		op.Status = OperationInterrupted
+	default:
+		op.Status = OperationFailed
+		op.Error = err.Error()
+	}
+	if saveErr := s.save(op); saveErr != nil && err == nil {
+		return saveErr
+	}
+	return err
+}
+
+// save writes an operation's file atomically.
+func (s *OperationStore) save(op *Operation) error {
+	op.Updated = time.Now()
+	data, err := json.MarshalIndent(op, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	filename := filepath.Join(s.dir, op.ID, "operation.json")
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, filename))
+}
+
+// operationTracker counts files written and failed during a run.
+type operationTracker struct {
+	countingTracker
+	failed int64
+}
+
+func (t *operationTracker) Update(u *ProgressUpdate) {
+	atomic.AddInt64(&t.failed, u.FilesFailed)
+	t.countingTracker.Update(u)
+}
+
+func (t *operationTracker) filesFailed() int64 {
+	return atomic.LoadInt64(&t.failed)
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// OutputLevel controls how much an operation prints while it runs.
+type OutputLevel int
+
+const (
+	// OutputQuiet prints no progress. Commands should print only errors and
+	// their final results, such as the paths they wrote.
+	OutputQuiet OutputLevel = iota - 1
+
+	// OutputNormal shows a progress bar in a terminal, or a line per update
+	// otherwise.
+	OutputNormal
+
+	// OutputVerbose prints a line for each file with its size and duration.
+	OutputVerbose
+)
+
+// TrackerForLevel returns a tracker for an operation at the given output
+// level. Verbose output is written to w. The totals are only used by
+// OutputNormal; if totalFiles is negative, the size is treated as unknown.
+func TrackerForLevel(
+	ctx context.Context,
+	level OutputLevel,
+	w io.Writer,
+	totalFiles, totalBytes int64,
+) ProgressTrackerWithStatus {
+	switch {
+	case level <= OutputQuiet:
+		return QuietTracker()
+	case level >= OutputVerbose:
+		return VerboseTracker(w)
+	case totalFiles < 0:
+		return UnboundedTracker(ctx)
+	default:
+		return BoundedTracker(ctx, totalFiles, totalBytes)
+	}
+}
+
+// QuietTracker tracks the status of an operation without printing anything,
+// including on close.
+func QuietTracker() ProgressTrackerWithStatus {
+	return &quietTracker{}
+}
+
+type quietTracker struct {
+	lock sync.Mutex
+	p    ProgressUpdate
+}
+
+func (t *quietTracker) Update(u *ProgressUpdate) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.p.update(u)
+}
+
+func (t *quietTracker) Status() *ProgressUpdate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.p.clone()
+}
+
+func (t *quietTracker) Close() error {
+	return nil
+}
+
+// VerboseTracker prints a line to w as each file finishes, with its size and
+// how long it took, and a summary on close. Files are only listed by
+// operations which report them; see FileTracker.
+func VerboseTracker(w io.Writer) ProgressTrackerWithStatus {
+	return &verboseTracker{w: w, start: time.Now(), started: map[string]fileStart{}}
+}
+
+type fileStart struct {
+	size int64
+	time time.Time
+}
+
+type verboseTracker struct {
+	lock    sync.Mutex
+	w       io.Writer
+	p       ProgressUpdate
+	start   time.Time
+	started map[string]fileStart
+}
+
+func (t *verboseTracker) Update(u *ProgressUpdate) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.p.update(u)
+}
+
+func (t *verboseTracker) FileStarted(path string, size int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.started[path] = fileStart{size: size, time: time.Now()}
+}
+
+func (t *verboseTracker) FileFinished(path string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	start, ok := t.started[path]
+	if !ok {
+		return
+	}
+	delete(t.started, path)
+
+	elapsed := time.Since(start.time).Truncate(time.Millisecond)
+	if err != nil {
+		fmt.Fprintf(t.w, "%s  failed after %s: %v\n", path, elapsed, err)
+		return
+	}
+	fmt.Fprintf(t.w, "%s  %s  %s\n", path, FormatBytes(start.size), elapsed)
+}
+
+func (t *verboseTracker) Status() *ProgressUpdate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.p.clone()
+}
+
+func (t *verboseTracker) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elapsed := time.Since(t.start)
+	_, err := fmt.Fprintf(t.w,
+		"Completed %d files (%s) in %s: %s, %d files/s%s\n",
+		t.p.FilesWritten,
+		FormatBytes(t.p.BytesWritten),
+		elapsed.Truncate(time.Second/10),
+		FormatRate(t.p.BytesWritten, elapsed),
+		int(math.Round(float64(t.p.FilesWritten)/elapsed.Seconds())),
+		t.p.problems(),
+	)
+	return err
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// pathReader reads dataset paths, one per line, such as the output of Find.
+// Blank lines are skipped and leading slashes are removed.
+type pathReader struct {
+	scanner *bufio.Scanner
+}
+
+func newPathReader(r io.Reader) *pathReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	return &pathReader{scanner: scanner}
+}
+
+// next returns the next path, or client.ErrDone at the end of the input.
+func (r *pathReader) next() (string, error) {
+	for r.scanner.Scan() {
+		p := strings.TrimLeft(strings.TrimSpace(r.scanner.Text()), "/")
+		if p != "" {
+			return p, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "failed to read paths")
+	}
+	return "", client.ErrDone
+}
+
+// pathIterator is an Iterator over files named by a list of paths.
+type pathIterator struct {
+	ctx     context.Context
+	dataset client.DatasetAPI
+	paths   *pathReader
+}
+
+func (i *pathIterator) Next() (*api.FileInfo, error) {
+	p, err := i.paths.next()
+	if err != nil {
+		return nil, err
+	}
+	info, err := i.dataset.FileInfo(i.ctx, p)
+	if err == client.ErrFileNotFound {
+		return nil, errors.Errorf("%s: no such file", p)
+	}
+	return info, err
+}
+
+// DeletePaths deletes the files named in r, one path per line, in batches.
+// It returns the number of files deleted.
+func DeletePaths(ctx context.Context, dataset *client.DatasetRef, r io.Reader) (int, error) {
+	paths := newPathReader(r)
+	var deleted int
+	batch := dataset.NewDeleteBatch()
+	for {
+		p, err := paths.next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		if !batch.HasCapacity() {
+			result, err := batch.Delete(ctx)
+			deleted += len(result.Files) - len(result.Failed())
+			if err != nil {
+				return deleted, err
+			}
+			batch = dataset.NewDeleteBatch()
+		}
+		if err := batch.AddFile(p); err != nil {
+			return deleted, err
+		}
+	}
+	result, err := batch.Delete(ctx)
+	deleted += len(result.Files) - len(result.Failed())
+	return deleted, err
+}
+
+// Touch creates each named file in a dataset as an empty file, such as a
+// zero-byte marker like _SUCCESS, in batches. Files which already exist are
+// left unchanged. It returns the number of files created.
+func Touch(ctx context.Context, dataset *client.DatasetRef, paths []string) (int, error) {
+	var created int
+	batch := dataset.NewUploadBatch()
+	for _, p := range paths {
+		p = strings.TrimLeft(p, "/")
+		if p == "" {
+			return created, errors.New("empty path")
+		}
+		_, err := dataset.FileInfo(ctx, p)
+		if err == nil {
+			continue
+		}
+		if err != client.ErrFileNotFound {
+			return created, err
+		}
+
+		if !batch.HasCapacity(0) {
+			result, err := batch.Upload(ctx)
+			created += len(result.Files) - len(result.Failed())
+			if err != nil {
+				return created, err
+			}
+			batch = dataset.NewUploadBatch()
+		}
+		if err := batch.AddFile(p, nil, 0); err != nil {
+			return created, err
+		}
+	}
+	result, err := batch.Upload(ctx)
+	created += len(result.Files) - len(result.Failed())
+	return created, err
+}
@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Ping checks that the server is reachable and healthy before large
+// transfers. It prints the server's build, then the round-trip time of count
+// health checks and their minimum, average, and maximum, to w. It returns an
+// error if any check fails or the server is unhealthy.
+func Ping(ctx context.Context, c *client.Client, w io.Writer, count int) error {
+	if count < 1 {
+		count = 1
+	}
+
+	fmt.Fprintf(w, "Server: %s\n", c.BaseURL())
+	if version, err := c.ServerVersion(ctx); err != nil {
+		fmt.Fprintf(w, "Version: unknown (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Version: %s\n", formatServerVersion(version))
+	}
+
+	var total, min, max time.Duration
+	for i := 0; i < count; i++ {
+		if i != 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return errors.WithStack(ctx.Err())
+			}
+		}
+
+		start := time.Now()
+		health, err := c.Health(ctx)
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Fprintf(w, "Health check failed after %v: %v\n", elapsed.Round(time.Microsecond), err)
+			return err
+		}
+		fmt.Fprintf(w, "Health: %s, round trip %v\n", health.Status, elapsed.Round(time.Microsecond))
+		names := make([]string, 0, len(health.Checks))
+		for name := range health.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if status := health.Checks[name]; status != api.HealthOK {
+				fmt.Fprintf(w, "  %s: %s\n", name, status)
+			}
+		}
+		if health.Status != api.HealthOK {
+			return errors.Errorf("server is unhealthy: %s", health.Status)
+		}
+
+		total += elapsed
+		if i == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+	}
+
+	if count > 1 {
+		avg := total / time.Duration(count)
+		fmt.Fprintf(w, "Round trip min/avg/max: %v/%v/%v\n",
+			min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+	}
+	return nil
+}
+
+// formatServerVersion describes a server's build on one line.
+func formatServerVersion(v *api.ServerVersion) string {
+	var details []string
+	if v.Commit != "" {
+		details = append(details, "commit "+v.Commit)
+	}
+	if v.Built != nil {
+		details = append(details, "built "+v.Built.UTC().Format(time.RFC3339))
+	}
+	if len(details) == 0 {
+		return v.Version
+	}
+	return v.Version + " (" + strings.Join(details, ", ") + ")"
+}
@@ -5,12 +5,10 @@ import (
 	"fmt"
 	"math"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/allenai/bytefmt"
-	"github.com/pkg/errors"
 	"github.com/vbauerster/mpb/v4"
 	"github.com/vbauerster/mpb/v4/decor"
 	"golang.org/x/crypto/ssh/terminal"
@@ -20,6 +18,13 @@ import (
 type ProgressUpdate struct {
 	FilesPending, FilesWritten int64
 	BytesPending, BytesWritten int64
+
+	// Files which could not be transferred.
+	FilesFailed int64
+
+	// Files and bytes transferred again after an attempt failed. A file is
+	// counted once per retry.
+	FilesRetried, BytesRetried int64
 }
 
 // ProgressTracker tracks the status of an operation.
@@ -28,6 +33,30 @@ type ProgressTracker interface {
 	Close() error
 }
 
+// FileTracker is an optional extension of ProgressTracker for trackers which
+// show the files in flight. Operations call FileStarted when they begin to
+// transfer a file of the given size, and FileFinished once it is done with the
+// error which failed it, if any. Both may be called concurrently.
+type FileTracker interface {
+	ProgressTracker
+	FileStarted(path string, size int64)
+	FileFinished(path string, err error)
+}
+
+// fileStarted tells a tracker that a file is in flight, if it is a FileTracker.
+func fileStarted(t ProgressTracker, path string, size int64) {
+	if ft, ok := t.(FileTracker); ok {
+		ft.FileStarted(path, size)
+	}
+}
+
+// fileFinished tells a tracker that a file is done, if it is a FileTracker.
+func fileFinished(t ProgressTracker, path string, err error) {
+	if ft, ok := t.(FileTracker); ok {
+		ft.FileFinished(path, err)
+	}
+}
+
 // ProgressTrackerWithStatus tracks the status of an operation
 // and exposes the current status of the operation.
 type ProgressTrackerWithStatus interface {
@@ -51,6 +80,13 @@ func BoundedTracker(ctx context.Context, totalFiles, totalBytes int64) ProgressT
 	}
 
 	p := &ProgressUpdate{}
+	t := &boundedTracker{
+		start:      time.Now(),
+		p:          p,
+		totalBytes: totalBytes,
+		throughput: NewThroughput(throughputWindow),
+		inFlight:   map[string]struct{}{},
+	}
 	progress := mpb.NewWithContext(ctx, mpb.WithWidth(50))
 	fileBar := progress.AddBar(totalFiles,
 		mpb.PrependDecorators(
@@ -62,7 +98,10 @@ func BoundedTracker(ctx context.Context, totalFiles, totalBytes int64) ProgressT
 				if p.FilesPending == 0 {
 					return ""
 				}
-				return fmt.Sprintf(" %d in progress", p.FilesPending)
+				return fmt.Sprintf(" %d in progress%s", p.FilesPending, t.currentFile())
+			}),
+			newDecorator(func(s *decor.Statistics) string {
+				return p.problems()
 			}),
 			decor.OnComplete(decor.Spinner(nil, decor.WCSyncSpace), "✔")))
 	byteBar := progress.AddBar(totalBytes,
@@ -75,17 +114,14 @@ func BoundedTracker(ctx context.Context, totalFiles, totalBytes int64) ProgressT
 				if p.BytesPending == 0 {
 					return ""
 				}
-				return fmt.Sprintf(" %s in progress", formatBytes(p.BytesPending))
+				return fmt.Sprintf(" %s in progress%s", FormatBytes(p.BytesPending), t.estimate())
 			}),
 			decor.OnComplete(decor.Spinner(nil, decor.WCSyncSpace), "✔")))
 
-	return &boundedTracker{
-		start:    time.Now(),
-		p:        p,
-		progress: progress,
-		fileBar:  fileBar,
-		byteBar:  byteBar,
-	}
+	t.progress = progress
+	t.fileBar = fileBar
+	t.byteBar = byteBar
+	return t
 }
 
 // UnboundedTracker shows the progress of an operation without a predefined size.
@@ -106,6 +142,9 @@ func UnboundedTracker(ctx context.Context) ProgressTrackerWithStatus {
 			}
 			return fmt.Sprintf(" %d in progress", p.FilesPending)
 		}),
+		newDecorator(func(s *decor.Statistics) string {
+			return p.problems()
+		}),
 		decor.OnComplete(decor.Spinner(nil, decor.WCSyncSpace), "✔")))
 	byteBar := progress.AddBar(0, mpb.PrependDecorators(
 		decor.Name("Bytes: "),
@@ -114,7 +153,7 @@ func UnboundedTracker(ctx context.Context) ProgressTrackerWithStatus {
 			if p.BytesPending == 0 {
 				return ""
 			}
-			return fmt.Sprintf(" %s in progress", formatBytes(p.BytesPending))
+			return fmt.Sprintf(" %s in progress", FormatBytes(p.BytesPending))
 		}),
 		decor.OnComplete(decor.Spinner(nil, decor.WCSyncSpace), "✔")))
 
@@ -129,19 +168,38 @@ func UnboundedTracker(ctx context.Context) ProgressTrackerWithStatus {
 
 // UploadStats finds the number of files and bytes that would be uploaded in a directory.
 func UploadStats(directory string) (files, bytes int64, err error) {
-	visitor := func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		if info.IsDir() || !info.Mode().IsRegular() {
-			return nil
-		}
+	return UploadStatsWithOptions(directory, nil)
+}
+
+// UploadStatsWithOptions is like UploadStats for an upload with the given
+// options, which should match those passed to UploadWithOptions and may be nil.
+func UploadStatsWithOptions(directory string, opts *UploadOptions) (files, bytes int64, err error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
 
+	visitor := func(filePath, relpath string, info os.FileInfo) error {
 		files++
 		bytes += info.Size()
 		return nil
 	}
-	err = filepath.Walk(directory, visitor)
+	err = walkUploadFiles(directory, opts, visitor)
+	return
+}
+
+// UploadSourcesStats is like UploadStatsWithOptions for the sources of
+// UploadSources.
+func UploadSourcesStats(sources []string, opts *UploadOptions) (files, bytes int64, err error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+
+	visitor := func(filePath, relpath string, info os.FileInfo) error {
+		files++
+		bytes += info.Size()
+		return nil
+	}
+	err = walkUploadSources(sources, opts, visitor)
 	return
 }
 
@@ -150,15 +208,26 @@ func (p *ProgressUpdate) update(u *ProgressUpdate) {
 	p.FilesWritten += u.FilesWritten
 	p.BytesPending += u.BytesPending
 	p.BytesWritten += u.BytesWritten
+	p.FilesFailed += u.FilesFailed
+	p.FilesRetried += u.FilesRetried
+	p.BytesRetried += u.BytesRetried
 }
 
 func (p *ProgressUpdate) clone() *ProgressUpdate {
-	return &ProgressUpdate{
-		FilesPending: p.FilesPending,
-		FilesWritten: p.FilesWritten,
-		BytesPending: p.BytesPending,
-		BytesWritten: p.BytesWritten,
+	clone := *p
+	return &clone
+}
+
+// problems describes failed and retried files, or is empty if there were none.
+func (p *ProgressUpdate) problems() string {
+	var s string
+	if p.FilesFailed != 0 {
+		s = fmt.Sprintf(", %d failed", p.FilesFailed)
+	}
+	if p.FilesRetried != 0 {
+		s += fmt.Sprintf(", %d retried (%s)", p.FilesRetried, FormatBytes(p.BytesRetried))
 	}
+	return s
 }
 
 type nopTracker struct{}
@@ -169,9 +238,10 @@ func (t *nopTracker) Close() error {
 }
 
 type progressTracker struct {
-	lock  sync.Mutex
-	p     ProgressUpdate
-	start time.Time
+	lock       sync.Mutex
+	p          ProgressUpdate
+	start      time.Time
+	throughput *Throughput
 }
 
 func (t *progressTracker) Update(u *ProgressUpdate) {
@@ -179,13 +249,19 @@ func (t *progressTracker) Update(u *ProgressUpdate) {
 	defer t.lock.Unlock()
 
 	t.p.update(u)
+	if t.throughput == nil {
+		t.throughput = NewThroughput(throughputWindow)
+	}
+	t.throughput.Add(time.Now(), t.p.BytesWritten)
 
 	fmt.Printf(
-		"Complete: %8d files, %-10s In Progress: %8d files, %-10s\n",
+		"Complete: %8d files, %-10s In Progress: %8d files, %-10s Rate: %s%s\n",
 		t.p.FilesWritten,
-		formatBytes(t.p.BytesWritten),
+		FormatBytes(t.p.BytesWritten),
 		t.p.FilesPending,
-		formatBytes(t.p.BytesPending),
+		FormatBytes(t.p.BytesPending),
+		FormatRate(int64(t.throughput.Rate()), time.Second),
+		t.p.problems(),
 	)
 }
 
@@ -205,8 +281,16 @@ type boundedTracker struct {
 	lock             sync.Mutex
 	start            time.Time
 	p                *ProgressUpdate
+	totalBytes       int64
 	progress         *mpb.Progress
 	fileBar, byteBar *mpb.Bar
+
+	// Guards the fields below, which are read while rendering. It is never held
+	// while calling into the bars, which may be waiting to render.
+	statsLock  sync.Mutex
+	throughput *Throughput
+	inFlight   map[string]struct{}
+	latest     string
 }
 
 func (t *boundedTracker) Update(u *ProgressUpdate) {
@@ -215,10 +299,66 @@ func (t *boundedTracker) Update(u *ProgressUpdate) {
 
 	t.p.update(u)
 
+	t.statsLock.Lock()
+	t.throughput.Add(time.Now(), t.p.BytesWritten)
+	t.statsLock.Unlock()
+
 	t.fileBar.SetCurrent(t.p.FilesWritten)
 	t.byteBar.SetCurrent(t.p.BytesWritten)
 }
 
+func (t *boundedTracker) FileStarted(path string, size int64) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	t.inFlight[path] = struct{}{}
+	t.latest = path
+}
+
+func (t *boundedTracker) FileFinished(path string, err error) {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	delete(t.inFlight, path)
+	if t.latest != path {
+		return
+	}
+	t.latest = ""
+	for p := range t.inFlight {
+		t.latest = p
+		break
+	}
+}
+
+// currentFile describes a file in flight, if the operation reports them.
+func (t *boundedTracker) currentFile() string {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	if t.latest == "" {
+		return ""
+	}
+	return ", including " + t.latest
+}
+
+// estimate describes the current rate and time remaining, once known.
+func (t *boundedTracker) estimate() string {
+	t.statsLock.Lock()
+	defer t.statsLock.Unlock()
+
+	rate := t.throughput.Rate()
+	if rate <= 0 {
+		return ""
+	}
+	s := ", " + FormatRate(int64(rate), time.Second)
+	if last, ok := t.throughput.last(); ok {
+		if eta := t.throughput.ETA(t.totalBytes - last); eta >= 0 {
+			s += ", " + eta.Round(time.Second).String() + " left"
+		}
+	}
+	return s
+}
+
 func (t *boundedTracker) Status() *ProgressUpdate {
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -272,6 +412,80 @@ func (t *unboundedTracker) Status() *ProgressUpdate {
 	return t.p.clone()
 }
 
+// Window over which transfer rates are averaged.
+const throughputWindow = 10 * time.Second
+
+// Throughput estimates the rate of a transfer from samples of the total bytes
+// written so far. The rate is averaged over a sliding window, so it follows
+// recent changes in speed. It is not safe for concurrent use.
+type Throughput struct {
+	window  time.Duration
+	samples []throughputSample
+}
+
+type throughputSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// NewThroughput creates a Throughput averaged over the given window.
+func NewThroughput(window time.Duration) *Throughput {
+	return &Throughput{window: window}
+}
+
+// Add records the total bytes written as of the given time.
+func (t *Throughput) Add(now time.Time, bytes int64) {
+	// Merge samples closer together than a hundredth of the window, so that
+	// frequent updates do not accumulate samples.
+	if n := len(t.samples); n > 1 && now.Sub(t.samples[n-2].time) < t.window/100 {
+		t.samples[n-1] = throughputSample{time: now, bytes: bytes}
+		return
+	}
+	t.samples = append(t.samples, throughputSample{time: now, bytes: bytes})
+
+	// Keep the newest sample outside the window as the start of the window.
+	i := 0
+	for i+1 < len(t.samples) && now.Sub(t.samples[i+1].time) >= t.window {
+		i++
+	}
+	t.samples = t.samples[i:]
+}
+
+// Rate returns the average bytes written per second over the window, or zero
+// until there are enough samples.
+func (t *Throughput) Rate() float64 {
+	if len(t.samples) < 2 {
+		return 0
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// ETA returns how long the remaining bytes will take to write at the current
+// rate, or -1 if the rate is not yet known.
+func (t *Throughput) ETA(remaining int64) time.Duration {
+	rate := t.Rate()
+	if rate <= 0 {
+		return -1
+	}
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// last returns the most recent total recorded, if any.
+func (t *Throughput) last() (int64, bool) {
+	if len(t.samples) == 0 {
+		return 0, false
+	}
+	return t.samples[len(t.samples)-1].bytes, true
+}
+
 type decorator struct {
 	decor.WC
 	f func(s *decor.Statistics) string
@@ -294,11 +508,11 @@ var ratioDecorator = newDecorator(func(s *decor.Statistics) string {
 })
 
 var byteCountDecorator = newDecorator(func(s *decor.Statistics) string {
-	return fmt.Sprintf("%-10s", formatBytes(s.Current))
+	return fmt.Sprintf("%-10s", FormatBytes(s.Current))
 })
 
 var byteRatioDecorator = newDecorator(func(s *decor.Statistics) string {
-	return fmt.Sprintf("%-10s / %10s", formatBytes(s.Current), formatBytes(s.Total))
+	return fmt.Sprintf("%-10s / %10s", FormatBytes(s.Current), FormatBytes(s.Total))
 })
 
 var percentageDecorator = newDecorator(func(s *decor.Statistics) string {
@@ -307,14 +521,16 @@ var percentageDecorator = newDecorator(func(s *decor.Statistics) string {
 
 func printCompletionMessage(p *ProgressUpdate, elapsed time.Duration) {
 	fmt.Printf(
-		"Completed in %s: %s, %d files/s\n",
+		"Completed in %s: %s, %d files/s%s\n",
 		elapsed.Truncate(time.Second/10),
 		FormatRate(p.BytesWritten, elapsed),
 		int(math.Round(float64(p.FilesWritten)/elapsed.Seconds())),
+		p.problems(),
 	)
 }
 
-func formatBytes(bytes int64) string {
+// FormatBytes returns a human-readable size, such as "1.5 GiB".
+func FormatBytes(bytes int64) string {
 	return fmt.Sprintf("%v", bytefmt.New(bytes, bytefmt.Binary))
 }
 
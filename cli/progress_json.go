@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// ProgressJSONv1 identifies version 1 of the machine-readable progress protocol.
+//
+// Each update is written as a single line containing a JSON-encoded
+// ProgressEvent. Consumers should ignore fields they do not recognize; new
+// fields may be added without changing the version, but existing fields will
+// not be removed or change meaning.
+const ProgressJSONv1 = "json-v1"
+
+// Event types in the progress protocol.
+const (
+	// ProgressEventUpdate is emitted whenever progress changes.
+	ProgressEventUpdate = "update"
+
+	// ProgressEventComplete is emitted once when the operation succeeds.
+	ProgressEventComplete = "complete"
+)
+
+// ProgressEvent is a single message in the progress protocol.
+type ProgressEvent struct {
+	// Version of the protocol, always ProgressJSONv1.
+	Version string `json:"version"`
+
+	// Type of event, such as ProgressEventUpdate.
+	Event string `json:"event"`
+
+	// Time the event was emitted.
+	Time time.Time `json:"time"`
+
+	// Seconds elapsed since the operation started.
+	Elapsed float64 `json:"elapsed"`
+
+	// Cumulative totals, not deltas.
+	FilesPending int64 `json:"filesPending"`
+	FilesWritten int64 `json:"filesWritten"`
+	BytesPending int64 `json:"bytesPending"`
+	BytesWritten int64 `json:"bytesWritten"`
+	FilesFailed  int64 `json:"filesFailed"`
+	FilesRetried int64 `json:"filesRetried"`
+	BytesRetried int64 `json:"bytesRetried"`
+
+	// Bytes written per second, averaged over recent updates.
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+
+	// Total size of the operation and the estimated seconds until it
+	// completes. Omitted if unknown.
+	TotalBytes int64   `json:"totalBytes,omitempty"`
+	ETA        float64 `json:"etaSeconds,omitempty"`
+}
+
+// JSONTracker emits progress to w in the ProgressJSONv1 protocol for
+// consumption by wrapping tools. Callers typically pass os.Stderr.
+func JSONTracker(w io.Writer) ProgressTrackerWithStatus {
+	return &jsonTracker{
+		encoder:    json.NewEncoder(w),
+		start:      time.Now(),
+		throughput: NewThroughput(throughputWindow),
+	}
+}
+
+// LogTracker is like JSONTracker, but emits an update only once per interval
+// rather than on every change, and on close. This suits logs collected from
+// non-interactive jobs, such as on Kubernetes, where a line per file would be
+// too many. If totalBytes is positive, updates include an ETA.
+func LogTracker(w io.Writer, interval time.Duration, totalBytes int64) ProgressTrackerWithStatus {
+	t := &jsonTracker{
+		encoder:    json.NewEncoder(w),
+		start:      time.Now(),
+		throughput: NewThroughput(throughputWindow),
+		totalBytes: totalBytes,
+		periodic:   true,
+		done:       make(chan struct{}),
+	}
+	go t.emitEvery(interval)
+	return t
+}
+
+type jsonTracker struct {
+	lock       sync.Mutex
+	encoder    *json.Encoder
+	p          ProgressUpdate
+	start      time.Time
+	throughput *Throughput
+	totalBytes int64
+
+	// Whether updates are emitted periodically instead of on every change.
+	// Closing done stops them.
+	periodic bool
+	done     chan struct{}
+}
+
+func (t *jsonTracker) Update(u *ProgressUpdate) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.p.update(u)
+	if t.periodic {
+		t.throughput.Add(time.Now(), t.p.BytesWritten)
+		return
+	}
+	t.emit(ProgressEventUpdate)
+}
+
+func (t *jsonTracker) emitEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.lock.Lock()
+			t.emit(ProgressEventUpdate)
+			t.lock.Unlock()
+		}
+	}
+}
+
+func (t *jsonTracker) Status() *ProgressUpdate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.p.clone()
+}
+
+func (t *jsonTracker) Close() error {
+	if t.done != nil {
+		close(t.done)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.emit(ProgressEventComplete)
+}
+
+func (t *jsonTracker) emit(event string) error {
+	now := time.Now()
+	t.throughput.Add(now, t.p.BytesWritten)
+	var eta float64
+	if t.totalBytes > 0 {
+		if d := t.throughput.ETA(t.totalBytes - t.p.BytesWritten); d >= 0 {
+			eta = math.Round(d.Seconds()*10) / 10
+		}
+	}
+	return t.encoder.Encode(&ProgressEvent{
+		Version:      ProgressJSONv1,
+		Event:        event,
+		Time:         now.UTC(),
+		Elapsed:      now.Sub(t.start).Seconds(),
+		FilesPending: t.p.FilesPending,
+		FilesWritten: t.p.FilesWritten,
+		BytesPending: t.p.BytesPending,
+		BytesWritten: t.p.BytesWritten,
+		FilesFailed:  t.p.FilesFailed,
+		FilesRetried: t.p.FilesRetried,
+		BytesRetried: t.p.BytesRetried,
+
+		BytesPerSecond: t.throughput.Rate(),
+		TotalBytes:     t.totalBytes,
+		ETA:            eta,
+	})
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// PruneDatasets deletes every dataset matching the filter, such as scratch
+// datasets abandoned by CI, printing each one to w. If dryRun is set, the
+// datasets are printed but not deleted.
+func PruneDatasets(
+	ctx context.Context,
+	c *client.Client,
+	filter *client.DatasetFilter,
+	w io.Writer,
+	dryRun bool,
+	concurrency int,
+) error {
+	var ids []string
+	var bytes int64
+	table := (&Table{}).AlignRight(2)
+	now := time.Now()
+	datasets := c.ListDatasets(ctx, filter)
+	for {
+		dataset, err := datasets.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		size := "unknown size"
+		if dataset.Size != nil {
+			size = FormatBytes(dataset.Size.Bytes)
+			bytes += dataset.Size.Bytes
+		}
+		table.Row(dataset.ID, "created "+FormatAge(dataset.Created, now), size)
+		ids = append(ids, dataset.ID)
+	}
+	if err := table.Render(w); err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Fprintf(w, "Would delete %d datasets (%s)\n", len(ids), FormatBytes(bytes))
+		return nil
+	}
+
+	result, err := c.DeleteDatasets(ctx, ids, concurrency)
+	failed := len(result.Failed())
+	fmt.Fprintf(w, "Deleted %d of %d datasets\n", len(ids)-failed, len(ids))
+	return err
+}
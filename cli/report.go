@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Results of a file in a DownloadReport.
+const (
+	// The file was downloaded and matched its digest.
+	ReportVerified = "verified"
+
+	// The local copy already matched the file's digest, so it wasn't downloaded.
+	ReportUnchanged = "unchanged"
+
+	// The file was written from an identical local copy in the digest cache.
+	ReportReused = "reused"
+
+	// The file couldn't be downloaded or didn't match its digest.
+	ReportFailed = "failed"
+)
+
+// DownloadReport describes what a download fetched, so that pipelines can
+// archive the provenance of their inputs. See DownloadOptions.Report.
+type DownloadReport struct {
+	// Dataset and path within it which were downloaded.
+	Dataset string `json:"dataset"`
+	Path    string `json:"path,omitempty"`
+
+	// Local directory the files were downloaded to.
+	Target string `json:"target"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Why the download failed, if it did.
+	Error string `json:"error,omitempty"`
+
+	// Every file the download completed or failed, sorted by path. Files not
+	// reached before a failure are omitted.
+	Files []DownloadReportFile `json:"files"`
+}
+
+// DownloadReportFile describes a file in a DownloadReport.
+type DownloadReportFile struct {
+	// Path of the file within the dataset.
+	Path string `json:"path"`
+
+	// Size and SHA256 digest of the file in the dataset.
+	Size   int64  `json:"size"`
+	Digest []byte `json:"digest"`
+
+	// One of the Report constants, such as ReportVerified.
+	Result string `json:"result"`
+
+	// Why the file failed, if it did.
+	Error string `json:"error,omitempty"`
+
+	// Time spent downloading the file. Omitted for files which weren't
+	// downloaded.
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// downloadReport collects a DownloadReport as files complete. A nil report
+// collects nothing.
+type downloadReport struct {
+	lock    sync.Mutex
+	report  DownloadReport
+	started map[string]time.Time
+}
+
+func newDownloadReport(dataset, sourcePath, targetPath string) *downloadReport {
+	return &downloadReport{
+		report: DownloadReport{
+			Dataset: dataset,
+			Path:    sourcePath,
+			Target:  targetPath,
+			Started: time.Now(),
+			Files:   []DownloadReportFile{},
+		},
+		started: map[string]time.Time{},
+	}
+}
+
+// fileStarted records the time a file's download started.
+func (r *downloadReport) fileStarted(info *api.FileInfo) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.started[info.Path] = time.Now()
+}
+
+// fileFinished records the outcome of a file's download.
+func (r *downloadReport) fileFinished(info *api.FileInfo, err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	file := reportFile(info, ReportVerified)
+	if err != nil {
+		file.Result = ReportFailed
+		file.Error = err.Error()
+	}
+	if started, ok := r.started[info.Path]; ok {
+		finished := time.Now()
+		file.Started = &started
+		file.Finished = &finished
+		delete(r.started, info.Path)
+	}
+	r.report.Files = append(r.report.Files, file)
+}
+
+// fileSkipped records a file which didn't need to be downloaded.
+func (r *downloadReport) fileSkipped(info *api.FileInfo, result string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report.Files = append(r.report.Files, reportFile(info, result))
+}
+
+func reportFile(info *api.FileInfo, result string) DownloadReportFile {
+	return DownloadReportFile{
+		Path:   info.Path,
+		Size:   info.Size,
+		Digest: info.Digest,
+		Result: result,
+	}
+}
+
+// write finishes the report with the download's outcome and writes it to w as
+// a single line of JSON.
+func (r *downloadReport) write(w io.Writer, downloadErr error) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.report.Finished = time.Now()
+	if downloadErr != nil {
+		r.report.Error = downloadErr.Error()
+	}
+	sort.Slice(r.report.Files, func(i, j int) bool {
+		return r.report.Files[i].Path < r.report.Files[j].Path
+	})
+	return errors.WithStack(json.NewEncoder(w).Encode(&r.report))
+}
+
+// lockedWriter serializes writes, such as reports of concurrent downloads
+// sharing a writer.
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
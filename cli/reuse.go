@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// downloadRecords records completed files in a download's journal and in the
+// digest cache shared with other downloads. Either may be nil.
+type downloadRecords struct {
+	journal *journal
+	digests *journal
+
+	// Copy files reused from the digest cache instead of hard linking them.
+	copies bool
+
+	// Report of the files completed by the download. May be nil.
+	report *downloadReport
+}
+
+// record records a downloaded file.
+func (r *downloadRecords) record(info *api.FileInfo, layout *localLayout) error {
+	if r.journal == nil && r.digests == nil {
+		return nil
+	}
+
+	filePath, err := filepath.Abs(layout.path(info))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	finfo, err := os.Stat(filePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.journal.record(journalEntry{
+		Path:    info.Path,
+		Size:    finfo.Size(),
+		ModTime: finfo.ModTime(),
+		Digest:  info.Digest,
+	}); err != nil {
+		return err
+	}
+
+	// The digest cache is shared between targets, so it records local paths.
+	return r.digests.record(journalEntry{
+		Path:    filePath,
+		Size:    finfo.Size(),
+		ModTime: finfo.ModTime(),
+		Digest:  info.Digest,
+	})
+}
+
+// reuse writes a file from an unchanged local copy with the same digest, if the
+// digest cache has one. It returns false if the file must be downloaded.
+func (r *downloadRecords) reuse(info *api.FileInfo, layout *localLayout) (bool, error) {
+	entry, ok := r.digests.lookupDigest(info.Digest)
+	if !ok {
+		return false, nil
+	}
+	source := entry.Path
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false, nil
+	}
+	if _, ok := r.digests.lookup(source, sourceInfo); !ok {
+		return false, nil
+	}
+
+	target, err := filepath.Abs(layout.path(info))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if target == source {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, errors.WithStack(err)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+
+	// A hard link shares the source's mode, so files with another mode are
+	// copied. Links across filesystems fail, so those are copied too.
+	if r.copies || sourceInfo.Mode().Perm() != fileMode(info) || os.Link(source, target) != nil {
+		if err := copyFile(source, target, fileMode(info)); err != nil {
+			return false, err
+		}
+	}
+	return true, r.record(info, layout)
+}
+
+// copyFile copies the contents of a local file to a new file.
+func copyFile(source, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(out.Close())
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// SealOptions selects the checks Seal makes before sealing a dataset. Zero
+// fields check nothing.
+type SealOptions struct {
+	// Paths of files which must exist, such as a README or a completion marker.
+	RequireFiles []string
+
+	// Maximum number of files and total bytes in the dataset.
+	MaxFiles int64
+	MaxBytes int64
+}
+
+// Seal checks a dataset and seals it if every check passes, printing a report
+// of the dataset and any problems found to w. If a check fails, the dataset is
+// left writable and the error matches client.ErrSealRejected. The options may
+// be nil.
+func Seal(ctx context.Context, dataset *client.DatasetRef, w io.Writer, opts *SealOptions) error {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
+	var checks []client.SealCheck
+	if len(opts.RequireFiles) != 0 {
+		checks = append(checks, client.RequireFiles(opts.RequireFiles...))
+	}
+	if opts.MaxFiles > 0 || opts.MaxBytes > 0 {
+		checks = append(checks, client.MaxSize(opts.MaxFiles, opts.MaxBytes))
+	}
+
+	report, err := dataset.SealWithChecks(ctx, checks...)
+	if report == nil {
+		return err
+	}
+	fmt.Fprintf(w, "Checked %d files (%s)\n", report.Files, FormatBytes(report.Bytes))
+	for _, problem := range report.Problems {
+		fmt.Fprintf(w, "  %s\n", problem)
+	}
+	if report.Sealed {
+		fmt.Fprintf(w, "Sealed %s\n", dataset.Name())
+	} else if len(report.Problems) != 0 {
+		fmt.Fprintf(w, "Not sealed: %d problems found\n", len(report.Problems))
+	}
+	return err
+}
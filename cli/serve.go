@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// FileServerHandler serves a dataset read-only over plain HTTP. Directories
+// are rendered as HTML listings. Files support range requests and carry their
+// digest as an ETag, so browsers and tools like curl and wget can resume and
+// revalidate downloads.
+func FileServerHandler(dataset client.DatasetAPI) http.Handler {
+	return &fileServer{dataset: dataset}
+}
+
+// Serve serves a dataset over plain HTTP on the given address, such as
+// ":8080", until the context is done. See FileServerHandler.
+func Serve(ctx context.Context, dataset client.DatasetAPI, addr string) error {
+	return serveGateway(ctx, addr, FileServerHandler(dataset))
+}
+
+type fileServer struct {
+	dataset client.DatasetAPI
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	info, err := gatewayStat(ctx, s.dataset, r.URL.Path)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveDir(w, r)
+		return
+	}
+
+	file := info.(gatewayFileInfo).info
+	etag, _ := gatewayFileInfo{file}.ETag(ctx)
+	w.Header().Set("ETag", etag)
+
+	// Set the type up front, or ServeContent reads the start of the file to
+	// sniff it.
+	contentType := mime.TypeByExtension(path.Ext(file.Path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	content := &gatewayFile{ctx: ctx, dataset: s.dataset, info: file}
+	defer content.Close()
+	http.ServeContent(w, r, info.Name(), file.Updated, content)
+}
+
+// dirListing renders a directory. Names are escaped by the template.
+var dirListing = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Updated}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type dirListingEntry struct {
+	Name, Href, Size, Updated string
+}
+
+func (s *fileServer) serveDir(w http.ResponseWriter, r *http.Request) {
+	entries, err := gatewayList(r.Context(), s.dataset, r.URL.Path)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+
+	var listing []dirListingEntry
+	for _, info := range entries {
+		entry := dirListingEntry{Name: info.Name(), Href: (&url.URL{Path: info.Name()}).String()}
+		if info.IsDir() {
+			entry.Name += "/"
+			entry.Href += "/"
+		} else {
+			entry.Size = FormatBytes(info.Size())
+		}
+		if !info.ModTime().IsZero() {
+			entry.Updated = info.ModTime().UTC().Format("2006-01-02 15:04:05")
+		}
+		listing = append(listing, entry)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := dirListing.Execute(w, struct {
+		Path    string
+		Entries []dirListingEntry
+	}{path.Join("/", gatewayPath(r.URL.Path)), listing}); err != nil {
+		logrus.WithField("path", r.URL.Path).WithError(err).Warn("Failed to render directory listing")
+	}
+}
+
+func (s *fileServer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	logrus.WithField("path", r.URL.Path).WithError(err).Error("Failed to serve request")
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
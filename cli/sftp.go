@@ -0,0 +1,694 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// SFTPOptions configures ServeSFTP.
+type SFTPOptions struct {
+	// Key identifying the server to clients. Required.
+	HostKey ssh.Signer
+
+	// Public keys of the clients allowed to connect. Required.
+	AuthorizedKeys []ssh.PublicKey
+
+	// Let clients create, replace, rename, and delete files. Writes to sealed
+	// datasets fail regardless. New directories are recorded with
+	// placeholders; see DirPlaceholder.
+	Writable bool
+}
+
+// ServeSFTP serves a dataset over SFTP on the given address, such as ":2022",
+// until the context is done, so that tools which only speak SFTP can use it.
+// Clients authenticate with one of the authorized keys under any user name.
+//
+// Only version 3 of the protocol is supported, which is what OpenSSH and most
+// other clients speak. Files are written when their handle is closed, and
+// attributes such as modification times can't be set.
+func ServeSFTP(ctx context.Context, dataset client.DatasetAPI, addr string, opts *SFTPOptions) error {
+	if opts == nil || opts.HostKey == nil {
+		return errors.New("a host key is required")
+	}
+	if len(opts.AuthorizedKeys) == 0 {
+		return errors.New("at least one authorized key is required")
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range opts.AuthorizedKeys {
+				if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.Errorf("unauthorized key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(opts.HostKey)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Close the listener and every connection once the context is done.
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+			if err := serveSSH(ctx, dataset, conn, config, opts.Writable); err != nil {
+				logrus.WithField("remote", conn.RemoteAddr()).WithError(err).Warn("SFTP connection failed")
+			}
+		}()
+	}
+}
+
+// serveSSH serves the SFTP subsystem on each session of an SSH connection.
+func serveSSH(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	conn net.Conn,
+	config *ssh.ServerConfig,
+	writable bool,
+) error {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				var subsystem struct{ Name string }
+				ok := req.Type == "subsystem" &&
+					ssh.Unmarshal(req.Payload, &subsystem) == nil &&
+					subsystem.Name == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				s := &sftpServer{dataset: dataset, writable: writable, handles: map[string]interface{}{}}
+				if err := s.serve(ctx, channel); err != nil {
+					logrus.WithError(err).Warn("SFTP session failed")
+				}
+				return
+			}
+		}()
+	}
+	return nil
+}
+
+// SFTP packet types, from draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// SFTP status codes.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// SFTP flags of open requests and file attributes.
+const (
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+)
+
+// Limits on packets, well above what clients send in practice.
+const (
+	sftpMaxPacket = 1024 * 1024
+	sftpMaxRead   = 256 * 1024
+	sftpDirBatch  = 100
+)
+
+// sftpServer serves a single SFTP session. Requests are handled in order.
+type sftpServer struct {
+	dataset  client.DatasetAPI
+	writable bool
+
+	// Open files and directories by handle.
+	handles    map[string]interface{}
+	nextHandle int
+}
+
+// sftpDir is an open directory, listed on the first read.
+type sftpDir struct {
+	name    string
+	entries []os.FileInfo
+	listed  bool
+}
+
+// sftpWriter buffers a file being written, since writes must know their size
+// in advance. It is written to the dataset when its handle is closed.
+type sftpWriter struct {
+	path string
+	file *os.File
+}
+
+func (s *sftpServer) serve(ctx context.Context, rw io.ReadWriter) error {
+	defer s.closeAll()
+
+	for {
+		var length uint32
+		if err := binary.Read(rw, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if length == 0 || length > sftpMaxPacket {
+			return errors.Errorf("invalid SFTP packet length %d", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(rw, packet); err != nil {
+			return errors.WithStack(err)
+		}
+
+		reply := s.handle(ctx, packet)
+		if reply == nil {
+			continue
+		}
+		out := make([]byte, 4, 4+len(reply))
+		binary.BigEndian.PutUint32(out, uint32(len(reply)))
+		if _, err := rw.Write(append(out, reply...)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// handle responds to a single request packet.
+func (s *sftpServer) handle(ctx context.Context, packet []byte) []byte {
+	r := &sftpReader{buf: packet[1:]}
+	if packet[0] == sftpInit {
+		return sftpPacket{sftpVersion}.uint32(3)
+	}
+
+	id := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	reply, err := s.dispatch(ctx, packet[0], id, r)
+	if err != nil {
+		return sftpStatusPacket(id, err)
+	}
+	return reply
+}
+
+// dispatch handles a request, returning its reply or an error to report.
+func (s *sftpServer) dispatch(ctx context.Context, op byte, id uint32, r *sftpReader) ([]byte, error) {
+	switch op {
+	case sftpRealpath:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		// Paths are resolved from the root, without checking that they exist.
+		p := path.Join("/", gatewayPath(name))
+		return sftpPacket{sftpName}.uint32(id).uint32(1).string(p).string(p).uint32(0), nil
+
+	case sftpStat, sftpLstat:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		info, err := gatewayStat(ctx, s.dataset, name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpPacket{sftpAttrs}.uint32(id).attrs(info), nil
+
+	case sftpFstat:
+		handle := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		switch h := s.handles[handle].(type) {
+		case *gatewayFile:
+			return sftpPacket{sftpAttrs}.uint32(id).attrs(gatewayFileInfo{h.info}), nil
+		case *sftpWriter:
+			info, err := h.file.Stat()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return sftpPacket{sftpAttrs}.uint32(id).attrs(namedFileInfo{info, path.Base(h.path)}), nil
+		case *sftpDir:
+			info, err := gatewayStat(ctx, s.dataset, h.name)
+			if err != nil {
+				return nil, err
+			}
+			return sftpPacket{sftpAttrs}.uint32(id).attrs(info), nil
+		}
+		return nil, errSFTPHandle
+
+	case sftpOpendir:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		info, err := gatewayStat(ctx, s.dataset, name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.Errorf("%s is not a directory", name)
+		}
+		return s.open(id, &sftpDir{name: name}), nil
+
+	case sftpReaddir:
+		handle := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		dir, ok := s.handles[handle].(*sftpDir)
+		if !ok {
+			return nil, errSFTPHandle
+		}
+		return s.readDir(ctx, id, dir)
+
+	case sftpOpen:
+		name, flags := r.string(), r.uint32()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return s.openFile(ctx, id, name, flags)
+
+	case sftpRead:
+		handle, offset, length := r.string(), r.uint64(), r.uint32()
+		if r.err != nil {
+			return nil, r.err
+		}
+		file, ok := s.handles[handle].(*gatewayFile)
+		if !ok {
+			return nil, errSFTPHandle
+		}
+		return s.read(id, file, int64(offset), length)
+
+	case sftpWrite:
+		handle, offset, data := r.string(), r.uint64(), r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		w, ok := s.handles[handle].(*sftpWriter)
+		if !ok {
+			return nil, errSFTPHandle
+		}
+		if _, err := w.file.WriteAt([]byte(data), int64(offset)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return sftpStatusPacket(id, nil), nil
+
+	case sftpClose:
+		handle := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return sftpStatusPacket(id, s.close(ctx, handle)), nil
+
+	case sftpSetstat, sftpFsetstat:
+		// Attributes aren't recorded, but clients set them after uploads, so
+		// accept them rather than failing the upload.
+		return sftpStatusPacket(id, nil), nil
+
+	case sftpRemove:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := s.checkWritable(name); err != nil {
+			return nil, err
+		}
+		if err := s.dataset.DeleteFile(ctx, gatewayPath(name)); err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, nil), nil
+
+	case sftpMkdir:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := s.checkWritable(name); err != nil {
+			return nil, err
+		}
+		if _, err := gatewayStat(ctx, s.dataset, name); err == nil {
+			return nil, &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+		}
+		placeholder := path.Join(gatewayPath(name), DirPlaceholder)
+		if err := s.dataset.WriteFile(ctx, placeholder, nil, 0); err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, nil), nil
+
+	case sftpRmdir:
+		name := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := s.checkWritable(name); err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, s.removeDir(ctx, name)), nil
+
+	case sftpRename:
+		oldName, newName := r.string(), r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := s.checkWritable(oldName); err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, gatewayRename(ctx, s.dataset, oldName, newName)), nil
+	}
+	return sftpPacket{sftpStatus}.uint32(id).uint32(sftpOpUnsupported).
+		string("operation not supported").string(""), nil
+}
+
+var errSFTPHandle = errors.New("invalid handle")
+
+func (s *sftpServer) checkWritable(name string) error {
+	if !s.writable {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+// open registers a handle and returns the reply carrying it.
+func (s *sftpServer) open(id uint32, h interface{}) []byte {
+	handle := strconv.Itoa(s.nextHandle)
+	s.nextHandle++
+	s.handles[handle] = h
+	return sftpPacket{sftpHandle}.uint32(id).string(handle)
+}
+
+func (s *sftpServer) openFile(ctx context.Context, id uint32, name string, flags uint32) ([]byte, error) {
+	if flags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreate|sftpFlagTrunc) == 0 {
+		info, err := gatewayStat(ctx, s.dataset, name)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return nil, errors.Errorf("%s is a directory", name)
+		}
+		return s.open(id, &gatewayFile{ctx: ctx, dataset: s.dataset, info: info.(gatewayFileInfo).info}), nil
+	}
+
+	if err := s.checkWritable(name); err != nil {
+		return nil, err
+	}
+	if flags&sftpFlagAppend != 0 || flags&sftpFlagTrunc == 0 && flags&sftpFlagCreate == 0 {
+		return nil, errors.New("files can only be replaced, not modified")
+	}
+	p := gatewayPath(name)
+	if p == "" {
+		return nil, errors.Errorf("%s is a directory", name)
+	}
+	file, err := ioutil.TempFile("", "fileheap-sftp-*")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.open(id, &sftpWriter{path: p, file: file}), nil
+}
+
+func (s *sftpServer) read(id uint32, file *gatewayFile, offset int64, length uint32) ([]byte, error) {
+	if offset >= file.info.Size {
+		return sftpPacket{sftpStatus}.uint32(id).uint32(sftpEOF).string("end of file").string(""), nil
+	}
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return sftpPacket{sftpData}.uint32(id).string(string(buf[:n])), nil
+}
+
+// readDir returns the next batch of a directory's entries.
+func (s *sftpServer) readDir(ctx context.Context, id uint32, dir *sftpDir) ([]byte, error) {
+	if !dir.listed {
+		entries, err := gatewayList(ctx, s.dataset, dir.name)
+		if err != nil {
+			return nil, err
+		}
+		dir.entries, dir.listed = entries, true
+	}
+	if len(dir.entries) == 0 {
+		return sftpPacket{sftpStatus}.uint32(id).uint32(sftpEOF).string("end of directory").string(""), nil
+	}
+
+	batch := dir.entries
+	if len(batch) > sftpDirBatch {
+		batch = batch[:sftpDirBatch]
+	}
+	dir.entries = dir.entries[len(batch):]
+
+	reply := sftpPacket{sftpName}.uint32(id).uint32(uint32(len(batch)))
+	for _, info := range batch {
+		reply = reply.string(info.Name()).string(sftpLongName(info)).attrs(info)
+	}
+	return reply, nil
+}
+
+// removeDir removes an empty directory's placeholder.
+func (s *sftpServer) removeDir(ctx context.Context, name string) error {
+	entries, err := gatewayList(ctx, s.dataset, name)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 0 {
+		return errors.Errorf("%s is not empty", name)
+	}
+	err = s.dataset.DeleteFile(ctx, path.Join(gatewayPath(name), DirPlaceholder))
+	if errors.Is(err, client.ErrFileNotFound) {
+		return &os.PathError{Op: "rmdir", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// close releases a handle, writing the file if it was opened for writing.
+func (s *sftpServer) close(ctx context.Context, handle string) error {
+	h, ok := s.handles[handle]
+	if !ok {
+		return errSFTPHandle
+	}
+	delete(s.handles, handle)
+
+	switch h := h.(type) {
+	case *gatewayFile:
+		return h.Close()
+	case *sftpWriter:
+		defer os.Remove(h.file.Name())
+		defer h.file.Close()
+		size, err := h.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := h.file.Seek(0, io.SeekStart); err != nil {
+			return errors.WithStack(err)
+		}
+		return s.dataset.WriteFile(ctx, h.path, h.file, size)
+	}
+	return nil
+}
+
+// closeAll releases every handle at the end of a session, discarding
+// unfinished writes.
+func (s *sftpServer) closeAll() {
+	for _, h := range s.handles {
+		switch h := h.(type) {
+		case *gatewayFile:
+			h.Close()
+		case *sftpWriter:
+			h.file.Close()
+			os.Remove(h.file.Name())
+		}
+	}
+	s.handles = nil
+}
+
+// sftpStatusPacket reports the outcome of a request.
+func sftpStatusPacket(id uint32, err error) []byte {
+	code := uint32(sftpOK)
+	message := "ok"
+	if err != nil {
+		message = err.Error()
+		switch {
+		case errors.Is(err, client.ErrFileNotFound) || errors.Is(err, os.ErrNotExist):
+			code = sftpNoSuchFile
+		case errors.Is(err, client.ErrDatasetReadOnly) || errors.Is(err, os.ErrPermission):
+			code = sftpPermissionDenied
+		case errors.Is(err, errSFTPMessage):
+			code = sftpBadMessage
+		default:
+			code = sftpFailure
+		}
+	}
+	return sftpPacket{sftpStatus}.uint32(id).uint32(code).string(message).string("")
+}
+
+// sftpLongName formats an entry like ls -l, which some clients display.
+func sftpLongName(info os.FileInfo) string {
+	return fmt.Sprintf("%s 1 fileheap fileheap %12d %s %s",
+		info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
+}
+
+// sftpPacket builds a packet, starting with its type.
+type sftpPacket []byte
+
+func (p sftpPacket) uint32(v uint32) sftpPacket {
+	return append(p, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (p sftpPacket) uint64(v uint64) sftpPacket {
+	return p.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+
+func (p sftpPacket) string(s string) sftpPacket {
+	return append(p.uint32(uint32(len(s))), s...)
+}
+
+func (p sftpPacket) attrs(info os.FileInfo) sftpPacket {
+	mode := uint32(info.Mode().Perm())
+	if info.IsDir() {
+		mode |= 0040000
+	} else {
+		mode |= 0100000
+	}
+	var mtime uint32
+	if t := info.ModTime(); !t.IsZero() {
+		mtime = uint32(t.Unix())
+	}
+	return p.uint32(sftpAttrSize | sftpAttrPermissions | sftpAttrTimes).
+		uint64(uint64(info.Size())).uint32(mode).uint32(mtime).uint32(mtime)
+}
+
+// sftpReader parses a packet. After the first malformed field, err is set and
+// every further field is zero.
+type sftpReader struct {
+	buf []byte
+	err error
+}
+
+var errSFTPMessage = errors.New("malformed message")
+
+func (r *sftpReader) uint32() uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.err = errSFTPMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.buf)) < n {
+		r.err = errSFTPMessage
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
@@ -0,0 +1,254 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/allenai/fileheap-client/client"
+	"github.com/allenai/fileheap-client/fileheaptest"
+)
+
+// sftpSession runs an sftpServer over a pipe, sending packets and parsing
+// replies as a client would.
+type sftpSession struct {
+	t      *testing.T
+	conn   net.Conn
+	nextID uint32
+}
+
+func newSFTPSession(t *testing.T, dataset client.DatasetAPI, writable bool) *sftpSession {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s := &sftpServer{dataset: dataset, writable: writable, handles: map[string]interface{}{}}
+		if err := s.serve(ctx, serverConn); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-done
+		cancel()
+	})
+	return &sftpSession{t: t, conn: clientConn}
+}
+
+// send writes a packet and returns the reply's type and body after its ID.
+func (s *sftpSession) send(packet sftpPacket) (byte, *sftpReader) {
+	s.t.Helper()
+	out := make([]byte, 4, 4+len(packet))
+	binary.BigEndian.PutUint32(out, uint32(len(packet)))
+	if _, err := s.conn.Write(append(out, packet...)); err != nil {
+		s.t.Fatalf("write: %v", err)
+	}
+
+	var length uint32
+	if err := binary.Read(s.conn, binary.BigEndian, &length); err != nil {
+		s.t.Fatalf("read length: %v", err)
+	}
+	reply := make([]byte, length)
+	if _, err := io.ReadFull(s.conn, reply); err != nil {
+		s.t.Fatalf("read reply: %v", err)
+	}
+	r := &sftpReader{buf: reply[1:]}
+	if reply[0] != sftpVersion {
+		if id := r.uint32(); id != s.nextID {
+			s.t.Fatalf("reply has ID %d; want %d", id, s.nextID)
+		}
+	}
+	return reply[0], r
+}
+
+// request sends a request of the given type with the next ID. Fields are
+// appended by the caller.
+func (s *sftpSession) request(op byte) sftpPacket {
+	s.nextID++
+	return sftpPacket{op}.uint32(s.nextID)
+}
+
+// status sends a request expecting a status reply, and returns its code.
+func (s *sftpSession) status(packet sftpPacket) uint32 {
+	s.t.Helper()
+	op, r := s.send(packet)
+	if op != sftpStatus {
+		s.t.Fatalf("got reply type %d; want status", op)
+	}
+	return r.uint32()
+}
+
+// handle sends a request expecting a handle reply.
+func (s *sftpSession) handle(packet sftpPacket) string {
+	s.t.Helper()
+	op, r := s.send(packet)
+	if op != sftpHandle {
+		s.t.Fatalf("got reply type %d with code %d; want handle", op, r.uint32())
+	}
+	return r.string()
+}
+
+func newTestDataset(t *testing.T, files map[string]string) *client.DatasetRef {
+	t.Helper()
+	ctx := context.Background()
+	dataset, err := fileheaptest.NewServer().Client().NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := dataset.WriteFile(ctx, name, bytes.NewReader([]byte(contents)), int64(len(contents))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dataset
+}
+
+func TestSFTPInit(t *testing.T) {
+	s := newSFTPSession(t, newTestDataset(t, nil), false)
+	op, r := s.send(sftpPacket{sftpInit}.uint32(3))
+	if op != sftpVersion || r.uint32() != 3 {
+		t.Fatalf("got reply type %d; want version 3", op)
+	}
+}
+
+func TestSFTPRead(t *testing.T) {
+	s := newSFTPSession(t, newTestDataset(t, map[string]string{"dir/a.txt": "hello"}), false)
+
+	op, r := s.send(s.request(sftpStat).string("/dir/a.txt"))
+	if op != sftpAttrs {
+		t.Fatalf("stat: got reply type %d; want attrs", op)
+	}
+	if flags, size := r.uint32(), r.uint64(); flags&sftpAttrSize == 0 || size != 5 {
+		t.Errorf("stat: got size %d; want 5", size)
+	}
+
+	handle := s.handle(s.request(sftpOpen).string("/dir/a.txt").uint32(0x01).uint32(0))
+	op, r = s.send(s.request(sftpRead).string(handle).uint64(1).uint32(100))
+	if op != sftpData {
+		t.Fatalf("read: got reply type %d; want data", op)
+	}
+	if data := r.string(); data != "ello" {
+		t.Errorf("read: got %q; want %q", data, "ello")
+	}
+	if code := s.status(s.request(sftpRead).string(handle).uint64(5).uint32(100)); code != sftpEOF {
+		t.Errorf("read at end: got status %d; want EOF", code)
+	}
+	if code := s.status(s.request(sftpClose).string(handle)); code != sftpOK {
+		t.Errorf("close: got status %d; want OK", code)
+	}
+}
+
+func TestSFTPReaddir(t *testing.T) {
+	s := newSFTPSession(t, newTestDataset(t, map[string]string{
+		"a.txt":     "a",
+		"dir/b.txt": "b",
+	}), false)
+
+	handle := s.handle(s.request(sftpOpendir).string("/"))
+	op, r := s.send(s.request(sftpReaddir).string(handle))
+	if op != sftpName {
+		t.Fatalf("readdir: got reply type %d; want name", op)
+	}
+	count := r.uint32()
+	var names []string
+	for i := uint32(0); i < count; i++ {
+		names = append(names, r.string())
+		r.string() // Long name.
+		r.uint32() // Attribute flags.
+		r.uint64() // Size.
+		r.uint32() // Permissions.
+		r.uint64() // Access and modification times.
+	}
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "dir" {
+		t.Errorf("readdir: got %q; want [a.txt dir]", names)
+	}
+	if code := s.status(s.request(sftpReaddir).string(handle)); code != sftpEOF {
+		t.Errorf("readdir at end: got status %d; want EOF", code)
+	}
+}
+
+func TestSFTPWrite(t *testing.T) {
+	dataset := newTestDataset(t, nil)
+	s := newSFTPSession(t, dataset, true)
+
+	flags := uint32(sftpFlagWrite | sftpFlagCreate | sftpFlagTrunc)
+	handle := s.handle(s.request(sftpOpen).string("/new.txt").uint32(flags).uint32(0))
+	if code := s.status(s.request(sftpWrite).string(handle).uint64(0).string("hello")); code != sftpOK {
+		t.Fatalf("write: got status %d; want OK", code)
+	}
+	if code := s.status(s.request(sftpClose).string(handle)); code != sftpOK {
+		t.Fatalf("close: got status %d; want OK", code)
+	}
+
+	r, err := dataset.ReadFile(context.Background(), "new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello" {
+		t.Errorf("got contents %q; want %q", data, "hello")
+	}
+}
+
+func TestSFTPErrors(t *testing.T) {
+	dataset := newTestDataset(t, map[string]string{"a.txt": "a"})
+	if err := dataset.Seal(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := newSFTPSession(t, dataset, true)
+
+	if code := s.status(s.request(sftpStat).string("/missing")); code != sftpNoSuchFile {
+		t.Errorf("stat missing file: got status %d; want no such file", code)
+	}
+	if code := s.status(s.request(sftpRemove).string("/a.txt")); code != sftpPermissionDenied {
+		t.Errorf("remove from sealed dataset: got status %d; want permission denied", code)
+	}
+
+	flags := uint32(sftpFlagWrite | sftpFlagCreate | sftpFlagTrunc)
+	handle := s.handle(s.request(sftpOpen).string("/b.txt").uint32(flags).uint32(0))
+	if code := s.status(s.request(sftpClose).string(handle)); code != sftpPermissionDenied {
+		t.Errorf("write to sealed dataset: got status %d; want permission denied", code)
+	}
+
+	// The path's length claims more bytes than the packet has.
+	if code := s.status(s.request(sftpStat).uint32(100)); code != sftpBadMessage {
+		t.Errorf("malformed request: got status %d; want bad message", code)
+	}
+	if code := s.status(s.request(sftpRead).string("nope").uint64(0).uint32(1)); code != sftpFailure {
+		t.Errorf("read of invalid handle: got status %d; want failure", code)
+	}
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	s := newSFTPSession(t, newTestDataset(t, map[string]string{"a.txt": "a"}), false)
+	if code := s.status(s.request(sftpRemove).string("/a.txt")); code != sftpPermissionDenied {
+		t.Errorf("remove: got status %d; want permission denied", code)
+	}
+	if code := s.status(s.request(sftpMkdir).string("/dir").uint32(0)); code != sftpPermissionDenied {
+		t.Errorf("mkdir: got status %d; want permission denied", code)
+	}
+}
+
+func TestSFTPPacketRoundTrip(t *testing.T) {
+	p := sftpPacket{sftpWrite}.uint32(7).string("handle").uint64(1 << 40).string("")
+	r := &sftpReader{buf: p[1:]}
+	if id, handle, offset, data := r.uint32(), r.string(), r.uint64(), r.string(); id != 7 || handle != "handle" ||
+		offset != 1<<40 || data != "" || r.err != nil || len(r.buf) != 0 {
+		t.Errorf("got %d %q %d %q %v", id, handle, offset, data, r.err)
+	}
+
+	r = &sftpReader{buf: p[1:8]}
+	r.uint32()
+	if r.string(); r.err != errSFTPMessage {
+		t.Errorf("truncated string: got error %v; want %v", r.err, errSFTPMessage)
+	}
+	if v := r.uint32(); v != 0 {
+		t.Errorf("field after error: got %d; want 0", v)
+	}
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// ShardMapFile is the name of the file recording the original path of each
+// file in a sharded download. It is written at the root of the target path.
+const ShardMapFile = ".fileheap-shards.jsonl"
+
+// shardMapEntry maps a file in a sharded download back to its dataset path.
+type shardMapEntry struct {
+	// Path of the file within the dataset.
+	Path string `json:"path"`
+
+	// Slash-separated path of the local file relative to the download root.
+	File string `json:"file"`
+}
+
+// localLayout maps dataset paths to local files.
+type localLayout struct {
+	root string
+
+	// Number of hex digits of each file's digest naming the directory it is
+	// stored in. Zero stores files at their dataset paths.
+	shard int
+}
+
+// file returns the local path of a file relative to the root.
+func (l *localLayout) file(info *api.FileInfo) string {
+	if l.shard == 0 {
+		return info.Path
+	}
+	digest := hex.EncodeToString(info.Digest)
+	return path.Join(digest[:l.shard], digest)
+}
+
+// path returns the local path of a file.
+func (l *localLayout) path(info *api.FileInfo) string {
+	return path.Join(l.root, l.file(info))
+}
+
+// shardMapIterator records the local file of each file in the shard map. Files
+// sharing a local file with an earlier one are recorded but not returned, so
+// concurrent batches never write the same file.
+type shardMapIterator struct {
+	files   client.Iterator
+	layout  *localLayout
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	seen    map[string]bool
+}
+
+func newShardMapIterator(files client.Iterator, layout *localLayout, w io.Writer) *shardMapIterator {
+	writer := bufio.NewWriter(w)
+	return &shardMapIterator{
+		files:   files,
+		layout:  layout,
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		seen:    map[string]bool{},
+	}
+}
+
+func (i *shardMapIterator) Next() (*api.FileInfo, error) {
+	for {
+		info, err := i.files.Next()
+		if err != nil {
+			return nil, err
+		}
+		file := i.layout.file(info)
+		if err := i.encoder.Encode(&shardMapEntry{Path: info.Path, File: file}); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !i.seen[file] {
+			i.seen[file] = true
+			return info, nil
+		}
+	}
+}
+
+func (i *shardMapIterator) flush() error {
+	return errors.WithStack(i.writer.Flush())
+}
+
+// walkShardMap calls fn for each file recorded in the shard map of a sharded
+// download, passing its dataset path as the relative path.
+func walkShardMap(
+	sourcePath string,
+	filter *pathFilter,
+	fn func(filePath, relpath string, info os.FileInfo) error,
+) error {
+	file, err := os.Open(filepath.Join(sourcePath, ShardMapFile))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	return readShardMap(file, func(entry shardMapEntry) error {
+		if filter.skipPath(entry.Path) {
+			return nil
+		}
+
+		filePath := filepath.Join(sourcePath, filepath.FromSlash(entry.File))
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return fn(filePath, entry.Path, info)
+	})
+}
+
+// readShardMap calls fn for each entry of a shard map.
+func readShardMap(r io.Reader, fn func(entry shardMapEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry shardMapEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return errors.Wrapf(err, "invalid %s", ShardMapFile)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(scanner.Err())
+}
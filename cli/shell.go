@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Shell is an interactive session for exploring and modifying a dataset with
+// commands such as ls, cd, get, put, rm, and stat.
+type Shell struct {
+	ctx     context.Context
+	dataset client.DatasetAPI
+	out     io.Writer
+
+	// Current directory within the dataset, without leading or trailing slashes.
+	// Empty at the dataset root.
+	cwd string
+}
+
+// NewShell creates a shell for a dataset which writes output to out.
+func NewShell(ctx context.Context, dataset client.DatasetAPI, out io.Writer) *Shell {
+	return &Shell{ctx: ctx, dataset: dataset, out: out}
+}
+
+// Prompt returns the prompt to show before reading each command.
+func (s *Shell) Prompt() string {
+	return fmt.Sprintf("%s:/%s> ", s.dataset.Name(), s.cwd)
+}
+
+// Run reads and executes commands from in until it is exhausted or the exit
+// command is given. Errors from individual commands are printed, not returned.
+func (s *Shell) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, s.Prompt())
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return errors.WithStack(scanner.Err())
+		}
+
+		err := s.Exec(scanner.Text())
+		if err == errExit {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+		}
+	}
+}
+
+var errExit = errors.New("exit")
+
+// Exec executes a single command.
+func (s *Shell) Exec(line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "exit", "quit":
+		return errExit
+	case "help":
+		fmt.Fprint(s.out, shellHelp)
+		return nil
+	case "pwd":
+		fmt.Fprintf(s.out, "/%s\n", s.cwd)
+		return nil
+	case "cd":
+		return s.cd(args)
+	case "ls":
+		return s.ls(args)
+	case "stat":
+		return s.stat(args)
+	case "get":
+		return s.get(args)
+	case "put":
+		return s.put(args)
+	case "rm":
+		return s.rm(args)
+	default:
+		return errors.Errorf("unknown command %q; try help", cmd)
+	}
+}
+
+const shellHelp = `Commands:
+  ls [dir]                 List a directory
+  cd [dir]                 Change directory
+  pwd                      Print the current directory
+  stat <file>              Show a file's size, digest, and last update
+  get <file> [local path]  Download a file
+  put <local path> [file]  Upload a file
+  rm <file>                Delete a file
+  exit                     Leave the shell
+`
+
+// Complete returns candidate completions for the last word of a line, for use
+// with a line editor. Candidates are full replacements for the last word.
+func (s *Shell) Complete(line string) []string {
+	args := strings.Fields(line)
+	if len(args) == 0 || strings.HasSuffix(line, " ") {
+		args = append(args, "")
+	}
+	if len(args) == 1 {
+		var matches []string
+		for _, cmd := range []string{"cd", "exit", "get", "help", "ls", "put", "pwd", "rm", "stat"} {
+			if strings.HasPrefix(cmd, args[0]) {
+				matches = append(matches, cmd)
+			}
+		}
+		return matches
+	}
+	if args[0] == "put" && len(args) == 2 {
+		// The first argument is a local path.
+		return nil
+	}
+
+	partial := args[len(args)-1]
+	dir, base := "", partial
+	if i := strings.LastIndex(partial, "/"); i >= 0 {
+		dir, base = partial[:i+1], partial[i+1:]
+	}
+
+	entries, err := s.list(s.resolve(dir))
+	if err != nil {
+		return nil
+	}
+	var matches []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, base) {
+			matches = append(matches, dir+entry)
+		}
+	}
+	return matches
+}
+
+// resolve converts a path relative to the current directory into a path
+// relative to the dataset root.
+func (s *Shell) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join("/", s.cwd, p)
+	}
+	return strings.TrimPrefix(path.Clean(p), "/")
+}
+
+// list returns the entries of a directory relative to the dataset root.
+func (s *Shell) list(dir string) ([]string, error) {
+	return listDir(s.ctx, s.dataset, dir)
+}
+
+// listDir returns the names of entries in a dataset directory, sorted, with a
+// trailing slash on subdirectories. The root directory is the empty string.
+func listDir(ctx context.Context, dataset client.DatasetAPI, dir string) ([]string, error) {
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	seen := map[string]bool{}
+	var entries []string
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(info.Path, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			entries = append(entries, name)
+		}
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+func (s *Shell) cd(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: cd [dir]")
+	}
+	if len(args) == 0 {
+		s.cwd = ""
+		return nil
+	}
+
+	dir := s.resolve(args[0])
+	if dir != "" {
+		entries, err := s.list(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return errors.Errorf("%s: no such directory", args[0])
+		}
+	}
+	s.cwd = dir
+	return nil
+}
+
+func (s *Shell) ls(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ls [dir]")
+	}
+	dir := s.cwd
+	if len(args) == 1 {
+		dir = s.resolve(args[0])
+	}
+
+	entries, err := s.list(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Fprintln(s.out, entry)
+	}
+	return nil
+}
+
+func (s *Shell) stat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: stat <file>")
+	}
+
+	return Stat(s.ctx, s.dataset, s.resolve(args[0]), s.out, FormatText)
+}
+
+func (s *Shell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get <file> [local path]")
+	}
+	remote := s.resolve(args[0])
+	local := path.Base(remote)
+	if len(args) == 2 {
+		local = args[1]
+	}
+
+	info, err := s.dataset.FileInfo(s.ctx, remote)
+	if err != nil {
+		return err
+	}
+	reader, err := s.dataset.ReadFile(s.ctx, remote)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.OpenFile(local, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode(info))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(file, io.TeeReader(reader, hash)); err != nil {
+		return errors.WithStack(err)
+	}
+	if digest := hash.Sum(nil); !bytes.Equal(digest, info.Digest) {
+		return errors.Errorf("%s has incorrect digest", remote)
+	}
+	return errors.WithStack(file.Close())
+}
+
+func (s *Shell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: put <local path> [file]")
+	}
+	local := args[0]
+	remote := s.resolve(filepath.Base(local))
+	if len(args) == 2 {
+		remote = s.resolve(args[1])
+	}
+
+	file, err := os.Open(local)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	finfo, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !finfo.Mode().IsRegular() {
+		return errors.Errorf("%s is not a regular file", local)
+	}
+	return s.dataset.WriteFile(s.ctx, remote, file, finfo.Size())
+}
+
+func (s *Shell) rm(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: rm <file>")
+	}
+	return s.dataset.DeleteFile(s.ctx, s.resolve(args[0]))
+}
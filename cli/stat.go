@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Output formats for commands which print information about files.
+const (
+	// FormatText is human-readable text. It may change between versions.
+	FormatText = "text"
+
+	// FormatJSON is a JSON object per file, for use in scripts.
+	FormatJSON = "json"
+)
+
+// FileStat describes a file as printed by Stat in the JSON format.
+type FileStat struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	DigestHex    string    `json:"digestHex"`
+	DigestBase64 string    `json:"digestBase64"`
+	Updated      time.Time `json:"updated"`
+
+	// Permission bits in octal, if recorded on upload.
+	Mode string `json:"mode,omitempty"`
+}
+
+// Stat prints the size, digest, and last update of a file in a dataset to w.
+// The format must be FormatText or FormatJSON; empty means FormatText.
+func Stat(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	filename string,
+	w io.Writer,
+	format string,
+) error {
+	if format == "" {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatJSON {
+		return errors.Errorf("unknown format %q", format)
+	}
+
+	info, err := dataset.FileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+	return printFileStat(w, info, format)
+}
+
+func printFileStat(w io.Writer, info *api.FileInfo, format string) error {
+	stat := FileStat{
+		Path:         info.Path,
+		Size:         info.Size,
+		DigestHex:    hex.EncodeToString(info.Digest),
+		DigestBase64: base64.StdEncoding.EncodeToString(info.Digest),
+		Updated:      info.Updated,
+	}
+	if info.Mode != 0 {
+		stat.Mode = api.EncodeFileMode(info.Mode)
+	}
+
+	if format == FormatJSON {
+		return errors.WithStack(json.NewEncoder(w).Encode(&stat))
+	}
+
+	fmt.Fprintf(w, "Path:    %s\n", stat.Path)
+	fmt.Fprintf(w, "Size:    %d (%s)\n", stat.Size, FormatBytes(stat.Size))
+	fmt.Fprintf(w, "SHA256:  %s\n", stat.DigestHex)
+	fmt.Fprintf(w, "Base64:  %s\n", stat.DigestBase64)
+	fmt.Fprintf(w, "Updated: %s\n", stat.Updated.Local())
+	if info.Mode != 0 {
+		fmt.Fprintf(w, "Mode:    %s\n", info.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Number of hex digits of each file's digest naming its directory in a store.
+const storeShardDirs = 2
+
+// linkTree links each file recorded in a shard map from the target path to its
+// copy in the store, replacing anything else at the file's path.
+func linkTree(shardMap io.Reader, targetPath, storePath string, symlink bool) error {
+	return readShardMap(shardMap, func(entry shardMapEntry) error {
+		source := filepath.Join(storePath, filepath.FromSlash(entry.File))
+		target := filepath.Join(targetPath, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if linked(source, target, symlink) {
+			return nil
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		if symlink {
+			return errors.WithStack(os.Symlink(source, target))
+		}
+		return errors.WithStack(os.Link(source, target))
+	})
+}
+
+// linked returns true if the target is already linked to the source.
+func linked(source, target string, symlink bool) bool {
+	if symlink {
+		dest, err := os.Readlink(target)
+		return err == nil && dest == source
+	}
+
+	targetInfo, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sourceInfo, targetInfo)
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Table renders rows of text in aligned columns, separated by two spaces. Rows
+// are held until Render, since every row determines the width of each column.
+// The zero value is an empty table with all columns aligned left.
+type Table struct {
+	rows  [][]string
+	right map[int]bool
+}
+
+// AlignRight aligns the given zero-based columns to the right, such as those
+// holding sizes or counts. It returns the table for chaining.
+func (t *Table) AlignRight(columns ...int) *Table {
+	if t.right == nil {
+		t.right = map[int]bool{}
+	}
+	for _, column := range columns {
+		t.right[column] = true
+	}
+	return t
+}
+
+// Row adds a row of cells. Rows may have different numbers of cells.
+func (t *Table) Row(cells ...string) {
+	t.rows = append(t.rows, cells)
+}
+
+// Len returns the number of rows in the table.
+func (t *Table) Len() int { return len(t.rows) }
+
+// Render writes the table to w, one line per row. The last cell of a left
+// aligned column is not padded, so lines have no trailing spaces.
+func (t *Table) Render(w io.Writer) error {
+	var widths []int
+	for _, row := range t.rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var line strings.Builder
+	for _, row := range t.rows {
+		line.Reset()
+		for i, cell := range row {
+			if i != 0 {
+				line.WriteString("  ")
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			switch {
+			case t.right[i]:
+				line.WriteString(pad)
+				line.WriteString(cell)
+			case i == len(row)-1:
+				line.WriteString(cell)
+			default:
+				line.WriteString(cell)
+				line.WriteString(pad)
+			}
+		}
+		line.WriteByte('\n')
+		if _, err := io.WriteString(w, line.String()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// FormatAge returns how long before now a time was, such as "3h ago". Times
+// more than a month old or in the future are shown as dates, and the zero
+// time as "-".
+func FormatAge(t, now time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	age := now.Sub(t)
+	switch {
+	case age < -time.Minute || age >= 30*24*time.Hour:
+		return t.Local().Format("2006-01-02")
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age/time.Minute))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(age/(24*time.Hour)))
+	}
+}
+
+// FormatExpiry returns when a time is due relative to now, such as
+// "2026-01-02 15:04 (in 3d)", or "2026-01-02 15:04 (expired)" if it has passed.
+func FormatExpiry(t, now time.Time) string {
+	date := t.Local().Format("2006-01-02 15:04")
+	left := t.Sub(now)
+	switch {
+	case left <= 0:
+		return date + " (expired)"
+	case left < time.Hour:
+		return fmt.Sprintf("%s (in %dm)", date, int(left/time.Minute))
+	case left < 24*time.Hour:
+		return fmt.Sprintf("%s (in %dh)", date, int(left/time.Hour))
+	default:
+		return fmt.Sprintf("%s (in %dd)", date, int(left/(24*time.Hour)))
+	}
+}
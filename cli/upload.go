@@ -8,6 +8,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -16,6 +18,183 @@ import (
 	"github.com/allenai/fileheap-client/client"
 )
 
+// UploadOptions provides optional configuration to Upload.
+type UploadOptions struct {
+	// Record each file's permission bits so they can be restored on download.
+	PreserveMode bool
+
+	// Glob patterns of files to upload. If empty, all files are uploaded.
+	// See Exclude for pattern syntax.
+	Include []string
+
+	// Glob patterns of files and directories to skip, such as ".git" or "*.tmp".
+	// Patterns containing a slash match the path relative to the source
+	// directory; other patterns match the name of any file or directory.
+	// Exclude takes precedence over Include.
+	Exclude []string
+
+	// After uploading, delete files under the target path that have no local
+	// counterpart so the dataset exactly mirrors the source. Remote files
+	// matching Exclude, or not matching Include, are left untouched.
+	Mirror bool
+
+	// Closing Stop asks the upload to let batches in flight finish, start no
+	// new ones, and return an *InterruptedError. See GracefulInterruptContext.
+	Stop <-chan struct{}
+
+	// Path of a file recording which files have been uploaded. If it exists,
+	// files unchanged since they were recorded are skipped. It is written if
+	// the upload is interrupted or fails, and removed once the upload succeeds.
+	StateFile string
+
+	// Path of a journal recording each file as soon as its batch is uploaded.
+	// Unlike StateFile, the journal survives crashes and is kept after the
+	// upload succeeds, so repeated uploads with the same journal skip files
+	// that are unchanged since they were recorded.
+	Journal string
+
+	// Treat the source as a sharded download (see DownloadOptions.ShardDirs)
+	// and upload each file to its original path, as recorded in ShardMapFile.
+	// Include and Exclude match the original paths.
+	Unshard bool
+
+	// Record each empty directory as an empty file named DirPlaceholder
+	// within it, so that Download recreates the directory. Otherwise only
+	// files are uploaded, and empty directories are lost.
+	KeepEmptyDirs bool
+}
+
+// DirPlaceholder names the empty files which record empty directories. See
+// UploadOptions.KeepEmptyDirs. Download creates the directory of each
+// placeholder instead of writing the placeholder itself.
+const DirPlaceholder = ".fileheap-keep"
+
+// isDirPlaceholder returns true if a file records an empty directory.
+func isDirPlaceholder(info *api.FileInfo) bool {
+	return info.Size == 0 && path.Base(info.Path) == DirPlaceholder
+}
+
+// placeholderInfo describes the placeholder of an empty directory as an empty
+// regular file with the directory's permissions and modification time.
+type placeholderInfo struct {
+	os.FileInfo
+}
+
+func (i placeholderInfo) Name() string      { return DirPlaceholder }
+func (i placeholderInfo) Size() int64       { return 0 }
+func (i placeholderInfo) Mode() os.FileMode { return i.FileInfo.Mode().Perm() }
+func (i placeholderInfo) IsDir() bool       { return false }
+
+// isEmptyDir returns true if a directory has no entries.
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// walkUploadFiles calls fn for each regular file under sourcePath selected by
+// the options' include and exclude patterns. Relative paths are slash-separated
+// and, for sharded sources, are the files' original paths.
+func walkUploadFiles(
+	sourcePath string,
+	opts *UploadOptions,
+	fn func(filePath, relpath string, info os.FileInfo) error,
+) error {
+	filter, err := newPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	if opts.Unshard {
+		return walkShardMap(sourcePath, filter, fn)
+	}
+
+	visitor := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		relpath, err := filepath.Rel(sourcePath, filePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relpath = filepath.ToSlash(relpath)
+
+		if info.IsDir() {
+			if relpath != "." && filter.skipDir(relpath) {
+				return filepath.SkipDir
+			}
+			if !opts.KeepEmptyDirs {
+				return nil
+			}
+			empty, err := isEmptyDir(filePath)
+			if err != nil || !empty {
+				return err
+			}
+			return fn(filePath, path.Join(relpath, DirPlaceholder), placeholderInfo{info})
+		}
+		if !info.Mode().IsRegular() || filter.skipFile(relpath) {
+			return nil
+		}
+		return fn(filePath, relpath, info)
+	}
+	return filepath.Walk(sourcePath, visitor)
+}
+
+// walkUploadSources is like walkUploadFiles for several sources, each of which
+// is a file or directory. Files are named by their base name and directories'
+// contents are below their base name, as with cp, so "." contributes its
+// contents directly.
+func walkUploadSources(
+	sources []string,
+	opts *UploadOptions,
+	fn func(filePath, relpath string, info os.FileInfo) error,
+) error {
+	filter, err := newPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	for _, source := range sources {
+		name := filepath.ToSlash(filepath.Base(filepath.Clean(source)))
+		if other, ok := names[name]; ok {
+			return errors.Errorf("%s and %s would both be uploaded to %s", other, source, name)
+		}
+		names[name] = source
+	}
+
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		name := filepath.ToSlash(filepath.Base(filepath.Clean(source)))
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() || filter.skipFile(name) {
+				continue
+			}
+			if err := fn(source, name, info); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = walkUploadFiles(source, opts, func(filePath, relpath string, info os.FileInfo) error {
+			return fn(filePath, path.Join(name, relpath), info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Upload the sourcePath to the targetPath in the targetPkg.
 func Upload(
 	ctx context.Context,
@@ -25,36 +204,147 @@ func Upload(
 	tracker ProgressTracker,
 	concurrency int,
 ) error {
+	return UploadWithOptions(ctx, sourcePath, targetPkg, targetPath, tracker, concurrency, nil)
+}
+
+// UploadWithOptions is like Upload, with additional configuration. The
+// options may be nil.
+func UploadWithOptions(
+	ctx context.Context,
+	sourcePath string,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+	opts *UploadOptions,
+) (err error) {
+	defer explainCancel(ctx, &err)
 	if concurrency < 1 {
 		return errors.New("concurrency must be positive")
 	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	walk := func(fn func(filePath, relpath string, info os.FileInfo) error) error {
+		return walkUploadFiles(sourcePath, opts, fn)
+	}
+	return upload(ctx, walk, targetPkg, targetPath, tracker, concurrency, opts)
+}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// UploadSources uploads several files and directories to the targetPath in the
+// targetPkg as one operation, sharing batches and the tracker. As with cp,
+// each source is uploaded below the target by its base name; a directory's
+// files keep their paths relative to it, and "." uploads a directory's
+// contents directly. Sources must have distinct base names. Include and
+// Exclude match the paths relative to each source.
+func UploadSources(
+	ctx context.Context,
+	sources []string,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+	opts *UploadOptions,
+) (err error) {
+	defer explainCancel(ctx, &err)
+	if concurrency < 1 {
+		return errors.New("concurrency must be positive")
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	walk := func(fn func(filePath, relpath string, info os.FileInfo) error) error {
+		return walkUploadSources(sources, opts, fn)
+	}
+	return upload(ctx, walk, targetPkg, targetPath, tracker, concurrency, opts)
+}
+
+// upload uploads the files visited by walk to the targetPath in the targetPkg.
+func upload(
+	ctx context.Context,
+	walk func(fn func(filePath, relpath string, info os.FileInfo) error) error,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	tracker ProgressTracker,
+	concurrency int,
+	opts *UploadOptions,
+) error {
+	state := &uploadState{Files: map[string]uploadedFile{}}
+	if opts.StateFile != "" {
+		var err error
+		if state, err = loadUploadState(opts.StateFile); err != nil {
+			return err
+		}
+	}
+	var stateLock sync.Mutex
+	saveState := func() error {
+		if opts.StateFile == "" {
+			return nil
+		}
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		return state.save(opts.StateFile)
+	}
 
+	var journal *journal
+	if opts.Journal != "" {
+		var err error
+		if journal, err = openJournal(opts.Journal); err != nil {
+			return err
+		}
+		defer journal.Close()
+	}
+
+	ctx, cancel := withCancelCause(ctx)
+	defer cancel(nil)
+
+	counter := &countingTracker{ProgressTracker: tracker}
 	asyncErr := async.Error{}
 	limiter := async.NewLimiter(concurrency)
 
-	uploadBatch := func(batch *client.UploadBatch) {
+	uploadBatch := func(batch *client.UploadBatch, files map[string]uploadedFile) {
 		length := int64(batch.Length())
 		size := batch.Size()
 
-		tracker.Update(&ProgressUpdate{
+		counter.Update(&ProgressUpdate{
 			FilesPending: length,
 			BytesPending: size,
 		})
-
-		if err := batch.Upload(ctx); err != nil {
-			tracker.Update(&ProgressUpdate{
+		for remotePath, file := range files {
+			fileStarted(counter, remotePath, file.Size)
+		}
+		_, err := batch.UploadWithLimiter(ctx, limiter)
+		for remotePath := range files {
+			fileFinished(counter, remotePath, err)
+		}
+		if err != nil {
+			counter.Update(&ProgressUpdate{
 				FilesPending: -length,
 				BytesPending: -size,
+				FilesFailed:  length,
 			})
 			asyncErr.Report(err)
-			cancel()
+			cancel(err)
 			return
 		}
 
-		tracker.Update(&ProgressUpdate{
+		entries := make([]journalEntry, 0, len(files))
+		stateLock.Lock()
+		for remotePath, file := range files {
+			state.Files[remotePath] = file
+			entries = append(entries, journalEntry{
+				Path:    remotePath,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+			})
+		}
+		stateLock.Unlock()
+		if err := journal.record(entries...); err != nil {
+			asyncErr.Report(err)
+			cancel(err)
+		}
+
+		counter.Update(&ProgressUpdate{
 			FilesWritten: length,
 			FilesPending: -length,
 			BytesWritten: size,
@@ -62,32 +352,54 @@ func Upload(
 		})
 	}
 
+	// Remote paths of all uploaded files, used to find extra files to delete.
+	uploaded := map[string]struct{}{}
+
+	// Number of files left for a later upload after being stopped.
+	var remaining int64
+
 	batch := targetPkg.NewUploadBatch()
-	visitor := func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	batchFiles := map[string]uploadedFile{}
+	visitor := func(filePath, relpath string, info os.FileInfo) error {
 		if err := asyncErr.Err(); err != nil {
 			return err
 		}
 
-		if info.IsDir() || !info.Mode().IsRegular() {
+		// Keep walking once stopped to count the files that remain.
+		if stopped(opts.Stop) {
+			remaining++
 			return nil
 		}
 
-		if !batch.HasCapacity(info.Size()) {
-			batchToUpload := batch
-			limiter.Go(func() { uploadBatch(batchToUpload) })
-			batch = targetPkg.NewUploadBatch()
+		remotePath := path.Join(targetPath, relpath)
+		key := strings.TrimPrefix(remotePath, "/")
+		if opts.Mirror {
+			uploaded[key] = struct{}{}
 		}
 
-		relpath, err := filepath.Rel(sourcePath, filePath)
-		if err != nil {
-			return errors.WithStack(err)
+		stateLock.Lock()
+		done := state.uploaded(key, info)
+		stateLock.Unlock()
+		if _, ok := journal.lookup(key, info); ok {
+			done = true
+		}
+		if done {
+			counter.Update(&ProgressUpdate{FilesWritten: 1, BytesWritten: info.Size()})
+			return nil
+		}
+
+		if !batch.HasCapacity(info.Size()) {
+			batchToUpload, filesToUpload := batch, batchFiles
+			limiter.Go(func() { uploadBatch(batchToUpload, filesToUpload) })
+			batch = targetPkg.NewUploadBatch()
+			batchFiles = map[string]uploadedFile{}
 		}
 
 		var reader io.Reader
-		if info.Size() < api.PutFileSizeLimit {
+		switch {
+		case info.Size() == 0:
+			// Nothing to read from empty files or directory placeholders.
+		case info.Size() < api.PutFileSizeLimit:
 			// Read small files into memory and immediately close them.
 			// This limits the number of open files to concurrency.
 			buf, err := ioutil.ReadFile(filePath)
@@ -95,23 +407,120 @@ func Upload(
 				return errors.WithStack(err)
 			}
 			reader = bytes.NewReader(buf)
-		} else {
+		default:
+			var err error
 			reader, err = os.Open(filePath)
 			if err != nil {
 				return errors.WithStack(err)
 			}
 		}
-		return batch.AddFile(path.Join(targetPath, relpath), reader, info.Size())
+		var mode os.FileMode
+		if opts.PreserveMode {
+			mode = info.Mode().Perm()
+		}
+		batchFiles[key] = uploadedFile{Size: info.Size(), ModTime: info.ModTime()}
+		return batch.AddFileWithMode(remotePath, reader, info.Size(), mode)
 	}
-	if err := filepath.Walk(sourcePath, visitor); err != nil {
+	if err := walk(visitor); err != nil {
+		limiter.Wait()
+		if saveErr := saveState(); saveErr != nil {
+			return saveErr
+		}
 		return err
 	}
-	limiter.Go(func() { uploadBatch(batch) })
+
+	// The last batch has not been sent, so it is left for later if stopped.
+	interrupted := remaining > 0 || stopped(opts.Stop)
+	if interrupted {
+		remaining += int64(batch.Length())
+	} else {
+		limiter.Go(func() { uploadBatch(batch, batchFiles) })
+	}
 	limiter.Wait()
 	if err := asyncErr.Err(); err != nil {
+		if saveErr := saveState(); saveErr != nil {
+			return saveErr
+		}
 		return err
 	}
+	if interrupted {
+		if err := saveState(); err != nil {
+			return err
+		}
+		return &InterruptedError{
+			Completed: counter.filesWritten(),
+			Remaining: remaining,
+			StateFile: opts.StateFile,
+		}
+	}
+
+	if opts.Mirror {
+		if err := deleteUnmatched(ctx, targetPkg, targetPath, uploaded, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.StateFile != "" {
+		if err := os.Remove(opts.StateFile); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
 
 	tracker.Close()
 	return nil
 }
+
+// deleteUnmatched deletes all files under the targetPath in the targetPkg
+// which were not uploaded and are not excluded by the options' filters.
+func deleteUnmatched(
+	ctx context.Context,
+	targetPkg *client.DatasetRef,
+	targetPath string,
+	uploaded map[string]struct{},
+	opts *UploadOptions,
+) error {
+	filter, err := newPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	// Manifest paths have no leading slash.
+	prefix := strings.Trim(path.Clean(targetPath), "/")
+	if prefix == "." {
+		prefix = ""
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	files := targetPkg.Files(ctx, &client.FileIteratorOptions{Prefix: prefix})
+	batch := targetPkg.NewDeleteBatch()
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, ok := uploaded[info.Path]; ok {
+			continue
+		}
+		if filter.skipPath(strings.TrimPrefix(info.Path, prefix)) {
+			continue
+		}
+
+		if !batch.HasCapacity() {
+			if _, err := batch.Delete(ctx); err != nil {
+				return err
+			}
+			batch = targetPkg.NewDeleteBatch()
+		}
+		if err := batch.AddFile(info.Path); err != nil {
+			return err
+		}
+	}
+	_, err = batch.Delete(ctx)
+	return err
+}
@@ -0,0 +1,263 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// VerifyOptions provides optional configuration to Verify.
+type VerifyOptions struct {
+	// Path of a digest cache, as in DownloadOptions.DigestCache. Local files
+	// recorded in the cache and unchanged since are trusted without reading
+	// them, and files which are read are recorded, so that repeated
+	// verification of a large mirror only reads files which changed.
+	DigestCache string
+
+	// Ignore local files which are not in the dataset.
+	IgnoreExtra bool
+}
+
+// Kinds of drift between a local mirror and its dataset.
+const (
+	// DriftMissing is a file in the dataset with no local copy.
+	DriftMissing = "missing"
+
+	// DriftModified is a local file whose contents differ from the dataset.
+	DriftModified = "modified"
+
+	// DriftExtra is a local file which is not in the dataset.
+	DriftExtra = "extra"
+)
+
+// Drift is a file which differs between a local mirror and its dataset.
+type Drift struct {
+	// Path of the file within the dataset.
+	Path string `json:"path"`
+
+	// Kind of difference, such as DriftModified.
+	Kind string `json:"kind"`
+}
+
+// VerifyReport describes the result of verifying a local mirror.
+type VerifyReport struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+
+	// Files and bytes in the dataset which were checked.
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Files and bytes which were read to compute their digests, rather than
+	// trusted from the digest cache.
+	FilesRead int64 `json:"filesRead"`
+	BytesRead int64 `json:"bytesRead"`
+
+	// Files which differ, in ascending path order within each kind.
+	Drift []Drift `json:"drift"`
+}
+
+// Verify checks that the files under sourcePath in a dataset match a local
+// mirror at targetPath, such as one made by Download. It reports files which
+// are missing, modified, or only exist locally. Drift is not an error.
+func Verify(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	sourcePath string,
+	targetPath string,
+	opts *VerifyOptions,
+) (*VerifyReport, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	report := &VerifyReport{Started: time.Now(), Drift: []Drift{}}
+
+	var digests *journal
+	var cachePath string
+	if opts.DigestCache != "" {
+		var err error
+		if digests, err = openJournal(opts.DigestCache); err != nil {
+			return nil, err
+		}
+		defer digests.Close()
+		if cachePath, err = filepath.Abs(opts.DigestCache); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	layout := &localLayout{root: targetPath}
+	expected := map[string]bool{}
+	files := dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: sourcePath})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		expected[info.Path] = true
+		report.Files++
+		report.Bytes += info.Size
+
+		filename, err := filepath.Abs(layout.path(info))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if isDirPlaceholder(info) {
+			// Placeholders are restored as directories rather than files.
+			filename = filepath.Dir(filename)
+		}
+		finfo, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			report.Drift = append(report.Drift, Drift{Path: info.Path, Kind: DriftMissing})
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if finfo.IsDir() {
+			if !isDirPlaceholder(info) {
+				report.Drift = append(report.Drift, Drift{Path: info.Path, Kind: DriftModified})
+			}
+			continue
+		}
+		if finfo.Size() != info.Size {
+			report.Drift = append(report.Drift, Drift{Path: info.Path, Kind: DriftModified})
+			continue
+		}
+
+		var digest []byte
+		if entry, ok := digests.lookup(filename, finfo); ok {
+			digest = entry.Digest
+		} else {
+			if digest, err = getDigest(filename); err != nil {
+				return nil, err
+			}
+			report.FilesRead++
+			report.BytesRead += finfo.Size()
+			if err := digests.record(journalEntry{
+				Path:    filename,
+				Size:    finfo.Size(),
+				ModTime: finfo.ModTime(),
+				Digest:  digest,
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if !bytes.Equal(digest, info.Digest) {
+			report.Drift = append(report.Drift, Drift{Path: info.Path, Kind: DriftModified})
+		}
+	}
+
+	if !opts.IgnoreExtra {
+		var extra []Drift
+		err := filepath.Walk(targetPath, func(filename string, finfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if finfo.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(targetPath, filename)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !strings.HasPrefix(rel, sourcePath) || expected[rel] {
+				return nil
+			}
+			if abs, err := filepath.Abs(filename); err == nil && abs == cachePath {
+				return nil
+			}
+			extra = append(extra, Drift{Path: rel, Kind: DriftExtra})
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		report.Drift = append(report.Drift, extra...)
+	}
+
+	report.Duration = time.Since(report.Started)
+	return report, nil
+}
+
+// VerifyDaemon verifies a local mirror as Verify does, then again every
+// interval until ctx is done, calling notify with the result of each run. A
+// failed run is passed to notify with its error rather than stopping the
+// daemon, so that transient outages don't end long-lived monitoring. It
+// returns once ctx is done.
+func VerifyDaemon(
+	ctx context.Context,
+	dataset client.DatasetAPI,
+	sourcePath string,
+	targetPath string,
+	interval time.Duration,
+	opts *VerifyOptions,
+	notify func(report *VerifyReport, err error),
+) error {
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		report, err := Verify(ctx, dataset, sourcePath, targetPath, opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		notify(report, err)
+		timer.Reset(interval)
+	}
+}
+
+// WriteMetrics writes the report as metrics in the Prometheus text format,
+// such as for the textfile collector of node_exporter. Each metric is labeled
+// with the given dataset.
+func (r *VerifyReport) WriteMetrics(w io.Writer, dataset string) error {
+	drift := map[string]int{DriftMissing: 0, DriftModified: 0, DriftExtra: 0}
+	for _, d := range r.Drift {
+		drift[d.Kind]++
+	}
+
+	label := fmt.Sprintf("dataset=%q", dataset)
+	var buf bytes.Buffer
+	metric := func(name, help, labels string, value interface{}) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %v\n", name, help, name, name, labels, value)
+	}
+	metric("fileheap_verify_last_run_timestamp_seconds", "Time the last verification started.",
+		label, r.Started.Unix())
+	metric("fileheap_verify_duration_seconds", "Duration of the last verification.",
+		label, r.Duration.Seconds())
+	metric("fileheap_verify_files", "Files checked by the last verification.",
+		label, r.Files)
+	metric("fileheap_verify_bytes", "Bytes checked by the last verification.",
+		label, r.Bytes)
+	metric("fileheap_verify_read_bytes", "Bytes read by the last verification.",
+		label, r.BytesRead)
+	fmt.Fprintf(&buf, "# HELP fileheap_verify_drift_files Files which differ from the dataset.\n")
+	fmt.Fprintf(&buf, "# TYPE fileheap_verify_drift_files gauge\n")
+	for _, kind := range []string{DriftMissing, DriftModified, DriftExtra} {
+		fmt.Fprintf(&buf, "fileheap_verify_drift_files{%s,kind=%q} %d\n", label, kind, drift[kind])
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return errors.WithStack(err)
+}
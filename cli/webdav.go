@@ -0,0 +1,244 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/webdav"
+
+	"github.com/allenai/fileheap-client/client"
+)
+
+// WebDAVOptions provides optional configuration to WebDAVHandler.
+type WebDAVOptions struct {
+	// Let clients create, replace, move, and delete files. Writes to sealed
+	// datasets fail regardless. New directories are recorded with
+	// placeholders; see DirPlaceholder.
+	Writable bool
+}
+
+// WebDAVHandler serves a dataset over WebDAV, so that file explorers and other
+// GUI tools can browse it. The dataset is read-only unless the options allow
+// writes. The options may be nil.
+func WebDAVHandler(dataset client.DatasetAPI, opts *WebDAVOptions) http.Handler {
+	if opts == nil {
+		opts = &WebDAVOptions{}
+	}
+	return &webdav.Handler{
+		FileSystem: &webdavFS{dataset: dataset, writable: opts.Writable},
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// ServeWebDAV serves a dataset over WebDAV on the given address, such as
+// ":8080", until the context is done. The options may be nil.
+func ServeWebDAV(ctx context.Context, dataset client.DatasetAPI, addr string, opts *WebDAVOptions) error {
+	return serveGateway(ctx, addr, WebDAVHandler(dataset, opts))
+}
+
+// webdavFS implements webdav.FileSystem over a dataset.
+type webdavFS struct {
+	dataset  client.DatasetAPI
+	writable bool
+}
+
+func (fs *webdavFS) checkWritable(op, name string) error {
+	if !fs.writable {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return gatewayStat(ctx, fs.dataset, name)
+}
+
+func (fs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.checkWritable("mkdir", name); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(ctx, name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return fs.dataset.WriteFile(ctx, path.Join(gatewayPath(name), DirPlaceholder), nil, 0)
+}
+
+func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := fs.checkWritable("open", name); err != nil {
+			return nil, err
+		}
+		if flag&os.O_APPEND != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("appending is not supported")}
+		}
+		if gatewayPath(name) == "" {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		tmp, err := ioutil.TempFile("", "fileheap-webdav-*")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &webdavWriter{File: tmp, ctx: ctx, dataset: fs.dataset, path: gatewayPath(name)}, nil
+	}
+
+	info, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &webdavDir{ctx: ctx, dataset: fs.dataset, name: name, info: info}, nil
+	}
+	return &webdavFile{
+		gatewayFile: gatewayFile{ctx: ctx, dataset: fs.dataset, info: info.(gatewayFileInfo).info},
+	}, nil
+}
+
+func (fs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	if err := fs.checkWritable("remove", name); err != nil {
+		return err
+	}
+	p := gatewayPath(name)
+	if p == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	if err := fs.dataset.DeleteFile(ctx, p); !errors.Is(err, client.ErrFileNotFound) {
+		return err
+	}
+
+	files := fs.dataset.ListFiles(ctx, &client.FileIteratorOptions{Prefix: p + "/"})
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fs.dataset.DeleteFile(ctx, info.Path); err != nil && !errors.Is(err, client.ErrFileNotFound) {
+			return err
+		}
+	}
+}
+
+func (fs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := fs.checkWritable("rename", oldName); err != nil {
+		return err
+	}
+	return gatewayRename(ctx, fs.dataset, oldName, newName)
+}
+
+// webdavFile reads a file.
+type webdavFile struct {
+	gatewayFile
+}
+
+func (f *webdavFile) Stat() (os.FileInfo, error) { return gatewayFileInfo{f.info}, nil }
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.Path, Err: os.ErrPermission}
+}
+
+// webdavDir lists a directory.
+type webdavDir struct {
+	ctx     context.Context
+	dataset client.DatasetAPI
+	name    string
+	info    os.FileInfo
+
+	// Entries not yet returned, once listed.
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *webdavDir) Stat() (os.FileInfo, error) { return d.info, nil }
+func (d *webdavDir) Close() error               { return nil }
+
+func (d *webdavDir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *webdavDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *webdavDir) Write(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+// Readdir returns up to count entries of the directory, or all remaining
+// entries if count is not positive.
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := gatewayList(d.ctx, d.dataset, d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// webdavWriter buffers a file in a temporary file and writes it to the dataset
+// when closed, since writes must know their size in advance.
+type webdavWriter struct {
+	*os.File
+	ctx     context.Context
+	dataset client.DatasetAPI
+	path    string
+}
+
+func (w *webdavWriter) Stat() (os.FileInfo, error) {
+	info, err := w.File.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return namedFileInfo{FileInfo: info, name: path.Base(w.path)}, nil
+}
+
+func (w *webdavWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (w *webdavWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	size, err := w.File.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	return w.dataset.WriteFile(w.ctx, w.path, w.File, size)
+}
+
+// namedFileInfo describes a temporary file by the name it will be written to.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedFileInfo) Name() string { return i.name }
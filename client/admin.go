@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// GCReportOptions provides optional configuration to GCReport.
+type GCReportOptions struct {
+	// Report datasets which were never sealed and are older than this. Zero
+	// reports none.
+	UnsealedOlderThan time.Duration
+}
+
+// GCReport describes storage which could be reclaimed, such as datasets past
+// their expiry and contents no dataset references. It requires an
+// administrator's token. The options may be nil.
+func (c *Client) GCReport(ctx context.Context, opts *GCReportOptions) (*api.GCReport, error) {
+	query := url.Values{}
+	if opts != nil && opts.UnsealedOlderThan > 0 {
+		cutoff := time.Now().Add(-opts.UnsealedOlderThan)
+		query.Set("unsealedBefore", cutoff.UTC().Format(time.RFC3339))
+	}
+
+	resp, err := c.sendRequest(ctx, http.MethodGet, "/admin/gc-report", query, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var body api.GCReport
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// AppendFile appends the contents of a reader to a file, creating the file if
+// it doesn't exist, so that producers such as running jobs can push logs as
+// they are written. The reader is read to its end before anything is sent.
+//
+// Files too large for a single request are extended through the upload API:
+// their whole chunks are copied by the server rather than sent again, so an
+// append sends little more than the new data. Smaller files, and files on
+// servers which can't copy chunks, are written again in full.
+//
+// Appends are not atomic. Concurrent writers to the same file may lose each
+// other's data, so each file should have a single producer.
+func (d *DatasetRef) AppendFile(ctx context.Context, filename string, r io.Reader) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	data, size, cleanup, err := d.client.spool(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	info, err := d.FileInfo(ctx, filename)
+	if err == ErrFileNotFound {
+		return d.WriteFile(ctx, filename, data, size)
+	}
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	if info.Size+size > d.client.limits.requestSizeLimit() {
+		base, err := d.deltaBaseOf(ctx, info)
+		if err != nil {
+			return err
+		}
+		if base != nil {
+			digest, err := d.appendChunks(ctx, filename, base, data, size)
+			var unsupported *ErrNotSupportedByServer
+			if err == nil {
+				return d.addFile(ctx, filename, digest, info.Mode)
+			}
+			if !errors.As(err, &unsupported) {
+				return err
+			}
+			logrus.WithField("path", filename).Debug("Server can't copy chunks; writing the whole file")
+			if _, err := data.Seek(0, io.SeekStart); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	existing, err := d.ReadFileRange(ctx, filename, 0, info.Size)
+	if err != nil {
+		return err
+	}
+	defer existing.Close()
+	return d.WriteFileWithOptions(ctx, filename, io.MultiReader(existing, data), info.Size+size, &WriteFileOptions{
+		Mode: info.Mode,
+	})
+}
+
+// appendChunks uploads the base file followed by data, copying the base's
+// whole chunks and sending the rest. It returns the digest of the upload.
+func (d *DatasetRef) appendChunks(
+	ctx context.Context,
+	filename string,
+	base *deltaBase,
+	data io.Reader,
+	size int64,
+) ([]byte, error) {
+	length := base.size + size
+	uploadID, target, err := d.client.createUpload(ctx, length)
+	if err != nil {
+		return nil, err
+	}
+	if len(target.PartURLs) != 0 {
+		return nil, &ErrNotSupportedByServer{Feature: "delta uploads"}
+	}
+
+	// The final chunk of the base is usually partial, so it is sent again
+	// along with the data which completes it.
+	copied := base.size / base.chunkSize * base.chunkSize
+	for offset := int64(0); offset < copied; offset += base.chunkSize {
+		digest := base.digests[offset/base.chunkSize]
+		if _, err := d.client.copyChunk(ctx, uploadID, offset, base.chunkSize, digest, length, base, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	var tail []byte
+	if copied < base.size {
+		if tail, err = d.readBaseTail(ctx, filename, base, copied); err != nil {
+			return nil, err
+		}
+	}
+
+	var digest []byte
+	reader := io.MultiReader(bytes.NewReader(tail), data)
+	err = d.client.forEachChunk(ctx, reader, length-copied, base.chunkSize, func(chunk *uploadChunk) (bool, error) {
+		chunk.offset += copied
+		digest, err = d.client.sendChunk(ctx, uploadID, chunk, length)
+		return digest != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if digest == nil {
+		return nil, errors.New("service did not return digest")
+	}
+	return digest, nil
+}
+
+// readBaseTail reads the partial final chunk of the base file, which begins at
+// offset, and verifies it against the chunk's digest.
+func (d *DatasetRef) readBaseTail(
+	ctx context.Context,
+	filename string,
+	base *deltaBase,
+	offset int64,
+) ([]byte, error) {
+	r, err := d.ReadFileRange(ctx, filename, offset, base.size-offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	digest := sha256.Sum256(tail)
+	if !bytes.Equal(digest[:], base.digests[len(base.digests)-1]) {
+		return nil, errors.Errorf("%s changed while appending", filename)
+	}
+	return tail, nil
+}
+
+// spool reads a reader to its end so that its size is known and it can be read
+// again. Data up to the request size limit is held in memory, and larger data
+// in a temporary file, which cleanup removes.
+func (c *Client) spool(r io.Reader) (io.ReadSeeker, int64, func(), error) {
+	limit := c.limits.requestSizeLimit()
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, limit+1)
+	if err == io.EOF {
+		return bytes.NewReader(buf.Bytes()), n, func() {}, nil
+	}
+	if err != nil {
+		return nil, 0, nil, errors.WithStack(err)
+	}
+
+	file, err := ioutil.TempFile("", "fileheap-append-*")
+	if err != nil {
+		return nil, 0, nil, errors.WithStack(err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	if _, err := buf.WriteTo(file); err != nil {
+		cleanup()
+		return nil, 0, nil, errors.WithStack(err)
+	}
+	m, err := io.Copy(file, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, errors.WithStack(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, nil, errors.WithStack(err)
+	}
+	return file, n + m, cleanup, nil
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// AddFilesBatch adds many files whose contents the server already holds, as
+// AddFile does for one, registering up to a batch of paths and digests in each
+// request. This makes importing manifests and copying datasets fast even for
+// millions of files. Servers which can't add files in batches are sent one
+// request per file.
+//
+// The result reports the outcome of each entry, in order. The returned error
+// is non-nil if any entry failed, and matches the result's Err.
+func (d *DatasetRef) AddFilesBatch(ctx context.Context, entries []api.FileEntry) (*BatchResult, error) {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.Path
+	}
+	result := newBatchResult(paths)
+	if len(entries) == 0 {
+		return result, nil
+	}
+	if err := d.checkWritable(); err != nil {
+		result.setAll(err)
+		return result, err
+	}
+
+	for start := 0; start < len(entries); {
+		// The limit may shrink as batches are sent, so it is checked for each.
+		end := start + d.client.limits.batchSizeLimit()
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := &BatchResult{Files: result.Files[start:end]}
+		d.addBatch(ctx, entries[start:end], batch)
+		start = end
+	}
+	return result, result.Err()
+}
+
+// addBatch adds a single batch of files, recording the outcome of each in the
+// result.
+func (d *DatasetRef) addBatch(ctx context.Context, entries []api.FileEntry, result *BatchResult) {
+	if len(entries) == 1 || !d.client.supports(ctx).BatchAdd {
+		d.addEach(ctx, entries, result)
+		return
+	}
+
+	err := d.sendAddBatch(ctx, entries, result)
+	var unsupported *ErrNotSupportedByServer
+	if errors.As(err, &unsupported) {
+		d.client.capabilities.disable(batchAdds)
+		d.addEach(ctx, entries, result)
+	} else if err != nil {
+		result.setAll(err)
+	}
+}
+
+// addEach adds every file one request at a time, recording the outcome of each
+// in the result.
+func (d *DatasetRef) addEach(ctx context.Context, entries []api.FileEntry, result *BatchResult) {
+	for i, entry := range entries {
+		result.Files[i].Err = d.addFile(ctx, entry.Path, entry.Digest, entry.Mode)
+	}
+}
+
+// sendAddBatch sends a batch request, recording per-file failures in the
+// result. It returns an error if the request as a whole failed.
+func (d *DatasetRef) sendAddBatch(ctx context.Context, entries []api.FileEntry, result *BatchResult) error {
+	buffer := d.client.getBuffer()
+	defer d.client.putBuffer(buffer)
+	mw := multipart.NewWriter(buffer)
+	for _, entry := range entries {
+		header := textproto.MIMEHeader{
+			api.HeaderPath:   {entry.Path},
+			api.HeaderDigest: {api.EncodeDigest(entry.Digest)},
+		}
+		if entry.Mode != 0 {
+			header.Set(api.HeaderFileMode, api.EncodeFileMode(entry.Mode))
+		}
+		if _, err := mw.CreatePart(header); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer d.client.cache.invalidate(d.id)
+
+	url := path.Join("datasets", d.id, "batch/add")
+	req, err := d.client.newRequest(http.MethodPost, url, nil, buffer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	resp, err := d.client.do(ctx, req)
+	d.client.limits.observeBatch(ctx, statusCode(resp), err)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if err := errorFromResponse(resp); err != nil {
+		return err
+	}
+
+	results, err := parseBatchResults(resp)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		index[entry.Path] = i
+	}
+	for _, file := range results.Results {
+		if file.Code < 400 {
+			continue
+		}
+		i, ok := index[file.Path]
+		if !ok {
+			return errors.Errorf("unexpected result for %s", file.Path)
+		}
+		result.Files[i].Err = batchFileError(file, "add")
+	}
+	return nil
+}
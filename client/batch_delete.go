@@ -27,7 +27,10 @@ func (b *DeleteBatch) Length() int {
 
 // HasCapacity checks whether the batch has capacity for another file.
 func (b *DeleteBatch) HasCapacity() bool {
-	return len(b.paths) < batchSizeLimit
+	if len(b.paths) > 0 && b.dataset.client.capabilities.lacks(batchDeletes) {
+		return false
+	}
+	return len(b.paths) < b.dataset.client.limits.batchSizeLimit()
 }
 
 // AddFile adds a file to the batch.
@@ -41,16 +44,51 @@ func (b *DeleteBatch) AddFile(path string) error {
 }
 
 // Delete all paths in the batch.
-func (b *DeleteBatch) Delete(ctx context.Context) error {
+//
+// The result reports the outcome of each file. The returned error is non-nil
+// if any file failed, and matches the result's Err.
+func (b *DeleteBatch) Delete(ctx context.Context) (*BatchResult, error) {
+	result := newBatchResult(b.paths)
 	if len(b.paths) == 0 {
-		return nil
+		return result, nil
 	}
 	if len(b.paths) == 1 {
-		return b.dataset.DeleteFile(ctx, b.paths[0])
+		result.setAll(b.dataset.DeleteFile(ctx, b.paths[0]))
+		return result, result.Err()
+	}
+	if !b.dataset.client.supports(ctx).BatchDelete {
+		b.deleteEach(ctx, result)
+		return result, result.Err()
+	}
+
+	if err := b.dataset.checkWritable(); err != nil {
+		result.setAll(err)
+		return result, err
+	}
+	err := b.delete(ctx, result)
+	var unsupported *ErrNotSupportedByServer
+	if errors.As(err, &unsupported) {
+		b.dataset.client.capabilities.disable(batchDeletes)
+		b.deleteEach(ctx, result)
+	} else if err != nil {
+		result.setAll(err)
 	}
+	return result, result.Err()
+}
 
-	buffer := getBuffer()
-	defer putBuffer(buffer)
+// deleteEach deletes every path one request at a time, recording the outcome
+// of each in the result.
+func (b *DeleteBatch) deleteEach(ctx context.Context, result *BatchResult) {
+	for i, path := range b.paths {
+		result.Files[i].Err = b.dataset.DeleteFile(ctx, path)
+	}
+}
+
+// delete sends a batch request, recording per-file failures in the result.
+// It returns an error if the request as a whole failed.
+func (b *DeleteBatch) delete(ctx context.Context, result *BatchResult) error {
+	buffer := b.dataset.client.getBuffer()
+	defer b.dataset.client.putBuffer(buffer)
 	mw := multipart.NewWriter(buffer)
 	for _, path := range b.paths {
 		if _, err := mw.CreatePart(textproto.MIMEHeader{
@@ -63,6 +101,8 @@ func (b *DeleteBatch) Delete(ctx context.Context) error {
 		return errors.WithStack(err)
 	}
 
+	defer b.dataset.client.cache.invalidate(b.dataset.id)
+
 	url := path.Join("datasets", b.dataset.id, "batch/delete")
 	req, err := b.dataset.client.newRequest(http.MethodPost, url, nil, buffer)
 	if err != nil {
@@ -71,9 +111,32 @@ func (b *DeleteBatch) Delete(ctx context.Context) error {
 	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
 
 	resp, err := b.dataset.client.do(ctx, req)
+	b.dataset.client.limits.observeBatch(ctx, statusCode(resp), err)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	defer resp.Body.Close()
-	return errorFromResponse(resp)
+	if err := errorFromResponse(resp); err != nil {
+		return err
+	}
+
+	results, err := parseBatchResults(resp)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(b.paths))
+	for i, path := range b.paths {
+		index[path] = i
+	}
+	for _, file := range results.Results {
+		if file.Code < 400 {
+			continue
+		}
+		i, ok := index[file.Path]
+		if !ok {
+			return errors.Errorf("unexpected result for %s", file.Path)
+		}
+		result.Files[i].Err = batchFileError(file, "delete")
+	}
+	return nil
 }
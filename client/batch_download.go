@@ -1,13 +1,16 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"path"
+	"sort"
 
 	"github.com/pkg/errors"
 
@@ -16,34 +19,50 @@ import (
 
 // BatchDownloader is an iterator over file batches.
 type BatchDownloader struct {
-	// Initial state.
-	ctx     context.Context
-	dataset *DatasetRef
-	files   Iterator
+	// Initial state. The context is only used by Next.
+	ctx           context.Context
+	dataset       *DatasetRef
+	files         Iterator
+	preserveOrder bool
+	readAhead     int64
 
 	nextInfo *api.FileInfo
 }
 
-// Next gets the next batch of files.
-// If the iterator is expended it will return the sentinel error Done.
+// Next gets the next batch of files using the context passed to
+// DownloadBatch. If the iterator is expended it will return the sentinel error
+// Done.
 func (d *BatchDownloader) Next() (*FileBatch, error) {
+	return d.NextContext(d.ctx)
+}
+
+// NextContext is like Next, but lists files with ctx. The batch is bound to
+// ctx, which governs its download until every file is read: cancelling ctx
+// fails the batch and the readers it returned.
+func (d *BatchDownloader) NextContext(ctx context.Context) (*FileBatch, error) {
 	var info *api.FileInfo
 	if d.nextInfo != nil {
 		info = d.nextInfo
 		d.nextInfo = nil
 	} else {
 		var err error
-		info, err = d.files.Next()
+		info, err = nextFile(ctx, d.files)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	batch := []*api.FileInfo{info}
-	batchSize := info.Size
+	batchSize := requestSize(info)
+	batchSizeLimit := d.dataset.client.limits.batchSizeLimit()
+	if !d.dataset.client.supports(ctx).BatchDownload {
+		// Each file is read in a request of its own.
+		batchSizeLimit = 1
+	}
+	requestSizeLimit := d.dataset.client.limits.batchBytesLimit()
 
 	for {
-		info, err := d.files.Next()
+		info, err := nextFile(ctx, d.files)
 		if err == ErrDone {
 			break
 		}
@@ -52,35 +71,83 @@ func (d *BatchDownloader) Next() (*FileBatch, error) {
 		}
 
 		// Adding next file would make the batch too large; defer processing of next file.
-		if len(batch) >= batchSizeLimit || batchSize+info.Size > requestSizeLimit {
+		if len(batch) >= batchSizeLimit || batchSize+requestSize(info) > requestSizeLimit {
 			d.nextInfo = info
 			break
 		}
 
 		batch = append(batch, info)
-		batchSize += info.Size
+		batchSize += requestSize(info)
+	}
+
+	if !d.preserveOrder {
+		groupByDirectory(batch)
+	}
+
+	var size int64
+	var remote int
+	for _, info := range batch {
+		size += info.Size
+		if !local(info) {
+			remote++
+		}
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	return &FileBatch{
-		ctx:     d.ctx,
-		dataset: d.dataset,
-		infos:   batch,
-		size:    batchSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		dataset:   d.dataset,
+		infos:     batch,
+		size:      size,
+		remote:    remote,
+		readAhead: d.readAhead,
 	}, nil
 }
 
+// groupByDirectory orders files so that those in the same directory are
+// adjacent, keeping their relative order otherwise. Manifest order interleaves
+// a directory's files with the contents of its subdirectories.
+func groupByDirectory(infos []*api.FileInfo) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		return path.Dir(infos[i].Path) < path.Dir(infos[j].Path)
+	})
+}
+
+// requestSize returns the number of bytes a file adds to a batch request.
+// Inlined and empty files are not requested.
+func requestSize(info *api.FileInfo) int64 {
+	if local(info) {
+		return 0
+	}
+	return info.Size
+}
+
+// local returns true if a file's contents are known without requesting them,
+// because they are inlined in the manifest or empty.
+func local(info *api.FileInfo) bool {
+	return info.Data != nil || info.Size == 0
+}
+
 // FileBatch is a batch of files with readers.
 type FileBatch struct {
-	// Initial state.
+	// Initial state. The context governs the batch's download; cancel aborts
+	// it, such as when the context of a call to NextContext is done.
 	ctx     context.Context
+	cancel  context.CancelFunc
 	dataset *DatasetRef
 	infos   []*api.FileInfo
 	size    int64
+	remote  int // Number of files which are neither inlined nor empty.
+
+	// Number of bytes to read ahead of the caller. Zero disables read-ahead.
+	readAhead int64
 
 	err  error
 	read int // Number of files read.
 	resp *http.Response
 	mr   *multipart.Reader
+	ra   *readAhead
 }
 
 // Length gets the number of files in a batch.
@@ -88,6 +155,12 @@ func (b *FileBatch) Length() int {
 	return len(b.infos)
 }
 
+// Files returns information about every file in the batch, in the order
+// they are returned by Next.
+func (b *FileBatch) Files() []*api.FileInfo {
+	return b.infos
+}
+
 // Size of the batch in bytes.
 func (b *FileBatch) Size() int64 {
 	return b.size
@@ -97,13 +170,43 @@ func (b *FileBatch) Size() int64 {
 // If the iterator is expended it will return the sentinel error Done.
 // The batch is closed if Next returns an error. Future calls will return the same error.
 func (b *FileBatch) Next() (*api.FileInfo, io.ReadCloser, error) {
+	return b.NextContext(b.ctx)
+}
+
+// NextContext is like Next, but also aborts the batch if ctx is done before
+// the call returns. The returned reader is bound to the batch's context rather
+// than ctx, since it is read after the call.
+func (b *FileBatch) NextContext(ctx context.Context) (*api.FileInfo, io.ReadCloser, error) {
 	if b.err != nil {
 		return nil, nil, b.err
 	}
+	if err := ctx.Err(); err != nil {
+		b.err = err
+		b.cancel()
+		return nil, nil, err
+	}
+	if ctx != b.ctx && ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.cancel()
+			case <-done:
+			}
+		}()
+	}
 
 	info, reader, err := b.next()
+	if err != nil && err != ErrDone && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		b.err = err
+		defer b.cancel()
+		if b.ra != nil {
+			b.ra.stop()
+		}
 		if b.resp != nil {
 			b.resp.Body.Close()
 		}
@@ -120,19 +223,23 @@ func (b *FileBatch) next() (*api.FileInfo, io.ReadCloser, error) {
 		return nil, nil, ErrDone
 	}
 
-	if len(b.infos) == 1 {
-		reader, err := b.dataset.ReadFile(b.ctx, b.infos[0].Path)
-		if err != nil {
-			return nil, nil, err
-		}
-		return b.infos[0], reader, nil
+	info := b.infos[b.read]
+	if local(info) {
+		return info, ioutil.NopCloser(bytes.NewReader(info.Data)), nil
+	}
+
+	if b.remote == 1 || !b.dataset.client.supports(b.ctx).BatchDownload {
+		return b.readFile(info)
 	}
 
 	if b.mr == nil {
-		buf := getBuffer()
-		defer putBuffer(buf)
+		buf := b.dataset.client.getBuffer()
+		defer b.dataset.client.putBuffer(buf)
 		mw := multipart.NewWriter(buf)
 		for _, info := range b.infos {
+			if local(info) {
+				continue
+			}
 			if _, err := mw.CreatePart(textproto.MIMEHeader{
 				api.HeaderDigest: {api.EncodeDigest(info.Digest)},
 			}); err != nil {
@@ -150,12 +257,22 @@ func (b *FileBatch) next() (*api.FileInfo, io.ReadCloser, error) {
 		}
 		req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
 
-		b.resp, err = b.dataset.client.do(b.ctx, req)
+		b.resp, err = b.dataset.client.doStreaming(b.ctx, req)
+		b.dataset.client.limits.observeBatch(b.ctx, statusCode(b.resp), err)
 		if err != nil {
 			return nil, nil, errors.WithStack(err)
 		}
 		if err := errorFromResponse(b.resp); err != nil {
-			return nil, nil, err
+			var unsupported *ErrNotSupportedByServer
+			if !errors.As(err, &unsupported) {
+				return nil, nil, err
+			}
+
+			// Read this and the remaining files one at a time.
+			b.resp.Body.Close()
+			b.resp = nil
+			b.dataset.client.capabilities.disable(batchDownloads)
+			return b.readFile(info)
 		}
 
 		mediaType, params, err := mime.ParseMediaType(b.resp.Header.Get("Content-Type"))
@@ -166,13 +283,41 @@ func (b *FileBatch) next() (*api.FileInfo, io.ReadCloser, error) {
 			return nil, nil, errors.New("unexpected media type")
 		}
 		b.mr = multipart.NewReader(b.resp.Body, params["boundary"])
+		if b.readAhead > 0 {
+			b.ra = startReadAhead(b.ctx, b.mr, b.remote, b.readAhead, b.batchError)
+		}
+	}
+
+	if b.ra != nil {
+		part, err := b.ra.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		return info, part, nil
 	}
 
 	part, err := b.mr.NextPart()
 	if err != nil {
-		return nil, nil, errors.Errorf("batch error: %s", b.resp.Trailer.Get(api.HeaderBatchError))
+		// Without a trailer, the response was cut short, such as by a timeout.
+		if err != io.EOF && b.resp.Trailer.Get(api.HeaderBatchError) == "" {
+			return nil, nil, errors.Wrap(err, "batch error")
+		}
+		return nil, nil, b.batchError()
 	}
-
-	info := b.infos[b.read]
 	return info, part, nil
 }
+
+// readFile reads a file in a request of its own.
+func (b *FileBatch) readFile(info *api.FileInfo) (*api.FileInfo, io.ReadCloser, error) {
+	reader, err := b.dataset.ReadFile(b.ctx, info.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, reader, nil
+}
+
+// batchError describes a batch response which ended before all files were read.
+// The trailer is only available once the body has been read to the end.
+func (b *FileBatch) batchError() error {
+	return errors.Errorf("batch error: %s", b.resp.Trailer.Get(api.HeaderBatchError))
+}
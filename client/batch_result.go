@@ -0,0 +1,94 @@
+package client
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// BatchResult reports the outcome of each file in a batch operation, so that
+// callers can retry just the files which failed.
+type BatchResult struct {
+	// Files in the order they were added to the batch.
+	Files []BatchFileResult
+}
+
+// BatchFileResult is the outcome of a single file in a batch operation.
+type BatchFileResult struct {
+	Path string
+
+	// Reason the file failed, or nil if it succeeded. Errors reported by the
+	// server for individual files have an api.Error cause with the file's status.
+	Err error
+}
+
+func newBatchResult(paths []string) *BatchResult {
+	result := &BatchResult{Files: make([]BatchFileResult, len(paths))}
+	for i, path := range paths {
+		result.Files[i].Path = path
+	}
+	return result
+}
+
+// setAll records the same outcome for every file.
+func (r *BatchResult) setAll(err error) {
+	for i := range r.Files {
+		r.Files[i].Err = err
+	}
+}
+
+// Failed returns the paths of all files which failed.
+func (r *BatchResult) Failed() []string {
+	var failed []string
+	for _, file := range r.Files {
+		if file.Err != nil {
+			failed = append(failed, file.Path)
+		}
+	}
+	return failed
+}
+
+// Err returns the first file's error, noting how many files failed in total,
+// or nil if all files succeeded.
+func (r *BatchResult) Err() error {
+	var first error
+	var count int
+	for _, file := range r.Files {
+		if file.Err != nil {
+			if first == nil {
+				first = file.Err
+			}
+			count++
+		}
+	}
+	if count > 1 {
+		return errors.Wrapf(first, "%d of %d files failed", count, len(r.Files))
+	}
+	return first
+}
+
+// parseBatchResults reads per-file results from a successful batch response.
+// Older servers respond without a body, in which case every file succeeded.
+func parseBatchResults(resp *http.Response) (*api.BatchResults, error) {
+	var results api.BatchResults
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := parseResponse(resp, &results); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return &results, nil
+}
+
+// batchFileError converts a failed file result into an error.
+func batchFileError(result api.BatchFileResult, action string) error {
+	apiErr := api.Error{Code: result.Code, Message: result.Message}
+	err := newAPIError(apiErr)
+	if result.Code == http.StatusNotFound {
+		// The dataset exists, so the file must be what is missing.
+		err = &typedError{err: apiErr, sentinel: ErrFileNotFound}
+	}
+	return errors.Wrapf(err, "failed to %s %s", action, result.Path)
+}
@@ -6,11 +6,14 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"os"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/async"
 )
 
 // UploadBatch contains files and their readers.
@@ -21,7 +24,11 @@ type UploadBatch struct {
 	paths   []string
 	readers []io.Reader
 	sizes   []int64
+	modes   []os.FileMode
 	size    int64
+
+	// Position of each reader when it was added, or -1 if it can't seek.
+	offsets []int64
 }
 
 // Length gets the number of files in a batch.
@@ -40,11 +47,28 @@ func (b *UploadBatch) HasCapacity(size int64) bool {
 		return true
 	}
 
-	return len(b.paths) < batchSizeLimit && b.size+size <= requestSizeLimit
+	// Without batch uploads, each file is sent in a request of its own.
+	if b.dataset.client.capabilities.lacks(batchUploads) {
+		return false
+	}
+
+	limits := b.dataset.client.limits
+	return len(b.paths) < limits.batchSizeLimit() && b.size+size <= limits.batchBytesLimit()
 }
 
-// AddFile adds a file to the batch.
+// AddFile adds a file to the batch. The reader of an empty file may be nil.
 func (b *UploadBatch) AddFile(path string, reader io.Reader, size int64) error {
+	return b.AddFileWithMode(path, reader, size, 0)
+}
+
+// AddFileWithMode adds a file to the batch and records its permission bits.
+// A zero mode records nothing.
+func (b *UploadBatch) AddFileWithMode(
+	path string,
+	reader io.Reader,
+	size int64,
+	mode os.FileMode,
+) error {
 	if !b.HasCapacity(size) {
 		return errors.New("batch does not have capacity for another file")
 	}
@@ -52,14 +76,45 @@ func (b *UploadBatch) AddFile(path string, reader io.Reader, size int64) error {
 	b.paths = append(b.paths, path)
 	b.readers = append(b.readers, reader)
 	b.sizes = append(b.sizes, size)
+	b.modes = append(b.modes, mode)
 	b.size += size
+
+	offset := int64(-1)
+	if seeker, ok := reader.(io.Seeker); ok {
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			offset = pos
+		}
+	}
+	b.offsets = append(b.offsets, offset)
 	return nil
 }
 
+// Maximum number of attempts to upload a batch.
+const batchUploadAttempts = 3
+
 // Upload the files in a batch. Closes all readers.
-func (b *UploadBatch) Upload(ctx context.Context) error {
+//
+// The result reports the outcome of each file. The returned error is non-nil
+// if any file failed, and matches the result's Err.
+//
+// Each request carries an idempotency key so the server can recognize
+// retries. If the server reports that some files failed with a transient
+// error, only those files are sent again, provided their readers can seek.
+//
+// Servers without batch uploads are sent each file in a request of its own,
+// one at a time. See UploadWithLimiter.
+func (b *UploadBatch) Upload(ctx context.Context) (*BatchResult, error) {
+	return b.UploadWithLimiter(ctx, nil)
+}
+
+// UploadWithLimiter is like Upload, but servers without batch uploads are sent
+// the files concurrently, under the limiter the caller runs batches with. The
+// calling goroutine sends files itself while the limiter is full, so it may
+// hold one of the limiter's slots. The limiter may be nil.
+func (b *UploadBatch) UploadWithLimiter(ctx context.Context, limiter *async.Limiter) (*BatchResult, error) {
+	result := newBatchResult(b.paths)
 	if len(b.paths) == 0 {
-		return nil
+		return result, nil
 	}
 
 	defer func() {
@@ -71,41 +126,258 @@ func (b *UploadBatch) Upload(ctx context.Context) error {
 	}()
 
 	if len(b.paths) == 1 {
-		return b.dataset.WriteFile(ctx, b.paths[0], b.readers[0], b.sizes[0])
+		result.setAll(b.dataset.WriteFileWithOptions(ctx, b.paths[0], b.readers[0], b.sizes[0], &WriteFileOptions{
+			Mode: b.modes[0],
+		}))
+		return result, result.Err()
+	}
+	pending := make([]int, len(b.paths))
+	for i := range pending {
+		pending[i] = i
+	}
+	if !b.dataset.client.supports(ctx).BatchUpload {
+		b.uploadEach(ctx, result, pending, limiter)
+		return result, result.Err()
 	}
 
-	buffer := getBuffer()
-	defer putBuffer(buffer)
-	mw := multipart.NewWriter(buffer)
-	for i, path := range b.paths {
-		pw, err := mw.CreatePart(textproto.MIMEHeader{
-			api.HeaderPath: {path},
-		})
-		if err != nil {
-			return errors.WithStack(err)
+	if err := b.dataset.checkWritable(); err != nil {
+		result.setAll(err)
+		return result, err
+	}
+	defer b.dataset.client.cache.invalidate(b.dataset.id)
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		result.setAll(err)
+		return result, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		errs, retryable := b.upload(ctx, key, pending)
+		var failed []int
+		for _, i := range pending {
+			result.Files[i].Err = errs[i]
+			if errs[i] != nil {
+				failed = append(failed, i)
+			}
 		}
-		if _, err := io.CopyN(pw, b.readers[i], b.sizes[i]); err != nil {
-			if err == io.EOF {
-				return errors.Errorf("%s truncated while uploading", b.paths[i])
+		if len(failed) == 0 {
+			return result, nil
+		}
+
+		// A server without batch uploads, or a proxy in front of it, rejects
+		// the request before storing anything. Send each file on its own.
+		var unsupported *ErrNotSupportedByServer
+		if attempt == 1 && len(failed) == len(pending) && errors.As(errs[failed[0]], &unsupported) {
+			b.dataset.client.capabilities.disable(batchUploads)
+			if b.rewind(failed) {
+				b.uploadEach(ctx, result, failed, limiter)
+			}
+			return result, result.Err()
+		}
+		if !retryable || attempt == batchUploadAttempts || !b.rewind(failed) {
+			return result, result.Err()
+		}
+		if err := sleep(ctx, time.Duration(attempt)*time.Second); err != nil {
+			return result, result.Err()
+		}
+
+		// Retrying a subset of files is a new request.
+		if len(failed) != len(pending) {
+			if key, err = newIdempotencyKey(); err != nil {
+				return result, result.Err()
 			}
-			return errors.WithStack(err)
 		}
+		pending = failed
 	}
-	if err := mw.Close(); err != nil {
-		return errors.WithStack(err)
+}
+
+// upload sends the files at the given indices in a single request. It returns
+// an error for each file which failed, keyed by index, and whether all of the
+// failures may succeed if sent again.
+func (b *UploadBatch) upload(ctx context.Context, key string, indices []int) (map[int]error, bool) {
+	fail := func(err error, retryable bool) (map[int]error, bool) {
+		errs := make(map[int]error, len(indices))
+		for _, i := range indices {
+			errs[i] = err
+		}
+		return errs, retryable
 	}
 
+	// Stream parts directly into the request body so that memory use does not
+	// grow with the size of the batch.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	length, err := b.bodyLength(mw.Boundary(), indices)
+	if err != nil {
+		return fail(err, false)
+	}
+
+	var writeErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeErr = b.writeParts(mw, indices)
+		pw.CloseWithError(writeErr)
+	}()
+	defer func() {
+		// Unblock the writer if the request ended early, and wait for it to
+		// finish before the readers are closed or rewound.
+		pr.Close()
+		<-done
+	}()
+
 	url := path.Join("datasets", b.dataset.id, "batch/upload")
-	req, err := b.dataset.client.newRequest(http.MethodPost, url, nil, buffer)
+	req, err := b.dataset.client.newRequest(http.MethodPost, url, nil, pr)
 	if err != nil {
-		return errors.WithStack(err)
+		return fail(errors.WithStack(err), false)
 	}
+	req.ContentLength = length
 	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	req.Header.Set(api.HeaderIdempotencyKey, key)
 
 	resp, err := b.dataset.client.do(ctx, req)
+	b.dataset.client.limits.observeBatch(ctx, statusCode(resp), err)
 	if err != nil {
-		return errors.WithStack(err)
+		pr.CloseWithError(err)
+		<-done
+		if writeErr != nil {
+			// Report why the body could not be written, such as a truncated file.
+			return fail(writeErr, false)
+		}
+		if ctx.Err() != nil {
+			return fail(ctx.Err(), false)
+		}
+		return fail(errors.WithStack(err), true)
 	}
 	defer resp.Body.Close()
-	return errorFromResponse(resp)
+	if err := errorFromResponse(resp); err != nil {
+		return fail(err, isRetryable(resp.StatusCode))
+	}
+
+	results, err := parseBatchResults(resp)
+	if err != nil {
+		return fail(err, false)
+	}
+
+	sent := make(map[string]int, len(indices))
+	for _, i := range indices {
+		sent[b.paths[i]] = i
+	}
+
+	errs := map[int]error{}
+	retryable := true
+	for _, result := range results.Results {
+		if result.Code < 400 {
+			continue
+		}
+		i, ok := sent[result.Path]
+		if !ok {
+			return fail(errors.Errorf("unexpected result for %s", result.Path), false)
+		}
+		errs[i] = batchFileError(result, "upload")
+		retryable = retryable && isRetryable(result.Code)
+	}
+	return errs, retryable
+}
+
+// uploadEach writes the files at the given indices in a request each,
+// recording the outcome of each in the result. Requests run under the limiter
+// while it has capacity, and otherwise in the calling goroutine.
+func (b *UploadBatch) uploadEach(ctx context.Context, result *BatchResult, indices []int, limiter *async.Limiter) {
+	if limiter != nil {
+		limiter = limiter.Share()
+		defer limiter.Wait()
+	}
+	for _, i := range indices {
+		i := i
+		write := func() {
+			result.Files[i].Err = b.dataset.WriteFileWithOptions(ctx, b.paths[i], b.readers[i], b.sizes[i], &WriteFileOptions{
+				Mode: b.modes[i],
+			})
+		}
+		if limiter == nil || !limiter.TryGo(write) {
+			write()
+		}
+	}
+}
+
+// rewind prepares the files at the given indices to be sent again.
+// It returns false if any file can't be rewound.
+func (b *UploadBatch) rewind(indices []int) bool {
+	if len(indices) == 0 {
+		return false
+	}
+	for _, i := range indices {
+		if b.sizes[i] == 0 {
+			// Nothing was read from empty files.
+			continue
+		}
+		if b.offsets[i] < 0 {
+			return false
+		}
+		if _, err := b.readers[i].(io.Seeker).Seek(b.offsets[i], io.SeekStart); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// partHeader returns the multipart header for the file at index i.
+func (b *UploadBatch) partHeader(i int) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{api.HeaderPath: {b.paths[i]}}
+	if mode := b.modes[i]; mode != 0 {
+		header.Set(api.HeaderFileMode, api.EncodeFileMode(mode))
+	}
+	return header
+}
+
+// writeParts writes the files at the given indices as parts of a multipart body.
+func (b *UploadBatch) writeParts(mw *multipart.Writer, indices []int) error {
+	for _, i := range indices {
+		pw, err := mw.CreatePart(b.partHeader(i))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if b.sizes[i] == 0 {
+			continue
+		}
+		if _, err := io.CopyN(pw, b.readers[i], b.sizes[i]); err != nil {
+			if err == io.EOF {
+				return errors.Errorf("%s truncated while uploading", b.paths[i])
+			}
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(mw.Close())
+}
+
+// bodyLength computes the exact size of the multipart body written by
+// writeParts with the given boundary.
+func (b *UploadBatch) bodyLength(boundary string, indices []int) (int64, error) {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for _, i := range indices {
+		if _, err := mw.CreatePart(b.partHeader(i)); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		cw.n += b.sizes[i]
+	}
+	if err := mw.Close(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return cw.n, nil
+}
+
+// countingWriter discards all data written to it, counting its length.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// ReadBlob reads stored contents by their SHA256 digest, regardless of which
+// datasets hold them, such as for a build cache keyed by digest. The contents
+// are verified as they are read: the final Read fails if they don't match.
+//
+// If the server has no contents with the digest, this returns ErrBlobNotFound.
+//
+// The caller must call Close on the returned reader when finished reading.
+func (c *Client) ReadBlob(ctx context.Context, digest []byte) (io.ReadCloser, error) {
+	if len(digest) != sha256.Size {
+		return nil, errors.New("digest must be exactly 32 bytes")
+	}
+	resp, err := c.blobRequest(ctx, http.MethodGet, digest)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{body: resp.Body, hash: sha256.New(), digest: digest}, nil
+}
+
+// HasBlob returns true if the server stores contents with the given SHA256
+// digest, which may then be read with ReadBlob or added to a dataset without
+// uploading them with DatasetRef.AddFile.
+func (c *Client) HasBlob(ctx context.Context, digest []byte) (bool, error) {
+	if len(digest) != sha256.Size {
+		return false, errors.New("digest must be exactly 32 bytes")
+	}
+	resp, err := c.blobRequest(ctx, http.MethodHead, digest)
+	if err == ErrBlobNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// blobRequest requests the contents with a digest. Blobs are named by the hex
+// encoding of their digest.
+func (c *Client) blobRequest(ctx context.Context, method string, digest []byte) (*http.Response, error) {
+	resp, err := c.sendRequest(ctx, method, path.Join("/blobs", hex.EncodeToString(digest)), nil, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// Responses to HEAD have no body to tell a missing blob from a server
+	// which doesn't serve blobs.
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodHead {
+		return nil, ErrBlobNotFound
+	}
+	err = errorFromResponse(resp)
+	var unsupported *ErrNotSupportedByServer
+	if resp.StatusCode == http.StatusNotFound && !errors.As(err, &unsupported) {
+		return nil, ErrBlobNotFound
+	}
+	return nil, err
+}
+
+// blobReader verifies contents against their digest as they are read.
+type blobReader struct {
+	body   io.ReadCloser
+	hash   hash.Hash
+	digest []byte
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.digest) {
+		return n, errors.Errorf("blob %x has incorrect digest", r.digest)
+	}
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	return r.body.Close()
+}
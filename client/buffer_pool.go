@@ -5,22 +5,37 @@ import (
 	"sync"
 )
 
-// Global pool of dynamically sized buffers.
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
+// bufferPool is a pool of dynamically sized buffers. Each client has its own
+// pool so that clients tuned for different workloads don't share buffers.
+type bufferPool struct {
+	pool sync.Pool
+
+	// Buffers which have grown beyond this capacity are discarded rather than
+	// pooled, so that one large request doesn't pin memory indefinitely.
+	// Zero means no limit.
+	maxSize int
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}}
 }
 
-// Get a buffer from the global pool. The buffer must be returned to the pool
+// Get a buffer from the client's pool. The buffer must be returned to the pool
 // with putBuffer when it is no longer needed.
-func getBuffer() *bytes.Buffer {
-	return bufferPool.Get().(*bytes.Buffer)
+func (c *Client) getBuffer() *bytes.Buffer {
+	return c.buffers.pool.Get().(*bytes.Buffer)
 }
 
-// Return a buffer to the global pool. The caller may not use the buffer
+// Return a buffer to the client's pool. The caller may not use the buffer
 // once it has been returned to the pool.
-func putBuffer(buf *bytes.Buffer) {
+func (c *Client) putBuffer(buf *bytes.Buffer) {
+	if c.buffers.maxSize > 0 && buf.Cap() > c.buffers.maxSize {
+		return
+	}
 	buf.Reset()
-	bufferPool.Put(buf)
+	c.buffers.pool.Put(buf)
 }
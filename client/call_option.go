@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// CallOption overrides the client's behavior for a single operation. Options
+// passed to a call are applied after the client's defaults from
+// WithCallDefaults, so they take precedence.
+type CallOption interface {
+	applyCall(o *callOptions)
+}
+
+type callOptions struct {
+	// Time limit for the whole operation, including reading the response.
+	// Zero means no limit beyond the caller's context.
+	timeout time.Duration
+
+	// Whether to verify file contents against their digests while reading.
+	verify bool
+
+	// Maximum number of times to resume an interrupted read. Negative means
+	// there is no limit as long as each attempt makes progress.
+	retries int
+}
+
+// WithCallDefaults returns an Option which applies the given call options to
+// every operation that accepts them, unless overridden by the call itself.
+func WithCallDefaults(opts ...CallOption) Option {
+	return withCallDefaults(opts)
+}
+
+type withCallDefaults []CallOption
+
+func (o withCallDefaults) Apply(c *Client) {
+	c.callDefaults = append(c.callDefaults, o...)
+}
+
+// callOptions resolves the options for a call over the client's defaults.
+func (c *Client) callOptions(opts []CallOption) *callOptions {
+	o := &callOptions{retries: -1}
+	for _, opt := range c.callDefaults {
+		opt.applyCall(o)
+	}
+	for _, opt := range opts {
+		opt.applyCall(o)
+	}
+	return o
+}
+
+// context derives the context for a call. The cancel function must be called
+// once the call and any response it returns are finished.
+func (o *callOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// WithTimeout returns a CallOption which limits the duration of an operation.
+// For reads, the limit covers reading the returned body until it is closed.
+// A zero duration removes any default limit.
+func WithTimeout(d time.Duration) CallOption {
+	return withTimeout(d)
+}
+
+type withTimeout time.Duration
+
+func (o withTimeout) applyCall(opts *callOptions) {
+	opts.timeout = time.Duration(o)
+}
+
+// WithVerify returns a CallOption which verifies file contents as they are
+// read. Whole files are checked against their digest, and the reader returns
+// an error at the end of the file if they do not match. Partial reads are
+// checked chunk by chunk, as with OpenVerified.
+func WithVerify() CallOption {
+	return withVerify(true)
+}
+
+// WithoutVerify returns a CallOption which disables verification enabled by
+// the client's defaults.
+func WithoutVerify() CallOption {
+	return withVerify(false)
+}
+
+type withVerify bool
+
+func (o withVerify) applyCall(opts *callOptions) {
+	opts.verify = bool(o)
+}
+
+// WithRetries returns a CallOption which limits the number of times a read is
+// resumed after the connection fails. By default, reads are resumed as long as
+// each attempt makes progress. Zero disables resuming.
+func WithRetries(n int) CallOption {
+	return withRetries(n)
+}
+
+type withRetries int
+
+func (o withRetries) applyCall(opts *callOptions) {
+	opts.retries = int(o)
+}
+
+// cancelOnClose releases a call's context when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// legacyCapabilities describes servers which don't serve /capabilities. Every
+// such release implemented all of the optional features which predate
+// discovery; later features, such as batch adds, are only used if advertised.
+var legacyCapabilities = api.Capabilities{
+	BatchUpload:   true,
+	BatchDownload: true,
+	BatchDelete:   true,
+	Uploads:       true,
+	PresignedURLs: true,
+}
+
+// capabilityRetryDelay is how long a failure to discover capabilities is
+// remembered before discovery is tried again.
+const capabilityRetryDelay = time.Minute
+
+// capabilityCache holds the server's capabilities once they are discovered.
+// The lock is never held while discovering them.
+type capabilityCache struct {
+	lock  sync.Mutex
+	value *api.Capabilities
+
+	// Why discovery last failed, and when it may be tried again.
+	err   error
+	retry time.Time
+
+	// Closed when discovery in progress finishes. Nil if there is none.
+	done chan struct{}
+}
+
+// feature selects one of the server's capabilities.
+type feature func(*api.Capabilities) *bool
+
+func batchUploads(c *api.Capabilities) *bool   { return &c.BatchUpload }
+func batchDownloads(c *api.Capabilities) *bool { return &c.BatchDownload }
+func batchDeletes(c *api.Capabilities) *bool   { return &c.BatchDelete }
+func batchAdds(c *api.Capabilities) *bool      { return &c.BatchAdd }
+
+// lacks returns true if the server is known not to implement a feature,
+// without discovering its capabilities.
+func (c *capabilityCache) lacks(f feature) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.value != nil && !*f(c.value)
+}
+
+// disable records that the server doesn't implement a feature after all, such
+// as when it responds to a request for it with 404 or 501. If capabilities
+// haven't been discovered, the server is assumed to predate discovery.
+func (c *capabilityCache) disable(f feature) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.value == nil {
+		value := legacyCapabilities
+		c.value = &value
+	}
+	*f(c.value) = false
+}
+
+// Capabilities returns the optional features the server implements. Servers
+// which don't serve them are assumed to implement every feature, as they did
+// before discovery existed.
+//
+// Capabilities are fetched once and cached for the life of the client. Any
+// limits they report lower the client's own. A failure to fetch them is also
+// cached for a minute, so that a failing server isn't asked on every request.
+func (c *Client) Capabilities(ctx context.Context) (*api.Capabilities, error) {
+	cache := &c.capabilities
+	for {
+		cache.lock.Lock()
+		if cache.value != nil {
+			value := *cache.value
+			cache.lock.Unlock()
+			return &value, nil
+		}
+		if cache.err != nil && time.Now().Before(cache.retry) {
+			err := cache.err
+			cache.lock.Unlock()
+			return nil, err
+		}
+		if cache.done == nil {
+			break
+		}
+
+		// Wait for discovery in progress rather than repeating it.
+		done := cache.done
+		cache.lock.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	cache.done = done
+	cache.lock.Unlock()
+
+	value, err := c.fetchCapabilities(ctx)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.done = nil
+	close(done)
+	if err != nil {
+		// A cancelled caller says nothing about the server.
+		if ctx.Err() == nil {
+			logrus.WithError(err).Warn("Failed to discover server capabilities")
+			cache.err = err
+			cache.retry = time.Now().Add(capabilityRetryDelay)
+		}
+		return nil, err
+	}
+	c.limits.lower(value.MaxBatchSize, value.MaxRequestSize)
+	cache.value = value
+	cache.err = nil
+
+	result := *value
+	return &result, nil
+}
+
+func (c *Client) fetchCapabilities(ctx context.Context) (*api.Capabilities, error) {
+	resp, err := c.sendRequest(ctx, http.MethodGet, "/capabilities", nil, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	// The path names no resource, so any of these means there is no route.
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		value := legacyCapabilities
+		return &value, nil
+	}
+
+	var body api.Capabilities
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// supports returns the server's capabilities for deciding how to make a
+// request. If discovery fails, it assumes a server which predates it, so the
+// request is made as it would have been without discovery. Discovery is tried
+// again once the failure expires.
+func (c *Client) supports(ctx context.Context) *api.Capabilities {
+	value, err := c.Capabilities(ctx)
+	if err != nil {
+		value := legacyCapabilities
+		return &value
+	}
+	return value
+}
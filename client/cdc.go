@@ -0,0 +1,481 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Parameters of content-defined chunking. Every client must use the same
+// parameters for their chunks to match, so they must never change.
+const (
+	cdcMinSize = 256 * 1024
+	cdcAvgSize = 1024 * 1024
+	cdcMaxSize = 4 * 1024 * 1024
+
+	// Chunks are cut where the top bits of the rolling hash are zero. Before
+	// the average size, more bits must be zero, making cuts less likely; after
+	// it, fewer, making them more likely. This normalizes chunk sizes around
+	// the average, as in FastCDC.
+	cdcMaskSmall = uint64(1<<22-1) << (64 - 22)
+	cdcMaskLarge = uint64(1<<18-1) << (64 - 18)
+)
+
+// Maximum number of chunks checked against the server at once. Chunks are held
+// in memory until they are checked and uploaded.
+const cdcBatchChunks = 16
+
+// cdcGear maps each byte to a pseudorandom value for the rolling hash.
+var cdcGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:])
+	}
+	return gear
+}()
+
+// cdcCut returns the length of the first chunk of data. Data shorter than the
+// maximum chunk size must be the end of the file.
+func cdcCut(data []byte) int {
+	n := len(data)
+	if n <= cdcMinSize {
+		return n
+	}
+	if n > cdcMaxSize {
+		n = cdcMaxSize
+	}
+	normal := cdcAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var hash uint64
+	i := cdcMinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + cdcGear[data[i]]
+		if hash&cdcMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + cdcGear[data[i]]
+		if hash&cdcMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// cdcChunker splits a reader into content-defined chunks.
+type cdcChunker struct {
+	r    io.Reader
+	buf  []byte
+	n    int // Bytes read into buf.
+	used int // Bytes of buf returned by the last call to next.
+	eof  bool
+}
+
+func newCDCChunker(r io.Reader) *cdcChunker {
+	return &cdcChunker{r: r, buf: make([]byte, cdcMaxSize)}
+}
+
+// next returns the next chunk, which is only valid until the following call,
+// or io.EOF after the last chunk.
+func (c *cdcChunker) next() ([]byte, error) {
+	copy(c.buf, c.buf[c.used:c.n])
+	c.n -= c.used
+	c.used = 0
+
+	if !c.eof {
+		n, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	c.used = cdcCut(c.buf[:c.n])
+	return c.buf[:c.used], nil
+}
+
+// writeChunked writes a file in content-defined chunks, uploading only the
+// chunks the server doesn't already have. See WithContentDefinedChunking.
+//
+// If the server doesn't support chunked files, it returns false after seeking
+// the source back to where it started so that the caller can write the file
+// normally. Sources which can't seek return the error instead.
+func (d *DatasetRef) writeChunked(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	mode os.FileMode,
+) (bool, error) {
+	start := int64(-1)
+	seeker, canSeek := source.(io.Seeker)
+	if canSeek {
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = pos
+		}
+	}
+
+	hash := sha256.New()
+	chunker := newCDCChunker(io.TeeReader(io.LimitReader(source, size), hash))
+	var manifest api.ChunkManifest
+	var batch [][]byte
+	releaseBatch := func() {
+		for _, data := range batch {
+			d.client.memory.release(int64(len(data)))
+		}
+		batch = nil
+	}
+	defer releaseBatch()
+	flush := func() error {
+		defer releaseBatch()
+		return d.client.uploadMissingChunks(ctx, batch)
+	}
+
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+		if err := d.client.memory.acquire(ctx, int64(len(chunk))); err != nil {
+			return true, errors.WithStack(err)
+		}
+		data := append([]byte{}, chunk...)
+		digest := sha256.Sum256(data)
+		manifest.Chunks = append(manifest.Chunks, api.ChunkRef{Digest: digest[:], Size: int64(len(data))})
+		batch = append(batch, data)
+
+		if len(batch) == cdcBatchChunks {
+			if err := flush(); err != nil {
+				return d.rewindChunked(err, seeker, start)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return d.rewindChunked(err, seeker, start)
+	}
+	if manifest.Size() != size {
+		return true, errors.Errorf("%s truncated while uploading", filename)
+	}
+
+	body, err := json.Marshal(&manifest)
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	path := path.Join("/datasets", d.id, "files", filename)
+	req, err := d.client.newRequest(http.MethodPut, path, nil, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", api.MediaTypeChunkManifest)
+	req.Header.Set(api.HeaderDigest, api.EncodeDigest(hash.Sum(nil)))
+	if mode != 0 {
+		req.Header.Set(api.HeaderFileMode, api.EncodeFileMode(mode))
+	}
+
+	resp, err := d.client.do(ctx, req)
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	return true, errorFromResponse(resp)
+}
+
+// rewindChunked handles an error from a chunked write, seeking the source back
+// to its start if the server doesn't support chunked files.
+func (d *DatasetRef) rewindChunked(err error, seeker io.Seeker, start int64) (bool, error) {
+	var unsupported *ErrNotSupportedByServer
+	if !errors.As(err, &unsupported) || start < 0 {
+		return true, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return true, errors.WithStack(err)
+	}
+	return false, nil
+}
+
+// missingBlobs returns the digests of blobs the server doesn't have.
+func (c *Client) missingBlobs(ctx context.Context, query *api.BlobDigests) (*api.BlobDigests, error) {
+	var missing api.BlobDigests
+	if ok, err := c.invokeGRPC(ctx, "MissingBlobs", true, query, &missing); ok {
+		return &missing, err
+	}
+
+	resp, err := c.sendRequest(ctx, http.MethodPost, "/blobs/missing", nil, query)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if err := parseResponse(resp, &missing); err != nil {
+		return nil, err
+	}
+	return &missing, nil
+}
+
+// uploadMissingChunks asks the server which chunks it lacks and uploads them.
+func (c *Client) uploadMissingChunks(ctx context.Context, chunks [][]byte) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	query := &api.BlobDigests{}
+	for _, data := range chunks {
+		digest := sha256.Sum256(data)
+		query.Digests = append(query.Digests, digest[:])
+	}
+	missing, err := c.missingBlobs(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[[sha256.Size]byte]bool{}
+	for _, digest := range missing.Digests {
+		var key [sha256.Size]byte
+		copy(key[:], digest)
+		wanted[key] = true
+	}
+	for _, data := range chunks {
+		key := sha256.Sum256(data)
+		if !wanted[key] {
+			continue
+		}
+		// Chunks repeated within the batch are uploaded once.
+		delete(wanted, key)
+
+		size := int64(len(data))
+		chunkSize := c.uploadChunkSize()
+		if size < chunkSize {
+			chunkSize = size
+		}
+		digest, err := c.upload(ctx, bytes.NewReader(data), size, chunkSize, nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(digest, key[:]) {
+			return errors.New("service returned the wrong digest for a chunk")
+		}
+	}
+	return nil
+}
+
+// ChunkManifest returns the content-defined chunks of a file written with
+// WithContentDefinedChunking. Returns ErrNotChunked for other files, and
+// ErrFileNotFound if the file does not exist.
+func (d *DatasetRef) ChunkManifest(ctx context.Context, filename string) (*api.ChunkManifest, error) {
+	path := path.Join("/datasets", d.id, "files", filename)
+	req, err := d.client.newRequest(http.MethodGet, path, d.readQuery(nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", api.MediaTypeChunkManifest)
+
+	resp, err := d.client.doRetry(ctx, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrFileNotFound
+	case http.StatusNotAcceptable:
+		return nil, ErrNotChunked
+	}
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	// Servers which don't know the media type send the file itself, which
+	// closing the body abandons.
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != api.MediaTypeChunkManifest {
+		return nil, ErrNotChunked
+	}
+	var manifest api.ChunkManifest
+	if err := decodeJSON(resp.Body, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// UpdateLocalFile downloads a file to a local path, replacing any file there.
+// If the file was written with WithContentDefinedChunking, chunks which the
+// existing local file already contains are copied from it, and only the rest
+// are downloaded. This makes refreshing a local copy of a large file cheap
+// when little of it changed.
+//
+// The new file is written beside the old one and verified before replacing
+// it, so the local file is never left partially written.
+func (d *DatasetRef) UpdateLocalFile(ctx context.Context, filename, localPath string) error {
+	info, err := d.FileInfo(ctx, filename)
+	if err != nil {
+		return err
+	}
+	manifest, err := d.ChunkManifest(ctx, filename)
+	if err != nil && err != ErrNotChunked {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(localPath), ".fileheap-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	w := io.MultiWriter(tmp, hash)
+	if manifest == nil {
+		r, err := d.ReadFile(ctx, filename)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if err := d.assembleChunks(ctx, filename, manifest, localPath, w); err != nil {
+		return err
+	}
+
+	if len(info.Digest) != 0 && !bytes.Equal(hash.Sum(nil), info.Digest) {
+		return errors.Errorf("%s changed while downloading or failed verification", filename)
+	}
+	if info.Mode != 0 {
+		if err := tmp.Chmod(info.Mode.Perm()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), localPath))
+}
+
+// assembleChunks writes a chunked file to w, copying chunks found in the local
+// file and downloading the rest. Runs of adjacent missing chunks are read in a
+// single request, and each chunk is verified as it arrives.
+func (d *DatasetRef) assembleChunks(
+	ctx context.Context,
+	filename string,
+	manifest *api.ChunkManifest,
+	localPath string,
+	w io.Writer,
+) error {
+	needed := map[[sha256.Size]byte]bool{}
+	for _, chunk := range manifest.Chunks {
+		var key [sha256.Size]byte
+		copy(key[:], chunk.Digest)
+		needed[key] = true
+	}
+
+	// Offsets of needed chunks in the local file.
+	local := map[[sha256.Size]byte]int64{}
+	localFile, err := os.Open(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if localFile != nil {
+		defer localFile.Close()
+		chunker := newCDCChunker(localFile)
+		var offset int64
+		for {
+			chunk, err := chunker.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			key := sha256.Sum256(chunk)
+			if needed[key] {
+				local[key] = offset
+			}
+			offset += int64(len(chunk))
+		}
+	}
+
+	var offset int64
+	chunks := manifest.Chunks
+	for len(chunks) > 0 {
+		var key [sha256.Size]byte
+		copy(key[:], chunks[0].Digest)
+		if localOffset, ok := local[key]; ok {
+			section := io.NewSectionReader(localFile, localOffset, chunks[0].Size)
+			if _, err := io.Copy(w, section); err != nil {
+				return errors.WithStack(err)
+			}
+			offset += chunks[0].Size
+			chunks = chunks[1:]
+			continue
+		}
+
+		// Download every missing chunk up to the next local one.
+		run := 1
+		length := chunks[0].Size
+		for ; run < len(chunks); run++ {
+			copy(key[:], chunks[run].Digest)
+			if _, ok := local[key]; ok {
+				break
+			}
+			length += chunks[run].Size
+		}
+		if err := d.downloadChunks(ctx, filename, offset, length, chunks[:run], w); err != nil {
+			return err
+		}
+		offset += length
+		chunks = chunks[run:]
+	}
+	return nil
+}
+
+// downloadChunks reads a run of adjacent chunks, verifying each one.
+func (d *DatasetRef) downloadChunks(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	chunks []api.ChunkRef,
+	w io.Writer,
+) error {
+	r, err := d.NewReader(ctx, filename, offset, length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, chunk := range chunks {
+		hash := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(w, hash), r, chunk.Size); err != nil {
+			return errors.WithStack(err)
+		}
+		if !bytes.Equal(hash.Sum(nil), chunk.Digest) {
+			return errors.Errorf("%s failed verification at offset %d", filename, offset)
+		}
+		offset += chunk.Size
+	}
+	return nil
+}
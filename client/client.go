@@ -2,7 +2,9 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +13,8 @@ import (
 	"net/http/httptrace"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/goware/urlx"
@@ -24,52 +28,180 @@ import (
 const userAgent = "fileheap/0.1.0"
 const ClientHostnameHeader = "Client-Hostname"
 
-const (
-	// Maximum number of requests to send in a batch.
-	batchSizeLimit = api.BatchSizeLimit
+// ClientIDHeader identifies the process sending a request, so that server logs
+// can tell apart processes sharing a host and user agent.
+const ClientIDHeader = "Client-ID"
 
-	// Maximum size of a request.
-	requestSizeLimit = api.PutFileSizeLimit
-)
+// clientID is shared by every client in the process.
+var clientID = newClientID()
+
+func newClientID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Sprintf("%d", os.Getpid())
+	}
+	return hex.EncodeToString(id[:])
+}
 
 // Client provides an API interface to FileHeap.
 type Client struct {
 	baseURL *url.URL
 	token   string
 	client  *http.Client
+	limits  *limits
+
+	// Client for responses which may take arbitrarily long to read, such as
+	// batch downloads. It shares the transport of client, but has no overall
+	// timeout; see doStreaming.
+	streaming *http.Client
+
+	// Maximum time a streaming response may go without sending data.
+	idleTimeout time.Duration
+
+	// Size of each chunk sent through the upload API. If zero, chunks are as
+	// large as the request size limit.
+	chunkSize int64
+
+	// Limit on memory held in request and response buffers. May be nil.
+	memory *memoryBudget
+
+	// Pool of buffers for request and response bodies.
+	buffers *bufferPool
+
+	// Cache of file metadata and manifest pages. May be nil.
+	cache *metadataCache
+
+	// Cache of validated responses for conditional requests. May be nil.
+	validators *validatorCache
+
+	// Whether to refuse redirects to hosts other than the base URL.
+	noRedirects bool
+
+	// Options applied to every call before the call's own options.
+	callDefaults []CallOption
+
+	// Whether file iterators verify that paths are strictly ascending.
+	checkOrder bool
+
+	// Requests shared by concurrent reads of the same range. May be nil.
+	shared *sharedReads
+
+	// Whether large uploads replacing a file copy its unchanged chunks.
+	deltaUploads bool
+
+	// Whether large uploads are written in content-defined chunks.
+	cdcUploads bool
+
+	// Namespace in which datasets are created and listed. Empty for the
+	// server's default.
+	namespace string
+
+	// Optional features of the server, once discovered.
+	capabilities capabilityCache
+
+	// User-Agent header sent with every request.
+	userAgent string
+
+	// Delay after which reads with no response are sent again. Zero disables
+	// hedging.
+	hedgeDelay time.Duration
+
+	// Address of the server's gRPC endpoint for metadata operations, and the
+	// transport to it. Empty and nil if metadata is sent over HTTP.
+	grpcAddress string
+	grpc        *grpcTransport
 }
 
 // New creates a new client connected the given address.
 //
-// Address should be in the form [scheme://]host[:port], where scheme defaults
-// to "https" and port defaults to the standard port for the given scheme, i.e.
-// 80 for http and 443 for https.
+// Address should be in the form [scheme://]host[:port][/path], where scheme
+// defaults to "https" and port defaults to the standard port for the given
+// scheme, i.e. 80 for http and 443 for https. The optional path is prefixed to
+// every request, for servers mounted below the root by a reverse proxy.
 func New(address string, options ...Option) (*Client, error) {
 	u, err := urlx.ParseWithDefaultScheme(address, "https")
 	if err != nil {
 		return nil, err
 	}
 
-	if u.Path != "" || u.Opaque != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
-		return nil, errors.New("address must be base server address in the form [scheme://]host[:port]")
+	if u.Opaque != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, errors.New("address must be base server address in the form [scheme://]host[:port][/path]")
 	}
-
-	c := &Client{baseURL: u, client: &http.Client{Timeout: 5 * time.Minute}}
+	u.Path = strings.TrimSuffix(path.Clean("/"+u.Path), "/")
+	u.RawPath = ""
+
+	// Each client has its own transport so that connection pools and their
+	// tuning are not shared with other clients or the rest of the program.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+	c := &Client{
+		baseURL: u,
+		client: &http.Client{
+			Timeout:   5 * time.Minute,
+			Transport: transport,
+		},
+		streaming:   &http.Client{Transport: transport},
+		idleTimeout: defaultIdleTimeout,
+		limits:      defaultLimits(),
+		buffers:     newBufferPool(),
+		userAgent:   userAgent,
+	}
+	c.client.CheckRedirect = c.checkRedirect
+	c.streaming.CheckRedirect = c.checkRedirect
 	for _, opt := range options {
 		opt.Apply(c)
 	}
+	if c.grpcAddress != "" {
+		if c.grpc, err = newGRPCTransport(c.grpcAddress); err != nil {
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
 
-// BaseURL returns the base URL of the client.
+// BaseURL returns the base URL of the client, including any base path.
 func (c *Client) BaseURL() *url.URL {
 	return &url.URL{
 		Scheme: c.baseURL.Scheme,
 		Host:   c.baseURL.Host,
+		Path:   c.baseURL.Path,
 	}
 }
 
+// resolve returns the URL of a path on the server, below the base path.
+func (c *Client) resolve(p string, query url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   c.baseURL.Scheme,
+		Host:     c.baseURL.Host,
+		Path:     path.Join("/", c.baseURL.Path, p),
+		RawQuery: query.Encode(),
+	}
+}
+
+// checkRedirect prepares a request to follow a redirect. Downloads may be
+// redirected to signed blob storage URLs, which carry their own credentials
+// and reject requests with other authorization.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host == c.baseURL.Host {
+		return nil
+	}
+	if c.noRedirects {
+		return errors.Errorf("redirect to %s is not allowed", req.URL.Host)
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Del("Content-Type")
+	req.Header.Del(ClientHostnameHeader)
+	req.Header.Del(ClientIDHeader)
+	req.Header.Del(api.HeaderRequestID)
+	deleteMetadataHeaders(req.Header)
+	return nil
+}
+
 type tracedBody struct {
 	body   io.ReadCloser
 	result *TraceResult
@@ -77,12 +209,18 @@ type tracedBody struct {
 }
 
 func (b *tracedBody) Close() error {
-	logrus.
+	entry := logrus.
 		WithFields(b.result.Fields()).
 		WithField("ContentLength", bytefmt.New(b.req.ContentLength, bytefmt.Binary)).
 		WithField("Method", b.req.Method).
-		WithField("URL", b.req.URL.String()).
-		Tracef("Completed FileHeap request")
+		WithField("URL", b.req.URL.String())
+	if id := b.req.Header.Get(api.HeaderRequestID); id != "" {
+		entry = entry.WithField("RequestID", id)
+	}
+	if md := MetadataFromContext(b.req.Context()); len(md) != 0 {
+		entry = entry.WithField("Metadata", formatMetadata(md))
+	}
+	entry.Tracef("Completed FileHeap request")
 	return b.body.Close()
 }
 
@@ -91,8 +229,18 @@ func (b *tracedBody) Read(p []byte) (n int, err error) {
 }
 
 func (c *Client) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return c.doWith(ctx, c.client, req)
+}
+
+// doWith sends a request with the given HTTP client.
+func (c *Client) doWith(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	// Metadata is only meant for the FileHeap service, not blob storage.
+	if req.URL.Host == c.baseURL.Host {
+		setMetadataHeaders(ctx, req.Header)
+		setRequestID(ctx, req.Header)
+	}
 	result := NewResult()
-	resp, err := c.client.Do(req.WithContext(withClientTrace(ctx, result)))
+	resp, err := client.Do(req.WithContext(withClientTrace(ctx, result)))
 	if err != nil {
 		return nil, err
 	}
@@ -106,24 +254,36 @@ func (c *Client) newRequest(
 	query url.Values,
 	body io.Reader,
 ) (*http.Request, error) {
-	u := c.baseURL.ResolveReference(&url.URL{Path: path, RawQuery: query.Encode()})
+	u := c.resolve(path, query)
 	req, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", userAgent)
+	c.setClientHeaders(req.Header)
+	return req, nil
+}
+
+// setClientHeaders sets the headers identifying and authorizing the client,
+// which are sent with every request to the server.
+func (c *Client) setClientHeaders(header http.Header) {
+	header.Set("User-Agent", c.userAgent)
 	if c.token != "" {
-		req.Header.Set("Authorization", "Bearer "+c.token)
+		header.Set("Authorization", "Bearer "+c.token)
 	}
 	clientHostname, err := os.Hostname()
 	if err != nil {
 		clientHostname = fmt.Sprintf("unknown because %s", err.Error())
 	}
-	req.Header.Set(ClientHostnameHeader, clientHostname)
-	return req, nil
+	header.Set(ClientHostnameHeader, clientHostname)
+	header.Set(ClientIDHeader, clientID)
+	if c.noRedirects {
+		header.Set(api.HeaderAllowRedirect, "false")
+	}
 }
 
 // sendRequest sends a request with an optional JSON-encoded body and returns the response.
+// Idempotent requests, including updates sent with an idempotency key, are
+// retried if they fail with a transient error such as a connection reset.
 func (c *Client) sendRequest(
 	ctx context.Context,
 	method string,
@@ -133,8 +293,8 @@ func (c *Client) sendRequest(
 ) (*http.Response, error) {
 	var reader io.Reader
 	if body != nil {
-		buf := getBuffer()
-		defer putBuffer(buf)
+		buf := c.getBuffer()
+		defer c.putBuffer(buf)
 		if err := json.NewEncoder(buf).Encode(body); err != nil {
 			return nil, err
 		}
@@ -146,7 +306,14 @@ func (c *Client) sendRequest(
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	return c.do(ctx, req)
+	if method == http.MethodPatch {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(api.HeaderIdempotencyKey, key)
+	}
+	return c.doRetry(ctx, req)
 }
 
 // errorFromResponse creates an error from an HTTP response, or nil on success.
@@ -156,32 +323,84 @@ func errorFromResponse(resp *http.Response) error {
 		return nil
 	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	bytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
 	if err != nil {
 		return errors.Wrap(err, "failed to read response")
 	}
 
 	var apiErr api.Error
-	if err := json.Unmarshal(bytes, &apiErr); err != nil {
-		return errors.Wrapf(err, "failed to parse response: %s", string(bytes))
+	parseErr := json.Unmarshal(bytes, &apiErr)
+	if err := unsupportedFeature(resp, parseErr == nil); err != nil {
+		return err
+	}
+	if parseErr != nil {
+		return errors.Wrapf(parseErr, "failed to parse response: %s", string(bytes))
 	}
 
-	return apiErr
+	// Older servers omit the status code from the body.
+	if apiErr.Code == 0 {
+		apiErr.Code = resp.StatusCode
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = resp.Header.Get(api.HeaderRequestID)
+	}
+	if resp.Request != nil {
+		// Servers which don't echo the ID can still be searched for the one
+		// the request was sent with.
+		if apiErr.RequestID == "" {
+			apiErr.RequestID = resp.Request.Header.Get(api.HeaderRequestID)
+		}
+		apiErr.Method = resp.Request.Method
+		apiErr.URL = resp.Request.URL.String()
+		apiErr.Metadata = metadataFromHeader(resp.Request.Header)
+	}
+	return newAPIError(apiErr)
 }
 
-// responseValue parses the response body and stores the result in the given value.
+// Limits on the size of response bodies held in memory, so that a misbehaving
+// server can't exhaust the client's memory.
+const (
+	maxResponseSize = 256 << 20
+	maxErrorSize    = 1 << 20
+)
+
+// parseResponse parses the response body and stores the result in the given value.
 // The value parameter should be a pointer to the desired structure.
 func parseResponse(resp *http.Response, value interface{}) error {
 	if err := errorFromResponse(resp); err != nil {
 		return err
 	}
+	return decodeJSON(resp.Body, value)
+}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+// decodeJSON decodes a JSON value as it is read from r, rather than reading
+// the whole body first, so large responses such as long listings don't hold
+// two copies in memory. Bodies larger than maxResponseSize are rejected.
+func decodeJSON(r io.Reader, value interface{}) error {
+	limited := &io.LimitedReader{R: r, N: maxResponseSize + 1}
+	if err := json.NewDecoder(limited).Decode(value); err != nil {
+		if limited.N <= 0 {
+			return errors.Errorf("response is larger than %d bytes", maxResponseSize)
+		}
+		return errors.Wrap(err, "failed to parse response")
 	}
 
-	return json.Unmarshal(bytes, value)
+	// Consume the rest of the body, such as a trailing newline, so that the
+	// connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(limited, 4096))
+	return nil
+}
+
+// readResponse reads a whole response body of at most maxResponseSize bytes.
+func readResponse(r io.Reader) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxResponseSize+1))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(body) > maxResponseSize {
+		return nil, errors.Errorf("response is larger than %d bytes", maxResponseSize)
+	}
+	return body, nil
 }
 
 type TraceResult struct {
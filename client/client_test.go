@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestClientsDoNotShareBuffers(t *testing.T) {
+	a, err := New("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.buffers == b.buffers {
+		t.Fatal("clients share a buffer pool")
+	}
+
+	buf := a.getBuffer()
+	a.putBuffer(buf)
+	if b.getBuffer() == buf {
+		t.Error("buffer returned to one client was reused by another")
+	}
+}
+
+func TestWithMaxPooledBufferSize(t *testing.T) {
+	c, err := New("localhost", WithMaxPooledBufferSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.buffers.maxSize != 1024 {
+		t.Fatalf("got max pooled size %d; want 1024", c.buffers.maxSize)
+	}
+
+	buf := c.getBuffer()
+	buf.Write(bytes.Repeat([]byte{'x'}, 4096))
+	c.putBuffer(buf)
+	if c.getBuffer() == buf {
+		t.Error("buffer larger than the limit was pooled")
+	}
+}
+
+func TestClientsDoNotShareTransports(t *testing.T) {
+	a, err := New("localhost", WithMaxIdleConnsPerHost(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ta, ok := a.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("got transport %T; want *http.Transport", a.client.Transport)
+	}
+	tb := b.client.Transport.(*http.Transport)
+	if ta == tb || ta == http.DefaultTransport || tb == http.DefaultTransport {
+		t.Fatal("clients share a transport")
+	}
+	if a.streaming.Transport != ta {
+		t.Error("streaming client doesn't share its client's transport")
+	}
+
+	if ta.MaxIdleConnsPerHost != 7 {
+		t.Errorf("got MaxIdleConnsPerHost %d; want 7", ta.MaxIdleConnsPerHost)
+	}
+	if tb.MaxIdleConnsPerHost == 7 {
+		t.Error("option applied to another client's transport")
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 7 {
+		t.Error("option applied to the default transport")
+	}
+}
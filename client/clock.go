@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// ClockSkew estimates how far the server's clock is ahead of the local clock,
+// or behind it if negative, from the Date header of a response. Since Date has
+// a resolution of one second, so does the estimate. Large skew makes file
+// update times appear to be in the future or the past, and can cause signed
+// URLs to be rejected as expired.
+func (c *Client) ClockSkew(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	resp, err := c.sendRequest(ctx, http.MethodHead, "/", nil, nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return 0, errors.New("server response has no Date header")
+	}
+	server, err := api.ParseHTTPTime(date)
+	if err != nil {
+		return 0, err
+	}
+
+	// Assume the server set the header midway through the request. Its clock
+	// is truncated to the second, so compare against the middle of that second.
+	local := start.Add(elapsed / 2)
+	return server.Add(500 * time.Millisecond).Sub(local).Round(time.Second), nil
+}
@@ -1,15 +1,18 @@
 package client
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
+	"os"
 	"path"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	"github.com/allenai/fileheap-client/api"
 )
@@ -17,15 +20,27 @@ import (
 // DatasetOpts allows clients to set options during creation of a new dataset.
 type DatasetOpts struct{}
 
-// NewDataset creates a new collection of files.
+// NewDataset creates a new collection of files, in the client's namespace if
+// it has one. See WithNamespace.
 func (c *Client) NewDataset(ctx context.Context) (*DatasetRef, error) {
-	resp, err := c.sendRequest(ctx, http.MethodPost, "/datasets", nil, nil)
+	var body api.Dataset
+	if ok, err := c.invokeGRPC(ctx, "CreateDataset", false, &api.DatasetSpec{Namespace: c.namespace}, &body); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &DatasetRef{client: c, id: body.ID}, nil
+	}
+
+	var spec interface{}
+	if c.namespace != "" {
+		spec = &api.DatasetSpec{Namespace: c.namespace}
+	}
+	resp, err := c.sendRequest(ctx, http.MethodPost, "/datasets", nil, spec)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var body api.Dataset
 	if err := parseResponse(resp, &body); err != nil {
 		return nil, err
 	}
@@ -44,6 +59,9 @@ func (c *Client) Dataset(id string) *DatasetRef {
 type DatasetRef struct {
 	client *Client
 	id     string
+
+	// ID of a snapshot to read from, if any. Snapshots are read-only.
+	snapshot string
 }
 
 // Name returns the dataset's unique identifier.
@@ -52,32 +70,80 @@ func (d *DatasetRef) Name() string { return d.id }
 // URL gets the URL of a dataset.
 func (d *DatasetRef) URL() string {
 	path := path.Join("/datasets", d.id)
-	u := d.client.baseURL.ResolveReference(&url.URL{Path: path})
+	u := d.client.resolve(path, nil)
 	return u.String()
 }
 
 // Info returns metadata about the dataset.
 func (d *DatasetRef) Info(ctx context.Context) (*api.Dataset, error) {
-	path := path.Join("/datasets", d.id)
-	resp, err := d.client.sendRequest(ctx, http.MethodGet, path, nil, nil)
-	if err != nil {
-		return nil, err
+	var body api.Dataset
+	if ok, err := d.client.invokeGRPC(ctx, "GetDataset", true, &api.DatasetRequest{ID: d.id}, &body); ok {
+		if err != nil {
+			return nil, err
+		}
+		return &body, nil
 	}
-	defer resp.Body.Close()
 
-	var body api.Dataset
-	if err := parseResponse(resp, &body); err != nil {
+	path := path.Join("/datasets", d.id)
+	if err := d.client.getJSON(ctx, path, nil, &body); err != nil {
 		return nil, err
 	}
 	return &body, nil
 }
 
+// ManifestDigest computes the canonical digest of the dataset's manifest by
+// listing all of its files. See api.ManifestHash for details.
+//
+// Sealed datasets report their manifest digest in Info, which is much cheaper
+// to retrieve for large datasets.
+func (d *DatasetRef) ManifestDigest(ctx context.Context) ([]byte, error) {
+	var hash api.ManifestHash
+	files := d.Files(ctx, nil)
+	for {
+		info, err := files.Next()
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := hash.Add(info.Path, info.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return hash.Sum(), nil
+}
+
 // Seal makes a dataset read-only. This operation is not reversible.
 func (d *DatasetRef) Seal(ctx context.Context) error {
-	path := path.Join("/datasets", d.id)
-	body := &api.DatasetPatch{ReadOnly: true}
+	return d.patch(ctx, api.DatasetPatch{ReadOnly: true})
+}
 
-	resp, err := d.client.sendRequest(ctx, http.MethodPatch, path, nil, body)
+// SetExpiry marks a dataset for automatic deletion after the given time, such
+// as for temporary scratch datasets. The zero time removes any expiry, so that
+// the dataset is kept until it is deleted. Expiry applies to sealed datasets
+// as well.
+func (d *DatasetRef) SetExpiry(ctx context.Context, t time.Time) error {
+	if !t.IsZero() {
+		t = t.UTC()
+	}
+	return d.patch(ctx, api.DatasetPatch{ExpiresAt: &t})
+}
+
+// patch modifies a dataset's metadata.
+func (d *DatasetRef) patch(ctx context.Context, patch api.DatasetPatch) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	defer d.client.cache.invalidate(d.id)
+
+	req := &api.DatasetPatchRequest{ID: d.id, Patch: patch}
+	if ok, err := d.client.invokeGRPC(ctx, "PatchDataset", true, req, nil); ok {
+		return err
+	}
+
+	path := path.Join("/datasets", d.id)
+	resp, err := d.client.sendRequest(ctx, http.MethodPatch, path, nil, &patch)
 	if err != nil {
 		return err
 	}
@@ -89,6 +155,15 @@ func (d *DatasetRef) Seal(ctx context.Context) error {
 //
 // This invalidates the DatasetRef and all associated file references.
 func (d *DatasetRef) Delete(ctx context.Context) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	defer d.client.cache.invalidate(d.id)
+
+	if ok, err := d.client.invokeGRPC(ctx, "DeleteDataset", false, &api.DatasetRequest{ID: d.id}, nil); ok {
+		return err
+	}
+
 	path := path.Join("/datasets", d.id)
 	resp, err := d.client.sendRequest(ctx, http.MethodDelete, path, nil, nil)
 	if err != nil {
@@ -108,15 +183,26 @@ type FileIteratorOptions struct {
 
 	// Prefix within the dataset. Only files that start with the prefix will be included.
 	Prefix string
+
+	// Inline the contents of files up to this many bytes in the manifest, so
+	// they can be read without further requests. Zero disables inlining.
+	// The server may apply a lower threshold.
+	InlineThreshold int64
+
+	// Resume a listing from a position saved by FileIterator.Cursor. The
+	// prefix should match that of the saved listing.
+	Cursor string
 }
 
 // Files returns an iterator over all files in the dataset.
 func (d *DatasetRef) Files(ctx context.Context, opts *FileIteratorOptions) *FileIterator {
-	i := &FileIterator{dataset: d, ctx: ctx}
-	if opts != nil {
-		i.opts = *opts
-	}
-	return i
+	return newFileIterator(ctx, d, opts)
+}
+
+// ListFiles is like Files, returning the iterator as an Iterator to satisfy
+// DatasetAPI.
+func (d *DatasetRef) ListFiles(ctx context.Context, opts *FileIteratorOptions) Iterator {
+	return d.Files(ctx, opts)
 }
 
 // NewUploadBatch creates an UploadBatch.
@@ -131,14 +217,61 @@ func (d *DatasetRef) NewDeleteBatch() *DeleteBatch {
 
 // DownloadBatch creates a BatchDownloader.
 func (d *DatasetRef) DownloadBatch(ctx context.Context, files Iterator) *BatchDownloader {
-	return &BatchDownloader{ctx: ctx, dataset: d, files: files}
+	return d.DownloadBatchWithOptions(ctx, files, nil)
+}
+
+// DownloadBatchOptions provides optional configuration to a BatchDownloader.
+type DownloadBatchOptions struct {
+	// Return files within each batch in the order the iterator produced them.
+	// By default, files in a batch are grouped by directory so that writes
+	// to disk or to an archive are more sequential.
+	PreserveOrder bool
+
+	// Number of bytes of upcoming files to read ahead in the background while
+	// the caller processes the current file, so that network reads overlap
+	// with disk writes. Zero disables read-ahead.
+	//
+	// With read-ahead, Close on a file's reader does not stop the download;
+	// callers should read each batch to the end or cancel its context.
+	ReadAhead int64
+}
+
+// DownloadBatchWithOptions is like DownloadBatch, with additional
+// configuration. The options may be nil.
+func (d *DatasetRef) DownloadBatchWithOptions(
+	ctx context.Context,
+	files Iterator,
+	opts *DownloadBatchOptions,
+) *BatchDownloader {
+	if opts == nil {
+		opts = &DownloadBatchOptions{}
+	}
+	return &BatchDownloader{
+		ctx:           ctx,
+		dataset:       d,
+		files:         files,
+		preserveOrder: opts.PreserveOrder,
+		readAhead:     opts.ReadAhead,
+	}
 }
 
 // FileInfo returns metadata about a file in the dataset.
 // Returns ErrFileNotFound if the file does not exist.
-func (d *DatasetRef) FileInfo(ctx context.Context, filename string) (*api.FileInfo, error) {
+func (d *DatasetRef) FileInfo(
+	ctx context.Context,
+	filename string,
+	opts ...CallOption,
+) (*api.FileInfo, error) {
+	ctx, cancel := d.client.callOptions(opts).context(ctx)
+	defer cancel()
+
+	generation := d.client.cache.generation(d.cacheID())
+	if info, ok := d.client.cache.fileInfo(d.cacheID(), generation, filename); ok {
+		return info, nil
+	}
+
 	path := path.Join("/datasets", d.id, "files", filename)
-	resp, err := d.client.sendRequest(ctx, http.MethodHead, path, nil, nil)
+	resp, err := d.client.sendRequest(ctx, http.MethodHead, path, d.readQuery(nil), nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -157,18 +290,32 @@ func (d *DatasetRef) FileInfo(ctx context.Context, filename string) (*api.FileIn
 			return nil, errors.WithStack(err)
 		}
 	}
-	if t := resp.Header.Get("Last-Modified"); t != "" {
-		info.Updated, err = time.Parse(api.HTTPTimeFormat, t)
+	if m := resp.Header.Get(api.HeaderFileMode); m != "" {
+		info.Mode, err = api.DecodeFileMode(m)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 	}
+	if t := resp.Header.Get("Last-Modified"); t != "" {
+		// Proxies sometimes rewrite the header, so a bad time isn't fatal.
+		if info.Updated, err = api.ParseHTTPTime(t); err != nil {
+			logrus.WithField("path", filename).WithError(err).Warn("Ignoring unparseable Last-Modified")
+		}
+	}
 
+	d.client.cache.putFileInfo(d.cacheID(), generation, info)
 	return info, nil
 }
 
 // DeleteFile deletes a file in the dataset.
-func (d *DatasetRef) DeleteFile(ctx context.Context, filename string) error {
+func (d *DatasetRef) DeleteFile(ctx context.Context, filename string, opts ...CallOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	defer d.client.cache.invalidate(d.id)
+	ctx, cancel := d.client.callOptions(opts).context(ctx)
+	defer cancel()
+
 	path := path.Join("/datasets", d.id, "files", filename)
 	resp, err := d.client.sendRequest(ctx, http.MethodDelete, path, nil, nil)
 	if err != nil {
@@ -186,12 +333,18 @@ func (d *DatasetRef) DeleteFile(ctx context.Context, filename string) error {
 // If the file doesn't exist, this returns ErrFileNotFound.
 //
 // The caller must call Close on the returned Reader when finished reading.
-func (d *DatasetRef) ReadFile(ctx context.Context, filename string) (io.ReadCloser, error) {
-	return d.ReadFileRange(ctx, filename, 0, -1)
+func (d *DatasetRef) ReadFile(
+	ctx context.Context,
+	filename string,
+	opts ...CallOption,
+) (io.ReadCloser, error) {
+	return d.ReadFileRange(ctx, filename, 0, -1, opts...)
 }
 
 // ReadFileRange reads at most length bytes from a file starting at the given offset.
 // If length is negative, the file is read until the end. Length must not be zero.
+// See WithTimeout, WithVerify, and WithRetries for the call options it accepts.
+// Unlike NewReader, it verifies partial ranges chunk by chunk.
 //
 // If the file doesn't exist, this returns ErrFileNotFound.
 //
@@ -200,41 +353,61 @@ func (d *DatasetRef) ReadFileRange(
 	ctx context.Context,
 	filename string,
 	offset, length int64,
+	opts ...CallOption,
 ) (io.ReadCloser, error) {
-	r, err := d.readFileRange(ctx, filename, offset, length)
+	o := d.client.callOptions(opts)
+	if !o.verify || (offset == 0 && length < 0) {
+		return d.NewReader(ctx, filename, offset, length, opts...)
+	}
+
+	ctx, cancel := o.context(ctx)
+	r, err := d.readVerified(ctx, filename, offset, length, o.retries)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
+	return &cancelOnClose{ReadCloser: r, cancel: cancel}, nil
+}
 
-	// Create a pipe so that we can retry reading the file from where we left off
-	// if there is an error. Errors are expected when reading the file takes longer
-	// than the HTTP client's timeout.
-	pr, pw := io.Pipe()
-	go func() {
-		defer r.Close()
-		defer pw.Close()
-		for {
-			n, err := io.Copy(pw, r)
-			if err == nil {
-				return
-			}
-			if n == 0 {
-				pw.CloseWithError(errors.WithStack(err))
-				return
-			}
-			offset += n
-			length -= n
-
-			r.Close()
-			r, err = d.readFileRange(ctx, filename, offset, length)
-			if err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-		}
-	}()
+// readVerified reads a partial range of a file, verifying it chunk by chunk.
+func (d *DatasetRef) readVerified(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	retries int,
+) (io.ReadCloser, error) {
+	info, err := d.FileInfo(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return nil, errors.New("length must not be zero")
+	}
+	f, err := d.OpenVerified(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	f.retries = retries
+
+	n := info.Size - offset
+	if length > 0 && length < n {
+		n = length
+	}
+	if n < 0 {
+		n = 0
+	}
 
-	return pr, nil
+	// Buffer whole chunks so that small reads don't each fetch a chunk.
+	bufSize := f.chunks.ChunkSize
+	if n < bufSize {
+		bufSize = n
+	}
+	if bufSize < 16 {
+		bufSize = 16
+	}
+	section := io.NewSectionReader(f, offset, n)
+	return ioutil.NopCloser(bufio.NewReaderSize(section, int(bufSize))), nil
 }
 
 func (d *DatasetRef) readFileRange(
@@ -249,8 +422,24 @@ func (d *DatasetRef) readFileRange(
 		return nil, errors.New("length must not be zero")
 	}
 
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := d.newRangeRequest(filename, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		return d.sendRangeRequest(ctx, req)
+	}
+	if d.client.shared == nil {
+		return open(ctx)
+	}
+	key := readFileRangeKey(d.cacheID(), filename, offset, length)
+	return d.client.shared.read(ctx, key, open)
+}
+
+// newRangeRequest creates a request to read a range of a file.
+func (d *DatasetRef) newRangeRequest(filename string, offset, length int64) (*http.Request, error) {
 	path := path.Join("/datasets", d.id, "files", filename)
-	req, err := d.client.newRequest(http.MethodGet, path, nil, nil)
+	req, err := d.client.newRequest(http.MethodGet, path, d.readQuery(nil), nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -259,8 +448,13 @@ func (d *DatasetRef) readFileRange(
 	} else if length > 0 {
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
 	}
+	return req, nil
+}
 
-	resp, err := d.client.do(ctx, req)
+// sendRangeRequest sends a request created by newRangeRequest and returns the
+// response body.
+func (d *DatasetRef) sendRangeRequest(ctx context.Context, req *http.Request) (io.ReadCloser, error) {
+	resp, err := d.client.doHedged(ctx, req)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -274,36 +468,99 @@ func (d *DatasetRef) readFileRange(
 }
 
 // WriteFile writes the source to the filename in this dataset.
+// Of the call options, only the timeout applies to writes.
 //
 // The file will be replaced if it exists or created if not. The file
 // becomes available when Close returns successfully. The previous file is
 // readable until the new file replaces it.
 //
 // It is the caller's responsibility to call Close when writing is complete.
+//
+// Empty files are written without reading the source, which may be nil.
 func (d *DatasetRef) WriteFile(
 	ctx context.Context,
 	filename string,
 	source io.Reader,
 	size int64,
+	opts ...CallOption,
 ) error {
+	return d.WriteFileWithOptions(ctx, filename, source, size, nil, opts...)
+}
+
+// WriteFileOptions provides optional configuration to WriteFileWithOptions.
+type WriteFileOptions struct {
+	// Permission bits to record so they can be restored on download.
+	// A zero mode records nothing.
+	Mode os.FileMode
+
+	// Size of each chunk sent through the upload API, overriding the client's
+	// default. Only used for files too large to write in a single request.
+	ChunkSize int64
+}
+
+// WriteFileWithOptions is like WriteFile, with additional configuration.
+// The options may be nil.
+func (d *DatasetRef) WriteFileWithOptions(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	opts *WriteFileOptions,
+	callOpts ...CallOption,
+) error {
+	if opts == nil {
+		opts = &WriteFileOptions{}
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	defer d.client.cache.invalidate(d.id)
+	ctx, cancel := d.client.callOptions(callOpts).context(ctx)
+	defer cancel()
+
 	// Only read size bytes from the source in case the source grows while writing.
+	original := source
 	source = io.LimitReader(source, size)
 
+	large := size > d.client.limits.requestSizeLimit()
+	if large && d.client.cdcUploads && d.client.supports(ctx).Uploads {
+		if written, err := d.writeChunked(ctx, filename, original, size, opts.Mode); written {
+			return err
+		}
+	}
+
 	var body io.Reader
 	var digest []byte
 
-	if size > requestSizeLimit {
+	if size == 0 {
+		// An empty body creates an empty file. Sending a digest instead would
+		// name an existing blob, which may not exist for empty contents.
+		body = http.NoBody
+	} else if large && !d.client.supports(ctx).Uploads {
+		// Without the upload API, the only way to write the file is to send it
+		// in a single request, which the server may reject as too large.
+		body = source
+	} else if large {
 		var err error
-		digest, err = d.client.upload(ctx, source, size)
+		chunkSize := opts.ChunkSize
+		if chunkSize <= 0 {
+			chunkSize = d.client.uploadChunkSize()
+		}
+		digest, err = d.uploadDelta(ctx, filename, original, size, chunkSize)
 		if err != nil {
 			if err == io.ErrUnexpectedEOF {
 				return errors.Errorf("%s truncated while uploading", filename)
 			}
 			return err
 		}
-	} else if size != 0 {
-		buf := getBuffer()
-		defer putBuffer(buf)
+	} else {
+		if err := d.client.memory.acquire(ctx, size); err != nil {
+			return errors.WithStack(err)
+		}
+		defer d.client.memory.release(size)
+
+		buf := d.client.getBuffer()
+		defer d.client.putBuffer(buf)
 		if _, err := io.CopyN(buf, source, size); err != nil {
 			if err == io.EOF {
 				return errors.Errorf("%s truncated while uploading", filename)
@@ -321,6 +578,9 @@ func (d *DatasetRef) WriteFile(
 	if digest != nil {
 		req.Header.Set(api.HeaderDigest, api.EncodeDigest(digest))
 	}
+	if opts.Mode != 0 {
+		req.Header.Set(api.HeaderFileMode, api.EncodeFileMode(opts.Mode))
+	}
 	if body != nil {
 		req.ContentLength = size
 	}
@@ -333,18 +593,75 @@ func (d *DatasetRef) WriteFile(
 	return errorFromResponse(resp)
 }
 
+// uploadDelta uploads a large file. With delta uploads enabled, it copies the
+// chunks of the file being replaced which are unchanged, falling back to
+// sending every chunk if the server can't copy them and the source can seek
+// back to where it started.
+func (d *DatasetRef) uploadDelta(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	chunkSize int64,
+) ([]byte, error) {
+	var base *deltaBase
+	if d.client.deltaUploads {
+		var err error
+		if base, err = d.deltaBase(ctx, filename); err != nil {
+			return nil, err
+		}
+	}
+
+	start := int64(-1)
+	seeker, canSeek := source.(io.Seeker)
+	if base != nil && canSeek {
+		if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = pos
+		}
+	}
+
+	digest, err := d.client.upload(ctx, io.LimitReader(source, size), size, chunkSize, base)
+	var unsupported *ErrNotSupportedByServer
+	if base == nil || !errors.As(err, &unsupported) || start < 0 {
+		return digest, err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	logrus.WithField("path", filename).Debug("Server can't copy chunks; uploading the whole file")
+	return d.client.upload(ctx, io.LimitReader(source, size), size, chunkSize, nil)
+}
+
 // AddFile to a dataset when the digest is already known.
 func (d *DatasetRef) AddFile(
 	ctx context.Context,
 	filename string,
 	digest []byte,
 ) error {
+	return d.addFile(ctx, filename, digest, 0)
+}
+
+// addFile is like AddFile, and also records the file's mode if it isn't zero.
+func (d *DatasetRef) addFile(
+	ctx context.Context,
+	filename string,
+	digest []byte,
+	mode os.FileMode,
+) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	defer d.client.cache.invalidate(d.id)
+
 	path := path.Join("/datasets", d.id, "files", filename)
 	req, err := d.client.newRequest(http.MethodPut, path, nil, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set(api.HeaderDigest, api.EncodeDigest(digest))
+	if mode != 0 {
+		req.Header.Set(api.HeaderFileMode, api.EncodeFileMode(mode))
+	}
 
 	resp, err := d.client.do(ctx, req)
 	if err != nil {
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Day is 24 hours, for use with DatasetFilter.OlderThan.
+const Day = 24 * time.Hour
+
+// DatasetFilter selects datasets to list. The zero value matches all datasets.
+type DatasetFilter struct {
+	// Only match datasets which have not been sealed.
+	Unsealed bool
+
+	// Only match datasets created longer ago than this.
+	OlderThan time.Duration
+
+	// Only match datasets in this namespace. Defaults to the client's
+	// namespace, if it has one; see WithNamespace.
+	Namespace string
+}
+
+func (f *DatasetFilter) match(dataset *api.Dataset, now time.Time) bool {
+	if f.Namespace != "" && dataset.Namespace != f.Namespace {
+		return false
+	}
+	if f.Unsealed && dataset.ReadOnly {
+		return false
+	}
+	if f.OlderThan > 0 && dataset.Created.After(now.Add(-f.OlderThan)) {
+		return false
+	}
+	return true
+}
+
+// ListDatasets returns an iterator over datasets visible to the client which
+// match the filter. The filter may be nil.
+func (c *Client) ListDatasets(ctx context.Context, filter *DatasetFilter) *DatasetIterator {
+	if filter == nil {
+		filter = &DatasetFilter{}
+	}
+	i := &DatasetIterator{ctx: ctx, client: c, filter: *filter, now: time.Now()}
+	if i.filter.Namespace == "" {
+		i.filter.Namespace = c.namespace
+	}
+	return i
+}
+
+// DatasetIterator is an iterator over datasets.
+type DatasetIterator struct {
+	// Context for calls to Next. NextContext ignores it.
+	ctx    context.Context
+	client *Client
+	filter DatasetFilter
+
+	// Time the listing started, against which ages are measured.
+	now time.Time
+
+	datasets []api.Dataset
+	cursor   string
+
+	// Whether the final request has been made.
+	lastRequest bool
+}
+
+// Next gets the next dataset in the iterator using the context passed to
+// ListDatasets. If the iterator is expended it will return the sentinel error
+// Done.
+func (i *DatasetIterator) Next() (*api.Dataset, error) {
+	return i.NextContext(i.ctx)
+}
+
+// NextContext is like Next, but makes any request for the next page with ctx.
+func (i *DatasetIterator) NextContext(ctx context.Context) (*api.Dataset, error) {
+	for {
+		for len(i.datasets) != 0 {
+			result := i.datasets[0]
+			i.datasets = i.datasets[1:]
+			// Servers may not support every filter, so check them here too.
+			if i.filter.match(&result, i.now) {
+				return &result, nil
+			}
+		}
+
+		if i.lastRequest {
+			return nil, ErrDone
+		}
+
+		query := url.Values{"cursor": {i.cursor}}
+		if i.filter.Unsealed {
+			query["readonly"] = []string{"false"}
+		}
+		if i.filter.Namespace != "" {
+			query["namespace"] = []string{i.filter.Namespace}
+		}
+		if i.filter.OlderThan > 0 {
+			query["createdBefore"] = []string{i.now.Add(-i.filter.OlderThan).UTC().Format(time.RFC3339)}
+		}
+		resp, err := i.client.sendRequest(ctx, http.MethodGet, "/datasets", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var body api.DatasetPage
+		err = parseResponse(resp, &body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		i.datasets = body.Datasets
+		i.cursor = body.Cursor
+		if body.Cursor == "" {
+			i.lastRequest = true
+		}
+	}
+}
+
+// DeleteDatasets deletes datasets and all of their files, making up to
+// concurrency requests at once. Each result's Path is a dataset ID; the
+// returned error is non-nil if any deletion failed, and matches the result's Err.
+func (c *Client) DeleteDatasets(ctx context.Context, ids []string, concurrency int) (*BatchResult, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	result := newBatchResult(ids)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result.Files[i].Err = c.Dataset(id).Delete(ctx)
+		}(i, id)
+	}
+	wg.Wait()
+	return result, result.Err()
+}
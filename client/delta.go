@@ -0,0 +1,149 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// deltaBase is an existing file whose chunks an upload may copy instead of
+// sending. See WithDeltaUploads.
+//
+// This is an aligned-block delta: the upload is cut at multiples of the base's
+// chunk size, and each piece is matched by digest against the base's chunks.
+// There is no rolling checksum, so data which moved to an unaligned offset is
+// not found. Content-defined chunking (see cdc.go) covers that case.
+type deltaBase struct {
+	digest    []byte
+	size      int64
+	chunkSize int64
+
+	// Digest of each chunk in order.
+	digests [][]byte
+
+	// Offset of each chunk in the file by its digest.
+	chunks map[[sha256.Size]byte]int64
+}
+
+// deltaBase describes the file an upload will replace, or returns nil if there
+// is no file or it wasn't uploaded in chunks the upload can use.
+func (d *DatasetRef) deltaBase(ctx context.Context, filename string) (*deltaBase, error) {
+	info, err := d.FileInfo(ctx, filename)
+	if err == ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.deltaBaseOf(ctx, info)
+}
+
+// deltaBaseOf is like deltaBase, given the file's info.
+func (d *DatasetRef) deltaBaseOf(ctx context.Context, info *api.FileInfo) (*deltaBase, error) {
+	if info.Size == 0 || local(info) {
+		return nil, nil
+	}
+
+	chunks, err := d.FileChunks(ctx, info.Path)
+	if err == ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if chunks.ChunkSize <= 0 || chunks.ChunkSize > d.client.limits.requestSizeLimit() {
+		return nil, nil
+	}
+	if len(info.ChunkRoot) != 0 && !bytes.Equal(chunks.Root(), info.ChunkRoot) {
+		// The file was replaced between requests.
+		return nil, nil
+	}
+
+	if int64(len(chunks.Digests)) != (info.Size+chunks.ChunkSize-1)/chunks.ChunkSize {
+		return nil, nil
+	}
+
+	base := &deltaBase{
+		digest:    info.Digest,
+		size:      info.Size,
+		chunkSize: chunks.ChunkSize,
+		digests:   chunks.Digests,
+		chunks:    make(map[[sha256.Size]byte]int64, len(chunks.Digests)),
+	}
+	for i, digest := range chunks.Digests {
+		var key [sha256.Size]byte
+		copy(key[:], digest)
+		if _, ok := base.chunks[key]; !ok {
+			base.chunks[key] = int64(i) * chunks.ChunkSize
+		}
+	}
+	return base, nil
+}
+
+// find returns the offset of a chunk in the base file, if it has one. The base
+// may be nil.
+func (b *deltaBase) find(chunk *uploadChunk) (int64, bool) {
+	if b == nil {
+		return 0, false
+	}
+	offset, ok := b.chunks[chunk.digest]
+	return offset, ok
+}
+
+// copyChunk writes n bytes at an offset in an upload by copying identical data,
+// whose digest is given, from the base file. It returns the digest of the
+// upload once the service has received all of its data.
+func (c *Client) copyChunk(
+	ctx context.Context,
+	uploadID string,
+	offset, n int64,
+	digest []byte,
+	length int64,
+	base *deltaBase,
+	sourceOffset int64,
+) ([]byte, error) {
+	path := path.Join("/uploads", uploadID)
+	req, err := c.newRequest(http.MethodPatch, path, nil, http.NoBody)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.ContentLength = 0
+	req.Header.Set(api.HeaderDigest, api.EncodeDigest(digest))
+	req.Header.Set(api.HeaderUploadLength, strconv.FormatInt(length, 10))
+	req.Header.Set(api.HeaderUploadOffset, strconv.FormatInt(offset, 10))
+	req.Header.Set(api.HeaderUploadSource, api.EncodeDigest(base.digest))
+	req.Header.Set(api.HeaderUploadSourceRange, fmt.Sprintf("bytes=%d-%d", sourceOffset, sourceOffset+n-1))
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	// Servers which ignore the source see an empty chunk which doesn't match
+	// its digest, or accept it without advancing the upload.
+	unsupported := &ErrNotSupportedByServer{Feature: "delta uploads", Code: resp.StatusCode}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotImplemented {
+		return nil, unsupported
+	}
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
+	}
+	if resp.Header.Get(api.HeaderUploadOffset) != strconv.FormatInt(offset+n, 10) {
+		return nil, unsupported
+	}
+
+	if str := resp.Header.Get(api.HeaderDigest); str != "" {
+		digest, err := api.DecodeDigest(str)
+		return digest, errors.WithStack(err)
+	}
+	return nil, nil
+}
@@ -1,6 +1,14 @@
 package client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/allenai/fileheap-client/api"
+)
 
 var (
 	// ErrDone indicates an iterator is expended.
@@ -12,4 +20,178 @@ var (
 
 	// ErrFileNotFound indicates that a file doesn't exist.
 	ErrFileNotFound = errors.New("file not found")
+
+	// ErrDatasetNotFound indicates that a dataset doesn't exist.
+	ErrDatasetNotFound = errors.New("dataset not found")
+
+	// ErrDatasetReadOnly indicates an attempt to modify a sealed dataset.
+	ErrDatasetReadOnly = errors.New("dataset is read-only")
+
+	// ErrUnauthorized indicates that the client's token is missing, invalid,
+	// or does not grant access to the requested resource.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrQuotaExceeded indicates that a write would exceed the storage quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrSealRejected indicates that a dataset was not sealed because it
+	// failed the checks passed to SealWithChecks.
+	ErrSealRejected = errors.New("dataset failed pre-seal checks")
+
+	// ErrNotChunked indicates that a file wasn't written in content-defined
+	// chunks, so it has no chunk manifest.
+	ErrNotChunked = errors.New("file is not chunked")
+
+	// ErrBlobNotFound indicates that the server has no contents with a digest.
+	ErrBlobNotFound = errors.New("blob not found")
 )
+
+// ErrNotSupportedByServer indicates that the server doesn't implement a
+// feature the client used, such as an older or minimal deployment lacking
+// batch requests. It is returned instead of the server's raw response, which
+// is often not a FileHeap error at all.
+type ErrNotSupportedByServer struct {
+	// Feature which is unsupported, such as "batch download".
+	Feature string
+
+	// Status code of the server's response.
+	Code int
+}
+
+func (e *ErrNotSupportedByServer) Error() string {
+	return fmt.Sprintf("server does not support %s (HTTP %d)", e.Feature, e.Code)
+}
+
+// Optional features by the parts of their request paths which identify them.
+// Datasets and files are always supported.
+var serverFeatures = []struct {
+	path    string
+	feature string
+}{
+	{"/batch/upload", "batch upload"},
+	{"/batch/download", "batch download"},
+	{"/batch/delete", "batch delete"},
+	{"/batch/add", "batch add"},
+	{"/manifest", "manifest listing"},
+	{"/sessions", "read sessions"},
+	{"/chunks/", "file chunks"},
+	{"/events", "watching datasets"},
+	{"/uploads", "the upload API"},
+	{"/blobs/missing", "content-defined chunking"},
+	{"/blobs/", "reading contents by digest"},
+	{"/health", "health checks"},
+	{"/version", "version reporting"},
+	{"/admin/", "admin reports"},
+}
+
+// unsupportedFeature returns an ErrNotSupportedByServer if a response shows
+// that the server lacks the feature the request used, or nil. Servers respond
+// to routes they don't have with 404 or 405 and a body which isn't a FileHeap
+// error, or with 501.
+func unsupportedFeature(resp *http.Response, parsed bool) error {
+	switch {
+	case resp.StatusCode == http.StatusNotImplemented:
+	case (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed) && !parsed:
+	default:
+		return nil
+	}
+	if resp.Request == nil {
+		return nil
+	}
+
+	// File paths may contain anything, so they can't identify a feature.
+	p := resp.Request.URL.Path
+	if strings.Contains(p, "/files/") {
+		return nil
+	}
+	for _, f := range serverFeatures {
+		if strings.Contains(p, f.path) {
+			return &ErrNotSupportedByServer{Feature: f.feature, Code: resp.StatusCode}
+		}
+	}
+	return nil
+}
+
+// sentinelFor returns the sentinel error matching an API error, or nil if
+// there is none. The error's reason identifies it if the server sent one.
+// Otherwise its status code does, but only for requests where the code can
+// mean just one thing: a 404 from an upload is not a missing dataset.
+func sentinelFor(err api.Error) error {
+	switch err.Reason {
+	case api.ReasonDatasetNotFound:
+		return ErrDatasetNotFound
+	case api.ReasonFileNotFound:
+		return ErrFileNotFound
+	case api.ReasonDatasetReadOnly:
+		return ErrDatasetReadOnly
+	case api.ReasonQuotaExceeded:
+		return ErrQuotaExceeded
+	}
+
+	switch err.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusInsufficientStorage:
+		return ErrQuotaExceeded
+	}
+
+	route, ok := datasetRoute(err.URL)
+	if !ok {
+		return nil
+	}
+	switch {
+	case err.Code == http.StatusNotFound && route != "files" && route != "chunks":
+		// Only the dataset itself can be missing. Requests for files may
+		// also be missing the file.
+		return ErrDatasetNotFound
+	case err.Code == http.StatusConflict && err.Method != http.MethodGet && (route == "files" || route == "batch"):
+		// The service rejects writes to sealed datasets as conflicting with
+		// their state.
+		return ErrDatasetReadOnly
+	}
+	return nil
+}
+
+// datasetRoute returns the part of a request URL's path naming the route
+// below a dataset, such as "files" or "manifest", or an empty string for the
+// dataset itself. It returns false if the URL isn't for a dataset.
+func datasetRoute(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	i := strings.Index(u.Path, "/datasets/")
+	if i < 0 {
+		return "", false
+	}
+	parts := strings.SplitN(u.Path[i+len("/datasets/"):], "/", 3)
+	if parts[0] == "" {
+		return "", false
+	}
+	if len(parts) == 1 {
+		return "", true
+	}
+	return parts[1], true
+}
+
+// typedError wraps an API error so that errors.Is matches the corresponding
+// sentinel. Its cause is still the api.Error, so errors.As and errors.Cause
+// behave as they would for the bare API error.
+type typedError struct {
+	err      api.Error
+	sentinel error
+}
+
+// newAPIError converts an API error into an error suitable to return to callers.
+func newAPIError(err api.Error) error {
+	if sentinel := sentinelFor(err); sentinel != nil {
+		return &typedError{err: err, sentinel: sentinel}
+	}
+	return err
+}
+
+func (e *typedError) Error() string              { return e.err.Error() }
+func (e *typedError) Cause() error               { return e.err }
+func (e *typedError) Unwrap() error              { return e.err }
+func (e *typedError) Is(target error) bool       { return target == e.sentinel }
+func (e *typedError) Format(s fmt.State, r rune) { e.err.Format(s, r) }
@@ -2,11 +2,14 @@ package client
 
 import (
 	"context"
-	"net/http"
+	"io"
+	"mime"
 	"net/url"
 	"path"
 	"strconv"
 
+	"github.com/pkg/errors"
+
 	"github.com/allenai/fileheap-client/api"
 )
 
@@ -15,8 +18,30 @@ type Iterator interface {
 	Next() (*api.FileInfo, error)
 }
 
+// ContextIterator is an Iterator which accepts a context on each call, so that
+// each call can have its own deadline. Iterators in this package implement it,
+// and consumers such as BatchDownloader pass their own context through to it.
+type ContextIterator interface {
+	Iterator
+	NextContext(ctx context.Context) (*api.FileInfo, error)
+}
+
+// nextFile gets the next file from an iterator, passing ctx if it accepts one.
+func nextFile(ctx context.Context, files Iterator) (*api.FileInfo, error) {
+	if i, ok := files.(ContextIterator); ok {
+		return i.NextContext(ctx)
+	}
+	return files.Next()
+}
+
 // FileIterator is an iterator over files within a dataset.
+//
+// Files are returned in ascending byte-wise order of their paths, as compared
+// by Go's string comparison, across all pages. Tools which depend on this,
+// such as for sharding or diffing, can use WithOrderCheck to fail loudly if a
+// server ever returns files out of order.
 type FileIterator struct {
+	// Context for calls to Next. NextContext ignores it.
 	ctx     context.Context
 	dataset *DatasetRef
 
@@ -26,16 +51,78 @@ type FileIterator struct {
 	files  []api.FileInfo
 	cursor string
 
+	// Cursor of the page the buffered files came from. Together with the
+	// path of the previous file returned, it saves the iterator's position.
+	page string
+
+	// Path of the previous file returned, to check ordering.
+	last string
+
+	// Path after which a resumed listing continues. Files up to and including
+	// it are dropped from the first page fetched.
+	after string
+
 	// Whether the final request has been made.
 	lastRequest bool
+
+	// Error to return from every call, such as for an invalid cursor.
+	err error
 }
 
-// Next gets the next file in the iterator. If iterator is expended it will
-// return the sentinel error Done.
+// newFileIterator creates an iterator, resuming from opts.Cursor if it is set.
+func newFileIterator(ctx context.Context, d *DatasetRef, opts *FileIteratorOptions) *FileIterator {
+	i := &FileIterator{dataset: d, ctx: ctx}
+	if opts != nil {
+		i.opts = *opts
+	}
+	if i.opts.Cursor == "" {
+		return i
+	}
+
+	values, err := url.ParseQuery(i.opts.Cursor)
+	if _, ok := values["after"]; err != nil || !ok {
+		i.err = errors.Errorf("invalid file iterator cursor %q", i.opts.Cursor)
+		return i
+	}
+	i.cursor = values.Get("page")
+	i.page = i.cursor
+	i.last = values.Get("after")
+	i.after = i.last
+	return i
+}
+
+// Cursor returns an opaque string saving the iterator's position, from which
+// the listing can be resumed with FileIteratorOptions.Cursor, such as after a
+// long walk of a huge dataset is interrupted. The resumed iterator continues
+// with the file following the last one returned. Before any file has been
+// returned, the cursor is empty and resuming from it starts from the
+// beginning.
+func (i *FileIterator) Cursor() string {
+	if i.page == "" && i.last == "" {
+		return ""
+	}
+	return url.Values{"page": {i.page}, "after": {i.last}}.Encode()
+}
+
+// Next gets the next file in the iterator using the context passed to Files.
+// If iterator is expended it will return the sentinel error Done.
 func (i *FileIterator) Next() (*api.FileInfo, error) {
+	return i.NextContext(i.ctx)
+}
+
+// NextContext is like Next, but makes any request for the next page with ctx.
+func (i *FileIterator) NextContext(ctx context.Context) (*api.FileInfo, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
 	if len(i.files) != 0 {
 		result := i.files[0]
 		i.files = i.files[1:]
+		if i.dataset.client.checkOrder && i.last != "" && result.Path <= i.last {
+			return nil, errors.Errorf(
+				"manifest out of order: %q returned after %q", result.Path, i.last)
+		}
+		i.last = result.Path
 		return &result, nil
 	}
 
@@ -48,25 +135,94 @@ func (i *FileIterator) Next() (*api.FileInfo, error) {
 	if limit := i.opts.PageSize; limit > 0 {
 		query["limit"] = []string{strconv.Itoa(limit)}
 	}
-	if i.opts.IncludeURLs {
+	if i.opts.IncludeURLs && i.dataset.client.supports(ctx).PresignedURLs {
 		query["url"] = []string{"true"}
 	}
-	resp, err := i.dataset.client.sendRequest(i.ctx, http.MethodGet, path, query, nil)
-	if err != nil {
-		return nil, err
+	if threshold := i.opts.InlineThreshold; threshold > 0 {
+		query["inline"] = []string{strconv.FormatInt(threshold, 10)}
 	}
-	defer resp.Body.Close()
-
-	var body api.ManifestPage
-	if err := parseResponse(resp, &body); err != nil {
+	body, err := i.fetchPage(ctx, path, i.dataset.readQuery(query))
+	if err != nil {
 		return nil, err
 	}
 
+	i.page = i.cursor
 	i.files = body.Files
+	if i.after != "" {
+		// Files are sorted by path, so those already returned come first.
+		for len(i.files) != 0 && i.files[0].Path <= i.after {
+			i.files = i.files[1:]
+		}
+		i.after = ""
+	}
 	i.cursor = body.Cursor
 	if body.Cursor == "" {
 		i.lastRequest = true
 	}
 
-	return i.Next()
+	return i.NextContext(ctx)
+}
+
+func (i *FileIterator) fetchPage(
+	ctx context.Context,
+	path string,
+	query url.Values,
+) (*api.ManifestPage, error) {
+	cache := i.dataset.client.cache
+	if i.opts.IncludeURLs {
+		// Presigned URLs expire, so pages containing them are not cached or
+		// revalidated.
+		cache = nil
+	}
+	generation := cache.generation(i.dataset.cacheID())
+	if page, ok := cache.manifestPage(i.dataset.cacheID(), generation, query.Encode()); ok {
+		return page, nil
+	}
+
+	body := &api.ManifestPage{}
+	req := manifestRequest(i.dataset.id, query)
+	ok, err := i.dataset.client.invokeGRPC(ctx, "ListManifest", true, req, body)
+	if !ok {
+		body, err = i.getPage(ctx, path, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache.putManifestPage(i.dataset.cacheID(), generation, query.Encode(), body)
+	return body, nil
+}
+
+// getPage requests a page of the manifest over HTTP.
+func (i *FileIterator) getPage(
+	ctx context.Context,
+	path string,
+	query url.Values,
+) (*api.ManifestPage, error) {
+	var page api.ManifestPage
+	err := i.dataset.client.get(ctx, path, query, manifestAccept, !i.opts.IncludeURLs, func(body io.Reader, contentType string) error {
+		return decodeManifestPage(body, contentType, &page)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Manifest pages are requested as protocol buffers, which are much faster to
+// parse than JSON. Servers which don't support them respond with JSON.
+var manifestAccept = api.MediaTypeProtobuf + ", " + api.MediaTypeJSON + ";q=0.9"
+
+// decodeManifestPage parses a manifest page of the given media type. JSON
+// pages are decoded as they are read; protocol buffers are read whole.
+func decodeManifestPage(body io.Reader, contentType string, page *api.ManifestPage) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != api.MediaTypeProtobuf {
+		return errors.Wrap(decodeJSON(body, page), "parsing manifest page")
+	}
+	data, err := readResponse(body)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(page.UnmarshalProto(data), "parsing manifest page")
 }
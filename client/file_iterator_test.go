@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// largeManifestPage returns a manifest page of n files.
+func largeManifestPage(n int) *api.ManifestPage {
+	page := &api.ManifestPage{Files: make([]api.FileInfo, n)}
+	updated := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range page.Files {
+		path := fmt.Sprintf("dir%03d/file%06d.txt", i%100, i)
+		digest := sha256.Sum256([]byte(path))
+		page.Files[i] = api.FileInfo{
+			Path:    path,
+			Size:    int64(i) * 1000,
+			Digest:  digest[:],
+			Updated: updated,
+		}
+	}
+	page.Cursor = page.Files[n-1].Path
+	return page
+}
+
+func BenchmarkDecodeManifestPage(b *testing.B) {
+	page := largeManifestPage(10000)
+	jsonPage, err := json.Marshal(page)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"JSON", api.MediaTypeJSON, jsonPage},
+		{"Protobuf", api.MediaTypeProtobuf, page.MarshalProto()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bench.data)))
+			for i := 0; i < b.N; i++ {
+				var decoded api.ManifestPage
+				if err := decodeManifestPage(bytes.NewReader(bench.data), bench.contentType, &decoded); err != nil {
+					b.Fatal(err)
+				}
+				if len(decoded.Files) != len(page.Files) {
+					b.Fatalf("got %d files; want %d", len(decoded.Files), len(page.Files))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListJSONManifest(b *testing.B) {
+	page := largeManifestPage(10000)
+	page.Cursor = ""
+	data, err := json.Marshal(page)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// The server ignores validators, so revalidated pages are read whole each time.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", api.MediaTypeJSON)
+		w.Header().Set("ETag", `"page"`)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	for _, bench := range []struct {
+		name    string
+		options []Option
+	}{
+		{"Streamed", nil},
+		{"Revalidated", []Option{WithConditionalRequests(10)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			c, err := New(server.URL, bench.options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				files := c.Dataset("ds").Files(context.Background(), nil)
+				var n int
+				for {
+					_, err := files.Next()
+					if err == ErrDone {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					n++
+				}
+				if n != len(page.Files) {
+					b.Fatalf("got %d files; want %d", n, len(page.Files))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goware/urlx"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// grpcTransport sends metadata operations to a server's gRPC endpoint. See
+// WithGRPC and api.GRPCService.
+type grpcTransport struct {
+	baseURL *url.URL
+	client  *http.Client
+
+	// Methods the server answered with UNIMPLEMENTED, which are sent over
+	// HTTP instead.
+	unimplemented sync.Map
+}
+
+// newGRPCTransport creates a transport for the gRPC endpoint at an address in
+// the form [scheme://]host[:port]. Plain http endpoints are sent HTTP/2
+// without TLS, which gRPC servers accept from clients that know to use it.
+func newGRPCTransport(address string) (*grpcTransport, error) {
+	u, err := urlx.ParseWithDefaultScheme(address, "https")
+	if err != nil {
+		return nil, err
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, errors.New("gRPC address must be in the form [scheme://]host[:port]")
+	}
+
+	transport := &http2.Transport{}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	default:
+		return nil, errors.Errorf("unsupported gRPC scheme %q", u.Scheme)
+	}
+	return &grpcTransport{
+		baseURL: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		client:  &http.Client{Timeout: 5 * time.Minute, Transport: transport},
+	}, nil
+}
+
+// protoMessage is a message which can be encoded in the gRPC schema.
+type protoMessage interface {
+	MarshalProto() []byte
+}
+
+// protoReply is a message which can be decoded from the gRPC schema.
+type protoReply interface {
+	UnmarshalProto(data []byte) error
+}
+
+// gRPC status codes, from https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// invokeGRPC calls a method of the metadata service, decoding its reply into
+// out unless out is nil. It returns false if the call should be made over HTTP
+// instead, because gRPC isn't configured or the server doesn't implement the
+// method. Idempotent calls are retried like idempotent HTTP requests.
+func (c *Client) invokeGRPC(
+	ctx context.Context,
+	method string,
+	idempotent bool,
+	in protoMessage,
+	out protoReply,
+) (bool, error) {
+	if c.grpc == nil {
+		return false, nil
+	}
+	if _, ok := c.grpc.unimplemented.Load(method); ok {
+		return false, nil
+	}
+
+	msg := in.MarshalProto()
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	for attempt := 1; ; attempt++ {
+		reply, err := c.sendGRPC(ctx, method, frame)
+		var apiErr api.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotImplemented {
+			c.grpc.unimplemented.Store(method, true)
+			return false, nil
+		}
+		retry := idempotent && attempt < requestAttempts &&
+			(isTransient(ctx, err) || (apiErr.Code != 0 && isRetryable(apiErr.Code)))
+		if !retry {
+			if err != nil {
+				return true, err
+			}
+			if out == nil {
+				return true, nil
+			}
+			return true, errors.Wrapf(out.UnmarshalProto(reply), "parsing %s reply", method)
+		}
+		if err := sleep(ctx, time.Duration(attempt)*time.Second); err != nil {
+			return true, err
+		}
+	}
+}
+
+// sendGRPC sends one framed request and returns its reply message. Failed
+// calls return an api.Error with the HTTP status code nearest the gRPC
+// status, so they match the same sentinel errors as HTTP requests do.
+func (c *Client) sendGRPC(ctx context.Context, method string, frame []byte) ([]byte, error) {
+	u := *c.grpc.baseURL
+	u.Path = "/" + api.GRPCService + "/" + method
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(frame))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.setClientHeaders(req.Header)
+	req.Header.Set("Content-Type", api.MediaTypeGRPC)
+	req.Header.Set("TE", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout < 1 {
+			timeout = 1
+		}
+		req.Header.Set("Grpc-Timeout", strconv.FormatInt(timeout, 10)+"m")
+	}
+	setMetadataHeaders(ctx, req.Header)
+	setRequestID(ctx, req.Header)
+
+	resp, err := c.doWith(ctx, c.grpc.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Trailers are only available once the body has been read.
+	body, err := readResponse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Calls which fail before replying send their status as headers.
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+
+	apiErr := api.Error{
+		RequestID: resp.Header.Get(api.HeaderRequestID),
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Metadata:  metadataFromHeader(req.Header),
+	}
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = req.Header.Get(api.HeaderRequestID)
+	}
+	code, err := strconv.Atoi(status)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		apiErr.Code = resp.StatusCode
+		if apiErr.Code == http.StatusOK {
+			apiErr.Code = http.StatusBadGateway
+		}
+		apiErr.Message = fmt.Sprintf("%s failed without a gRPC status (HTTP %d)", method, resp.StatusCode)
+		return nil, newAPIError(apiErr)
+	}
+	if code != grpcOK {
+		apiErr.Code, apiErr.Reason = httpStatusFromGRPC(code)
+		apiErr.Message, _ = url.PathUnescape(message)
+		if apiErr.Message == "" {
+			apiErr.Message = fmt.Sprintf("%s failed with gRPC status %d", method, code)
+		}
+		return nil, newAPIError(apiErr)
+	}
+
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return nil, errors.Errorf("%s reply is not a single uncompressed message", method)
+	}
+	return body[5:], nil
+}
+
+// httpStatusFromGRPC returns the HTTP status code nearest a gRPC status, and
+// the error reason it implies. Every method of the service concerns a dataset,
+// so a missing resource is a missing dataset, and the service reserves
+// FAILED_PRECONDITION for changes to sealed datasets.
+func httpStatusFromGRPC(code int) (int, string) {
+	switch code {
+	case grpcInvalidArgument:
+		return http.StatusBadRequest, ""
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout, ""
+	case grpcNotFound:
+		return http.StatusNotFound, api.ReasonDatasetNotFound
+	case grpcAlreadyExists, grpcAborted:
+		return http.StatusConflict, ""
+	case grpcFailedPrecondition:
+		return http.StatusConflict, api.ReasonDatasetReadOnly
+	case grpcPermissionDenied:
+		return http.StatusForbidden, ""
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests, ""
+	case grpcUnimplemented:
+		return http.StatusNotImplemented, ""
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable, ""
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized, ""
+	}
+	return http.StatusInternalServerError, ""
+}
+
+// manifestRequest converts the query of an HTTP manifest request for a
+// dataset to its gRPC equivalent.
+func manifestRequest(id string, query url.Values) *api.ManifestRequest {
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	inline, _ := strconv.ParseInt(query.Get("inline"), 10, 64)
+	return &api.ManifestRequest{
+		Dataset:         id,
+		Cursor:          query.Get("cursor"),
+		Prefix:          query.Get("path"),
+		Limit:           limit,
+		IncludeURLs:     query.Get("url") == "true",
+		InlineThreshold: inline,
+		Snapshot:        query.Get("snapshot"),
+	}
+}
@@ -0,0 +1,209 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+	"github.com/allenai/fileheap-client/fileheaptest"
+)
+
+func TestGRPCMetadata(t *testing.T) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	// Files are written over HTTP, but metadata operations must use gRPC, as
+	// nothing listens at the client's HTTP address.
+	writer := s.Client()
+	c, err := client.New("http://127.0.0.1:1", client.WithGRPC(s.URL), client.WithNamespace("ns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataset, err := c.NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "dir/c.txt"} {
+		if err := writer.Dataset(dataset.Name()).WriteFile(ctx, name, bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := dataset.Files(ctx, &client.FileIteratorOptions{PageSize: 2, InlineThreshold: 100})
+	var names []string
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(info.Data) != info.Path {
+			t.Errorf("%s: got inline data %q", info.Path, info.Data)
+		}
+		names = append(names, info.Path)
+	}
+	if len(names) != 3 || names[0] != "a.txt" || names[2] != "dir/c.txt" {
+		t.Errorf("got files %q; want [a.txt b.txt dir/c.txt]", names)
+	}
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := dataset.SetExpiry(ctx, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err := dataset.Seal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := dataset.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Namespace != "ns" || !info.ReadOnly || info.ExpiresAt == nil || !info.ExpiresAt.Equal(expiry) ||
+		info.Size == nil || info.Size.Files != 3 || len(info.ManifestDigest) == 0 {
+		t.Errorf("got info %+v", info)
+	}
+
+	if err := dataset.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.Info(ctx); !errors.Is(err, client.ErrDatasetNotFound) {
+		t.Errorf("info of deleted dataset: got %v; want %v", err, client.ErrDatasetNotFound)
+	}
+}
+
+func TestGRPCChunkedUpload(t *testing.T) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	// Chunked uploads ask which chunks the server lacks over gRPC.
+	c := s.Client(client.WithGRPC(s.URL), client.WithContentDefinedChunking(), client.WithRequestSizeLimit(1<<10))
+	dataset, err := c.NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, name := range []string{"a", "b"} {
+		if err := dataset.WriteFile(ctx, name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := dataset.ReadFile(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, %v; want the %d bytes written", len(got), err, len(data))
+	}
+}
+
+func TestGRPCUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	var calls int32
+	grpc := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Grpc-Status", "12")
+	}), &http2.Server{}))
+	defer grpc.Close()
+
+	c := s.Client(client.WithGRPC(grpc.URL))
+	dataset, err := c.NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := dataset.Info(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d gRPC calls; want one for each method", calls)
+	}
+}
+
+func TestWithGRPCInvalidAddress(t *testing.T) {
+	if _, err := client.New("localhost", client.WithGRPC("ftp://localhost")); err == nil {
+		t.Error("got no error for an ftp address")
+	}
+}
+
+func BenchmarkListManifest(b *testing.B) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	const files = 5000
+	dataset, err := s.Client().NewDataset(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("dir%02d/file%05d.txt", i%50, i)
+		if err := dataset.WriteFile(ctx, name, bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// A server which only accepts JSON lists the manifest as JSON.
+	jsonServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", api.MediaTypeJSON)
+		s.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer jsonServer.Close()
+	jsonClient, err := client.New(jsonServer.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		name   string
+		client *client.Client
+	}{
+		{"JSON", jsonClient},
+		{"Protobuf", s.Client()},
+		{"GRPC", s.Client(client.WithGRPC(s.URL))},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it := bench.client.Dataset(dataset.Name()).Files(ctx, nil)
+				var n int
+				for {
+					_, err := it.Next()
+					if err == client.ErrDone {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					n++
+				}
+				if n != files {
+					b.Fatalf("got %d files; want %d", n, files)
+				}
+			}
+		})
+	}
+}
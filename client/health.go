@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Health checks whether the server is ready to serve requests. An unhealthy
+// server's report is returned without an error; check its Status. The check is
+// never retried, so it reflects the server's state and latency right now.
+func (c *Client) Health(ctx context.Context) (*api.Health, error) {
+	req, err := c.newRequest(http.MethodGet, "/health", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var body api.Health
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		// Unhealthy servers respond with a report, unless something in front
+		// of them answered instead.
+		if err := decodeJSON(resp.Body, &body); err == nil && body.Status != "" {
+			return &body, nil
+		}
+		return &api.Health{Status: resp.Status}, nil
+	}
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// ServerVersion describes the build of the server.
+func (c *Client) ServerVersion(ctx context.Context) (*api.ServerVersion, error) {
+	resp, err := c.sendRequest(ctx, http.MethodGet, "/version", nil, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var body api.ServerVersion
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
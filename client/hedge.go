@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// hedgedResult is the outcome of one of the copies of a hedged request.
+type hedgedResult struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+// doHedged sends a request and, if it hasn't been answered within the hedge
+// delay, sends it again. Whichever copy responds first is returned and the
+// other is cancelled. A copy which fails is ignored while the other may still
+// succeed. Only requests without bodies which are safe to repeat are hedged;
+// others are sent once.
+func (c *Client) doHedged(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.hedgeDelay <= 0 || req.Body != nil ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return c.do(ctx, req)
+	}
+
+	// Both copies carry the same ID, so the server can tell they are one
+	// request.
+	if req.URL.Host == c.baseURL.Host {
+		setRequestID(ctx, req.Header)
+	}
+
+	results := make(chan hedgedResult, 2)
+	send := func() {
+		ctx, cancel := context.WithCancel(ctx)
+		go func() {
+			resp, err := c.do(ctx, req.Clone(ctx))
+			results <- hedgedResult{resp: resp, err: err, cancel: cancel}
+		}()
+	}
+	send()
+	pending := 1
+
+	timer := time.NewTimer(c.hedgeDelay)
+	defer timer.Stop()
+	hedge := timer.C
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			send()
+			pending++
+
+		case result := <-results:
+			pending--
+			if result.err != nil && pending > 0 {
+				result.cancel()
+				continue
+			}
+			if result.err != nil {
+				result.cancel()
+				return nil, result.err
+			}
+
+			go discardHedged(results, pending)
+			result.resp.Body = &cancelOnClose{ReadCloser: result.resp.Body, cancel: result.cancel}
+			return result.resp, nil
+		}
+	}
+}
+
+// discardHedged cancels the copies of a request which lost the race.
+func discardHedged(results <-chan hedgedResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		result.cancel()
+		if result.resp != nil {
+			result.resp.Body.Close()
+		}
+	}
+}
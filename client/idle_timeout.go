@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default timeouts for streaming responses.
+const (
+	defaultResponseHeaderTimeout = time.Minute
+	defaultIdleTimeout           = time.Minute
+)
+
+// idleTimeoutError is returned when a response stops sending data. It is a
+// net.Error so that callers treat it like other network timeouts.
+type idleTimeoutError struct {
+	idle time.Duration
+}
+
+func (e *idleTimeoutError) Error() string {
+	return "no data received for " + e.idle.String()
+}
+
+func (e *idleTimeoutError) Timeout() bool   { return true }
+func (e *idleTimeoutError) Temporary() bool { return true }
+
+// doStreaming sends a request whose response may take arbitrarily long to
+// read, such as a batch download. Instead of the client's overall timeout,
+// the response must begin within the transport's response header timeout,
+// and the body fails if no data arrives within the idle timeout. There is no
+// limit on the whole transfer as long as data keeps flowing.
+func (c *Client) doStreaming(ctx context.Context, req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.doWith(ctx, c.streaming, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if c.idleTimeout <= 0 {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	body := &idleTimeoutBody{body: resp.Body, idle: c.idleTimeout, cancel: cancel}
+	body.timer = time.AfterFunc(c.idleTimeout, body.expire)
+	resp.Body = body
+	return resp, nil
+}
+
+// idleTimeoutBody cancels a response if no data arrives for the idle timeout.
+type idleTimeoutBody struct {
+	body   io.ReadCloser
+	idle   time.Duration
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	lock    sync.Mutex
+	expired bool
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.lock.Lock()
+	b.expired = true
+	b.lock.Unlock()
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && err != io.EOF {
+		b.lock.Lock()
+		expired := b.expired
+		b.lock.Unlock()
+		if expired {
+			return n, errors.WithStack(&idleTimeoutError{idle: b.idle})
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
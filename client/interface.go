@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// DatasetAPI is the interface of a dataset, independent of where its files
+// are stored. It is satisfied by *DatasetRef. Code written against it can be
+// tested with fakes or run against other storage.
+type DatasetAPI interface {
+	// Name returns the dataset's unique identifier.
+	Name() string
+
+	// Info returns metadata about the dataset.
+	Info(ctx context.Context) (*api.Dataset, error)
+
+	// ManifestDigest computes the canonical digest of the dataset's manifest.
+	ManifestDigest(ctx context.Context) ([]byte, error)
+
+	// Seal makes the dataset read-only.
+	Seal(ctx context.Context) error
+
+	// Delete deletes the dataset and all of its files.
+	Delete(ctx context.Context) error
+
+	// ListFiles returns an iterator over files in the dataset in ascending
+	// byte-wise order of their paths. The options may be nil.
+	ListFiles(ctx context.Context, opts *FileIteratorOptions) Iterator
+
+	// FileInfo returns metadata about a file, or ErrFileNotFound.
+	FileInfo(ctx context.Context, filename string, opts ...CallOption) (*api.FileInfo, error)
+
+	// ReadFile reads the contents of a file, or returns ErrFileNotFound.
+	ReadFile(ctx context.Context, filename string, opts ...CallOption) (io.ReadCloser, error)
+
+	// ReadFileRange reads at most length bytes from a file starting at the
+	// given offset. If length is negative, the file is read until the end.
+	ReadFileRange(
+		ctx context.Context,
+		filename string,
+		offset, length int64,
+		opts ...CallOption,
+	) (io.ReadCloser, error)
+
+	// WriteFile writes size bytes from the source to a file, replacing it if
+	// it exists.
+	WriteFile(ctx context.Context, filename string, source io.Reader, size int64, opts ...CallOption) error
+
+	// WriteFileWithOptions is like WriteFile, with additional configuration.
+	WriteFileWithOptions(
+		ctx context.Context,
+		filename string,
+		source io.Reader,
+		size int64,
+		opts *WriteFileOptions,
+		callOpts ...CallOption,
+	) error
+
+	// DeleteFile deletes a file, or returns ErrFileNotFound.
+	DeleteFile(ctx context.Context, filename string, opts ...CallOption) error
+}
+
+// RemoteDatasetAPI extends DatasetAPI with the operations of a dataset on a
+// FileHeap server, including batches. It is satisfied by *DatasetRef.
+type RemoteDatasetAPI interface {
+	DatasetAPI
+
+	// URL gets the URL of the dataset.
+	URL() string
+
+	// AddFile adds a file whose contents the server already holds.
+	AddFile(ctx context.Context, filename string, digest []byte) error
+
+	// AddFilesBatch adds many files whose contents the server already holds.
+	AddFilesBatch(ctx context.Context, entries []api.FileEntry) (*BatchResult, error)
+
+	// NewUploadBatch creates an UploadBatch.
+	NewUploadBatch() *UploadBatch
+
+	// NewDeleteBatch creates a DeleteBatch.
+	NewDeleteBatch() *DeleteBatch
+
+	// DownloadBatch creates a BatchDownloader.
+	DownloadBatch(ctx context.Context, files Iterator) *BatchDownloader
+
+	// DownloadBatchWithOptions is like DownloadBatch, with additional
+	// configuration.
+	DownloadBatchWithOptions(ctx context.Context, files Iterator, opts *DownloadBatchOptions) *BatchDownloader
+
+	// FileChunks returns the chunk digests of a file.
+	FileChunks(ctx context.Context, filename string) (*api.FileChunks, error)
+
+	// OpenVerified opens a file for verified random access.
+	OpenVerified(ctx context.Context, info *api.FileInfo) (*VerifiedFile, error)
+
+	// NewReadSession opens a read session for the dataset or a single file.
+	NewReadSession(ctx context.Context, filename string) (*ReadSession, error)
+}
+
+// ClientAPI is the interface of a client. It is satisfied by *Client.
+type ClientAPI interface {
+	// BaseURL returns the base URL of the client.
+	BaseURL() *url.URL
+
+	// NewDataset creates a new dataset.
+	NewDataset(ctx context.Context) (*DatasetRef, error)
+
+	// Dataset creates a reference to an existing dataset by ID.
+	Dataset(id string) *DatasetRef
+
+	// ListDatasets returns an iterator over datasets matching a filter.
+	ListDatasets(ctx context.Context, filter *DatasetFilter) *DatasetIterator
+
+	// DeleteDatasets deletes datasets, making up to concurrency requests at once.
+	DeleteDatasets(ctx context.Context, ids []string, concurrency int) (*BatchResult, error)
+}
+
+var (
+	_ DatasetAPI       = (*DatasetRef)(nil)
+	_ RemoteDatasetAPI = (*DatasetRef)(nil)
+	_ ClientAPI        = (*Client)(nil)
+)
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Adaptive batch limits.
+const (
+	// Batches never shrink below this many bytes, or below a single file.
+	minBatchBytes = 1 << 20
+
+	// Number of consecutive successful batches after which limits double.
+	batchGrowthStreak = 8
+
+	// Minimum time between halvings, so that concurrent batches failing
+	// together only halve the limits once.
+	batchShrinkInterval = 10 * time.Second
+)
+
+// limits tracks the request size limits enforced by a server. Limits start at
+// the compiled defaults and may only be lowered, so a client never sends a
+// request the default server would reject.
+//
+// Batches are further limited by an adaptive scale: batch limits halve when
+// batch requests time out or are rejected as too large, and grow back after a
+// run of successes, so bulk transfers recover on constrained deployments.
+type limits struct {
+	lock sync.Mutex
+
+	// Maximum number of requests to send in a batch.
+	batchSize int
+
+	// Maximum size of a request.
+	requestSize int64
+
+	// Number of times batch limits have been halved.
+	shift int
+
+	// Number of consecutive successful batches since limits last changed.
+	streak int
+
+	// Time at which limits were last halved.
+	shrunk time.Time
+}
+
+func defaultLimits() *limits {
+	return &limits{
+		batchSize:   api.BatchSizeLimit,
+		requestSize: api.PutFileSizeLimit,
+	}
+}
+
+// lower reduces limits to the given values. Non-positive values are ignored
+// and values above the current limit have no effect.
+func (l *limits) lower(batchSize int, requestSize int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if batchSize > 0 && batchSize < l.batchSize {
+		l.batchSize = batchSize
+	}
+	if requestSize > 0 && requestSize < l.requestSize {
+		l.requestSize = requestSize
+	}
+}
+
+// batchSizeLimit returns the maximum number of files in a batch.
+func (l *limits) batchSizeLimit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if size := l.batchSize >> l.shift; size > 1 {
+		return size
+	}
+	return 1
+}
+
+// batchBytesLimit returns the maximum size of the files in a batch. A batch
+// may exceed it with a single file.
+func (l *limits) batchBytesLimit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	size := l.requestSize >> l.shift
+	if size < minBatchBytes {
+		size = minBatchBytes
+	}
+	if size > l.requestSize {
+		size = l.requestSize
+	}
+	return size
+}
+
+// observeBatch adapts batch limits to the outcome of a batch request, given
+// its status code or the error which prevented a response.
+func (l *limits) observeBatch(ctx context.Context, code int, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if isOverloaded(ctx, code, err) {
+		l.streak = 0
+		atFloor := l.batchSize>>l.shift <= 1 && l.requestSize>>l.shift <= minBatchBytes
+		if atFloor || time.Since(l.shrunk) < batchShrinkInterval {
+			return
+		}
+		l.shift++
+		l.shrunk = time.Now()
+		return
+	}
+	if err != nil || code >= 300 || l.shift == 0 {
+		return
+	}
+	if l.streak++; l.streak >= batchGrowthStreak {
+		l.shift--
+		l.streak = 0
+	}
+}
+
+// isOverloaded returns true if a request failed because it was too large or
+// took too long, rather than because the caller gave up.
+func isOverloaded(ctx context.Context, code int, err error) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusRequestEntityTooLarge, http.StatusGatewayTimeout:
+		return true
+	}
+	var netErr net.Error
+	return err != nil && ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (l *limits) requestSizeLimit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.requestSize
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBudget limits the total size of buffers held at once. Callers acquire
+// the size of a buffer before filling it and release it once the buffer is
+// returned to the pool, blocking while the budget is exhausted.
+//
+// A nil budget is unlimited.
+type memoryBudget struct {
+	lock    sync.Mutex
+	limit   int64
+	used    int64
+	waiters []*budgetWaiter // First in, first out.
+}
+
+type budgetWaiter struct {
+	size  int64
+	ready chan struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+// acquire reserves size bytes, blocking until they are available or the
+// context is done. Requests larger than the whole budget wait until no other
+// buffers are held.
+func (b *memoryBudget) acquire(ctx context.Context, size int64) error {
+	if b == nil {
+		return nil
+	}
+	size = b.clamp(size)
+
+	b.lock.Lock()
+	if len(b.waiters) == 0 && b.used+size <= b.limit {
+		b.used += size
+		b.lock.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{size: size, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		select {
+		case <-w.ready:
+			// Acquired while cancelling; give it back.
+			b.used -= size
+		default:
+			for i, waiter := range b.waiters {
+				if waiter == w {
+					b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		b.notify()
+		return ctx.Err()
+	}
+}
+
+// tryAcquire reserves size bytes if they are available now, without waiting.
+func (b *memoryBudget) tryAcquire(size int64) bool {
+	if b == nil {
+		return true
+	}
+	size = b.clamp(size)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.waiters) != 0 || b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+// release returns size bytes to the budget. The size must match the size
+// passed to acquire.
+func (b *memoryBudget) release(size int64) {
+	if b == nil {
+		return
+	}
+	size = b.clamp(size)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= size
+	b.notify()
+}
+
+func (b *memoryBudget) clamp(size int64) int64 {
+	if size > b.limit {
+		return b.limit
+	}
+	return size
+}
+
+// notify wakes waiters in order while they fit. Must be called with the lock held.
+func (b *memoryBudget) notify() {
+	for len(b.waiters) != 0 {
+		w := b.waiters[0]
+		if b.used+w.size > b.limit {
+			return
+		}
+		b.used += w.size
+		b.waiters = b.waiters[1:]
+		close(w.ready)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+type metadataKey struct{}
+
+// WithMetadata returns a context carrying a metadata value, such as a job or
+// experiment ID, which the client forwards with every request made under the
+// context so that server logs can attribute traffic to workloads. Values are
+// also included in trace logs and in the detail of API errors.
+//
+// The key must be a valid HTTP header name. Metadata already on the context
+// is kept unless it has the same key.
+func WithMetadata(ctx context.Context, key, value string) context.Context {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	old := MetadataFromContext(ctx)
+	md := make(map[string]string, len(old)+1)
+	for k, v := range old {
+		md[k] = v
+	}
+	md[key] = value
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the metadata attached to a context with
+// WithMetadata. The result must not be modified.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// setMetadataHeaders adds a context's metadata to a request.
+func setMetadataHeaders(ctx context.Context, header http.Header) {
+	for key, value := range MetadataFromContext(ctx) {
+		header.Set(api.HeaderMetadataPrefix+key, value)
+	}
+}
+
+// metadataFromHeader recovers request metadata from a request's headers.
+func metadataFromHeader(header http.Header) map[string]string {
+	var md map[string]string
+	for key := range header {
+		if strings.HasPrefix(key, api.HeaderMetadataPrefix) {
+			if md == nil {
+				md = map[string]string{}
+			}
+			md[strings.TrimPrefix(key, api.HeaderMetadataPrefix)] = header.Get(key)
+		}
+	}
+	return md
+}
+
+// deleteMetadataHeaders removes request metadata before a request leaves the
+// FileHeap service.
+func deleteMetadataHeaders(header http.Header) {
+	for key := range header {
+		if strings.HasPrefix(key, api.HeaderMetadataPrefix) {
+			header.Del(key)
+		}
+	}
+}
+
+// formatMetadata renders metadata as sorted key=value pairs.
+func formatMetadata(md map[string]string) string {
+	pairs := make([]string, 0, len(md))
+	for key, value := range md {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
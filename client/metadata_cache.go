@@ -0,0 +1,149 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// metadataCache is a bounded LRU cache of file metadata and manifest pages.
+//
+// Entries are keyed by a per-dataset generation. Mutating a dataset through the
+// client advances its generation, so stale entries are never returned and age
+// out of the cache. Callers must read the generation before sending a request
+// and store its result under that generation, so that results racing with a
+// write are discarded.
+//
+// A nil cache is disabled.
+type metadataCache struct {
+	lock        sync.Mutex
+	maxEntries  int
+	order       *list.List // Most recently used first.
+	entries     map[cacheKey]*list.Element
+	generations map[string]uint64
+}
+
+type cacheKind int
+
+const (
+	fileInfoEntry cacheKind = iota
+	manifestEntry
+)
+
+type cacheKey struct {
+	kind       cacheKind
+	dataset    string
+	generation uint64
+
+	// File path for file info, or encoded query for manifest pages.
+	key string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+}
+
+func newMetadataCache(maxEntries int) *metadataCache {
+	return &metadataCache{
+		maxEntries:  maxEntries,
+		order:       list.New(),
+		entries:     map[cacheKey]*list.Element{},
+		generations: map[string]uint64{},
+	}
+}
+
+// generation returns the current generation of a dataset.
+func (c *metadataCache) generation(dataset string) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generations[dataset]
+}
+
+// invalidate discards all entries for a dataset. It must be called whenever
+// the client modifies a dataset.
+func (c *metadataCache) invalidate(dataset string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generations[dataset]++
+}
+
+func (c *metadataCache) fileInfo(dataset string, generation uint64, path string) (*api.FileInfo, bool) {
+	value, ok := c.get(cacheKey{fileInfoEntry, dataset, generation, path})
+	if !ok {
+		return nil, false
+	}
+	info := *value.(*api.FileInfo)
+	return &info, true
+}
+
+func (c *metadataCache) putFileInfo(dataset string, generation uint64, info *api.FileInfo) {
+	value := *info
+	c.put(cacheKey{fileInfoEntry, dataset, generation, info.Path}, &value)
+}
+
+func (c *metadataCache) manifestPage(dataset string, generation uint64, query string) (*api.ManifestPage, bool) {
+	value, ok := c.get(cacheKey{manifestEntry, dataset, generation, query})
+	if !ok {
+		return nil, false
+	}
+	return value.(*api.ManifestPage), true
+}
+
+func (c *metadataCache) putManifestPage(
+	dataset string,
+	generation uint64,
+	query string,
+	page *api.ManifestPage,
+) {
+	c.put(cacheKey{manifestEntry, dataset, generation, query}, page)
+}
+
+func (c *metadataCache) get(key cacheKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+func (c *metadataCache) put(key cacheKey, value interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key.generation != c.generations[key.dataset] {
+		// The dataset changed while the value was being fetched.
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -1,5 +1,10 @@
 package client
 
+import (
+	"net/http"
+	"time"
+)
+
 // Option allows a caller to configure additional options on a client.
 type Option interface {
 	Apply(c *Client)
@@ -15,3 +20,300 @@ type withToken string
 func (o withToken) Apply(c *Client) {
 	c.token = string(o)
 }
+
+// WithoutRedirects returns an Option which prevents downloads from being
+// redirected to blob storage. Use this in environments that can only reach the
+// FileHeap service itself.
+func WithoutRedirects() Option {
+	return withoutRedirects{}
+}
+
+type withoutRedirects struct{}
+
+func (o withoutRedirects) Apply(c *Client) {
+	c.noRedirects = true
+}
+
+// WithUploadChunkSize returns an Option which sets the size in bytes of each
+// chunk sent when uploading large files. Larger chunks improve throughput on
+// high-latency links, while smaller chunks reduce memory use. Each upload
+// holds up to two chunks in memory. Defaults to the request size limit.
+func WithUploadChunkSize(size int64) Option {
+	return withUploadChunkSize(size)
+}
+
+type withUploadChunkSize int64
+
+func (o withUploadChunkSize) Apply(c *Client) {
+	c.chunkSize = int64(o)
+}
+
+// WithMaxBufferMemory returns an Option which limits the total size in bytes
+// of file data buffered in memory by the client at once. Operations block
+// until enough memory is available. A single buffer larger than the limit
+// waits until no other buffers are held.
+func WithMaxBufferMemory(limit int64) Option {
+	return withMaxBufferMemory(limit)
+}
+
+type withMaxBufferMemory int64
+
+func (o withMaxBufferMemory) Apply(c *Client) {
+	if o > 0 {
+		c.memory = newMemoryBudget(int64(o))
+	}
+}
+
+// WithMetadataCache returns an Option which caches up to maxEntries file infos
+// and manifest pages in memory. Cached entries for a dataset are discarded
+// whenever the client modifies it, but changes made by other clients are not
+// observed until entries are evicted. This benefits interactive tools which
+// repeatedly list and stat the same files.
+func WithMetadataCache(maxEntries int) Option {
+	return withMetadataCache(maxEntries)
+}
+
+type withMetadataCache int
+
+func (o withMetadataCache) Apply(c *Client) {
+	if o > 0 {
+		c.cache = newMetadataCache(int(o))
+	}
+}
+
+// WithConditionalRequests returns an Option which remembers up to maxEntries
+// dataset infos and manifest pages along with their ETag and Last-Modified
+// validators. Repeated requests are made conditional, so an unchanged response
+// costs the server a 304 instead of its whole body. Unlike WithMetadataCache,
+// every request still reaches the server, so results are never stale. This
+// benefits tools which poll the same dataset every few seconds.
+func WithConditionalRequests(maxEntries int) Option {
+	return withConditionalRequests(maxEntries)
+}
+
+type withConditionalRequests int
+
+func (o withConditionalRequests) Apply(c *Client) {
+	if o > 0 {
+		c.validators = newValidatorCache(int(o))
+	}
+}
+
+// WithBatchSizeLimit returns an Option which caps the number of files sent in
+// a single batch request. Use this for servers that enforce a smaller limit
+// than api.BatchSizeLimit. Limits above the default are ignored.
+func WithBatchSizeLimit(limit int) Option {
+	return withBatchSizeLimit(limit)
+}
+
+type withBatchSizeLimit int
+
+func (o withBatchSizeLimit) Apply(c *Client) {
+	c.limits.lower(int(o), 0)
+}
+
+// WithRequestSizeLimit returns an Option which caps the size in bytes of a
+// single request. Files larger than the limit are sent through the upload API
+// in chunks of at most the limit. Use this for servers that enforce a smaller
+// limit than api.PutFileSizeLimit. Limits above the default are ignored.
+func WithRequestSizeLimit(limit int64) Option {
+	return withRequestSizeLimit(limit)
+}
+
+type withRequestSizeLimit int64
+
+func (o withRequestSizeLimit) Apply(c *Client) {
+	c.limits.lower(0, int64(o))
+}
+
+// WithMaxPooledBufferSize returns an Option which discards buffers that grow
+// beyond size bytes instead of keeping them for reuse. This bounds the memory
+// an idle client retains after transferring large files.
+func WithMaxPooledBufferSize(size int) Option {
+	return withMaxPooledBufferSize(size)
+}
+
+type withMaxPooledBufferSize int
+
+func (o withMaxPooledBufferSize) Apply(c *Client) {
+	c.buffers.maxSize = int(o)
+}
+
+// WithMaxIdleConnsPerHost returns an Option which sets the number of idle
+// connections the client keeps open to each host. Raise this when using high
+// concurrency against a single server. Defaults to 2.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return withMaxIdleConnsPerHost(n)
+}
+
+type withMaxIdleConnsPerHost int
+
+func (o withMaxIdleConnsPerHost) Apply(c *Client) {
+	if transport, ok := c.client.Transport.(*http.Transport); ok {
+		transport.MaxIdleConnsPerHost = int(o)
+	}
+}
+
+// WithResponseHeaderTimeout returns an Option which limits how long the client
+// waits for the server to begin responding to a request, such as while it
+// prepares a batch download. Zero waits indefinitely. Defaults to one minute.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return withResponseHeaderTimeout(d)
+}
+
+type withResponseHeaderTimeout time.Duration
+
+func (o withResponseHeaderTimeout) Apply(c *Client) {
+	if transport, ok := c.client.Transport.(*http.Transport); ok {
+		transport.ResponseHeaderTimeout = time.Duration(o)
+	}
+}
+
+// WithIdleTimeout returns an Option which fails batch downloads that receive
+// no data for the given duration. Batch downloads have no overall time limit,
+// so slow transfers succeed as long as data keeps arriving, while stalled ones
+// fail promptly. Zero disables the limit. Defaults to one minute.
+func WithIdleTimeout(d time.Duration) Option {
+	return withIdleTimeout(d)
+}
+
+type withIdleTimeout time.Duration
+
+func (o withIdleTimeout) Apply(c *Client) {
+	c.idleTimeout = time.Duration(o)
+}
+
+// WithOrderCheck returns an Option which makes file iterators return an error
+// if the server lists files out of ascending path order, or lists a path twice.
+// Use this in tools which rely on manifest order for correctness.
+func WithOrderCheck() Option {
+	return withOrderCheck{}
+}
+
+type withOrderCheck struct{}
+
+func (o withOrderCheck) Apply(c *Client) {
+	c.checkOrder = true
+}
+
+// WithSharedReads returns an Option which lets concurrent reads of the same
+// range of a file share one request, such as when many goroutines in a data
+// loader open the same file at once. Reads which begin while an identical
+// request awaits its response receive a copy of its body instead of sending
+// their own. Readers sharing a response advance together, so each must keep
+// reading or be closed for the others to make progress.
+func WithSharedReads() Option {
+	return withSharedReads{}
+}
+
+type withSharedReads struct{}
+
+func (o withSharedReads) Apply(c *Client) {
+	c.shared = newSharedReads()
+}
+
+// WithDeltaUploads returns an Option which lets uploads of large files that
+// replace an existing file send only the blocks which changed. Unchanged
+// blocks are copied by the server from the existing file. This saves most of
+// the transfer when a small part of a large file is modified in place or
+// appended to, such as a growing log or a checkpoint with few updated layers.
+//
+// This is an aligned-block delta: blocks are cut at multiples of the existing
+// file's chunk size and compared by digest, so data inserted or removed
+// partway through a file causes everything after it to be sent. Use
+// WithContentDefinedChunking for files edited that way. Servers without
+// support for copying chunks receive the whole file.
+func WithDeltaUploads() Option {
+	return withDeltaUploads{}
+}
+
+type withDeltaUploads struct{}
+
+func (o withDeltaUploads) Apply(c *Client) {
+	c.deltaUploads = true
+}
+
+// WithContentDefinedChunking returns an Option which writes files too large
+// for a single request as content-defined chunks. Each chunk is uploaded only
+// if the server doesn't already have it, from any file in any dataset, so new
+// versions of large files and copies of files with shared contents transfer
+// only the data which is new. Boundaries between chunks depend on the data
+// around them, so unlike WithDeltaUploads, data inserted or removed partway
+// through a file only changes the chunks around it.
+//
+// Use UpdateLocalFile to download such files reusing chunks of a local copy.
+// Servers without support for chunked files receive the whole file. This
+// takes precedence over WithDeltaUploads.
+func WithContentDefinedChunking() Option {
+	return withContentDefinedChunking{}
+}
+
+type withContentDefinedChunking struct{}
+
+func (o withContentDefinedChunking) Apply(c *Client) {
+	c.cdcUploads = true
+}
+
+// WithNamespace returns an Option which creates datasets in the given
+// namespace, such as a team's, on servers shared by several tenants. Listings
+// of datasets only include those in the namespace unless their filter names
+// another. Datasets in other namespaces can still be used by ID.
+func WithNamespace(namespace string) Option {
+	return withNamespace(namespace)
+}
+
+type withNamespace string
+
+func (o withNamespace) Apply(c *Client) {
+	c.namespace = string(o)
+}
+
+// WithUserAgent returns an Option which identifies the tool using the client in
+// the User-Agent header of every request, such as "mytool/1.2". The client's
+// own product token is appended, so server logs can attribute traffic to the
+// tool while still showing the client version.
+func WithUserAgent(product string) Option {
+	return withUserAgent(product)
+}
+
+type withUserAgent string
+
+func (o withUserAgent) Apply(c *Client) {
+	if o != "" {
+		c.userAgent = string(o) + " " + userAgent
+	}
+}
+
+// WithHedgedReads returns an Option which sends reads, such as of file infos,
+// manifest pages, and file contents, a second time if no response has begun
+// after the given delay. Whichever response begins first is used and the other
+// request is cancelled. This smooths out long-tail latency, such as during
+// large manifest walks, at the cost of extra requests: a delay near the
+// server's 95th percentile latency hedges about one read in twenty. Zero
+// disables hedging, which is the default.
+func WithHedgedReads(delay time.Duration) Option {
+	return withHedgedReads(delay)
+}
+
+type withHedgedReads time.Duration
+
+func (o withHedgedReads) Apply(c *Client) {
+	c.hedgeDelay = time.Duration(o)
+}
+
+// WithGRPC returns an Option which sends metadata operations, such as creating
+// and sealing datasets, listing manifests, and coordinating chunked uploads,
+// to the server's gRPC endpoint at the given address. Each call costs less than
+// an HTTP request, which matters for very chatty workloads. File contents are
+// still sent over HTTP. Operations the endpoint doesn't implement fall back to
+// HTTP. The address is in the form [scheme://]host[:port], where scheme
+// defaults to "https"; plain "http" endpoints must accept HTTP/2 without TLS.
+func WithGRPC(address string) Option {
+	return withGRPC(address)
+}
+
+type withGRPC string
+
+func (o withGRPC) Apply(c *Client) {
+	c.grpcAddress = string(o)
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+
+	"github.com/pkg/errors"
+)
+
+// Size of each buffer filled by read-ahead.
+const readAheadChunkSize = 64 * 1024
+
+// readAhead reads the parts of a batch response in the background, holding
+// a bounded amount of data, so that network reads of later files overlap with
+// the caller's processing of earlier ones.
+//
+// For each part, the reader sends a start message, which carries an error if
+// the part could not be read, followed by data chunks and finally io.EOF.
+type readAhead struct {
+	chunks  chan readAheadChunk
+	done    chan struct{}
+	current *readAheadPart
+}
+
+type readAheadChunk struct {
+	data []byte
+	err  error
+}
+
+// startReadAhead reads the given number of parts from mr, buffering up to
+// limit bytes. The batchErr function describes a batch which ends early.
+func startReadAhead(
+	ctx context.Context,
+	mr *multipart.Reader,
+	parts int,
+	limit int64,
+	batchErr func() error,
+) *readAhead {
+	capacity := int(limit / readAheadChunkSize)
+	if capacity < 1 {
+		capacity = 1
+	}
+	ra := &readAhead{
+		chunks: make(chan readAheadChunk, capacity),
+		done:   make(chan struct{}),
+	}
+	go ra.run(ctx, mr, parts, batchErr)
+	return ra
+}
+
+func (ra *readAhead) run(ctx context.Context, mr *multipart.Reader, parts int, batchErr func() error) {
+	defer close(ra.chunks)
+
+	send := func(c readAheadChunk) bool {
+		select {
+		case ra.chunks <- c:
+			return true
+		case <-ra.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for i := 0; i < parts; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			send(readAheadChunk{err: batchErr()})
+			return
+		}
+		if !send(readAheadChunk{}) {
+			return
+		}
+
+		for {
+			buf := make([]byte, readAheadChunkSize)
+			n, err := io.ReadFull(part, buf)
+			if n > 0 && !send(readAheadChunk{data: buf[:n]}) {
+				return
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if !send(readAheadChunk{err: io.EOF}) {
+					return
+				}
+				break
+			}
+			if err != nil {
+				send(readAheadChunk{err: errors.WithStack(err)})
+				return
+			}
+		}
+	}
+}
+
+// next returns a reader for the next part, skipping whatever the caller left
+// unread of the previous one.
+func (ra *readAhead) next() (io.ReadCloser, error) {
+	if ra.current != nil {
+		if err := ra.current.drain(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, ok := <-ra.chunks
+	if !ok {
+		return nil, errors.WithStack(io.ErrUnexpectedEOF)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	ra.current = &readAheadPart{ra: ra}
+	return ra.current, nil
+}
+
+// stop the background reader.
+func (ra *readAhead) stop() {
+	close(ra.done)
+}
+
+// readAheadPart reads a single part from the read-ahead buffer.
+type readAheadPart struct {
+	ra  *readAhead
+	buf []byte
+	err error
+}
+
+func (p *readAheadPart) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		c, ok := <-p.ra.chunks
+		if !ok {
+			p.err = errors.WithStack(io.ErrUnexpectedEOF)
+			continue
+		}
+		if c.err != nil {
+			p.err = c.err
+			continue
+		}
+		p.buf = c.data
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// Close is a no-op; unread data is skipped when the next part is requested.
+func (p *readAheadPart) Close() error {
+	return nil
+}
+
+// drain discards the rest of the part, returning any error other than io.EOF.
+func (p *readAheadPart) drain() error {
+	p.buf = nil
+	for p.err == nil {
+		c, ok := <-p.ra.chunks
+		if !ok {
+			return errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		p.err = c.err
+	}
+	if p.err == io.EOF {
+		return nil
+	}
+	return p.err
+}
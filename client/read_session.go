@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Time before a read session expires at which it is renewed.
+const readSessionRenewal = 30 * time.Second
+
+// ReadSession reads files with a short-lived token issued for a dataset or a
+// single file. The server checks the token without the lookups needed to
+// authorize the client's own credentials, which helps workloads that issue
+// many small ranged reads, such as FUSE mounts. The token is renewed as it
+// nears expiry.
+//
+// Sessions are safe for concurrent use.
+type ReadSession struct {
+	dataset *DatasetRef
+	path    string
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewReadSession opens a read session. If filename is not empty, the session
+// may only read that file.
+func (d *DatasetRef) NewReadSession(ctx context.Context, filename string) (*ReadSession, error) {
+	s := &ReadSession{dataset: d, path: filename}
+	if _, err := s.currentToken(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Expires returns the time at which the session's current token expires.
+func (s *ReadSession) Expires() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.expires
+}
+
+// currentToken returns a token valid for at least readSessionRenewal,
+// requesting a new one if needed.
+func (s *ReadSession) currentToken(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token != "" && time.Until(s.expires) > readSessionRenewal {
+		return s.token, nil
+	}
+
+	d := s.dataset
+	path := path.Join("/datasets", d.id, "sessions")
+	resp, err := d.client.sendRequest(ctx, http.MethodPost, path, nil, &api.ReadSessionSpec{Path: s.path})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var body api.ReadSession
+	if err := parseResponse(resp, &body); err != nil {
+		return "", err
+	}
+	if body.Token == "" {
+		return "", errors.New("service returned empty session token")
+	}
+	s.token, s.expires = body.Token, body.Expires
+	return s.token, nil
+}
+
+// ReadFileRange reads at most length bytes from a file starting at the given
+// offset. If length is negative, the file is read until the end. Length must
+// not be zero.
+//
+// If the file doesn't exist, this returns ErrFileNotFound.
+func (s *ReadSession) ReadFileRange(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+	if length == 0 {
+		return nil, errors.New("length must not be zero")
+	}
+	if s.path != "" && filename != s.path {
+		return nil, errors.Errorf("read session is limited to %s", s.path)
+	}
+
+	token, err := s.currentToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.dataset.newRangeRequest(filename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.dataset.sendRangeRequest(ctx, req)
+}
+
+// Open returns a file which reads through the session.
+func (s *ReadSession) Open(ctx context.Context, filename string) *SessionFile {
+	return &SessionFile{ctx: ctx, session: s, path: filename}
+}
+
+// SessionFile reads a file through a ReadSession.
+type SessionFile struct {
+	ctx     context.Context
+	session *ReadSession
+	path    string
+}
+
+// ReadAt implements io.ReaderAt. Each call makes a single ranged request.
+func (f *SessionFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r, err := f.session.ReadFileRange(f.ctx, f.path, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		// Reads past the end of the file are short.
+		err = io.EOF
+	}
+	return n, errors.WithStack(err)
+}
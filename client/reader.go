@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Reader reads a file or a range of it from a dataset.
+//
+// If the connection fails mid-read, such as when reading takes longer than the
+// HTTP client's timeout, the Reader requests the rest of the range and carries
+// on from where it left off. By default it resumes for as long as each attempt
+// makes progress; see WithRetries.
+//
+// When verifying, the Reader hashes the whole file as it is read and returns an
+// error instead of io.EOF if the digest does not match, so callers must read to
+// the end for the file to be verified.
+//
+// A Reader is not safe for concurrent reads, but BytesRead and Resumes may be
+// called from any goroutine, such as to report progress.
+type Reader struct {
+	dataset *DatasetRef
+	ctx     context.Context
+	cancel  context.CancelFunc
+	path    string
+	retries int
+
+	// Remaining range to read. A negative length reads to the end of the file.
+	offset int64
+	length int64
+
+	// Current response body, or nil after it failed.
+	body io.ReadCloser
+
+	// Bytes read from the current body.
+	progress int64
+
+	// Hash of the whole file and its expected digest, if verifying.
+	hash   hash.Hash
+	digest []byte
+
+	// First error which ended the read, returned by every later Read.
+	err error
+
+	bytesRead int64
+	resumes   int64
+}
+
+// NewReader opens a file for reading, starting at the given offset. At most
+// length bytes are read, or the whole file if length is negative. Length must
+// not be zero. See WithTimeout, WithVerify, and WithRetries for the call
+// options it accepts; only whole files can be verified, so use OpenVerified
+// to verify a partial range.
+//
+// If the file doesn't exist, this returns ErrFileNotFound.
+//
+// The caller must call Close when finished reading.
+func (d *DatasetRef) NewReader(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	opts ...CallOption,
+) (*Reader, error) {
+	o := d.client.callOptions(opts)
+	if o.verify && (offset != 0 || length >= 0) {
+		return nil, errors.New("only whole files can be verified; use OpenVerified for ranges")
+	}
+
+	ctx, cancel := o.context(ctx)
+	var digest []byte
+	if o.verify {
+		info, err := d.FileInfo(ctx, filename)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		digest = info.Digest
+	}
+
+	r, err := d.openReader(ctx, filename, offset, length, o.retries, digest)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.cancel = cancel
+	return r, nil
+}
+
+// openReader opens a Reader within an existing call. If digest is not nil, the
+// reader verifies the whole file against it.
+func (d *DatasetRef) openReader(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	retries int,
+	digest []byte,
+) (*Reader, error) {
+	body, err := d.readFileRange(ctx, filename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		dataset: d,
+		ctx:     ctx,
+		path:    filename,
+		retries: retries,
+		offset:  offset,
+		length:  length,
+		body:    body,
+	}
+	if digest != nil {
+		r.hash = sha256.New()
+		r.digest = digest
+	}
+	return r, nil
+}
+
+// Read reads from the file, resuming the request if the connection fails.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if r.body == nil {
+			// The range was read to the end just as the connection failed.
+			if r.length == 0 {
+				return 0, r.finish()
+			}
+
+			body, err := r.dataset.readFileRange(r.ctx, r.path, r.offset, r.length)
+			if err != nil {
+				r.err = err
+				return 0, err
+			}
+			r.body = body
+			r.progress = 0
+		}
+
+		n, err := r.body.Read(p)
+		r.advance(p[:n])
+		if err == nil {
+			return n, nil
+		}
+		if err == io.EOF {
+			if ferr := r.finish(); ferr != io.EOF {
+				return n, ferr
+			}
+			return n, io.EOF
+		}
+
+		r.body.Close()
+		r.body = nil
+		if r.progress == 0 || (r.retries >= 0 && int(r.Resumes()) >= r.retries) {
+			r.err = errors.WithStack(err)
+			return n, r.err
+		}
+		atomic.AddInt64(&r.resumes, 1)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// advance records bytes read from the current body.
+func (r *Reader) advance(p []byte) {
+	n := int64(len(p))
+	r.offset += n
+	if r.length > 0 {
+		r.length -= n
+	}
+	r.progress += n
+	atomic.AddInt64(&r.bytesRead, n)
+	if r.hash != nil {
+		r.hash.Write(p)
+	}
+}
+
+// finish ends a successful read, verifying the file's digest if required.
+func (r *Reader) finish() error {
+	r.err = io.EOF
+	if r.hash != nil && !bytes.Equal(r.hash.Sum(nil), r.digest) {
+		r.err = errors.Errorf("%s has incorrect digest", r.path)
+	}
+	return r.err
+}
+
+// BytesRead returns the number of bytes read so far.
+func (r *Reader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.bytesRead)
+}
+
+// Resumes returns the number of times the read was resumed after the
+// connection failed.
+func (r *Reader) Resumes() int {
+	return int(atomic.LoadInt64(&r.resumes))
+}
+
+// Close stops reading and releases the reader's connection.
+func (r *Reader) Close() error {
+	var err error
+	if r.body != nil {
+		err = r.body.Close()
+		r.body = nil
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.err == nil {
+		r.err = errors.New("read after close")
+	}
+	return err
+}
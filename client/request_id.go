@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying a request ID, which the client
+// sends in the X-Request-ID header of every request made under the context in
+// place of the ID it would otherwise generate for each request. Use this to
+// correlate a caller's own logs, or a trace spanning several services, with
+// server logs.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID attached to a context with
+// WithRequestID, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// setRequestID identifies a request by the context's request ID, or by a new
+// random ID. A request which already has an ID, such as one being retried,
+// keeps it, so that every attempt can be found under the same ID.
+func setRequestID(ctx context.Context, header http.Header) {
+	if header.Get(api.HeaderRequestID) != "" {
+		return
+	}
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return
+		}
+		id = hex.EncodeToString(b[:])
+	}
+	header.Set(api.HeaderRequestID, id)
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// requestAttempts is the number of times an idempotent request is sent before
+// its failure is returned.
+const requestAttempts = 3
+
+// isRetryable returns true if a request which failed with the given status
+// code may succeed if sent again.
+func isRetryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// isTransient returns true if a request which failed with the given error,
+// such as a connection reset, may succeed if sent again.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isIdempotent returns true if a request may safely be sent more than once.
+// Updates are idempotent only if they carry an idempotency key.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut:
+		return true
+	}
+	return req.Header.Get(api.HeaderIdempotencyKey) != ""
+}
+
+// doRetry sends a request. Idempotent requests which fail with a transient
+// error or a retryable status are sent again, up to requestAttempts times in
+// all, waiting a little longer before each attempt. The request's body must
+// be rewindable through GetBody, as it is for in-memory bodies.
+func (c *Client) doRetry(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req) || (req.Body != nil && req.GetBody == nil) {
+		return c.do(ctx, req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.doHedged(ctx, req)
+		if attempt == requestAttempts {
+			return resp, err
+		}
+		if err != nil && !isTransient(ctx, err) {
+			return nil, err
+		}
+		if err == nil {
+			if !isRetryable(resp.StatusCode) {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+
+		if err := sleep(ctx, time.Duration(attempt)*time.Second); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			req.Body = body
+		}
+	}
+}
+
+// statusCode returns the status code of a response, or zero if there is none.
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newIdempotencyKey returns a random key identifying a request across retries.
+func newIdempotencyKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(key[:]), nil
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// SealCheck validates a dataset before SealWithChecks seals it. File is called
+// with each file in manifest order, then Done once every file has been seen.
+// Each returns a description of any problem found, or nil.
+type SealCheck interface {
+	File(info *api.FileInfo) error
+	Done() error
+}
+
+// SealReport describes the checks of a dataset by SealWithChecks.
+type SealReport struct {
+	// Files and bytes in the dataset when it was checked.
+	Files int64
+	Bytes int64
+
+	// Problems found by the checks. The dataset is sealed only if there are
+	// none.
+	Problems []string
+
+	// Whether the dataset was sealed.
+	Sealed bool
+}
+
+// Err returns an error matching ErrSealRejected which describes the problems
+// found, or nil if there were none.
+func (r *SealReport) Err() error {
+	switch len(r.Problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Wrap(ErrSealRejected, r.Problems[0])
+	default:
+		return errors.Wrapf(ErrSealRejected, "%s (and %d more problems)", r.Problems[0], len(r.Problems)-1)
+	}
+}
+
+// SealWithChecks walks the dataset's manifest and seals it only if every
+// check passes. The report describes the dataset and any problems found; if
+// there are problems, the returned error matches ErrSealRejected and the
+// dataset is left writable.
+//
+// Files written while the checks run are not covered by them. If the sealed
+// manifest differs from the one checked, the dataset remains sealed and an
+// error is returned.
+func (d *DatasetRef) SealWithChecks(ctx context.Context, checks ...SealCheck) (*SealReport, error) {
+	report := &SealReport{}
+	var hash api.ManifestHash
+	files := d.Files(ctx, nil)
+	for {
+		info, err := nextFile(ctx, files)
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Files++
+		report.Bytes += info.Size
+		if err := hash.Add(info.Path, info.Digest); err != nil {
+			return nil, err
+		}
+		for _, check := range checks {
+			if err := check.File(info); err != nil {
+				report.Problems = append(report.Problems, err.Error())
+			}
+		}
+	}
+	for _, check := range checks {
+		if err := check.Done(); err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		}
+	}
+	if err := report.Err(); err != nil {
+		return report, err
+	}
+
+	if err := d.Seal(ctx); err != nil {
+		return report, err
+	}
+	report.Sealed = true
+
+	info, err := d.Info(ctx)
+	if err != nil {
+		return report, err
+	}
+	if info.ManifestDigest != nil && !bytes.Equal(info.ManifestDigest, hash.Sum()) {
+		return report, errors.New("dataset changed while it was checked and was sealed with unchecked files")
+	}
+	return report, nil
+}
+
+// RequireFiles returns a SealCheck which fails if any of the given paths is
+// not a file in the dataset.
+func RequireFiles(paths ...string) SealCheck {
+	missing := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		missing[path] = true
+	}
+	return &requireFiles{missing: missing}
+}
+
+type requireFiles struct {
+	missing map[string]bool
+}
+
+func (c *requireFiles) File(info *api.FileInfo) error {
+	delete(c.missing, info.Path)
+	return nil
+}
+
+func (c *requireFiles) Done() error {
+	if len(c.missing) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(c.missing))
+	for path := range c.missing {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return errors.Errorf("missing required files: %v", paths)
+}
+
+// MaxSize returns a SealCheck which fails if the dataset has more than
+// maxFiles files or maxBytes bytes in total. A limit of zero is ignored.
+func MaxSize(maxFiles, maxBytes int64) SealCheck {
+	return &maxSize{maxFiles: maxFiles, maxBytes: maxBytes}
+}
+
+type maxSize struct {
+	maxFiles, maxBytes int64
+	files, bytes       int64
+}
+
+func (c *maxSize) File(info *api.FileInfo) error {
+	c.files++
+	c.bytes += info.Size
+	return nil
+}
+
+func (c *maxSize) Done() error {
+	if c.maxFiles > 0 && c.files > c.maxFiles {
+		return errors.Errorf("dataset has %d files, more than the limit of %d", c.files, c.maxFiles)
+	}
+	if c.maxBytes > 0 && c.bytes > c.maxBytes {
+		return errors.Errorf("dataset has %d bytes, more than the limit of %d", c.bytes, c.maxBytes)
+	}
+	return nil
+}
+
+// CheckEachFile returns a SealCheck which calls fn with each file and fails
+// if it returns an error for any of them, such as to reject empty files.
+func CheckEachFile(fn func(info *api.FileInfo) error) SealCheck {
+	return checkEachFile(fn)
+}
+
+type checkEachFile func(info *api.FileInfo) error
+
+func (c checkEachFile) File(info *api.FileInfo) error {
+	if err := c(info); err != nil {
+		return errors.Wrap(err, info.Path)
+	}
+	return nil
+}
+
+func (c checkEachFile) Done() error { return nil }
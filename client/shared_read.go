@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// sharedReads lets concurrent reads of the same range of a file share one
+// request. Reads which begin while an identical request awaits its response
+// join it, and the response body is copied to each of them as it arrives.
+type sharedReads struct {
+	mu      sync.Mutex
+	flights map[string]*readFlight
+}
+
+func newSharedReads() *sharedReads {
+	return &sharedReads{flights: map[string]*readFlight{}}
+}
+
+// readFlight is a request shared by one or more reads.
+type readFlight struct {
+	// Closed once the response arrives, after which err is set and readers is
+	// no longer modified.
+	done chan struct{}
+	err  error
+
+	// Pipes to each read waiting for the response. Guarded by sharedReads.mu.
+	readers []*io.PipeWriter
+}
+
+// readFileRangeKey identifies a range of a file for sharing reads.
+func readFileRangeKey(dataset, filename string, offset, length int64) string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d", dataset, filename, offset, length)
+}
+
+// read joins the request in flight for the key, or starts one with open if
+// there is none, and returns a reader of its response body. The request is not
+// canceled with ctx, since other reads may share it; it ends once every reader
+// is closed.
+func (s *sharedReads) read(
+	ctx context.Context,
+	key string,
+	open func(ctx context.Context) (io.ReadCloser, error),
+) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+
+	s.mu.Lock()
+	flight, ok := s.flights[key]
+	if !ok {
+		flight = &readFlight{done: make(chan struct{})}
+		s.flights[key] = flight
+		go s.send(detachedContext{ctx}, key, flight, open)
+	}
+	flight.readers = append(flight.readers, pw)
+	s.mu.Unlock()
+
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		pr.CloseWithError(ctx.Err())
+		return nil, ctx.Err()
+	}
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	return pr, nil
+}
+
+// send sends a shared request and copies its response to every reader which
+// joined before it arrived.
+func (s *sharedReads) send(
+	ctx context.Context,
+	key string,
+	flight *readFlight,
+	open func(ctx context.Context) (io.ReadCloser, error),
+) {
+	body, err := open(ctx)
+
+	// Later reads start a new request, since they would miss what has been
+	// copied so far.
+	s.mu.Lock()
+	delete(s.flights, key)
+	readers := flight.readers
+	s.mu.Unlock()
+
+	flight.err = err
+	close(flight.done)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	// Readers advance together: each write waits for the reader to take it.
+	// Readers which have closed are dropped, and the request ends once none
+	// remain.
+	buf := make([]byte, 32*1024)
+	for len(readers) != 0 {
+		n, err := body.Read(buf)
+		if n > 0 {
+			live := readers[:0]
+			for _, w := range readers {
+				if _, werr := w.Write(buf[:n]); werr == nil {
+					live = append(live, w)
+				}
+			}
+			readers = live
+		}
+		if err != nil {
+			// Readers see io.EOF when closed with a nil error.
+			if err == io.EOF {
+				err = nil
+			}
+			for _, w := range readers {
+				w.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
+
+// detachedContext carries the values of a context, such as request metadata,
+// without its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// ShuffleOptions provides optional configuration to ShuffledFiles.
+type ShuffleOptions struct {
+	// Options for listing the dataset, such as a prefix. May be nil.
+	Files *FileIteratorOptions
+
+	// Shard the shuffled files among WorldSize workers, such as the processes
+	// of a distributed training job, and return only those for the worker
+	// numbered Rank, counting from zero. Every worker must list the same
+	// dataset with the same seed. Zero WorldSize returns every file.
+	Rank      int
+	WorldSize int
+
+	// Give every worker the same number of files by dropping the last few
+	// shuffled files when they can't be shared evenly, as distributed training
+	// typically requires.
+	EvenShards bool
+}
+
+// ShuffledFiles returns an iterator over files in the dataset in a random
+// order determined by the seed. The manifest is listed once, on the first call
+// to Next, and held in memory. The same seed always produces the same order
+// for the same files, so use a different seed for each epoch, such as the
+// epoch number added to a base seed. The options may be nil.
+func (d *DatasetRef) ShuffledFiles(ctx context.Context, seed int64, opts *ShuffleOptions) Iterator {
+	if opts == nil {
+		opts = &ShuffleOptions{}
+	}
+	return &shuffledIterator{ctx: ctx, dataset: d, seed: seed, opts: *opts}
+}
+
+// shuffledIterator returns a shuffled shard of a dataset's files.
+type shuffledIterator struct {
+	ctx     context.Context
+	dataset *DatasetRef
+	seed    int64
+	opts    ShuffleOptions
+
+	// Files remaining, once listed.
+	files  []*api.FileInfo
+	listed bool
+}
+
+func (i *shuffledIterator) Next() (*api.FileInfo, error) {
+	return i.NextContext(i.ctx)
+}
+
+func (i *shuffledIterator) NextContext(ctx context.Context) (*api.FileInfo, error) {
+	if !i.listed {
+		if err := i.list(ctx); err != nil {
+			return nil, err
+		}
+		i.listed = true
+	}
+	if len(i.files) == 0 {
+		return nil, ErrDone
+	}
+	info := i.files[0]
+	i.files = i.files[1:]
+	return info, nil
+}
+
+// list lists, shuffles, and shards the dataset's files.
+func (i *shuffledIterator) list(ctx context.Context) error {
+	rank, world := i.opts.Rank, i.opts.WorldSize
+	if world < 0 || (world == 0 && rank != 0) || (world > 0 && (rank < 0 || rank >= world)) {
+		return errors.Errorf("invalid rank %d of world size %d", rank, world)
+	}
+
+	var files []*api.FileInfo
+	it := i.dataset.Files(ctx, i.opts.Files)
+	for {
+		info, err := nextFile(ctx, it)
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, info)
+	}
+
+	// Manifests are sorted, so every worker shuffles the same list the same
+	// way.
+	r := rand.New(rand.NewSource(i.seed))
+	r.Shuffle(len(files), func(a, b int) { files[a], files[b] = files[b], files[a] })
+
+	if world <= 1 {
+		i.files = files
+		return nil
+	}
+	if i.opts.EvenShards {
+		files = files[:len(files)-len(files)%world]
+	}
+	shard := make([]*api.FileInfo, 0, len(files)/world+1)
+	for j := rank; j < len(files); j += world {
+		shard = append(shard, files[j])
+	}
+	i.files = shard
+	return nil
+}
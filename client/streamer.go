@@ -0,0 +1,283 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Defaults for StreamerOptions.
+const (
+	defaultStreamerPrefetch    = 8
+	defaultStreamerConcurrency = 4
+	defaultStreamerMemory      = 256 * 1024 * 1024
+)
+
+// StreamerOptions provides optional configuration to a DatasetStreamer. Zero
+// fields take their defaults.
+type StreamerOptions struct {
+	// Maximum number of files fetched ahead of the caller, including those
+	// still downloading. Defaults to 8.
+	Prefetch int
+
+	// Maximum number of files downloaded at once. Defaults to 4.
+	Concurrency int
+
+	// Maximum number of bytes of prefetched files held in memory, including
+	// the file the caller is reading. Defaults to 256 MiB.
+	MaxMemory int64
+
+	// Directory for temporary files holding prefetched files which don't fit
+	// in memory. If empty, prefetching pauses until the caller closes enough
+	// files to free the memory.
+	SpillDir string
+}
+
+// DatasetStreamer reads files from a dataset in the order of an iterator,
+// downloading upcoming files in the background while the caller processes the
+// current one. This keeps the network busy during sequential reads, such as
+// epochs of ML training over a dataset.
+//
+// Each file is verified against its digest before it is returned. Readers
+// must be closed to release the memory or disk space holding their file.
+type DatasetStreamer struct {
+	cancel context.CancelFunc
+	queue  chan *prefetchedFile
+	once   sync.Once
+}
+
+// prefetchedFile is a file downloaded ahead of the caller.
+type prefetchedFile struct {
+	info *api.FileInfo
+
+	// Closed once the file is downloaded or failed.
+	ready chan struct{}
+	err   error
+
+	// Contents of the file, held in memory or in a temporary file.
+	data   []byte
+	file   *os.File
+	memory *memoryBudget
+	size   int64 // Bytes acquired from memory.
+}
+
+// NewStreamer starts reading the files produced by the iterator in the
+// background. The options may be nil. Call Close when finished, even if every
+// file was read.
+func (d *DatasetRef) NewStreamer(ctx context.Context, files Iterator, opts *StreamerOptions) *DatasetStreamer {
+	if opts == nil {
+		opts = &StreamerOptions{}
+	}
+	prefetch := opts.Prefetch
+	if prefetch <= 0 {
+		prefetch = defaultStreamerPrefetch
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultStreamerConcurrency
+	}
+	maxMemory := opts.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultStreamerMemory
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &DatasetStreamer{
+		cancel: cancel,
+		// The caller holds one file, so the queue holds the rest.
+		queue: make(chan *prefetchedFile, prefetch-1),
+	}
+	go s.run(ctx, files, &prefetcher{
+		dataset:  d,
+		memory:   newMemoryBudget(maxMemory),
+		spillDir: opts.SpillDir,
+		slots:    make(chan struct{}, concurrency),
+	})
+	return s
+}
+
+// prefetcher downloads files for a DatasetStreamer.
+type prefetcher struct {
+	dataset  *DatasetRef
+	memory   *memoryBudget
+	spillDir string
+	slots    chan struct{} // Limits concurrent downloads.
+}
+
+// run lists files and starts downloading each in order, queueing them for the
+// caller. Memory is reserved in order too, so a later file never holds memory
+// an earlier one is waiting for.
+func (s *DatasetStreamer) run(ctx context.Context, files Iterator, p *prefetcher) {
+	defer close(s.queue)
+
+	for {
+		info, err := nextFile(ctx, files)
+		if err == ErrDone {
+			return
+		}
+		f := &prefetchedFile{info: info, ready: make(chan struct{}), memory: p.memory}
+		if err != nil {
+			f.err = err
+			close(f.ready)
+			s.queue <- f
+			return
+		}
+
+		if err := p.start(ctx, f); err != nil {
+			f.err = err
+			close(f.ready)
+			s.queue <- f
+			return
+		}
+		select {
+		case s.queue <- f:
+		case <-ctx.Done():
+			<-f.ready
+			f.discard()
+			return
+		}
+	}
+}
+
+// start reserves space for a file and begins downloading it.
+func (p *prefetcher) start(ctx context.Context, f *prefetchedFile) error {
+	if local(f.info) {
+		f.data = f.info.Data
+		close(f.ready)
+		return nil
+	}
+
+	spill := false
+	if p.spillDir == "" {
+		if err := p.memory.acquire(ctx, f.info.Size); err != nil {
+			return err
+		}
+	} else {
+		spill = !p.memory.tryAcquire(f.info.Size)
+	}
+	if !spill {
+		f.size = f.info.Size
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		f.discard()
+		return ctx.Err()
+	}
+	go func() {
+		defer func() { <-p.slots }()
+		defer close(f.ready)
+		if spill {
+			f.err = p.download(ctx, f.info, func(r io.Reader) error {
+				return f.spill(r, p.spillDir)
+			})
+		} else {
+			f.err = p.download(ctx, f.info, func(r io.Reader) error {
+				f.data = make([]byte, f.info.Size)
+				_, err := io.ReadFull(r, f.data)
+				return err
+			})
+		}
+		if f.err != nil {
+			f.discard()
+		}
+	}()
+	return nil
+}
+
+// download reads a file with fill, then verifies that it has no more data and
+// matches its digest.
+func (p *prefetcher) download(ctx context.Context, info *api.FileInfo, fill func(r io.Reader) error) error {
+	r, err := p.dataset.openReader(ctx, info.Path, 0, -1, -1, info.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := fill(r); err != nil {
+		return errors.Wrap(err, info.Path)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		if err == nil || err == io.EOF {
+			err = errors.Errorf("%s is larger than its listed size", info.Path)
+		}
+		return err
+	}
+	return nil
+}
+
+// spill writes a file to a temporary file in dir.
+func (f *prefetchedFile) spill(r io.Reader, dir string) error {
+	file, err := ioutil.TempFile(dir, ".fileheap-stream-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.file = file
+	if _, err := io.CopyN(file, r, f.info.Size); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return errors.WithStack(err)
+}
+
+// discard releases the memory or disk space holding a file.
+func (f *prefetchedFile) discard() {
+	f.data = nil
+	f.memory.release(f.size)
+	f.size = 0
+	if f.file != nil {
+		f.file.Close()
+		os.Remove(f.file.Name())
+		f.file = nil
+	}
+}
+
+// Next returns the next file and a reader of its contents, or ErrDone once
+// every file has been returned. The reader must be closed when finished.
+func (s *DatasetStreamer) Next() (*api.FileInfo, io.ReadCloser, error) {
+	f, ok := <-s.queue
+	if !ok {
+		return nil, nil, ErrDone
+	}
+	<-f.ready
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	if f.file != nil {
+		return f.info, &prefetchedReader{Reader: f.file, file: f}, nil
+	}
+	return f.info, &prefetchedReader{Reader: bytes.NewReader(f.data), file: f}, nil
+}
+
+// prefetchedReader reads a prefetched file, discarding it on Close.
+type prefetchedReader struct {
+	io.Reader
+	file *prefetchedFile
+	once sync.Once
+}
+
+func (r *prefetchedReader) Close() error {
+	r.once.Do(r.file.discard)
+	return nil
+}
+
+// Close stops prefetching and releases every file which has not been returned
+// by Next. Readers already returned remain valid until they are closed.
+func (s *DatasetStreamer) Close() error {
+	s.once.Do(func() {
+		s.cancel()
+		for f := range s.queue {
+			<-f.ready
+			f.discard()
+		}
+	})
+	return nil
+}
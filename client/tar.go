@@ -0,0 +1,81 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Tar writes every remaining file to w as a tar stream, without touching disk.
+// Entries are named by their paths within the dataset and carry the file's
+// recorded mode, or 0644 if none was recorded.
+//
+// Each file is verified against its digest as it is written. Since the
+// entry is already in the stream by then, a mismatch is reported as an error
+// and the stream must be discarded.
+func (d *BatchDownloader) Tar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for {
+		batch, err := d.Next()
+		if err == ErrDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := batch.writeTar(tw); err != nil {
+			return err
+		}
+	}
+	return errors.WithStack(tw.Close())
+}
+
+func (b *FileBatch) writeTar(tw *tar.Writer) error {
+	for {
+		info, reader, err := b.Next()
+		if err == ErrDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mode := int64(0644)
+		if info.Mode != 0 {
+			mode = int64(info.Mode.Perm())
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     info.Path,
+			Size:     info.Size,
+			Mode:     mode,
+			ModTime:  info.Updated,
+		}); err != nil {
+			reader.Close()
+			return errors.WithStack(err)
+		}
+
+		hash := sha256.New()
+		_, err = io.Copy(tw, io.TeeReader(reader, hash))
+		reader.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !bytes.Equal(hash.Sum(nil), info.Digest) {
+			return errors.Errorf("%s has incorrect digest", info.Path)
+		}
+	}
+}
+
+// TarReader is like Tar, but returns the stream as a reader for callers which
+// forward it elsewhere. Closing the reader stops the download.
+func (d *BatchDownloader) TarReader() io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(d.Tar(pw))
+	}()
+	return pr
+}
@@ -1,87 +1,320 @@
 package client
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha256"
 	"io"
+	"mime"
 	"net/http"
 	"path"
 	"strconv"
-	"strings"
 
 	"github.com/pkg/errors"
 
 	"github.com/allenai/fileheap-client/api"
 )
 
+// uploadChunk is a chunk of an upload read ahead of being sent.
+type uploadChunk struct {
+	buf    *bytes.Buffer
+	size   int64 // Memory reserved for the buffer.
+	offset int64
+	digest [sha256.Size]byte
+	err    error
+}
+
 // upload writes the contents of a reader using the upload API.
 // This is more expensive than putting the file directly, but is more resilient
 // to networking errors and does not require the digest to be known beforehand.
-// Note: upload does not support empty readers.
+// Empty files are written directly by WriteFile, as upload requires data.
+//
+// Chunks are read and hashed while the previous chunk is being sent, so at
+// most two chunks are held in memory at once.
+//
+// If the service offers presigned blob storage URLs for the upload, data is
+// sent directly to blob storage instead.
+//
+// If base is not nil, chunks are aligned with those of the base file, and
+// chunks it already contains are copied from it rather than sent.
 func (c *Client) upload(
 	ctx context.Context,
 	reader io.Reader,
 	length int64,
+	chunkSize int64,
+	base *deltaBase,
 ) (digest []byte, err error) {
-	resp, err := c.sendRequest(ctx, http.MethodPost, "/uploads", nil, nil)
+	uploadID, target, err := c.createUpload(ctx, length)
+	if err != nil {
+		return nil, err
+	}
+	if len(target.PartURLs) != 0 {
+		return c.uploadParts(ctx, uploadID, target, reader, length)
+	}
+
+	if base != nil {
+		chunkSize = base.chunkSize
+	}
+	if length < chunkSize {
+		// Avoid creating a massive buffer for small data.
+		chunkSize = length
+	}
+
+	err = c.forEachChunk(ctx, reader, length, chunkSize, func(chunk *uploadChunk) (bool, error) {
+		if offset, ok := base.find(chunk); ok {
+			n := int64(chunk.buf.Len())
+			digest, err = c.copyChunk(ctx, uploadID, chunk.offset, n, chunk.digest[:], length, base, offset)
+		} else {
+			digest, err = c.sendChunk(ctx, uploadID, chunk, length)
+		}
+		return digest != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if digest == nil {
+		return nil, errors.New("service did not return digest")
+	}
+	return digest, nil
+}
+
+// createUpload starts an upload of the given length, returning its ID and
+// where to send its data.
+func (c *Client) createUpload(ctx context.Context, length int64) (string, *api.Upload, error) {
+	if length <= 0 {
+		return "", nil, errors.New("upload requires a positive length")
+	}
+
+	req, err := c.newRequest(http.MethodPost, "/uploads", nil, nil)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	req.Header.Set(api.HeaderUploadLength, strconv.FormatInt(length, 10))
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if err := errorFromResponse(resp); err != nil {
+		return "", nil, err
+	}
+
+	// Older services respond without a body.
+	var target api.Upload
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := parseResponse(resp, &target); err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+	}
+	return resp.Header.Get(api.HeaderUploadID), &target, nil
+}
+
+// uploadParts sends the contents of a reader to presigned blob storage URLs,
+// then completes the upload with the digest of the data.
+func (c *Client) uploadParts(
+	ctx context.Context,
+	uploadID string,
+	target *api.Upload,
+	reader io.Reader,
+	length int64,
+) ([]byte, error) {
+	if target.PartSize <= 0 {
+		return nil, errors.Errorf("service returned invalid part size %d", target.PartSize)
+	}
+	if parts := (length + target.PartSize - 1) / target.PartSize; int64(len(target.PartURLs)) != parts {
+		return nil, errors.Errorf("service returned %d part URLs, expected %d", len(target.PartURLs), parts)
+	}
+
+	hash := sha256.New()
+	var part int
+	err := c.forEachChunk(ctx, reader, length, target.PartSize, func(chunk *uploadChunk) (bool, error) {
+		hash.Write(chunk.buf.Bytes())
+		err := c.putPart(ctx, target.PartURLs[part], chunk.buf)
+		part++
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest := hash.Sum(nil)
+
+	path := path.Join("/uploads", uploadID, "complete")
+	req, err := c.newRequest(http.MethodPost, path, nil, nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	req.Header.Set(api.HeaderDigest, api.EncodeDigest(digest))
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
 	if err := errorFromResponse(resp); err != nil {
-		resp.Body.Close()
 		return nil, err
 	}
-	resp.Body.Close()
-	uploadID := resp.Header.Get(api.HeaderUploadID)
+	return digest, nil
+}
 
-	chunkSize := requestSizeLimit
-	if length < int64(chunkSize) {
-		// Avoid creating a massive buffer for small data.
-		chunkSize = int(length)
+// putPart sends a part of an upload to a presigned URL.
+func (c *Client) putPart(ctx context.Context, url string, body *bytes.Buffer) error {
+	// Presigned URLs carry their own credentials, so send no authorization.
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("failed to upload part: %s", resp.Status)
+	}
+	return nil
+}
+
+// forEachChunk calls fn with each chunk of a reader in order, reading the next
+// chunk while fn runs. Iteration stops when fn returns true or an error.
+func (c *Client) forEachChunk(
+	ctx context.Context,
+	reader io.Reader,
+	length int64,
+	chunkSize int64,
+	fn func(chunk *uploadChunk) (bool, error),
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	chunks := make(chan *uploadChunk)
+	go c.readChunks(ctx, reader, length, chunkSize, chunks)
+	defer func() {
+		// Wait for the reader to stop so the caller may safely close it.
+		cancel()
+		for chunk := range chunks {
+			c.releaseChunk(chunk)
+		}
+	}()
+
+	for chunk := range chunks {
+		if chunk.err != nil {
+			c.releaseChunk(chunk)
+			return chunk.err
+		}
+		done, err := fn(chunk)
+		c.releaseChunk(chunk)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	// The reader stops early if the context is cancelled.
+	return ctx.Err()
+}
+
+// uploadChunkSize returns the default size of each chunk sent through the
+// upload API.
+func (c *Client) uploadChunkSize() int64 {
+	if c.chunkSize > 0 {
+		return c.chunkSize
 	}
-	buf := getBuffer()
-	defer putBuffer(buf)
+	return c.limits.requestSizeLimit()
+}
+
+// readChunks reads a reader in chunks and sends them to a channel, which is
+// closed when the reader is exhausted, on the first error, or when the context
+// is cancelled.
+func (c *Client) readChunks(
+	ctx context.Context,
+	reader io.Reader,
+	length int64,
+	chunkSize int64,
+	chunks chan<- *uploadChunk,
+) {
+	defer close(chunks)
 
-	var written int64
-	for written < length {
-		n, err := io.CopyN(buf, reader, int64(chunkSize))
+	var offset int64
+	for offset < length {
+		size := chunkSize
+		if length-offset < size {
+			size = length - offset
+		}
+		if err := c.memory.acquire(ctx, size); err != nil {
+			return
+		}
+
+		buf := c.getBuffer()
+		n, err := io.CopyN(buf, reader, chunkSize)
 		if err == io.EOF {
-			if written+n != length {
-				return nil, io.ErrUnexpectedEOF
+			if offset+n != length {
+				err = io.ErrUnexpectedEOF
+			} else {
+				err = nil
 			}
 		} else if err != nil {
-			return nil, errors.WithStack(err)
+			err = errors.WithStack(err)
 		}
 
-		path := path.Join("/uploads", uploadID)
-		req, err := c.newRequest(http.MethodPatch, path, nil, buf)
+		chunk := &uploadChunk{
+			buf:    buf,
+			size:   size,
+			offset: offset,
+			digest: sha256.Sum256(buf.Bytes()),
+			err:    err,
+		}
+		select {
+		case chunks <- chunk:
+		case <-ctx.Done():
+			c.releaseChunk(chunk)
+			return
+		}
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return
 		}
+		offset += n
+	}
+}
 
-		req.ContentLength = n
-		req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
-		req.Header.Set("Upload-Offset", strconv.FormatInt(written, 10))
+// releaseChunk returns a chunk's buffer to the pool.
+func (c *Client) releaseChunk(chunk *uploadChunk) {
+	c.putBuffer(chunk.buf)
+	c.memory.release(chunk.size)
+}
 
-		resp, err := c.do(ctx, req)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		if err := errorFromResponse(resp); err != nil {
-			resp.Body.Close()
-			return nil, err
-		}
-		resp.Body.Close()
+// sendChunk writes a chunk to an upload. It returns the digest of the upload
+// once the service has received all of its data.
+func (c *Client) sendChunk(
+	ctx context.Context,
+	uploadID string,
+	chunk *uploadChunk,
+	length int64,
+) ([]byte, error) {
+	n := int64(chunk.buf.Len())
+	path := path.Join("/uploads", uploadID)
+	req, err := c.newRequest(http.MethodPatch, path, nil, chunk.buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-		if str := resp.Header.Get(api.HeaderDigest); str != "" {
-			parts := strings.SplitN(str, " ", 2)
-			digest, err := base64.StdEncoding.DecodeString(parts[1])
-			return digest, errors.WithStack(err)
-		}
+	// Record each chunk's digest so that ranged reads can be verified.
+	req.ContentLength = n
+	req.Header.Set(api.HeaderDigest, api.EncodeDigest(chunk.digest[:]))
+	req.Header.Set(api.HeaderUploadLength, strconv.FormatInt(length, 10))
+	req.Header.Set(api.HeaderUploadOffset, strconv.FormatInt(chunk.offset, 10))
 
-		written += n
-		buf.Reset()
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if err := errorFromResponse(resp); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("service did not return digest")
+	if str := resp.Header.Get(api.HeaderDigest); str != "" {
+		digest, err := api.DecodeDigest(str)
+		return digest, errors.WithStack(err)
+	}
+	return nil, nil
 }
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/async"
+)
+
+// DownloadFromURL writes a file to w directly from the presigned URL included
+// in its info, bypassing the FileHeap service. The file is split into parts
+// which are fetched with up to the given number of concurrent range requests.
+//
+// The caller is responsible for verifying the written data against the file's
+// digest, since parts may be written out of order.
+func (d *DatasetRef) DownloadFromURL(
+	ctx context.Context,
+	info *api.FileInfo,
+	w io.WriterAt,
+	connections int,
+) error {
+	if info.URL == "" {
+		return errors.Errorf("%s has no URL", info.Path)
+	}
+	if connections < 1 {
+		return errors.New("connections must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	partSize := d.client.limits.requestSizeLimit()
+	asyncErr := async.Error{}
+	limiter := async.NewLimiter(connections)
+	for offset := int64(0); offset < info.Size; offset += partSize {
+		if err := asyncErr.Err(); err != nil {
+			break
+		}
+
+		offset := offset
+		length := partSize
+		if offset+length > info.Size {
+			length = info.Size - offset
+		}
+		limiter.Go(func() {
+			if err := d.client.downloadPart(ctx, info.URL, w, offset, length); err != nil {
+				asyncErr.Report(errors.Wrapf(err, "failed to download %s", info.Path))
+				cancel()
+			}
+		})
+	}
+	limiter.Wait()
+	return asyncErr.Err()
+}
+
+// downloadPart copies a byte range from a URL to the same range of w.
+func (c *Client) downloadPart(
+	ctx context.Context,
+	url string,
+	w io.WriterAt,
+	offset, length int64,
+) error {
+	// Presigned URLs carry their own credentials, so send no authorization.
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	if err := c.memory.acquire(ctx, length); err != nil {
+		return errors.WithStack(err)
+	}
+	defer c.memory.release(length)
+
+	buf := c.getBuffer()
+	defer c.putBuffer(buf)
+	if _, err := io.CopyN(buf, resp.Body, length); err != nil {
+		if err == io.EOF {
+			return errors.New("response truncated")
+		}
+		return errors.WithStack(err)
+	}
+	if _, err := w.WriteAt(buf.Bytes(), offset); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// validatorCache is a bounded LRU cache of metadata responses and their HTTP
+// validators, keyed by URL and accepted media types. Requests for a cached URL
+// are made conditional, so the server can answer with 304 Not Modified instead
+// of sending the body again.
+//
+// Unlike metadataCache, every use of an entry is revalidated with the server,
+// so changes made by other clients are always observed.
+//
+// A nil cache is disabled.
+type validatorCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	order      *list.List // Most recently used first.
+	entries    map[string]*list.Element
+}
+
+type validatedResponse struct {
+	key          string // Accepted media types and URL.
+	etag         string
+	lastModified string
+	contentType  string
+	body         []byte
+}
+
+func newValidatorCache(maxEntries int) *validatorCache {
+	return &validatorCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *validatorCache) get(key string) *validatedResponse {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*validatedResponse)
+}
+
+func (c *validatorCache) put(resp *validatedResponse) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[resp.key]; ok {
+		elem.Value = resp
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[resp.key] = c.order.PushFront(resp)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*validatedResponse).key)
+	}
+}
+
+func (c *validatorCache) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// getJSON sends a GET request and parses the JSON response into value. If
+// conditional requests are enabled, a previous response for the same URL is
+// revalidated and reused if the server reports it is not modified.
+func (c *Client) getJSON(
+	ctx context.Context,
+	path string,
+	query url.Values,
+	value interface{},
+) error {
+	return c.get(ctx, path, query, api.MediaTypeJSON, true, func(body io.Reader, _ string) error {
+		return decodeJSON(body, value)
+	})
+}
+
+// get sends a GET request accepting the given media types and decodes the
+// response body with its media type. If revalidate is set and conditional
+// requests are enabled, a previous response is reused if the server reports it
+// is not modified.
+func (c *Client) get(
+	ctx context.Context,
+	path string,
+	query url.Values,
+	accept string,
+	revalidate bool,
+	decode func(body io.Reader, contentType string) error,
+) error {
+	req, err := c.newRequest(http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+
+	// Responses depend on the media types accepted as well as the URL.
+	validators := c.validators
+	if !revalidate {
+		validators = nil
+	}
+	key := accept + " " + req.URL.String()
+	cached := validators.get(key)
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := c.doRetry(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return decode(bytes.NewReader(cached.body), cached.contentType)
+	}
+	if err := errorFromResponse(resp); err != nil {
+		validators.remove(key)
+		return err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if validators == nil || (etag == "" && lastModified == "") {
+		// Bodies which won't be revalidated are decoded as they arrive.
+		validators.remove(key)
+		return decode(resp.Body, contentType)
+	}
+
+	// Bodies kept to revalidate later are read whole.
+	body, err := readResponse(resp.Body)
+	if err != nil {
+		return err
+	}
+	validators.put(&validatedResponse{
+		key:          key,
+		etag:         etag,
+		lastModified: lastModified,
+		contentType:  contentType,
+		body:         body,
+	})
+	return decode(bytes.NewReader(body), contentType)
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// FileChunks returns the chunk digests of a file.
+// Returns ErrFileNotFound if the file does not exist.
+func (d *DatasetRef) FileChunks(ctx context.Context, filename string) (*api.FileChunks, error) {
+	path := path.Join("/datasets", d.id, "chunks", filename)
+	resp, err := d.client.sendRequest(ctx, http.MethodGet, path, d.readQuery(nil), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrFileNotFound
+	}
+
+	var body api.FileChunks
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// OpenVerified opens a file for random access. Each read fetches only the
+// chunks it touches and verifies them against the file's chunk digests, so
+// partial reads of huge files keep the integrity guarantees of a full download.
+//
+// The info should come from the file iterator or FileInfo. If it includes a
+// chunk root, the chunk digests are verified against it.
+func (d *DatasetRef) OpenVerified(ctx context.Context, info *api.FileInfo) (*VerifiedFile, error) {
+	chunks, err := d.FileChunks(ctx, info.Path)
+	if err != nil {
+		return nil, err
+	}
+	if chunks.ChunkSize <= 0 {
+		return nil, errors.Errorf("%s has invalid chunk size %d", info.Path, chunks.ChunkSize)
+	}
+	expected := (info.Size + chunks.ChunkSize - 1) / chunks.ChunkSize
+	if expected == 0 {
+		// Empty files consist of a single empty chunk.
+		expected = 1
+	}
+	if int64(len(chunks.Digests)) != expected {
+		return nil, errors.Errorf(
+			"%s has %d chunk digests, expected %d",
+			info.Path, len(chunks.Digests), expected)
+	}
+	if info.ChunkRoot != nil && !bytes.Equal(chunks.Root(), info.ChunkRoot) {
+		return nil, errors.Errorf("%s has chunk digests that do not match its chunk root", info.Path)
+	}
+
+	return &VerifiedFile{
+		ctx:     ctx,
+		dataset: d,
+		path:    info.Path,
+		size:    info.Size,
+		chunks:  chunks,
+		retries: -1,
+	}, nil
+}
+
+// VerifiedFile provides verified random access to a file in a dataset.
+// It implements io.ReaderAt and is safe for concurrent use.
+type VerifiedFile struct {
+	// Initial state.
+	ctx     context.Context
+	dataset *DatasetRef
+	path    string
+	size    int64
+	chunks  *api.FileChunks
+	retries int
+}
+
+// Size of the file in bytes.
+func (f *VerifiedFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt reads len(p) bytes starting at offset off. The range is widened to
+// whole chunks, each of which is verified before any of its bytes are returned.
+func (f *VerifiedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("offset must not be negative")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+
+	chunkSize := f.chunks.ChunkSize
+	first := off / chunkSize
+	last := (end - 1) / chunkSize
+	start := first * chunkSize
+	stop := (last + 1) * chunkSize
+	if stop > f.size {
+		stop = f.size
+	}
+
+	r, err := f.dataset.openReader(f.ctx, f.path, start, stop-start, f.retries, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	bufSize := chunkSize
+	if stop-start < bufSize {
+		bufSize = stop - start
+	}
+	if err := f.dataset.client.memory.acquire(f.ctx, bufSize); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.dataset.client.memory.release(bufSize)
+
+	buf := f.dataset.client.getBuffer()
+	defer f.dataset.client.putBuffer(buf)
+
+	var n int
+	for i := first; i <= last; i++ {
+		chunkStart := i * chunkSize
+		chunkLen := chunkSize
+		if chunkStart+chunkLen > f.size {
+			chunkLen = f.size - chunkStart
+		}
+
+		buf.Reset()
+		if _, err := io.CopyN(buf, r, chunkLen); err != nil {
+			if err == io.EOF {
+				return n, errors.Errorf("%s truncated while reading", f.path)
+			}
+			return n, errors.WithStack(err)
+		}
+		if digest := sha256.Sum256(buf.Bytes()); !bytes.Equal(digest[:], f.chunks.Digests[i]) {
+			return n, errors.Errorf("%s has incorrect digest for chunk %d", f.path, i)
+		}
+
+		// Copy the part of the chunk that overlaps the requested range.
+		lo := off + int64(n) - chunkStart
+		n += copy(p[n:], buf.Bytes()[lo:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Longest time the server holds a request for dataset changes. It must be
+// well within the transport's response header timeout.
+const watchWait = 30 * time.Second
+
+// Watch sends an event on the returned channel for each file written to or
+// deleted from the dataset after the call, in the order they were made, so
+// that consumers of an unsealed dataset can process files as they appear
+// without listing the dataset repeatedly. Changes are long-polled from the
+// server.
+//
+// The channel is closed once ctx is done, once the dataset is sealed and every
+// change before that was sent, or if the server fails to respond after
+// retries, in which case the failure is logged.
+func (d *DatasetRef) Watch(ctx context.Context) (<-chan api.FileEvent, error) {
+	page, err := d.fileEvents(ctx, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan api.FileEvent)
+	go func() {
+		defer close(events)
+		for !page.Final {
+			cursor := page.Cursor
+			if page, err = d.fileEvents(ctx, cursor, watchWait); err != nil {
+				if ctx.Err() == nil {
+					logrus.WithError(err).WithField("dataset", d.id).Warn("Stopped watching dataset")
+				}
+				return
+			}
+			for _, event := range page.Events {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// fileEvents lists changes to the dataset's files after a cursor, waiting up to
+// the given time for one if there are none.
+func (d *DatasetRef) fileEvents(ctx context.Context, cursor string, wait time.Duration) (*api.FileEventPage, error) {
+	query := url.Values{"cursor": {cursor}}
+	if wait > 0 {
+		query.Set("wait", strconv.Itoa(int(wait/time.Second)))
+	}
+	path := path.Join("/datasets", d.id, "events")
+	resp, err := d.client.sendRequest(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	var body api.FileEventPage
+	if err := parseResponse(resp, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
@@ -0,0 +1,81 @@
+package fileheaptest
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// gcReport describes expired and unsealed datasets and the storage deleting
+// them would free. Every request is treated as an administrator's.
+func (s *Server) gcReport(w http.ResponseWriter, r *http.Request) {
+	var unsealedBefore time.Time
+	if str := r.URL.Query().Get("unsealedBefore"); str != "" {
+		var err error
+		if unsealedBefore, err = time.Parse(time.RFC3339, str); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid unsealedBefore: %v", err)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	report := api.GCReport{Expired: []api.Dataset{}, Unsealed: []api.Dataset{}}
+	now := time.Now()
+	live := map[[sha256.Size]byte]bool{}
+	expired := map[[sha256.Size]byte]bool{}
+	for _, ds := range s.datasets {
+		refs := live
+		if ds.ExpiresAt != nil && ds.ExpiresAt.Before(now) {
+			report.Expired = append(report.Expired, *s.describe(ds))
+			refs = expired
+		} else if !ds.ReadOnly && !unsealedBefore.IsZero() && ds.Created.Before(unsealedBefore) {
+			report.Unsealed = append(report.Unsealed, *s.describe(ds))
+		}
+		for _, f := range ds.files {
+			s.reference(refs, f.digest)
+		}
+	}
+	for _, ds := range s.snapshots {
+		for _, f := range ds.files {
+			s.reference(live, f.digest)
+		}
+	}
+
+	for digest, b := range s.blobs {
+		if live[digest] {
+			continue
+		}
+		if !expired[digest] {
+			report.OrphanedBlobs++
+			report.OrphanedBytes += int64(len(b.data))
+		}
+		report.ReclaimableBytes += int64(len(b.data))
+	}
+
+	for _, datasets := range [][]api.Dataset{report.Expired, report.Unsealed} {
+		sort.Slice(datasets, func(i, j int) bool {
+			return datasets[i].Created.Before(datasets[j].Created)
+		})
+	}
+	writeJSON(w, &report)
+}
+
+// reference marks the contents with a digest as referenced, along with any
+// chunks they were written from. The caller must hold the server's lock.
+func (s *Server) reference(refs map[[sha256.Size]byte]bool, digest [sha256.Size]byte) {
+	refs[digest] = true
+	b, ok := s.blobs[digest]
+	if !ok || b.manifest == nil {
+		return
+	}
+	for _, chunk := range b.manifest.Chunks {
+		var key [sha256.Size]byte
+		copy(key[:], chunk.Digest)
+		refs[key] = true
+	}
+}
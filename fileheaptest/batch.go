@@ -0,0 +1,258 @@
+package fileheaptest
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// multipartReader reads the parts of a multipart/mixed request body.
+func multipartReader(w http.ResponseWriter, r *http.Request) (*multipart.Reader, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		writeError(w, http.StatusUnsupportedMediaType, "expected multipart/mixed body")
+		return nil, false
+	}
+	return multipart.NewReader(r.Body, params["boundary"]), true
+}
+
+func (s *Server) batchUpload(w http.ResponseWriter, r *http.Request, id string) {
+	mr, ok := multipartReader(w, r)
+	if !ok {
+		return
+	}
+
+	type part struct {
+		path string
+		mode os.FileMode
+		data []byte
+	}
+	var parts []part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		var mode os.FileMode
+		if str := p.Header.Get(api.HeaderFileMode); str != "" {
+			if mode, err = api.DecodeFileMode(str); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid file mode: %v", err)
+				return
+			}
+		}
+		parts = append(parts, part{path: p.Header.Get(api.HeaderPath), mode: mode, data: data})
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	if ds.ReadOnly {
+		writeError(w, http.StatusConflict, "dataset %s is read-only", id)
+		return
+	}
+
+	results := api.BatchResults{Results: []api.BatchFileResult{}}
+	for _, p := range parts {
+		if p.path == "" {
+			results.Results = append(results.Results, api.BatchFileResult{
+				Code:    http.StatusBadRequest,
+				Message: "missing path",
+			})
+			continue
+		}
+		digest := s.putBlob(p.data, nil)
+		s.putFile(ds, p.path, &file{digest: digest, mode: p.mode, updated: time.Now().UTC()})
+		results.Results = append(results.Results, api.BatchFileResult{Path: p.path, Code: http.StatusOK})
+	}
+	writeJSON(w, &results)
+}
+
+func (s *Server) batchDownload(w http.ResponseWriter, r *http.Request, id string) {
+	mr, ok := multipartReader(w, r)
+	if !ok {
+		return
+	}
+
+	var digests [][sha256.Size]byte
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		decoded, err := api.DecodeDigest(p.Header.Get(api.HeaderDigest))
+		if err != nil || len(decoded) != sha256.Size {
+			writeError(w, http.StatusBadRequest, "invalid digest %q", p.Header.Get(api.HeaderDigest))
+			return
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], decoded)
+		digests = append(digests, digest)
+	}
+
+	s.lock.Lock()
+	if _, ok := s.datasets[id]; !ok {
+		s.lock.Unlock()
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	blobs := make([]*blob, len(digests))
+	for i, digest := range digests {
+		blobs[i] = s.blobs[digest]
+	}
+	s.lock.Unlock()
+
+	// Failures after the response starts are reported in a trailer.
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("Trailer", api.HeaderBatchError)
+	for i, b := range blobs {
+		if b == nil {
+			w.Header().Set(api.HeaderBatchError, "no content with digest "+api.EncodeDigest(digests[i][:]))
+			return
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{api.HeaderDigest: {api.EncodeDigest(digests[i][:])}})
+		if err != nil {
+			w.Header().Set(api.HeaderBatchError, err.Error())
+			return
+		}
+		if _, err := pw.Write(b.data); err != nil {
+			return
+		}
+	}
+	mw.Close()
+}
+
+func (s *Server) batchDelete(w http.ResponseWriter, r *http.Request, id string) {
+	mr, ok := multipartReader(w, r)
+	if !ok {
+		return
+	}
+
+	var paths []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		paths = append(paths, p.Header.Get(api.HeaderPath))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	if ds.ReadOnly {
+		writeError(w, http.StatusConflict, "dataset %s is read-only", id)
+		return
+	}
+
+	results := api.BatchResults{Results: []api.BatchFileResult{}}
+	for _, path := range paths {
+		code, message := s.removeFile(id, path)
+		results.Results = append(results.Results, api.BatchFileResult{Path: path, Code: code, Message: message})
+	}
+	writeJSON(w, &results)
+}
+
+// batchAdd adds files from existing blobs, named by the headers of empty parts.
+func (s *Server) batchAdd(w http.ResponseWriter, r *http.Request, id string) {
+	mr, ok := multipartReader(w, r)
+	if !ok {
+		return
+	}
+
+	var headers []textproto.MIMEHeader
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		headers = append(headers, p.Header)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	if ds.ReadOnly {
+		writeError(w, http.StatusConflict, "dataset %s is read-only", id)
+		return
+	}
+
+	results := api.BatchResults{Results: []api.BatchFileResult{}}
+	for _, header := range headers {
+		path := header.Get(api.HeaderPath)
+		code, message := s.addFile(ds, path, header)
+		results.Results = append(results.Results, api.BatchFileResult{Path: path, Code: code, Message: message})
+	}
+	writeJSON(w, &results)
+}
+
+// addFile adds a file from the blob named by a part's Digest header, returning
+// a status code and an error message. The caller must hold the server's lock.
+func (s *Server) addFile(ds *dataset, path string, header textproto.MIMEHeader) (int, string) {
+	if path == "" {
+		return http.StatusBadRequest, "missing path"
+	}
+	str := header.Get(api.HeaderDigest)
+	expected, err := api.DecodeDigest(str)
+	if err != nil || len(expected) != sha256.Size {
+		return http.StatusBadRequest, "invalid digest " + str
+	}
+	var mode os.FileMode
+	if str := header.Get(api.HeaderFileMode); str != "" {
+		if mode, err = api.DecodeFileMode(str); err != nil {
+			return http.StatusBadRequest, "invalid file mode " + str
+		}
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], expected)
+	if _, ok := s.blobs[digest]; !ok {
+		return http.StatusBadRequest, "no content with digest " + str
+	}
+	s.putFile(ds, path, &file{digest: digest, mode: mode, updated: time.Now().UTC()})
+	return http.StatusOK, ""
+}
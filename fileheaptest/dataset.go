@@ -0,0 +1,290 @@
+package fileheaptest
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allenai/bytefmt"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// Default number of files in each manifest page.
+const manifestPageSize = 1000
+
+func (s *Server) createDataset(w http.ResponseWriter, r *http.Request) {
+	var spec api.DatasetSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid dataset spec: %v", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds := &dataset{
+		Dataset: api.Dataset{ID: s.newID("ds"), Created: time.Now().UTC(), Namespace: spec.Namespace},
+		files:   map[string]*file{},
+	}
+	s.datasets[ds.ID] = ds
+	writeJSON(w, s.describe(ds))
+}
+
+func (s *Server) listDatasets(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var createdBefore time.Time
+	if str := query.Get("createdBefore"); str != "" {
+		var err error
+		if createdBefore, err = time.Parse(time.RFC3339, str); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid createdBefore: %v", err)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	page := api.DatasetPage{Datasets: []api.Dataset{}}
+	for _, ds := range s.datasets {
+		if query.Get("readonly") == "false" && ds.ReadOnly {
+			continue
+		}
+		if _, ok := query["namespace"]; ok && ds.Namespace != query.Get("namespace") {
+			continue
+		}
+		if !createdBefore.IsZero() && !ds.Created.Before(createdBefore) {
+			continue
+		}
+		page.Datasets = append(page.Datasets, *s.describe(ds))
+	}
+	sort.Slice(page.Datasets, func(i, j int) bool {
+		return page.Datasets[i].Created.Before(page.Datasets[j].Created)
+	})
+	writeJSON(w, &page)
+}
+
+func (s *Server) serveDataset(w http.ResponseWriter, r *http.Request, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeCacheableJSON(w, r, s.describe(ds))
+
+	case http.MethodPatch:
+		var patch api.DatasetPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+			return
+		}
+		if patch.ReadOnly && !ds.ReadOnly {
+			ds.ReadOnly = true
+			s.notifyChanged()
+		}
+		if patch.ExpiresAt != nil {
+			ds.ExpiresAt = nil
+			if !patch.ExpiresAt.IsZero() {
+				expiresAt := patch.ExpiresAt.UTC()
+				ds.ExpiresAt = &expiresAt
+			}
+		}
+		writeJSON(w, s.describe(ds))
+
+	case http.MethodDelete:
+		delete(s.datasets, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// describe returns a dataset's metadata, including its size. The caller must
+// hold the server's lock.
+func (s *Server) describe(ds *dataset) *api.Dataset {
+	result := ds.Dataset
+	size := &api.DatasetSize{Final: ds.ReadOnly, Files: int64(len(ds.files))}
+	for _, f := range ds.files {
+		size.Bytes += int64(len(s.blobs[f.digest].data))
+	}
+	size.BytesHuman = bytefmt.New(size.Bytes, bytefmt.Binary).String()
+	result.Size = size
+
+	if ds.ReadOnly {
+		var hash api.ManifestHash
+		for _, path := range sortedPaths(ds, "") {
+			digest := ds.files[path].digest
+			hash.Add(path, digest[:])
+		}
+		result.ManifestDigest = hash.Sum()
+	}
+	return &result
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := manifestPageSize
+	if str := query.Get("limit"); str != "" {
+		var err error
+		if limit, err = strconv.Atoi(str); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit %q", str)
+			return
+		}
+	}
+	var inline int64
+	if str := query.Get("inline"); str != "" {
+		var err error
+		if inline, err = strconv.ParseInt(str, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid inline threshold %q", str)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.readDataset(r, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+
+	// Cursors are the last path of the previous page.
+	paths := sortedPaths(ds, query.Get("path"))
+	if cursor := query.Get("cursor"); cursor != "" {
+		paths = paths[sort.SearchStrings(paths, cursor+"\x00"):]
+	}
+
+	page := api.ManifestPage{Files: []api.FileInfo{}}
+	for _, path := range paths {
+		if len(page.Files) == limit {
+			page.Cursor = page.Files[limit-1].Path
+			break
+		}
+		info := s.fileInfo(ds, path)
+		if query.Get("url") == "true" {
+			info.URL = s.URL + "/datasets/" + id + "/files/" + path
+		}
+		if inline > 0 && info.Size <= inline {
+			info.Data = append([]byte{}, s.blobs[ds.files[path].digest].data...)
+		}
+		page.Files = append(page.Files, *info)
+	}
+	if acceptsProtobuf(r) {
+		writeCacheable(w, r, api.MediaTypeProtobuf, page.MarshalProto())
+		return
+	}
+	writeCacheableJSON(w, r, &page)
+}
+
+// acceptsProtobuf reports whether a request accepts api.MediaTypeProtobuf.
+// Quality values are ignored; the server prefers protocol buffers whenever they
+// are accepted.
+func acceptsProtobuf(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == api.MediaTypeProtobuf {
+			return true
+		}
+	}
+	return false
+}
+
+// Lifetime of read session tokens.
+const readSessionLifetime = 15 * time.Minute
+
+// createReadSession issues a read session token. Tokens are not checked, as the
+// server does not authenticate requests.
+func (s *Server) createReadSession(w http.ResponseWriter, r *http.Request, id string) {
+	var spec api.ReadSessionSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body: %v", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	if _, ok := ds.files[spec.Path]; spec.Path != "" && !ok {
+		writeError(w, http.StatusNotFound, "file %s not found", spec.Path)
+		return
+	}
+	session := &api.ReadSession{
+		Token:   s.newID("session"),
+		Expires: time.Now().Add(readSessionLifetime).UTC(),
+	}
+	if spec.Snapshot {
+		// Files are replaced rather than modified, so copying the map pins
+		// them. Snapshots are kept for the life of the server.
+		snapshot := &dataset{Dataset: ds.Dataset, files: make(map[string]*file, len(ds.files))}
+		for path, f := range ds.files {
+			snapshot.files[path] = f
+		}
+		session.Snapshot = s.newID("snapshot")
+		s.snapshots[session.Snapshot] = snapshot
+	}
+	writeJSON(w, session)
+}
+
+// readDataset returns the dataset a request reads from: the snapshot named by
+// its snapshot parameter, or else the dataset itself. The caller must hold the
+// server's lock.
+func (s *Server) readDataset(r *http.Request, id string) (*dataset, bool) {
+	if name := r.URL.Query().Get("snapshot"); name != "" {
+		ds, ok := s.snapshots[name]
+		return ds, ok && ds.ID == id
+	}
+	ds, ok := s.datasets[id]
+	return ds, ok
+}
+
+// fileInfo describes a file. The caller must hold the server's lock.
+func (s *Server) fileInfo(ds *dataset, path string) *api.FileInfo {
+	f := ds.files[path]
+	b := s.blobs[f.digest]
+	digest := f.digest
+	info := &api.FileInfo{
+		Path:    path,
+		Size:    int64(len(b.data)),
+		Digest:  digest[:],
+		Updated: f.updated,
+		Mode:    f.mode,
+	}
+	chunks := api.FileChunks{ChunkSize: b.chunkSize, Digests: b.chunks}
+	info.ChunkRoot = chunks.Root()
+	return info
+}
+
+// sortedPaths returns the paths in a dataset beginning with a prefix, in
+// ascending byte-wise order.
+func sortedPaths(ds *dataset, prefix string) []string {
+	var paths []string
+	for path := range ds.files {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,80 @@
+package fileheaptest
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// recordEvent appends a change to a dataset's events. The caller must hold the
+// server's lock.
+func (s *Server) recordEvent(ds *dataset, event api.FileEvent) {
+	ds.events = append(ds.events, event)
+	s.notifyChanged()
+}
+
+// notifyChanged wakes requests waiting for a dataset to change. The caller
+// must hold the server's lock.
+func (s *Server) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// serveEvents lists changes to a dataset's files after a cursor, which is the
+// number of changes already listed, waiting for one if asked to.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, id string) {
+	query := r.URL.Query()
+	var wait time.Duration
+	if str := query.Get("wait"); str != "" {
+		seconds, err := strconv.Atoi(str)
+		if err != nil || seconds < 0 {
+			writeError(w, http.StatusBadRequest, "invalid wait %q", str)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		s.lock.Lock()
+		ds, ok := s.datasets[id]
+		if !ok {
+			s.lock.Unlock()
+			writeError(w, http.StatusNotFound, "dataset %s not found", id)
+			return
+		}
+
+		cursor := len(ds.events)
+		if str := query.Get("cursor"); str != "" {
+			var err error
+			if cursor, err = strconv.Atoi(str); err != nil || cursor < 0 || cursor > len(ds.events) {
+				s.lock.Unlock()
+				writeError(w, http.StatusBadRequest, "invalid cursor %q", str)
+				return
+			}
+		}
+		page := api.FileEventPage{
+			Events: append([]api.FileEvent{}, ds.events[cursor:]...),
+			Cursor: strconv.Itoa(len(ds.events)),
+			Final:  ds.ReadOnly,
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		if len(page.Events) != 0 || page.Final || query.Get("cursor") == "" {
+			writeJSON(w, &page)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			writeJSON(w, &page)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
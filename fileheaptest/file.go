@@ -0,0 +1,226 @@
+package fileheaptest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, id, path string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.readFile(w, r, id, path)
+	case http.MethodPut:
+		s.writeFile(w, r, id, path)
+	case http.MethodDelete:
+		s.deleteFile(w, r, id, path)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) readFile(w http.ResponseWriter, r *http.Request, id, path string) {
+	s.lock.Lock()
+	ds, ok := s.readDataset(r, id)
+	if !ok {
+		s.lock.Unlock()
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	f, ok := ds.files[path]
+	if !ok {
+		s.lock.Unlock()
+		writeError(w, http.StatusNotFound, "file %s not found", path)
+		return
+	}
+	b := s.blobs[f.digest]
+	s.lock.Unlock()
+
+	if strings.Contains(r.Header.Get("Accept"), api.MediaTypeChunkManifest) {
+		if b.manifest == nil {
+			writeError(w, http.StatusNotAcceptable, "file %s is not chunked", path)
+			return
+		}
+		w.Header().Set(api.HeaderDigest, api.EncodeDigest(f.digest[:]))
+		w.Header().Set("Content-Type", api.MediaTypeChunkManifest)
+		json.NewEncoder(w).Encode(b.manifest)
+		return
+	}
+	data := b.data
+
+	w.Header().Set(api.HeaderDigest, api.EncodeDigest(f.digest[:]))
+	if f.mode != 0 {
+		w.Header().Set(api.HeaderFileMode, api.EncodeFileMode(f.mode))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, path, f.updated, bytes.NewReader(data))
+}
+
+// writeFile stores a file from the request body, or from an existing blob
+// named by the Digest header if the body is empty, or from stored chunks if
+// the body is a chunk manifest.
+func (s *Server) writeFile(w http.ResponseWriter, r *http.Request, id, path string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body: %v", err)
+		return
+	}
+	var mode os.FileMode
+	if str := r.Header.Get(api.HeaderFileMode); str != "" {
+		if mode, err = api.DecodeFileMode(str); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid file mode: %v", err)
+			return
+		}
+	}
+	var expected []byte
+	if str := r.Header.Get(api.HeaderDigest); str != "" {
+		if expected, err = api.DecodeDigest(str); err != nil || len(expected) != sha256.Size {
+			writeError(w, http.StatusBadRequest, "invalid digest %q", str)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.datasets[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	if ds.ReadOnly {
+		writeError(w, http.StatusConflict, "dataset %s is read-only", id)
+		return
+	}
+
+	var digest [sha256.Size]byte
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == api.MediaTypeChunkManifest {
+		var manifest api.ChunkManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid chunk manifest: %v", err)
+			return
+		}
+		var contents []byte
+		for _, chunk := range manifest.Chunks {
+			var key [sha256.Size]byte
+			copy(key[:], chunk.Digest)
+			b, ok := s.blobs[key]
+			if !ok || int64(len(b.data)) != chunk.Size {
+				writeError(w, http.StatusBadRequest, "no chunk with digest %s", api.EncodeDigest(chunk.Digest))
+				return
+			}
+			contents = append(contents, b.data...)
+		}
+		digest = s.putBlob(contents, nil)
+		if expected != nil && !bytes.Equal(digest[:], expected) {
+			writeError(w, http.StatusBadRequest, "chunks do not match digest")
+			return
+		}
+		if b := s.blobs[digest]; b.manifest == nil {
+			b.manifest = &manifest
+		}
+	} else if len(data) == 0 && expected != nil {
+		copy(digest[:], expected)
+		if _, ok := s.blobs[digest]; !ok {
+			writeError(w, http.StatusBadRequest, "no content with digest %s", api.EncodeDigest(expected))
+			return
+		}
+	} else {
+		digest = s.putBlob(data, nil)
+		if expected != nil && !bytes.Equal(digest[:], expected) {
+			writeError(w, http.StatusBadRequest, "body does not match digest")
+			return
+		}
+	}
+
+	s.putFile(ds, path, &file{digest: digest, mode: mode, updated: time.Now().UTC()})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request, id, path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	code, message := s.removeFile(id, path)
+	if code != http.StatusOK {
+		writeError(w, code, "%s", message)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFile deletes a file from a dataset, returning a status code and an
+// error message. The caller must hold the server's lock.
+func (s *Server) removeFile(id, path string) (int, string) {
+	ds, ok := s.datasets[id]
+	if !ok {
+		return http.StatusNotFound, "dataset " + id + " not found"
+	}
+	if ds.ReadOnly {
+		return http.StatusConflict, "dataset " + id + " is read-only"
+	}
+	if _, ok := ds.files[path]; !ok {
+		return http.StatusNotFound, "file " + path + " not found"
+	}
+	delete(ds.files, path)
+	s.recordEvent(ds, api.FileEvent{Type: api.FileDeleted, Path: path})
+	return http.StatusOK, ""
+}
+
+// putFile writes a file to a dataset. The caller must hold the server's lock.
+func (s *Server) putFile(ds *dataset, path string, f *file) {
+	ds.files[path] = f
+	s.recordEvent(ds, api.FileEvent{Type: api.FileWritten, Path: path, File: s.fileInfo(ds, path)})
+}
+
+func (s *Server) serveChunks(w http.ResponseWriter, r *http.Request, id, path string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ds, ok := s.readDataset(r, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "dataset %s not found", id)
+		return
+	}
+	f, ok := ds.files[path]
+	if !ok {
+		writeError(w, http.StatusNotFound, "file %s not found", path)
+		return
+	}
+	b := s.blobs[f.digest]
+	writeJSON(w, &api.FileChunks{ChunkSize: b.chunkSize, Digests: b.chunks})
+}
+
+// putBlob stores contents and returns their digest. Contents written in a
+// single request have one chunk; otherwise chunks lists the digest of each
+// chunkSize bytes. The caller must hold the server's lock.
+func (s *Server) putBlob(data []byte, u *upload) [sha256.Size]byte {
+	digest := sha256.Sum256(data)
+	if _, ok := s.blobs[digest]; ok {
+		return digest
+	}
+
+	b := &blob{data: data, chunkSize: int64(len(data)), chunks: [][]byte{digest[:]}}
+	if u != nil {
+		b.chunkSize, b.chunks = u.chunkSize, u.chunks
+	}
+	if b.chunkSize == 0 {
+		// Chunk sizes must be positive, even for empty files.
+		b.chunkSize = 1
+	}
+	s.blobs[digest] = b
+	return digest
+}
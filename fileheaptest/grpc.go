@@ -0,0 +1,172 @@
+package fileheaptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+// serveGRPC serves the gRPC metadata service by translating each call to the
+// equivalent HTTP request, so both transports share one implementation.
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", api.MediaTypeGRPC)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		writeGRPCStatus(w, http.StatusBadRequest, "request is not a single uncompressed message")
+		return
+	}
+	msg := body[5:]
+
+	var req *http.Request
+	var reply func([]byte) ([]byte, error)
+	switch strings.TrimPrefix(r.URL.Path, "/"+api.GRPCService+"/") {
+	case "GetDataset":
+		var in api.DatasetRequest
+		err = in.UnmarshalProto(msg)
+		req = httptest.NewRequest(http.MethodGet, path.Join("/datasets", in.ID), nil)
+		reply = datasetReply
+	case "CreateDataset":
+		var in api.DatasetSpec
+		err = in.UnmarshalProto(msg)
+		req = newJSONRequest(http.MethodPost, "/datasets", &in)
+		reply = datasetReply
+	case "PatchDataset":
+		var in api.DatasetPatchRequest
+		err = in.UnmarshalProto(msg)
+		req = newJSONRequest(http.MethodPatch, path.Join("/datasets", in.ID), &in.Patch)
+		reply = datasetReply
+	case "DeleteDataset":
+		var in api.DatasetRequest
+		err = in.UnmarshalProto(msg)
+		req = httptest.NewRequest(http.MethodDelete, path.Join("/datasets", in.ID), nil)
+		reply = func([]byte) ([]byte, error) { return nil, nil }
+	case "ListManifest":
+		var in api.ManifestRequest
+		err = in.UnmarshalProto(msg)
+		req = httptest.NewRequest(http.MethodGet, path.Join("/datasets", in.Dataset, "manifest")+"?"+manifestQuery(&in), nil)
+		req.Header.Set("Accept", api.MediaTypeProtobuf)
+		reply = func(body []byte) ([]byte, error) { return body, nil }
+	case "MissingBlobs":
+		var in api.BlobDigests
+		err = in.UnmarshalProto(msg)
+		req = newJSONRequest(http.MethodPost, "/blobs/missing", &in)
+		reply = func(body []byte) ([]byte, error) {
+			var out api.BlobDigests
+			if err := json.Unmarshal(body, &out); err != nil {
+				return nil, err
+			}
+			return out.MarshalProto(), nil
+		}
+	default:
+		writeGRPCStatus(w, http.StatusNotImplemented, "method not implemented")
+		return
+	}
+	if err != nil {
+		writeGRPCStatus(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	req.Header.Set(api.HeaderRequestID, w.Header().Get(api.HeaderRequestID))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code >= 400 {
+		var apiErr api.Error
+		json.Unmarshal(rec.Body.Bytes(), &apiErr)
+		writeGRPCStatus(w, rec.Code, apiErr.Message)
+		return
+	}
+	out, err := reply(rec.Body.Bytes())
+	if err != nil {
+		writeGRPCStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	frame := make([]byte, 5, 5+len(out))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(out)))
+	w.Write(append(frame, out...))
+	writeGRPCStatus(w, http.StatusOK, "")
+}
+
+// newJSONRequest creates a request with a JSON body.
+func newJSONRequest(method, target string, body interface{}) *http.Request {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, target, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// datasetReply converts a JSON dataset to its gRPC message.
+func datasetReply(body []byte) ([]byte, error) {
+	var out api.Dataset
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+	return out.MarshalProto(), nil
+}
+
+// manifestQuery converts a gRPC manifest request to the query of its HTTP
+// equivalent.
+func manifestQuery(in *api.ManifestRequest) string {
+	query := url.Values{}
+	if in.Cursor != "" {
+		query.Set("cursor", in.Cursor)
+	}
+	if in.Prefix != "" {
+		query.Set("path", in.Prefix)
+	}
+	if in.Limit != 0 {
+		query.Set("limit", strconv.FormatInt(in.Limit, 10))
+	}
+	if in.IncludeURLs {
+		query.Set("url", "true")
+	}
+	if in.InlineThreshold != 0 {
+		query.Set("inline", strconv.FormatInt(in.InlineThreshold, 10))
+	}
+	if in.Snapshot != "" {
+		query.Set("snapshot", in.Snapshot)
+	}
+	return query.Encode()
+}
+
+// writeGRPCStatus ends a gRPC response with the status nearest an HTTP status
+// code, in trailers declared by serveGRPC.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	status := 2 // UNKNOWN
+	switch {
+	case code < 400:
+		status = 0 // OK
+	case code == http.StatusBadRequest:
+		status = 3 // INVALID_ARGUMENT
+	case code == http.StatusNotFound:
+		status = 5 // NOT_FOUND
+	case code == http.StatusConflict:
+		status = 9 // FAILED_PRECONDITION
+	case code == http.StatusForbidden:
+		status = 7 // PERMISSION_DENIED
+	case code == http.StatusTooManyRequests:
+		status = 8 // RESOURCE_EXHAUSTED
+	case code == http.StatusNotImplemented:
+		status = 12 // UNIMPLEMENTED
+	case code == http.StatusServiceUnavailable:
+		status = 14 // UNAVAILABLE
+	case code == http.StatusUnauthorized:
+		status = 16 // UNAUTHENTICATED
+	case code >= 500:
+		status = 13 // INTERNAL
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if message != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+}
@@ -0,0 +1,253 @@
+// Package fileheaptest provides an in-memory FileHeap server for testing code
+// which uses the client.
+package fileheaptest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Server is an in-memory implementation of the FileHeap API, served over
+// HTTP on the loopback interface. It implements datasets, files, chunks,
+// batches, uploads, read sessions, snapshots, chunked files, and file events,
+// and the gRPC metadata service at the same address (see client.WithGRPC); it
+// does not authenticate requests or offer presigned part URLs.
+//
+// Servers are safe for concurrent use. Call Close when finished.
+type Server struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	datasets  map[string]*dataset
+	snapshots map[string]*dataset
+	uploads   map[string]*upload
+	blobs     map[[sha256.Size]byte]*blob
+	nextID    int
+
+	// Closed and replaced whenever a dataset changes, to wake requests
+	// waiting for changes.
+	changed chan struct{}
+}
+
+type dataset struct {
+	api.Dataset
+	files map[string]*file
+
+	// Every change to the dataset's files, in order.
+	events []api.FileEvent
+}
+
+type file struct {
+	digest  [sha256.Size]byte
+	mode    os.FileMode // Zero if no mode was recorded.
+	updated time.Time
+}
+
+// blob holds the contents of files with a given digest.
+type blob struct {
+	data []byte
+
+	// Chunks the contents were uploaded in.
+	chunkSize int64
+	chunks    [][]byte
+
+	// Content-defined chunks, if the contents were written from them.
+	manifest *api.ChunkManifest
+}
+
+type upload struct {
+	length    int64
+	data      []byte
+	chunkSize int64
+	chunks    [][]byte
+}
+
+// NewServer starts a new, empty server.
+func NewServer() *Server {
+	s := &Server{
+		datasets:  map[string]*dataset{},
+		snapshots: map[string]*dataset{},
+		uploads:   map[string]*upload{},
+		blobs:     map[[sha256.Size]byte]*blob{},
+		changed:   make(chan struct{}),
+	}
+	// Plain HTTP/2 is accepted alongside HTTP/1.1 for gRPC clients.
+	s.Server = httptest.NewServer(h2c.NewHandler(s, &http2.Server{}))
+	return s
+}
+
+// Client creates a client connected to the server.
+func (s *Server) Client(options ...client.Option) *client.Client {
+	c, err := client.New(s.URL, options...)
+	if err != nil {
+		// The server's URL is always valid.
+		panic(err)
+	}
+	return c
+}
+
+// newID returns a new unique identifier with the given prefix.
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s_%d", prefix, s.nextID)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.nextRequestID(w, r)
+	if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		s.serveGRPC(w, r)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 4)
+	switch {
+	case parts[0] == "datasets" && len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.listDatasets(w, r)
+		case http.MethodPost:
+			s.createDataset(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+
+	case parts[0] == "datasets" && len(parts) == 2:
+		s.serveDataset(w, r, parts[1])
+
+	case parts[0] == "datasets" && len(parts) == 3 && parts[2] == "manifest":
+		s.serveManifest(w, r, parts[1])
+
+	case parts[0] == "datasets" && len(parts) == 3 && parts[2] == "events" && r.Method == http.MethodGet:
+		s.serveEvents(w, r, parts[1])
+
+	case parts[0] == "datasets" && len(parts) == 3 && parts[2] == "sessions" && r.Method == http.MethodPost:
+		s.createReadSession(w, r, parts[1])
+
+	case parts[0] == "datasets" && len(parts) == 4 && parts[2] == "files":
+		s.serveFile(w, r, parts[1], parts[3])
+
+	case parts[0] == "datasets" && len(parts) == 4 && parts[2] == "chunks":
+		s.serveChunks(w, r, parts[1], parts[3])
+
+	case parts[0] == "datasets" && len(parts) == 4 && parts[2] == "batch":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		switch parts[3] {
+		case "upload":
+			s.batchUpload(w, r, parts[1])
+		case "download":
+			s.batchDownload(w, r, parts[1])
+		case "delete":
+			s.batchDelete(w, r, parts[1])
+		case "add":
+			s.batchAdd(w, r, parts[1])
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+
+	case parts[0] == "uploads" && len(parts) == 1 && r.Method == http.MethodPost:
+		s.createUpload(w, r)
+
+	case parts[0] == "uploads" && len(parts) == 2 && r.Method == http.MethodPatch:
+		s.writeUpload(w, r, parts[1])
+
+	case parts[0] == "health" && len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, &api.Health{Status: api.HealthOK})
+
+	case parts[0] == "version" && len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, &api.ServerVersion{Version: "fileheaptest"})
+
+	case parts[0] == "capabilities" && len(parts) == 1 && r.Method == http.MethodGet:
+		// Manifests never include URLs, since blobs are only stored here.
+		writeJSON(w, &api.Capabilities{
+			BatchUpload:   true,
+			BatchDownload: true,
+			BatchDelete:   true,
+			BatchAdd:      true,
+			Uploads:       true,
+		})
+
+	case parts[0] == "blobs" && len(parts) == 2 && parts[1] == "missing" && r.Method == http.MethodPost:
+		s.missingBlobs(w, r)
+
+	case parts[0] == "admin" && len(parts) == 2 && parts[1] == "gc-report" && r.Method == http.MethodGet:
+		s.gcReport(w, r)
+
+	case parts[0] == "blobs" && len(parts) == 2 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.readBlob(w, r, parts[1])
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// nextRequestID identifies a response like a real server would, echoing the
+// request's own ID if it has one.
+func (s *Server) nextRequestID(w http.ResponseWriter, r *http.Request) {
+	if id := r.Header.Get(api.HeaderRequestID); id != "" {
+		w.Header().Set(api.HeaderRequestID, id)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w.Header().Set(api.HeaderRequestID, s.newID("req"))
+}
+
+// writeJSON writes a successful response with a JSON body.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeCacheableJSON is like writeJSON, but sets an ETag and responds with 304
+// Not Modified if the request's If-None-Match header matches it.
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeCacheable(w, r, "application/json", body)
+}
+
+// writeCacheable writes a successful response with a body of the given media
+// type, setting an ETag as writeCacheableJSON does.
+func writeCacheable(w http.ResponseWriter, r *http.Request, mediaType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(body)
+}
+
+// writeError writes an error response in the server's format.
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&api.Error{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		RequestID: w.Header().Get(api.HeaderRequestID),
+	})
+}
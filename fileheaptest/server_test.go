@@ -0,0 +1,91 @@
+package fileheaptest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/allenai/fileheap-client/client"
+	"github.com/allenai/fileheap-client/fileheaptest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := fileheaptest.NewServer()
+	defer s.Close()
+
+	dataset, err := s.Client().NewDataset(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":     "hello",
+		"dir/b.txt": "world",
+		"empty":     "",
+	}
+	for name, contents := range files {
+		if err := dataset.WriteFile(ctx, name, bytes.NewReader([]byte(contents)), int64(len(contents))); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	for name, contents := range files {
+		r, err := dataset.ReadFile(ctx, name)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != contents {
+			t.Errorf("read %s: got %q, %v; want %q", name, data, err, contents)
+		}
+	}
+
+	info, err := dataset.FileInfo(ctx, "dir/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || len(info.Digest) == 0 {
+		t.Errorf("got info %+v; want size 5 with a digest", info)
+	}
+
+	list := func() []string {
+		var names []string
+		it := dataset.Files(ctx, nil)
+		for {
+			info, err := it.Next()
+			if err == client.ErrDone {
+				return names
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, info.Path)
+		}
+	}
+	if names := list(); len(names) != 3 || names[0] != "a.txt" || names[1] != "dir/b.txt" || names[2] != "empty" {
+		t.Errorf("got files %q; want [a.txt dir/b.txt empty]", names)
+	}
+
+	if err := dataset.DeleteFile(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.ReadFile(ctx, "a.txt"); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("read deleted file: got %v; want %v", err, client.ErrFileNotFound)
+	}
+	if err := dataset.DeleteFile(ctx, "a.txt"); !errors.Is(err, client.ErrFileNotFound) {
+		t.Errorf("delete deleted file: got %v; want %v", err, client.ErrFileNotFound)
+	}
+	if names := list(); len(names) != 2 || names[0] != "dir/b.txt" {
+		t.Errorf("got files %q after delete; want [dir/b.txt empty]", names)
+	}
+
+	if err := dataset.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataset.Info(ctx); !errors.Is(err, client.ErrDatasetNotFound) {
+		t.Errorf("info of deleted dataset: got %v; want %v", err, client.ErrDatasetNotFound)
+	}
+}
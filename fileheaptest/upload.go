@@ -0,0 +1,163 @@
+package fileheaptest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/allenai/fileheap-client/api"
+)
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(api.HeaderUploadLength), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid upload length %q", r.Header.Get(api.HeaderUploadLength))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := s.newID("upload")
+	s.uploads[id] = &upload{length: length}
+	w.Header().Set(api.HeaderUploadID, id)
+	writeJSON(w, &api.Upload{ID: id})
+}
+
+// writeUpload appends a chunk to an upload. Chunks must be sent in order. Once
+// the upload is complete, its contents are stored and their digest returned.
+// Chunks may be copied from an existing file instead of sent in the body.
+func (s *Server) writeUpload(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body: %v", err)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(api.HeaderUploadOffset), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid upload offset %q", r.Header.Get(api.HeaderUploadOffset))
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if source := r.Header.Get(api.HeaderUploadSource); source != "" {
+		if data, err = s.copySource(source, r.Header.Get(api.HeaderUploadSourceRange)); err != nil {
+			writeError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	chunkDigest := sha256.Sum256(data)
+	if str := r.Header.Get(api.HeaderDigest); str != "" {
+		expected, err := api.DecodeDigest(str)
+		if err != nil || !bytes.Equal(expected, chunkDigest[:]) {
+			writeError(w, http.StatusBadRequest, "chunk does not match digest")
+			return
+		}
+	}
+
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "upload %s not found", id)
+		return
+	}
+	if offset != int64(len(u.data)) {
+		writeError(w, http.StatusConflict, "expected offset %d, got %d", len(u.data), offset)
+		return
+	}
+	if offset+int64(len(data)) > u.length {
+		writeError(w, http.StatusBadRequest, "chunk exceeds upload length")
+		return
+	}
+
+	if u.chunkSize == 0 {
+		u.chunkSize = int64(len(data))
+	}
+	u.data = append(u.data, data...)
+	u.chunks = append(u.chunks, chunkDigest[:])
+	w.Header().Set(api.HeaderUploadOffset, strconv.Itoa(len(u.data)))
+	if int64(len(u.data)) == u.length {
+		digest := s.putBlob(u.data, u)
+		delete(s.uploads, id)
+		w.Header().Set(api.HeaderDigest, api.EncodeDigest(digest[:]))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// copySource returns a range of an existing blob, given the values of the
+// Upload-Source and Upload-Source-Range headers. The caller must hold the
+// server's lock.
+func (s *Server) copySource(source, sourceRange string) ([]byte, error) {
+	digest, err := api.DecodeDigest(source)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid upload source %q", source)
+	}
+	var key [sha256.Size]byte
+	copy(key[:], digest)
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("upload source %s not found", source)
+	}
+
+	var first, last int64
+	if _, err := fmt.Sscanf(sourceRange, "bytes=%d-%d", &first, &last); err != nil ||
+		first < 0 || last < first || last >= int64(len(b.data)) {
+		return nil, fmt.Errorf("invalid upload source range %q", sourceRange)
+	}
+	return b.data[first : last+1], nil
+}
+
+// readBlob responds with the contents named by the hex encoding of their digest.
+func (s *Server) readBlob(w http.ResponseWriter, r *http.Request, name string) {
+	digest, err := hex.DecodeString(name)
+	if err != nil || len(digest) != sha256.Size {
+		writeError(w, http.StatusBadRequest, "invalid digest %q", name)
+		return
+	}
+
+	s.lock.Lock()
+	var key [sha256.Size]byte
+	copy(key[:], digest)
+	b, ok := s.blobs[key]
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "blob %s not found", name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+	w.Header().Set(api.HeaderDigest, api.EncodeDigest(digest))
+	if r.Method == http.MethodGet {
+		w.Write(b.data)
+	}
+}
+
+// missingBlobs responds with the digests in the request which name no stored
+// contents.
+func (s *Server) missingBlobs(w http.ResponseWriter, r *http.Request) {
+	var query api.BlobDigests
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	missing := api.BlobDigests{Digests: [][]byte{}}
+	for _, digest := range query.Digests {
+		var key [sha256.Size]byte
+		copy(key[:], digest)
+		if _, ok := s.blobs[key]; !ok || len(digest) != sha256.Size {
+			missing.Digests = append(missing.Digests, digest)
+		}
+	}
+	writeJSON(w, &missing)
+}
@@ -0,0 +1,360 @@
+// Package localfs implements client.DatasetAPI with a local directory, so that
+// code written against the interface can run offline or in CI without a
+// FileHeap server.
+package localfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allenai/bytefmt"
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// Dataset is a dataset whose files are stored in a local directory. Each
+// regular file under the directory is a file in the dataset, named by its
+// slash-separated path relative to the directory. Digests are computed when
+// files are listed and cached while files are unchanged.
+//
+// Sealing a Dataset only affects that value; nothing is recorded on disk.
+type Dataset struct {
+	root string
+
+	lock     sync.Mutex
+	readOnly bool
+	digests  map[string]cachedDigest
+}
+
+// cachedDigest is the digest of a version of a file.
+type cachedDigest struct {
+	size    int64
+	modTime time.Time
+	digest  []byte
+}
+
+var _ client.DatasetAPI = (*Dataset)(nil)
+
+// Open opens a directory as a dataset, creating it if it doesn't exist.
+func Open(dir string) (*Dataset, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Dataset{root: root, digests: map[string]cachedDigest{}}, nil
+}
+
+// Name returns the absolute path of the dataset's directory.
+func (d *Dataset) Name() string { return d.root }
+
+// Info returns metadata about the dataset. Its creation time is the
+// directory's modification time.
+func (d *Dataset) Info(ctx context.Context) (*api.Dataset, error) {
+	stat, err := os.Stat(d.root)
+	if os.IsNotExist(err) {
+		return nil, client.ErrDatasetNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	d.lock.Lock()
+	readOnly := d.readOnly
+	d.lock.Unlock()
+
+	size := &api.DatasetSize{Final: readOnly}
+	var hash api.ManifestHash
+	files := d.ListFiles(ctx, nil)
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size.Files++
+		size.Bytes += info.Size
+		if err := hash.Add(info.Path, info.Digest); err != nil {
+			return nil, err
+		}
+	}
+	size.BytesHuman = bytefmt.New(size.Bytes, bytefmt.Binary).String()
+
+	info := &api.Dataset{
+		ID:       d.root,
+		Created:  stat.ModTime(),
+		ReadOnly: readOnly,
+		Size:     size,
+	}
+	if readOnly {
+		info.ManifestDigest = hash.Sum()
+	}
+	return info, nil
+}
+
+// ManifestDigest computes the canonical digest of the dataset's manifest.
+func (d *Dataset) ManifestDigest(ctx context.Context) ([]byte, error) {
+	var hash api.ManifestHash
+	files := d.ListFiles(ctx, nil)
+	for {
+		info, err := files.Next()
+		if err == client.ErrDone {
+			return hash.Sum(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := hash.Add(info.Path, info.Digest); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Seal makes the dataset read-only.
+func (d *Dataset) Seal(ctx context.Context) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.readOnly = true
+	return nil
+}
+
+// Delete removes the dataset's directory and everything in it.
+func (d *Dataset) Delete(ctx context.Context) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	return errors.WithStack(os.RemoveAll(d.root))
+}
+
+// ListFiles returns an iterator over files in the dataset in ascending
+// byte-wise order of their paths. The directory is walked when the iterator is created;
+// files are hashed as they are returned. URLs are file:// URLs.
+func (d *Dataset) ListFiles(ctx context.Context, opts *client.FileIteratorOptions) client.Iterator {
+	if opts == nil {
+		opts = &client.FileIteratorOptions{}
+	}
+	paths, err := d.walk(opts.Prefix)
+	return &fileIterator{ctx: ctx, dataset: d, opts: *opts, paths: paths, err: err}
+}
+
+// FileInfo returns metadata about a file, or client.ErrFileNotFound.
+func (d *Dataset) FileInfo(ctx context.Context, filename string, opts ...client.CallOption) (*api.FileInfo, error) {
+	filePath, err := d.path(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && !stat.Mode().IsRegular()) {
+		return nil, client.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	digest, err := d.digest(filePath, stat)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FileInfo{
+		Path:    strings.Trim(path.Clean("/"+filename), "/"),
+		Size:    stat.Size(),
+		Digest:  digest,
+		Updated: stat.ModTime(),
+		Mode:    stat.Mode().Perm(),
+	}, nil
+}
+
+// ReadFile reads the contents of a file, or returns client.ErrFileNotFound.
+func (d *Dataset) ReadFile(ctx context.Context, filename string, opts ...client.CallOption) (io.ReadCloser, error) {
+	return d.ReadFileRange(ctx, filename, 0, -1, opts...)
+}
+
+// ReadFileRange reads at most length bytes from a file starting at the given
+// offset. If length is negative, the file is read until the end. Length must
+// not be zero.
+func (d *Dataset) ReadFileRange(
+	ctx context.Context,
+	filename string,
+	offset, length int64,
+	opts ...client.CallOption,
+) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+	if length == 0 {
+		return nil, errors.New("length must not be zero")
+	}
+	filePath, err := d.path(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, client.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.WithStack(err)
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return &limitedFile{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// limitedFile reads part of a file.
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// WriteFile writes size bytes from the source to a file, replacing it if it
+// exists.
+func (d *Dataset) WriteFile(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	opts ...client.CallOption,
+) error {
+	return d.WriteFileWithOptions(ctx, filename, source, size, nil, opts...)
+}
+
+// WriteFileWithOptions is like WriteFile, with additional configuration. The
+// file is written to a temporary file and renamed into place, so readers see
+// either the old or new contents.
+func (d *Dataset) WriteFileWithOptions(
+	ctx context.Context,
+	filename string,
+	source io.Reader,
+	size int64,
+	opts *client.WriteFileOptions,
+	callOpts ...client.CallOption,
+) error {
+	if opts == nil {
+		opts = &client.WriteFileOptions{}
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	filePath, err := d.path(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(filePath), ".fileheap-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := io.CopyN(temp, source, size); err != nil {
+		if err == io.EOF {
+			return errors.Errorf("%s truncated while uploading", filename)
+		}
+		return errors.WithStack(err)
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := temp.Chmod(mode); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := temp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(temp.Name(), filePath))
+}
+
+// DeleteFile deletes a file, or returns client.ErrFileNotFound. Directories
+// left empty are removed too.
+func (d *Dataset) DeleteFile(ctx context.Context, filename string, opts ...client.CallOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	filePath, err := d.path(filename)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return client.ErrFileNotFound
+		}
+		return errors.WithStack(err)
+	}
+
+	for dir := filepath.Dir(filePath); dir != d.root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *Dataset) checkWritable() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.readOnly {
+		return client.ErrDatasetReadOnly
+	}
+	return nil
+}
+
+// path returns the local path of a file, which must be within the dataset.
+func (d *Dataset) path(filename string) (string, error) {
+	name := strings.Trim(path.Clean("/"+filename), "/")
+	if name == "" {
+		return "", errors.Errorf("invalid file name %q", filename)
+	}
+	return filepath.Join(d.root, filepath.FromSlash(name)), nil
+}
+
+// digest returns the digest of a file, hashing it unless it is unchanged since
+// it was last hashed.
+func (d *Dataset) digest(filePath string, stat os.FileInfo) ([]byte, error) {
+	d.lock.Lock()
+	cached, ok := d.digests[filePath]
+	d.lock.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.digest, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	digest := hash.Sum(nil)
+
+	d.lock.Lock()
+	d.digests[filePath] = cachedDigest{size: stat.Size(), modTime: stat.ModTime(), digest: digest}
+	d.lock.Unlock()
+	return digest, nil
+}
@@ -0,0 +1,88 @@
+package localfs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/allenai/fileheap-client/api"
+	"github.com/allenai/fileheap-client/client"
+)
+
+// fileIterator returns the files found by walking a dataset's directory.
+type fileIterator struct {
+	ctx     context.Context
+	dataset *Dataset
+	opts    client.FileIteratorOptions
+	paths   []string
+	err     error
+}
+
+func (i *fileIterator) Next() (*api.FileInfo, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if err := i.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for len(i.paths) != 0 {
+		name := i.paths[0]
+		i.paths = i.paths[1:]
+
+		info, err := i.dataset.FileInfo(i.ctx, name)
+		if err == client.ErrFileNotFound {
+			// Deleted since the walk.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		filePath, _ := i.dataset.path(name)
+		if i.opts.IncludeURLs {
+			info.URL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(filePath)}).String()
+		}
+		if threshold := i.opts.InlineThreshold; threshold > 0 && info.Size <= threshold {
+			if info.Data, err = ioutil.ReadFile(filePath); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		return info, nil
+	}
+	return nil, client.ErrDone
+}
+
+// walk returns the path of each regular file in the dataset beginning with a
+// prefix, sorted in ascending byte-wise order. Temporary files left by writes
+// are skipped.
+func (d *Dataset) walk(prefix string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(d.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".fileheap-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, filePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rel = filepath.ToSlash(rel); strings.HasPrefix(rel, prefix) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, client.ErrDatasetNotFound
+	}
+	sort.Strings(paths)
+	return paths, err
+}